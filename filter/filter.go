@@ -0,0 +1,404 @@
+// Package filter implements the filtering of DNS requests using the
+// hosts-style and adblock-style rule lists.
+package filter
+
+import (
+	"cmp"
+	"context"
+	"encoding"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/service"
+	"github.com/miekg/dns"
+)
+
+// LogPrefix is a prefix for logging.
+const LogPrefix = "filter"
+
+const (
+	// DefaultRefreshInterval is the default interval between the refreshes of
+	// the rule lists.
+	DefaultRefreshInterval = 24 * time.Hour
+
+	// DefaultBlockedResponseTTL is the default TTL of the records in the
+	// blocking responses in seconds.
+	DefaultBlockedResponseTTL = 10
+
+	// defaultHTTPTimeout is the timeout of the HTTP client used to download
+	// the rule lists if none is configured.
+	defaultHTTPTimeout = 30 * time.Second
+)
+
+// ErrBlocked is returned within [proxy.BeforeRequestError] for the requests
+// blocked by the rule lists.
+const ErrBlocked errors.Error = "blocked by filter"
+
+// BlockingMode is the type of the response to the blocked requests.
+type BlockingMode string
+
+const (
+	// BlockingModeNXDOMAIN makes the filter respond with NXDOMAIN.  It's the
+	// default blocking mode.
+	BlockingModeNXDOMAIN BlockingMode = "nxdomain"
+
+	// BlockingModeREFUSED makes the filter respond with REFUSED.
+	BlockingModeREFUSED BlockingMode = "refused"
+
+	// BlockingModeNullIP makes the filter respond to the A and AAAA requests
+	// with the unspecified addresses, 0.0.0.0 and ::, and to the other
+	// requests with NODATA.
+	BlockingModeNullIP BlockingMode = "null_ip"
+
+	// BlockingModeCustomIP makes the filter respond to the A and AAAA requests
+	// with the configured addresses, and to the other requests with NODATA.
+	BlockingModeCustomIP BlockingMode = "custom_ip"
+)
+
+// type check
+var _ encoding.TextUnmarshaler = (*BlockingMode)(nil)
+
+// UnmarshalText implements [encoding.TextUnmarshaler] interface for
+// *BlockingMode.
+func (m *BlockingMode) UnmarshalText(b []byte) (err error) {
+	switch bm := BlockingMode(b); bm {
+	case
+		BlockingModeNXDOMAIN,
+		BlockingModeREFUSED,
+		BlockingModeNullIP,
+		BlockingModeCustomIP:
+		*m = bm
+	default:
+		return fmt.Errorf(
+			"invalid blocking mode %q, supported: %q, %q, %q, %q",
+			b,
+			BlockingModeNXDOMAIN,
+			BlockingModeREFUSED,
+			BlockingModeNullIP,
+			BlockingModeCustomIP,
+		)
+	}
+
+	return nil
+}
+
+// type check
+var _ encoding.TextMarshaler = BlockingMode("")
+
+// MarshalText implements [encoding.TextMarshaler] interface for BlockingMode.
+func (m BlockingMode) MarshalText() (text []byte, err error) {
+	return []byte(m), nil
+}
+
+// Config contains the configuration of the filter.
+type Config struct {
+	// Logger is used as the base logger for the service.  If nil,
+	// [slog.Default] with [LogPrefix] is used.
+	Logger *slog.Logger
+
+	// MessageConstructor constructs the blocking responses.  If nil,
+	// [proxy.DefaultMessageConstructor] is used.  It may also implement
+	// [proxy.ExtendedMessageConstructor], see
+	// [proxy.ExtendMessageConstructor].
+	MessageConstructor proxy.MessageConstructor
+
+	// HTTPClient is used to download the rule lists.  If nil, a client with a
+	// default timeout is used.
+	HTTPClient *http.Client
+
+	// BlockingMode is the type of the response to the blocked requests.  If
+	// empty, [BlockingModeNXDOMAIN] is used.
+	BlockingMode BlockingMode
+
+	// BlockingIPv4 is the address to respond to the blocked A requests with
+	// in the [BlockingModeCustomIP].  If it's not valid, such requests are
+	// responded with NODATA.
+	BlockingIPv4 netip.Addr
+
+	// BlockingIPv6 is the address to respond to the blocked AAAA requests
+	// with in the [BlockingModeCustomIP].  If it's not valid, such requests are
+	// responded with NODATA.
+	BlockingIPv6 netip.Addr
+
+	// Lists are the paths to the local files or the HTTP(S) URLs of the rule
+	// lists.  The lists may contain the hosts-style rules, the plain domain
+	// names, and the adblock-style rules, such as "||example.org^" to block a
+	// domain with its subdomains and "@@||example.org^" to make an exception.
+	// The adblock-style rules with modifiers or wildcards aren't supported and
+	// are skipped.
+	Lists []string
+
+	// RefreshInterval is the interval between the refreshes of the lists.  If
+	// zero, [DefaultRefreshInterval] is used.
+	RefreshInterval time.Duration
+
+	// BlockedResponseTTL is the TTL of the records in the blocking responses
+	// in seconds.  If zero, [DefaultBlockedResponseTTL] is used.
+	BlockedResponseTTL uint32
+}
+
+// Filter blocks the requests for the domains matching the rule lists.  It
+// should be set as [proxy.Config.BeforeRequestHandler] and started to load the
+// lists.
+type Filter struct {
+	// logger is used to log the loading of the lists.  It's never nil.
+	logger *slog.Logger
+
+	// messages constructs the blocking responses.
+	messages proxy.ExtendedMessageConstructor
+
+	// client is used to download the lists.
+	client *http.Client
+
+	// rules are the rule sets parsed from the lists, by the indexes of the
+	// lists.  The rule sets of the lists never loaded are nil.
+	rules atomic.Pointer[[]*ruleSet]
+
+	// refreshMu serializes the refreshes of the lists.
+	refreshMu *sync.Mutex
+
+	// mu protects done.
+	mu *sync.Mutex
+
+	// done is closed to stop the refreshing.  It's nil if the filter isn't
+	// running.
+	done chan struct{}
+
+	// lists are the paths and URLs of the rule lists.
+	lists []string
+
+	// blockingAddrs are the addresses to respond to the blocked address
+	// requests with.
+	blockingAddrs []netip.Addr
+
+	// refreshInterval is the interval between the refreshes of the lists.
+	refreshInterval time.Duration
+
+	// blockingMode is the type of the response to the blocked requests.
+	blockingMode BlockingMode
+
+	// blockedTTL is the TTL of the records in the blocking responses.
+	blockedTTL uint32
+}
+
+// New returns a new properly initialized *Filter.  c must not be nil.  The
+// lists aren't loaded until the filter is started.
+func New(c *Config) (f *Filter, err error) {
+	f = &Filter{
+		messages:        proxy.ExtendMessageConstructor(c.MessageConstructor),
+		client:          c.HTTPClient,
+		refreshMu:       &sync.Mutex{},
+		mu:              &sync.Mutex{},
+		lists:           c.Lists,
+		refreshInterval: cmp.Or(c.RefreshInterval, DefaultRefreshInterval),
+		blockingMode:    cmp.Or(c.BlockingMode, BlockingModeNXDOMAIN),
+		blockedTTL:      cmp.Or(c.BlockedResponseTTL, DefaultBlockedResponseTTL),
+	}
+
+	if c.Logger != nil {
+		f.logger = c.Logger
+	} else {
+		f.logger = slog.Default().With(slogutil.KeyPrefix, LogPrefix)
+	}
+
+	if f.client == nil {
+		f.client = &http.Client{
+			Timeout: defaultHTTPTimeout,
+		}
+	}
+
+	switch f.blockingMode {
+	case BlockingModeNXDOMAIN, BlockingModeREFUSED:
+		// Go on.
+	case BlockingModeNullIP:
+		f.blockingAddrs = []netip.Addr{netip.IPv4Unspecified(), netip.IPv6Unspecified()}
+	case BlockingModeCustomIP:
+		f.blockingAddrs, err = customBlockingAddrs(c.BlockingIPv4, c.BlockingIPv6)
+		if err != nil {
+			return nil, fmt.Errorf("blocking mode %q: %w", f.blockingMode, err)
+		}
+	default:
+		return nil, fmt.Errorf("invalid blocking mode %q", f.blockingMode)
+	}
+
+	rules := make([]*ruleSet, len(f.lists))
+	f.rules.Store(&rules)
+
+	return f, nil
+}
+
+// customBlockingAddrs validates and returns the addresses for the
+// [BlockingModeCustomIP].
+func customBlockingAddrs(ipv4, ipv6 netip.Addr) (addrs []netip.Addr, err error) {
+	if ipv4.IsValid() {
+		if !ipv4.Is4() {
+			return nil, fmt.Errorf("blocking ipv4: %s is not an ipv4 address", ipv4)
+		}
+
+		addrs = append(addrs, ipv4)
+	}
+
+	if ipv6.IsValid() {
+		if !ipv6.Is6() || ipv6.Is4In6() {
+			return nil, fmt.Errorf("blocking ipv6: %s is not an ipv6 address", ipv6)
+		}
+
+		addrs = append(addrs, ipv6)
+	}
+
+	if len(addrs) == 0 {
+		return nil, errors.Error("no blocking addresses")
+	}
+
+	return addrs, nil
+}
+
+// type check
+var _ service.Interface = (*Filter)(nil)
+
+// Start implements the [service.Interface] interface for *Filter.  It loads the
+// lists and starts refreshing them in a separate goroutine.  The lists failed
+// to load are logged and retried on the next refresh.
+func (f *Filter) Start(ctx context.Context) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.done != nil {
+		return nil
+	}
+
+	err = f.Refresh(ctx)
+	if err != nil {
+		f.logger.ErrorContext(ctx, "loading lists", slogutil.KeyError, err)
+	}
+
+	f.done = make(chan struct{})
+
+	go f.loop(f.done)
+
+	return nil
+}
+
+// Shutdown implements the [service.Interface] interface for *Filter.  It stops
+// refreshing the lists.
+func (f *Filter) Shutdown(_ context.Context) (err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.done != nil {
+		close(f.done)
+		f.done = nil
+	}
+
+	return nil
+}
+
+// loop refreshes the lists each refresh interval until done is closed.
+func (f *Filter) loop(done chan struct{}) {
+	ctx := context.Background()
+	defer slogutil.RecoverAndLog(ctx, f.logger)
+
+	ticker := time.NewTicker(f.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := f.Refresh(ctx)
+			if err != nil {
+				f.logger.ErrorContext(ctx, "refreshing lists", slogutil.KeyError, err)
+			}
+		}
+	}
+}
+
+// Refresh loads all the lists again.  The previously loaded rules of the lists
+// failed to load are kept.  It is safe for concurrent use.
+func (f *Filter) Refresh(ctx context.Context) (err error) {
+	f.refreshMu.Lock()
+	defer f.refreshMu.Unlock()
+
+	prev := *f.rules.Load()
+	rules := make([]*ruleSet, len(f.lists))
+
+	var errs []error
+	for i, l := range f.lists {
+		var unsupported int
+		rules[i], unsupported, err = f.loadList(ctx, l)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("list %q: %w", l, err))
+			rules[i] = prev[i]
+
+			continue
+		}
+
+		f.logger.DebugContext(ctx, "list loaded", "list", l, "unsupported_rules", unsupported)
+	}
+
+	f.rules.Store(&rules)
+
+	return errors.Join(errs...)
+}
+
+// HandleBefore implements the [proxy.BeforeRequestHandler] interface for
+// *Filter.  It returns a [proxy.BeforeRequestError] with [ErrBlocked] if the
+// requested domain is blocked.
+func (f *Filter) HandleBefore(_ *proxy.Proxy, dctx *proxy.DNSContext) (err error) {
+	if len(dctx.Req.Question) != 1 {
+		// Let the proxy handle the invalid requests.
+		return nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(dctx.Req.Question[0].Name, "."))
+	if !f.isBlocked(host) {
+		return nil
+	}
+
+	return &proxy.BeforeRequestError{
+		Err:      fmt.Errorf("%q: %w", host, ErrBlocked),
+		Response: f.blockingResponse(dctx.Req),
+	}
+}
+
+// isBlocked returns true if the lowercased host without the trailing dot
+// matches a blocking rule of any list and doesn't match an exception rule of
+// any list.
+func (f *Filter) isBlocked(host string) (ok bool) {
+	for _, rs := range *f.rules.Load() {
+		if rs == nil {
+			continue
+		}
+
+		blocked, allowed := rs.match(host)
+		if allowed {
+			return false
+		}
+
+		ok = ok || blocked
+	}
+
+	return ok
+}
+
+// blockingResponse returns the response to the blocked request req.
+func (f *Filter) blockingResponse(req *dns.Msg) (resp *dns.Msg) {
+	switch f.blockingMode {
+	case BlockingModeREFUSED:
+		return f.messages.NewMsgREFUSED(req)
+	case BlockingModeNullIP, BlockingModeCustomIP:
+		return f.messages.NewMsgAddrs(req, f.blockedTTL, f.blockingAddrs)
+	default:
+		return f.messages.NewMsgNXDOMAIN(req)
+	}
+}
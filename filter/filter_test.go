@@ -0,0 +1,243 @@
+package filter_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/filter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestFilter returns a new started filter with conf, using the discarding
+// logger.
+func newTestFilter(t *testing.T, conf *filter.Config) (f *filter.Filter) {
+	t.Helper()
+
+	conf.Logger = slogutil.NewDiscardLogger()
+	f, err := filter.New(conf)
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	require.NoError(t, f.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return f.Shutdown(ctx) })
+
+	return f
+}
+
+// handle returns the blocking response of f to the request for host of qtype
+// or nil if the request isn't blocked.
+func handle(t *testing.T, f *filter.Filter, host string, qtype uint16) (resp *dns.Msg) {
+	t.Helper()
+
+	dctx := &proxy.DNSContext{
+		Req: (&dns.Msg{}).SetQuestion(host, qtype),
+	}
+
+	err := f.HandleBefore(nil, dctx)
+	if err == nil {
+		return nil
+	}
+
+	require.ErrorIs(t, err, filter.ErrBlocked)
+
+	befReqErr := &proxy.BeforeRequestError{}
+	require.True(t, errors.As(err, &befReqErr))
+
+	return befReqErr.Response
+}
+
+func TestFilter_HandleBefore(t *testing.T) {
+	listPath := filepath.Join(t.TempDir(), "list.txt")
+	err := os.WriteFile(listPath, []byte("||blocked.example^\n0.0.0.0 host.example\n"), 0o600)
+	require.NoError(t, err)
+
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		_, _ = io.WriteString(w, "||remote.example^\n@@||allowed.blocked.example^\n")
+	}))
+	t.Cleanup(srv.Close)
+
+	f := newTestFilter(t, &filter.Config{
+		Lists: []string{listPath, srv.URL},
+	})
+
+	testCases := []struct {
+		name        string
+		host        string
+		wantBlocked bool
+	}{{
+		name:        "file",
+		host:        "sub.blocked.example.",
+		wantBlocked: true,
+	}, {
+		name:        "hosts",
+		host:        "host.example.",
+		wantBlocked: true,
+	}, {
+		name:        "url",
+		host:        "REMOTE.example.",
+		wantBlocked: true,
+	}, {
+		name:        "exception",
+		host:        "allowed.blocked.example.",
+		wantBlocked: false,
+	}, {
+		name:        "not_blocked",
+		host:        "example.",
+		wantBlocked: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := handle(t, f, tc.host, dns.TypeA)
+			if !tc.wantBlocked {
+				assert.Nil(t, resp)
+
+				return
+			}
+
+			require.NotNil(t, resp)
+			assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		})
+	}
+
+	t.Run("refresh_failed", func(t *testing.T) {
+		fail.Store(true)
+		require.NoError(t, os.WriteFile(listPath, nil, 0o600))
+
+		err = f.Refresh(context.Background())
+		require.Error(t, err)
+
+		assert.Nil(t, handle(t, f, "blocked.example.", dns.TypeA))
+		assert.NotNil(t, handle(t, f, "remote.example.", dns.TypeA))
+	})
+}
+
+func TestFilter_HandleBefore_blockingMode(t *testing.T) {
+	listPath := filepath.Join(t.TempDir(), "list.txt")
+	require.NoError(t, os.WriteFile(listPath, []byte("blocked.example\n"), 0o600))
+
+	const host = "blocked.example."
+
+	testCases := []struct {
+		conf      *filter.Config
+		name      string
+		wantAns   []string
+		qtype     uint16
+		wantRcode int
+	}{{
+		conf: &filter.Config{
+			BlockingMode: filter.BlockingModeREFUSED,
+		},
+		name:      "refused",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeRefused,
+	}, {
+		conf: &filter.Config{
+			BlockingMode: filter.BlockingModeNullIP,
+		},
+		name:      "null_ip_a",
+		wantAns:   []string{"blocked.example.\t10\tIN\tA\t0.0.0.0"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		conf: &filter.Config{
+			BlockingMode: filter.BlockingModeNullIP,
+		},
+		name:      "null_ip_aaaa",
+		wantAns:   []string{"blocked.example.\t10\tIN\tAAAA\t::"},
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		conf: &filter.Config{
+			BlockingMode:       filter.BlockingModeCustomIP,
+			BlockingIPv4:       netip.MustParseAddr("192.0.2.1"),
+			BlockedResponseTTL: 60,
+		},
+		name:      "custom_ip",
+		wantAns:   []string{"blocked.example.\t60\tIN\tA\t192.0.2.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		conf: &filter.Config{
+			BlockingMode: filter.BlockingModeCustomIP,
+			BlockingIPv4: netip.MustParseAddr("192.0.2.1"),
+		},
+		name:      "custom_ip_nodata",
+		wantAns:   nil,
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.conf.Lists = []string{listPath}
+			f := newTestFilter(t, tc.conf)
+
+			resp := handle(t, f, host, tc.qtype)
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+
+			var ans []string
+			for _, rr := range resp.Answer {
+				ans = append(ans, rr.String())
+			}
+			assert.Equal(t, tc.wantAns, ans)
+		})
+	}
+}
+
+func TestNew_badConfig(t *testing.T) {
+	testCases := []struct {
+		conf       *filter.Config
+		name       string
+		wantErrMsg string
+	}{{
+		conf: &filter.Config{
+			BlockingMode: "bad",
+		},
+		name:       "bad_mode",
+		wantErrMsg: `invalid blocking mode "bad"`,
+	}, {
+		conf: &filter.Config{
+			BlockingMode: filter.BlockingModeCustomIP,
+		},
+		name:       "no_addrs",
+		wantErrMsg: `blocking mode "custom_ip": no blocking addresses`,
+	}, {
+		conf: &filter.Config{
+			BlockingMode: filter.BlockingModeCustomIP,
+			BlockingIPv6: netip.MustParseAddr("192.0.2.1"),
+		},
+		name:       "bad_ipv6",
+		wantErrMsg: `blocking mode "custom_ip": blocking ipv6: 192.0.2.1 is not an ipv6 address`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := filter.New(tc.conf)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
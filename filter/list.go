@@ -0,0 +1,69 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/ioutil"
+)
+
+// maxListSize is the maximum size of a downloaded rule list in bytes.
+const maxListSize = 64 * 1024 * 1024
+
+// isURL returns true if the list is an HTTP(S) URL rather than a file path.
+func isURL(list string) (ok bool) {
+	return strings.HasPrefix(list, "http://") || strings.HasPrefix(list, "https://")
+}
+
+// loadList reads and parses the rule list from the file path or the URL.
+func (f *Filter) loadList(ctx context.Context, list string) (rs *ruleSet, unsupported int, err error) {
+	var rc io.ReadCloser
+	if isURL(list) {
+		rc, err = f.download(ctx, list)
+	} else {
+		rc, err = os.Open(list)
+	}
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, 0, err
+	}
+	defer func() { err = errors.WithDeferred(err, rc.Close()) }()
+
+	return parseRules(rc)
+}
+
+// download requests the list from the URL u and returns its body.
+func (f *Filter) download(ctx context.Context, u string) (body io.ReadCloser, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating request: %w", err)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	return readCloser{
+		Reader: ioutil.LimitReader(resp.Body, maxListSize),
+		Closer: resp.Body,
+	}, nil
+}
+
+// readCloser combines a reader and a closer of the same data.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,165 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// maxRuleLen is the maximum length of a rule list line in bytes.
+const maxRuleLen = 64 * 1024
+
+// ignoredHosts are the hostnames commonly listed in the hosts-style rule lists
+// which must not be blocked.
+var ignoredHosts = container.NewMapSet(
+	"localhost",
+	"localhost.localdomain",
+	"local",
+	"broadcasthost",
+	"ip6-localhost",
+	"ip6-loopback",
+	"ip6-localnet",
+	"ip6-mcastprefix",
+	"ip6-allnodes",
+	"ip6-allrouters",
+	"ip6-allhosts",
+	"0.0.0.0",
+)
+
+// ruleSet is the set of rules parsed from a single rule list.  All the domain
+// names are lowercased and have no trailing dot.
+type ruleSet struct {
+	// blockedHosts are the names blocked without their subdomains, those come
+	// from the hosts-style rules.
+	blockedHosts *container.MapSet[string]
+
+	// blockedDomains are the names blocked along with their subdomains, those
+	// come from the adblock-style rules and the plain domain names.
+	blockedDomains *container.MapSet[string]
+
+	// allowedDomains are the names allowed along with their subdomains, those
+	// come from the adblock-style exception rules.
+	allowedDomains *container.MapSet[string]
+}
+
+// parseRules parses the hosts-style and adblock-style rules from r.
+// unsupported is the number of the rules which syntax isn't supported, those
+// are skipped.
+func parseRules(r io.Reader) (rs *ruleSet, unsupported int, err error) {
+	rs = &ruleSet{
+		blockedHosts:   container.NewMapSet[string](),
+		blockedDomains: container.NewMapSet[string](),
+		allowedDomains: container.NewMapSet[string](),
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, maxRuleLen)
+	for s.Scan() {
+		if !rs.addRule(strings.TrimSpace(s.Text())) {
+			unsupported++
+		}
+	}
+
+	err = s.Err()
+	if err != nil {
+		return nil, 0, fmt.Errorf("scanning: %w", err)
+	}
+
+	return rs, unsupported, nil
+}
+
+// addRule adds the rule from line to rs.  ok is false if the rule isn't
+// supported.
+func (rs *ruleSet) addRule(line string) (ok bool) {
+	switch {
+	case line == "", line[0] == '!', line[0] == '#', line[0] == '[':
+		// Skip empty lines, comments, and adblock list headers.
+		return true
+	case strings.HasPrefix(line, "@@||"):
+		return addAdblockRule(rs.allowedDomains, line[len("@@||"):])
+	case strings.HasPrefix(line, "||"):
+		return addAdblockRule(rs.blockedDomains, line[len("||"):])
+	default:
+		return rs.addHostsRule(line)
+	}
+}
+
+// addAdblockRule adds the domain from the adblock-style rule to set.  rule
+// must have its leading "||" or "@@||" removed.  ok is false if the rule has
+// modifiers, wildcards, or paths, which aren't supported.
+func addAdblockRule(set *container.MapSet[string], rule string) (ok bool) {
+	rule = strings.TrimSuffix(rule, "^")
+	if strings.ContainsAny(rule, "$*/|^") {
+		return false
+	}
+
+	name, ok := normalizeDomain(rule)
+	if ok {
+		set.Add(name)
+	}
+
+	return ok
+}
+
+// addHostsRule adds the names from a hosts-style rule or a plain domain name
+// to rs.  ok is false if line is neither.
+func (rs *ruleSet) addHostsRule(line string) (ok bool) {
+	line, _, _ = strings.Cut(line, "#")
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		var name string
+		name, ok = normalizeDomain(fields[0])
+		if ok {
+			rs.blockedDomains.Add(name)
+		}
+
+		return ok
+	}
+
+	if _, err := netip.ParseAddr(fields[0]); err != nil {
+		return false
+	}
+
+	for _, f := range fields[1:] {
+		name, valid := normalizeDomain(f)
+		if valid && !ignoredHosts.Has(name) {
+			rs.blockedHosts.Add(name)
+		}
+	}
+
+	return true
+}
+
+// normalizeDomain returns the lowercased name without the trailing dot.  ok is
+// false if name isn't a valid domain name.
+func normalizeDomain(name string) (norm string, ok bool) {
+	norm = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	return norm, netutil.ValidateDomainName(norm) == nil
+}
+
+// match returns the result of matching the lowercased host without the
+// trailing dot against rs.  allowed is true if host matches an exception rule,
+// blocked is true if it matches a blocking rule.
+func (rs *ruleSet) match(host string) (blocked, allowed bool) {
+	blocked = rs.blockedHosts.Has(host)
+	for d := host; ; {
+		if rs.allowedDomains.Has(d) {
+			return blocked, true
+		}
+
+		blocked = blocked || rs.blockedDomains.Has(d)
+
+		_, parent, found := strings.Cut(d, ".")
+		if !found {
+			return blocked, false
+		}
+
+		d = parent
+	}
+}
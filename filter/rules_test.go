@@ -0,0 +1,83 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRuleSet_match(t *testing.T) {
+	const rules = `! Adblock-style comment.
+# Hosts-style comment.
+[Adblock Plus 2.0]
+0.0.0.0 hosts.example  Other.Example # Inline comment.
+127.0.0.1 localhost
+plain.example
+||adblock.example^
+@@||allowed.adblock.example^
+||modifiers.example^$important
+||wild*.example^
+/regexp/
+`
+
+	rs, unsupported, err := parseRules(strings.NewReader(rules))
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, unsupported)
+
+	testCases := []struct {
+		host        string
+		wantBlocked bool
+		wantAllowed bool
+	}{{
+		host:        "hosts.example",
+		wantBlocked: true,
+		wantAllowed: false,
+	}, {
+		host:        "other.example",
+		wantBlocked: true,
+		wantAllowed: false,
+	}, {
+		host:        "sub.hosts.example",
+		wantBlocked: false,
+		wantAllowed: false,
+	}, {
+		host:        "localhost",
+		wantBlocked: false,
+		wantAllowed: false,
+	}, {
+		host:        "plain.example",
+		wantBlocked: true,
+		wantAllowed: false,
+	}, {
+		host:        "sub.plain.example",
+		wantBlocked: true,
+		wantAllowed: false,
+	}, {
+		host:        "sub.adblock.example",
+		wantBlocked: true,
+		wantAllowed: false,
+	}, {
+		host:        "sub.allowed.adblock.example",
+		wantBlocked: false,
+		wantAllowed: true,
+	}, {
+		host:        "modifiers.example",
+		wantBlocked: false,
+		wantAllowed: false,
+	}, {
+		host:        "example",
+		wantBlocked: false,
+		wantAllowed: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			blocked, allowed := rs.match(tc.host)
+			assert.Equal(t, tc.wantBlocked, blocked)
+			assert.Equal(t, tc.wantAllowed, allowed)
+		})
+	}
+}
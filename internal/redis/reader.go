@@ -0,0 +1,154 @@
+package redis
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+// maxDepth is the maximum nesting depth of the array replies.
+const maxDepth = 8
+
+// Errors returned by [Reader.ReadReply] for the malformed replies.
+const (
+	// ErrBulkTooLong is returned when a bulk string reply is longer than the
+	// configured maximum.
+	ErrBulkTooLong errors.Error = "bulk string too long"
+
+	// ErrArrayTooLong is returned when an array reply has more elements than
+	// the configured maximum.
+	ErrArrayTooLong errors.Error = "array too long"
+
+	// ErrTooDeep is returned when the array replies are nested too deeply.
+	ErrTooDeep errors.Error = "arrays nested too deeply"
+)
+
+// Error is an error reply from Redis.
+type Error string
+
+// type check
+var _ error = Error("")
+
+// Error implements the [error] interface for Error.
+func (e Error) Error() (msg string) {
+	return "redis: " + string(e)
+}
+
+// Reader reads the RESP2 replies.  It limits the sizes of the replies, so that
+// a misbehaving server can't make it allocate too much memory.
+type Reader struct {
+	// r is the underlying reader.
+	r *bufio.Reader
+
+	// maxBulkLen is the maximum length of a bulk string.
+	maxBulkLen int
+
+	// maxArrayLen is the maximum number of elements of an array.
+	maxArrayLen int
+}
+
+// NewReader returns a new *Reader reading from r.  maxBulkLen and maxArrayLen
+// must be positive.
+func NewReader(r io.Reader, maxBulkLen, maxArrayLen int) (rr *Reader) {
+	return &Reader{
+		r:           bufio.NewReader(r),
+		maxBulkLen:  maxBulkLen,
+		maxArrayLen: maxArrayLen,
+	}
+}
+
+// ReadReply reads a single reply.  The reply is one of: string for simple
+// strings, [Error] for errors, int64 for integers, []byte or nil for bulk
+// strings, and []any or nil for arrays.
+func (r *Reader) ReadReply() (reply any, err error) {
+	return r.readReply(0)
+}
+
+// readReply reads a single reply nested into depth arrays.
+func (r *Reader) readReply(depth int) (reply any, err error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	} else if len(line) == 0 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	typ, data := line[0], line[1:]
+	switch typ {
+	case '+':
+		return string(data), nil
+	case '-':
+		return Error(data), nil
+	case ':':
+		return strconv.ParseInt(string(data), 10, 64)
+	case '$':
+		return r.readBulk(data)
+	case '*':
+		return r.readArray(data, depth)
+	default:
+		return nil, fmt.Errorf("unexpected reply type %q", typ)
+	}
+}
+
+// readBulk reads the bulk string of length.
+func (r *Reader) readBulk(length []byte) (reply any, err error) {
+	n, err := strconv.Atoi(string(length))
+	if err != nil {
+		return nil, fmt.Errorf("bulk length: %w", err)
+	} else if n < 0 {
+		return nil, nil
+	} else if n > r.maxBulkLen {
+		return nil, fmt.Errorf("%w: %d bytes", ErrBulkTooLong, n)
+	}
+
+	buf := make([]byte, n+2)
+	_, err = io.ReadFull(r.r, buf)
+	if err != nil {
+		return nil, fmt.Errorf("bulk data: %w", err)
+	}
+
+	return buf[:n], nil
+}
+
+// readArray reads the array of length nested into depth arrays.
+func (r *Reader) readArray(length []byte, depth int) (reply any, err error) {
+	n, err := strconv.Atoi(string(length))
+	if err != nil {
+		return nil, fmt.Errorf("array length: %w", err)
+	} else if n < 0 {
+		return nil, nil
+	} else if n > r.maxArrayLen {
+		return nil, fmt.Errorf("%w: %d elements", ErrArrayTooLong, n)
+	} else if depth >= maxDepth {
+		return nil, ErrTooDeep
+	}
+
+	arr := make([]any, n)
+	for i := range arr {
+		arr[i], err = r.readReply(depth + 1)
+		if err != nil {
+			return nil, fmt.Errorf("array element at index %d: %w", i, err)
+		}
+	}
+
+	return arr, nil
+}
+
+// readLine reads a single CRLF-terminated line without the terminator.
+func (r *Reader) readLine() (line []byte, err error) {
+	line, err = r.r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	line, ok := bytes.CutSuffix(line, []byte("\r\n"))
+	if !ok {
+		return nil, errors.Error("line not terminated with crlf")
+	}
+
+	return line, nil
+}
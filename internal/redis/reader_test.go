@@ -0,0 +1,92 @@
+package redis_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/internal/redis"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader_ReadReply(t *testing.T) {
+	const (
+		maxBulkLen  = 8
+		maxArrayLen = 2
+	)
+
+	testCases := []struct {
+		want       any
+		name       string
+		in         string
+		wantErrMsg string
+	}{{
+		want:       "OK",
+		name:       "simple_string",
+		in:         "+OK\r\n",
+		wantErrMsg: "",
+	}, {
+		want:       redis.Error("ERR bad"),
+		name:       "error",
+		in:         "-ERR bad\r\n",
+		wantErrMsg: "",
+	}, {
+		want:       int64(42),
+		name:       "integer",
+		in:         ":42\r\n",
+		wantErrMsg: "",
+	}, {
+		want:       []byte("a\r\nb"),
+		name:       "bulk",
+		in:         "$4\r\na\r\nb\r\n",
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "null_bulk",
+		in:         "$-1\r\n",
+		wantErrMsg: "",
+	}, {
+		want:       []any{[]byte("0"), []any{}},
+		name:       "array",
+		in:         "*2\r\n$1\r\n0\r\n*0\r\n",
+		wantErrMsg: "",
+	}, {
+		want:       nil,
+		name:       "bulk_too_long",
+		in:         "$4294967295\r\n",
+		wantErrMsg: "bulk string too long: 4294967295 bytes",
+	}, {
+		want:       nil,
+		name:       "array_too_long",
+		in:         "*4294967295\r\n",
+		wantErrMsg: "array too long: 4294967295 elements",
+	}, {
+		want:       nil,
+		name:       "nested_too_long",
+		in:         "*1\r\n*3\r\n",
+		wantErrMsg: "array element at index 0: array too long: 3 elements",
+	}, {
+		want: nil,
+		name: "too_deep",
+		in:   strings.Repeat("*1\r\n", 9),
+		wantErrMsg: "array element at index 0: " +
+			strings.Repeat("array element at index 0: ", 7) +
+			"arrays nested too deeply",
+	}, {
+		want:       nil,
+		name:       "bad_type",
+		in:         "!1\r\n",
+		wantErrMsg: `unexpected reply type '!'`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := redis.NewReader(strings.NewReader(tc.in), maxBulkLen, maxArrayLen)
+
+			reply, err := r.ReadReply()
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.want, reply)
+		})
+	}
+}
@@ -0,0 +1,304 @@
+// Package redis contains a minimal client for Redis speaking the RESP2
+// protocol over TCP.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+)
+
+const (
+	// defaultTimeout is the default timeout of the commands.
+	defaultTimeout = 1 * time.Second
+
+	// defaultMaxIdleConns is the default maximum number of idle connections.
+	defaultMaxIdleConns = 16
+
+	// defaultMaxBulkLen is the default maximum length of a bulk string reply.
+	defaultMaxBulkLen = 512 * 1024
+
+	// defaultMaxArrayLen is the default maximum number of elements of an array
+	// reply.
+	defaultMaxArrayLen = 64 * 1024
+)
+
+// ErrNoAddr is returned when the address of Redis isn't set.
+const ErrNoAddr errors.Error = "no redis address"
+
+// Config is the configuration of the [Client].
+type Config struct {
+	// Addr is the address of the Redis server in the host:port form.  It must
+	// not be empty.
+	Addr string
+
+	// Username is the name of the Redis user to authenticate as.  If empty,
+	// the default user is used.
+	Username string
+
+	// Password is the password to authenticate with.  If empty, no
+	// authentication is performed.
+	Password string
+
+	// Timeout is the timeout of dialing and of each command.  If not positive,
+	// a second is used.
+	Timeout time.Duration
+
+	// DB is the number of the Redis database to use.
+	DB int
+
+	// MaxIdleConns is the maximum number of idle connections kept open.  If
+	// not positive, 16 is used.
+	MaxIdleConns int
+
+	// MaxBulkLen is the maximum length of a bulk string reply in bytes.  If
+	// not positive, 512 KiB is used.
+	MaxBulkLen int
+
+	// MaxArrayLen is the maximum number of elements of an array reply.  If not
+	// positive, 65536 is used.
+	MaxArrayLen int
+}
+
+// Client is a client for Redis.  It keeps a pool of connections, which are
+// established on demand.  It's safe for concurrent use.
+type Client struct {
+	// idle are the connections ready to be used.
+	idle chan *conn
+
+	// dialer dials the new connections.
+	dialer *net.Dialer
+
+	// addr is the address of the Redis server.
+	addr string
+
+	// username is the name of the Redis user to authenticate as.
+	username string
+
+	// password is the password to authenticate with.
+	password string
+
+	// timeout is the timeout of each command.
+	timeout time.Duration
+
+	// db is the number of the Redis database to use.
+	db int
+
+	// maxBulkLen is the maximum length of a bulk string reply.
+	maxBulkLen int
+
+	// maxArrayLen is the maximum number of elements of an array reply.
+	maxArrayLen int
+}
+
+// type check
+var _ io.Closer = (*Client)(nil)
+
+// New returns a new properly initialized *Client.  conf must not be nil.
+func New(conf *Config) (c *Client, err error) {
+	if conf.Addr == "" {
+		return nil, ErrNoAddr
+	}
+
+	timeout := conf.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &Client{
+		idle:        make(chan *conn, valueOrDefault(conf.MaxIdleConns, defaultMaxIdleConns)),
+		dialer:      &net.Dialer{Timeout: timeout},
+		addr:        conf.Addr,
+		username:    conf.Username,
+		password:    conf.Password,
+		timeout:     timeout,
+		db:          conf.DB,
+		maxBulkLen:  valueOrDefault(conf.MaxBulkLen, defaultMaxBulkLen),
+		maxArrayLen: valueOrDefault(conf.MaxArrayLen, defaultMaxArrayLen),
+	}, nil
+}
+
+// valueOrDefault returns v if it's positive and def otherwise.
+func valueOrDefault(v, def int) (res int) {
+	if v > 0 {
+		return v
+	}
+
+	return def
+}
+
+// Do sends the command with args to Redis and returns the reply.  See
+// [Reader.ReadReply] for the types of the reply.  The error replies are
+// returned as errors of type [Error].  The command is aborted after the
+// configured timeout or when ctx is done, whatever happens first.
+func (c *Client) Do(ctx context.Context, args ...[]byte) (reply any, err error) {
+	cn, err := c.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err = cn.do(ctx, c.timeout, args...)
+	if err != nil {
+		// The state of the connection is unknown.
+		return nil, errors.WithDeferred(err, cn.conn.Close())
+	}
+
+	c.putConn(cn)
+
+	if respErr, ok := reply.(Error); ok {
+		return nil, respErr
+	}
+
+	return reply, nil
+}
+
+// Close implements the [io.Closer] interface for *Client.  It closes the idle
+// connections.
+func (c *Client) Close() (err error) {
+	var errs []error
+	for {
+		select {
+		case cn := <-c.idle:
+			errs = append(errs, cn.conn.Close())
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// getConn returns an idle connection or dials a new one.
+func (c *Client) getConn(ctx context.Context) (cn *conn, err error) {
+	select {
+	case cn = <-c.idle:
+		return cn, nil
+	default:
+		// Go on.
+	}
+
+	nc, err := c.dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("dialing: %w", err)
+	}
+
+	cn = &conn{
+		conn: nc,
+		r:    NewReader(nc, c.maxBulkLen, c.maxArrayLen),
+		w:    bufio.NewWriter(nc),
+	}
+
+	err = c.setUp(ctx, cn)
+	if err != nil {
+		return nil, errors.WithDeferred(err, nc.Close())
+	}
+
+	return cn, nil
+}
+
+// setUp authenticates cn and selects the database, if configured.
+func (c *Client) setUp(ctx context.Context, cn *conn) (err error) {
+	if c.password != "" {
+		args := [][]byte{[]byte("AUTH"), []byte(c.password)}
+		if c.username != "" {
+			args = [][]byte{args[0], []byte(c.username), args[1]}
+		}
+
+		err = cn.doOK(ctx, c.timeout, args...)
+		if err != nil {
+			return fmt.Errorf("authenticating: %w", err)
+		}
+	}
+
+	if c.db != 0 {
+		err = cn.doOK(ctx, c.timeout, []byte("SELECT"), strconv.AppendInt(nil, int64(c.db), 10))
+		if err != nil {
+			return fmt.Errorf("selecting db: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// putConn returns cn to the idle connections or closes it if there are too
+// many of those.
+func (c *Client) putConn(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		_ = cn.conn.Close()
+	}
+}
+
+// conn is a single connection to Redis.  It isn't safe for concurrent use.
+type conn struct {
+	// conn is the underlying connection.
+	conn net.Conn
+
+	// r reads the replies from conn.
+	r *Reader
+
+	// w writes the commands to conn.
+	w *bufio.Writer
+}
+
+// do sends the command with args and reads the reply.  The command is aborted
+// after timeout or when ctx is done, whatever happens first.
+func (c *conn) do(ctx context.Context, timeout time.Duration, args ...[]byte) (reply any, err error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+
+	err = c.conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	err = c.write(args)
+	if err != nil {
+		return nil, fmt.Errorf("writing command: %w", err)
+	}
+
+	reply, err = c.r.ReadReply()
+	if err != nil {
+		return nil, fmt.Errorf("reading reply: %w", err)
+	}
+
+	return reply, nil
+}
+
+// doOK is like [conn.do] but expects the OK reply.
+func (c *conn) doOK(ctx context.Context, timeout time.Duration, args ...[]byte) (err error) {
+	reply, err := c.do(ctx, timeout, args...)
+	if err != nil {
+		return err
+	}
+
+	switch reply := reply.(type) {
+	case Error:
+		return reply
+	case string:
+		if reply == "OK" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unexpected reply %v", reply)
+}
+
+// write writes the command with args as an array of bulk strings.
+func (c *conn) write(args [][]byte) (err error) {
+	_, _ = fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		_, _ = fmt.Fprintf(c.w, "$%d\r\n", len(a))
+		_, _ = c.w.Write(a)
+		_, _ = c.w.WriteString("\r\n")
+	}
+
+	return c.w.Flush()
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
@@ -13,10 +14,12 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/filter"
 	proxynetutil "github.com/AdguardTeam/dnsproxy/internal/netutil"
 	"github.com/AdguardTeam/dnsproxy/internal/version"
 	"github.com/AdguardTeam/dnsproxy/proxy"
@@ -63,12 +66,31 @@ type Options struct {
 	// DNSCryptConfigPath is the path to the DNSCrypt configuration file.
 	DNSCryptConfigPath string `yaml:"dnscrypt-config" short:"g" long:"dnscrypt-config" description:"Path to a file with DNSCrypt configuration. You can generate one using https://github.com/ameshkov/dnscrypt"`
 
+	// CacheSnapshot is the path to the file the cache is saved to on shutdown
+	// and loaded from on start.
+	CacheSnapshot string `yaml:"cache-snapshot" long:"cache-snapshot" description:"Path to the file the cache is saved to on shutdown and loaded from on start"`
+
+	// CacheRedis is the URL of the Redis server to store the cache in.
+	CacheRedis string `yaml:"cache-redis" long:"cache-redis" description:"URL of the Redis server to store the cache in and share it between several instances, e.g. redis://:password@localhost:6379/0"`
+
 	// EDNSAddr is the custom EDNS Client Address to send.
 	EDNSAddr string `yaml:"edns-addr" long:"edns-addr" description:"Send EDNS Client Address"`
 
 	// UpstreamMode determines the logic through which upstreams will be used.
 	// If not specified the [proxy.UpstreamModeLoadBalance] is used.
-	UpstreamMode string `yaml:"upstream-mode" long:"upstream-mode" description:"Defines the upstreams logic mode, possible values: load_balance, parallel, fastest_addr (default: load_balance)" optional:"yes" optional-value:"load_balance"`
+	UpstreamMode string `yaml:"upstream-mode" long:"upstream-mode" description:"Defines the upstreams logic mode, possible values: load_balance, parallel, fastest_addr, hedged, strict_order, round_robin (default: load_balance)" optional:"yes" optional-value:"load_balance"`
+
+	// UpstreamStatsDecay is the smoothing factor of the moving averages of the
+	// upstreams' response time and error rate used in the load-balancing mode.
+	UpstreamStatsDecay float64 `yaml:"upstream-stats-decay" long:"upstream-stats-decay" description:"Smoothing factor of the moving averages of the upstreams' response time and error rate used in the load_balance mode, from 0 to 1. Default: 0.05"`
+
+	// HedgeDelay is the delay after which the request is also sent to the next
+	// upstream in the hedged upstream mode.
+	HedgeDelay timeutil.Duration `yaml:"hedge-delay" long:"hedge-delay" description:"Delay after which the request is also sent to the next upstream in the hedged mode in a human-readable form. Default: derived from the upstream's response time"`
+
+	// HedgePercentile is the percentile of the upstream's recent response times
+	// used as the delay in the hedged upstream mode, if HedgeDelay isn't set.
+	HedgePercentile float64 `yaml:"hedge-percentile" long:"hedge-percentile" description:"Percentile of the upstream's recent response times used as the delay in the hedged mode, from 0 to 1. Default: 0.95"`
 
 	// ListenAddrs is the list of server's listen addresses.
 	ListenAddrs []string `yaml:"listen-addrs" short:"l" long:"listen" description:"Listening addresses"`
@@ -97,6 +119,14 @@ type Options struct {
 	// Fallbacks is the list of fallback DNS upstream servers.
 	Fallbacks []string `yaml:"fallback" short:"f" long:"fallback" description:"Fallback resolvers to use when regular ones are unavailable, can be specified multiple times. You can also specify path to a file with the list of servers"`
 
+	// FailureRcodes are the response codes of the upstreams' responses
+	// considered failures.
+	FailureRcodes []string `yaml:"failure-rcode" long:"failure-rcode" description:"Response code, e.g. SERVFAIL, of the upstream's response considered a failure, so that the next upstream or the fallbacks are used and the response isn't cached, can be specified multiple times"`
+
+	// FailOnEmptyAnswer makes the NOERROR responses without answers to A and
+	// AAAA requests considered failures.
+	FailOnEmptyAnswer bool `yaml:"fail-on-empty-answer" long:"fail-on-empty-answer" description:"Consider the upstream's NOERROR responses without answers to A and AAAA requests failures" optional:"yes" optional-value:"true"`
+
 	// PrivateRDNSUpstreams are upstreams to use for reverse DNS lookups of
 	// private addresses, including the requests for authority records, such as
 	// SOA and NS.
@@ -118,6 +148,72 @@ type Options struct {
 	// go-flags doesn't support text unmarshalers.
 	BogusNXDomain []string `yaml:"bogus-nxdomain" long:"bogus-nxdomain" description:"Transform the responses containing at least a single IP that matches specified addresses and CIDRs into NXDOMAIN.  Can be specified multiple times."`
 
+	// DNSSECTrustAnchors are the DS records, in the presentation format, of
+	// the zones trusted when validating DNSSEC.  If not specified, the root
+	// zone KSKs are used.
+	DNSSECTrustAnchors []string `yaml:"dnssec-trust-anchor" long:"dnssec-trust-anchor" description:"DS record of a DNSSEC trust anchor, e.g. '. IN DS 20326 8 2 E06D...'.  If not specified, the root zone keys are used.  Can be specified multiple times"`
+
+	// DNSSECNegativeTrustAnchors are the domains, for which along with their
+	// subdomains the DNSSEC validation is disabled.
+	DNSSECNegativeTrustAnchors []string `yaml:"dnssec-nta" long:"dnssec-nta" description:"Domain for which, along with its subdomains, DNSSEC validation is disabled.  Can be specified multiple times"`
+
+	// ZoneFiles are the paths to the RFC 1035 zone files of the zones to
+	// answer authoritatively.
+	ZoneFiles []string `yaml:"zone-file" long:"zone-file" description:"Path to the RFC 1035 zone file of the zone to answer authoritatively.  Reloaded on SIGHUP.  Can be specified multiple times"`
+
+	// HostsFiles are the paths to the hosts files to answer the A, AAAA, and
+	// PTR requests from.
+	HostsFiles []string `yaml:"hosts-file" long:"hosts-file" description:"Path to the hosts file to answer A, AAAA, and PTR requests from.  Reloaded on changes.  Can be specified multiple times"`
+
+	// RPZFiles are the paths to the zone files of the response policy zones.
+	RPZFiles []string `yaml:"rpz-file" long:"rpz-file" description:"Path to the zone file of a response policy zone.  Reloaded on SIGHUP.  Can be specified multiple times"`
+
+	// RPZTransfers are the response policy zones to transfer from primary
+	// servers, each in the name@address format.
+	RPZTransfers []string `yaml:"rpz-axfr" long:"rpz-axfr" description:"Response policy zone to transfer via AXFR, e.g. 'rpz.example@192.0.2.1:53'.  Transferred again on SIGHUP.  Can be specified multiple times"`
+
+	// Rewrites are the dnsmasq-style rules answering the requests for domains
+	// and their subdomains locally, each in the /domain[/domain...]/answer
+	// format, where the answer is an IP address or a domain name.
+	Rewrites []string `yaml:"rewrite" long:"rewrite" description:"Answer the requests for the domains and their subdomains with the address or the CNAME to the domain, e.g. '/example.lan/10.0.0.5'.  Can be specified multiple times"`
+
+	// RewriteTTL is the TTL of the rewritten records, in seconds.
+	RewriteTTL uint32 `yaml:"rewrite-ttl" long:"rewrite-ttl" description:"TTL of the rewritten records, in seconds" default:"10"`
+
+	// HealthCheckInterval is the interval between the health check probes of
+	// the upstreams in a human-readable form.  Zero value disables the health
+	// checks.
+	HealthCheckInterval timeutil.Duration `yaml:"health-check-interval" long:"health-check-interval" description:"Interval between the health check probes of the upstreams in a human-readable form. Zero value disables the health checks"`
+
+	// HealthCheckDomain is the domain name queried by the health check probes.
+	HealthCheckDomain string `yaml:"health-check-domain" long:"health-check-domain" description:"Domain name queried by the health check probes. Default: the root domain"`
+
+	// HealthCheckQtype is the type of the health check queries.
+	HealthCheckQtype string `yaml:"health-check-qtype" long:"health-check-qtype" description:"Type of the health check queries. Default: NS"`
+
+	// HealthCheckFailures is the number of consecutive failed health check
+	// probes after which an upstream is skipped until a probe succeeds.
+	HealthCheckFailures uint `yaml:"health-check-failures" long:"health-check-failures" description:"Number of consecutive failed health check probes after which an upstream is skipped until a probe succeeds. Default: 3"`
+
+	// FilterLists are the paths or the URLs of the hosts-style or
+	// adblock-style rule lists to block the requests with.
+	FilterLists []string `yaml:"filter-list" long:"filter-list" description:"Path or HTTP(S) URL of a hosts-style or adblock-style rule list to block requests with.  Can be specified multiple times"`
+
+	// FilterBlockingMode is the type of the response to the blocked requests.
+	FilterBlockingMode string `yaml:"filter-blocking-mode" long:"filter-blocking-mode" description:"Response to the blocked requests, possible values: nxdomain, refused, null_ip, custom_ip (default: nxdomain)"`
+
+	// FilterBlockingIPv4 is the address to respond to the blocked A requests
+	// with in the custom_ip blocking mode.
+	FilterBlockingIPv4 string `yaml:"filter-blocking-ipv4" long:"filter-blocking-ipv4" description:"IPv4 address to respond to the blocked A requests with in the custom_ip blocking mode"`
+
+	// FilterBlockingIPv6 is the address to respond to the blocked AAAA
+	// requests with in the custom_ip blocking mode.
+	FilterBlockingIPv6 string `yaml:"filter-blocking-ipv6" long:"filter-blocking-ipv6" description:"IPv6 address to respond to the blocked AAAA requests with in the custom_ip blocking mode"`
+
+	// FilterRefreshInterval is the interval between the refreshes of the rule
+	// lists in a human-readable form.
+	FilterRefreshInterval timeutil.Duration `yaml:"filter-refresh-interval" long:"filter-refresh-interval" description:"Interval between the refreshes of the rule lists in a human-readable form" default:"24h"`
+
 	// Timeout for outbound DNS queries to remote upstream servers in a
 	// human-readable form.  Default is 10s.
 	Timeout timeutil.Duration `yaml:"timeout" long:"timeout" description:"Timeout for outbound DNS queries to remote upstream servers in a human-readable form" default:"10s"`
@@ -131,6 +227,31 @@ type Options struct {
 	// greater.
 	CacheMaxTTL uint32 `yaml:"cache-max-ttl" long:"cache-max-ttl" description:"Maximum TTL value for DNS entries, in seconds."`
 
+	// CacheOptimisticAnswerTTL is the TTL of the expired cached responses
+	// served in the optimistic cache mode.
+	CacheOptimisticAnswerTTL timeutil.Duration `yaml:"cache-optimistic-answer-ttl" long:"cache-optimistic-answer-ttl" description:"TTL of expired responses served from the optimistic cache in a human-readable form. Default: 10s"`
+
+	// CacheOptimisticMaxAge is the maximum time after expiration for which the
+	// cached responses are served in the optimistic cache mode.
+	CacheOptimisticMaxAge timeutil.Duration `yaml:"cache-optimistic-max-age" long:"cache-optimistic-max-age" description:"Maximum time after expiration for which the responses are served from the optimistic cache in a human-readable form. Zero value means no limit" default:"12h"`
+
+	// CacheOptimisticClientTimeout is the time to wait for the refreshed
+	// response before serving the expired one in the optimistic cache mode.
+	CacheOptimisticClientTimeout timeutil.Duration `yaml:"cache-optimistic-client-timeout" long:"cache-optimistic-client-timeout" description:"Time to wait for the upstream to refresh an expired response before serving it from the optimistic cache in a human-readable form. Zero value means serving it immediately"`
+
+	// CacheOptimisticRecheckInterval is the time during which the expired
+	// cached response isn't refreshed after a failed refresh in the
+	// optimistic cache mode.
+	CacheOptimisticRecheckInterval timeutil.Duration `yaml:"cache-optimistic-recheck-interval" long:"cache-optimistic-recheck-interval" description:"Time during which an expired response from the optimistic cache isn't refreshed after a failure in a human-readable form" default:"30s"`
+
+	// CachePrefetchMinHits is the minimum number of cache hits of a response
+	// to prefetch it.
+	CachePrefetchMinHits uint `yaml:"cache-prefetch-min-hits" long:"cache-prefetch-min-hits" description:"Minimum number of cache hits of a response within its TTL to prefetch it. Default: 2"`
+
+	// CachePrefetchThreshold is the fraction of the original TTL of a cached
+	// response remaining at which it's prefetched.
+	CachePrefetchThreshold float64 `yaml:"cache-prefetch-threshold" long:"cache-prefetch-threshold" description:"Fraction of the original TTL of a cached response remaining at which it's prefetched, from 0 to 1. Default: 0.1"`
+
 	// CacheSizeBytes is the cache size in bytes.  Default is 64k.
 	CacheSizeBytes int `yaml:"cache-size" long:"cache-size" description:"Cache size (in bytes). Default: 64k"`
 
@@ -171,6 +292,14 @@ type Options struct {
 	// Insecure disables upstream servers TLS certificate verification.
 	Insecure bool `yaml:"insecure" long:"insecure" description:"Disable secure TLS certificate validation" optional:"yes" optional-value:"false"`
 
+	// RandomizeCase enables the DNS 0x20 encoding of the queries to the plain
+	// DNS upstreams.
+	RandomizeCase bool `yaml:"randomize-case" long:"randomize-case" description:"Randomize the case of the query names sent to the plain DNS upstreams and reject the responses not matching it (DNS 0x20 encoding)" optional:"yes" optional-value:"true"`
+
+	// Cookies enables the DNS cookies for both the plain DNS server and the
+	// plain DNS upstreams.
+	Cookies bool `yaml:"dns-cookies" long:"dns-cookies" description:"Enable DNS cookies (RFC 7873) for the plain DNS server and upstreams. Clients with valid server cookies bypass the UDP ratelimit" optional:"yes" optional-value:"true"`
+
 	// IPv6Disabled makes the server to respond with NODATA to all AAAA queries.
 	IPv6Disabled bool `yaml:"ipv6-disabled" long:"ipv6-disabled" description:"If specified, all AAAA requests will be replied with NoError RCode and empty answer" optional:"yes" optional-value:"true"`
 
@@ -183,6 +312,10 @@ type Options struct {
 	// already expired.
 	CacheOptimistic bool `yaml:"cache-optimistic" long:"cache-optimistic" description:"If specified, optimistic DNS cache is enabled" optional:"yes" optional-value:"true"`
 
+	// CachePrefetch, if set to true, enables prefetching of the frequently
+	// requested cached responses before they expire.
+	CachePrefetch bool `yaml:"cache-prefetch" long:"cache-prefetch" description:"If specified, frequently requested cached responses are prefetched before they expire" optional:"yes" optional-value:"true"`
+
 	// Cache controls whether DNS responses are cached or not.
 	Cache bool `yaml:"cache" long:"cache" description:"If specified, DNS cache is enabled" optional:"yes" optional-value:"true"`
 
@@ -192,6 +325,10 @@ type Options struct {
 	// EnableEDNSSubnet uses EDNS Client Subnet extension.
 	EnableEDNSSubnet bool `yaml:"edns" long:"edns" description:"Use EDNS Client Subnet extension" optional:"yes" optional-value:"true"`
 
+	// DNSSEC defines whether the DNSSEC validation of upstream responses is
+	// enabled or not.
+	DNSSEC bool `yaml:"dnssec" long:"dnssec" description:"If specified, dnsproxy will validate DNSSEC signatures of upstream responses" optional:"yes" optional-value:"true"`
+
 	// DNS64 defines whether DNS64 functionality is enabled or not.
 	DNS64 bool `yaml:"dns64" long:"dns64" description:"If specified, dnsproxy will act as a DNS64 server" optional:"yes" optional-value:"true"`
 
@@ -199,6 +336,46 @@ type Options struct {
 	// lookups of private addresses, including the requests for authority
 	// records, such as SOA and NS.
 	UsePrivateRDNS bool `yaml:"use-private-rdns" long:"use-private-rdns" description:"If specified, use private upstreams for reverse DNS lookups of private addresses" optional:"yes" optional-value:"true"`
+
+	// Views are the sets of settings applied to the requests from particular
+	// clients.  Those are only configurable in the YAML configuration file.
+	Views []*viewOptions `yaml:"views"`
+}
+
+// viewOptions is the configuration of a single view.
+type viewOptions struct {
+	// Name is the unique name of the view.
+	Name string `yaml:"name"`
+
+	// EDNSAddr is the ECS IP used in the requests within the view.
+	EDNSAddr string `yaml:"edns-addr"`
+
+	// ClientSubnets are the subnets of the clients the view is applied to.
+	ClientSubnets []string `yaml:"client-subnets"`
+
+	// ListenAddrs are the local addresses of the listeners, in the ip:port
+	// format, the view is applied to.
+	ListenAddrs []string `yaml:"listen-addrs"`
+
+	// Upstreams are the upstreams used within the view, in the same format as
+	// the general ones.
+	Upstreams []string `yaml:"upstream"`
+
+	// DNS64Prefix defines the DNS64 prefixes used within the view.
+	DNS64Prefix []string `yaml:"dns64-prefix"`
+
+	// CacheSizeBytes is the size of the cache of the view in bytes.
+	CacheSizeBytes int `yaml:"cache-size"`
+
+	// Cache enables the separate cache of the view.
+	Cache bool `yaml:"cache"`
+
+	// EnableEDNSSubnet enables the EDNS Client Subnet extension within the
+	// view.
+	EnableEDNSSubnet bool `yaml:"edns"`
+
+	// DNS64 enables DNS64 within the view.
+	DNS64 bool `yaml:"dns64"`
 }
 
 const (
@@ -359,6 +536,15 @@ func runProxy(ctx context.Context, l *slog.Logger, options *Options) (err error)
 		dnsProxy.RequestHandler = ipv6Config.handleDNSRequest
 	}
 
+	// Start the filter, if any, to load the rule lists.
+	flt, hasFilter := conf.BeforeRequestHandler.(*filter.Filter)
+	if hasFilter {
+		err = flt.Start(ctx)
+		if err != nil {
+			return fmt.Errorf("starting filter: %w", err)
+		}
+	}
+
 	// Start the proxy server.
 	err = dnsProxy.Start(ctx)
 	if err != nil {
@@ -367,8 +553,10 @@ func runProxy(ctx context.Context, l *slog.Logger, options *Options) (err error)
 
 	// TODO(e.burkov):  Use signal handler.
 	signalChannel := make(chan os.Signal, 1)
-	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChannel
+	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := <-signalChannel; sig == syscall.SIGHUP; sig = <-signalChannel {
+		reloadProxy(ctx, l, dnsProxy)
+	}
 
 	// Stopping the proxy.
 	err = dnsProxy.Shutdown(ctx)
@@ -376,9 +564,47 @@ func runProxy(ctx context.Context, l *slog.Logger, options *Options) (err error)
 		return fmt.Errorf("stopping dnsproxy: %w", err)
 	}
 
+	// Close the external cache storage, if any, since the proxy doesn't own it.
+	if c, ok := conf.CacheStorage.(io.Closer); ok {
+		err = c.Close()
+		if err != nil {
+			return fmt.Errorf("closing cache storage: %w", err)
+		}
+	}
+
+	if hasFilter {
+		err = flt.Shutdown(ctx)
+		if err != nil {
+			return fmt.Errorf("stopping filter: %w", err)
+		}
+	}
+
 	return nil
 }
 
+// reloadProxy reloads the data dnsProxy loads from files and logs the errors,
+// if any.
+func reloadProxy(ctx context.Context, l *slog.Logger, dnsProxy *proxy.Proxy) {
+	l.InfoContext(ctx, "reloading")
+
+	err := dnsProxy.ReloadZones()
+	if err != nil {
+		l.ErrorContext(ctx, "reloading", slogutil.KeyError, err)
+	}
+
+	err = dnsProxy.ReloadRPZ()
+	if err != nil {
+		l.ErrorContext(ctx, "reloading", slogutil.KeyError, err)
+	}
+
+	if flt, ok := dnsProxy.BeforeRequestHandler.(*filter.Filter); ok {
+		err = flt.Refresh(ctx)
+		if err != nil {
+			l.ErrorContext(ctx, "refreshing filter lists", slogutil.KeyError, err)
+		}
+	}
+}
+
 // runPprof runs pprof server on localhost:6060.
 func runPprof(l *slog.Logger) {
 	mux := http.NewServeMux()
@@ -432,6 +658,25 @@ func createProxyConfig(
 		CacheOptimistic: options.CacheOptimistic,
 		RefuseAny:       options.RefuseAny,
 		HTTP3:           options.HTTP3,
+
+		CacheOptimisticAnswerTTL:       options.CacheOptimisticAnswerTTL.Duration,
+		CacheOptimisticMaxAge:          options.CacheOptimisticMaxAge.Duration,
+		CacheOptimisticClientTimeout:   options.CacheOptimisticClientTimeout.Duration,
+		CacheOptimisticRecheckInterval: options.CacheOptimisticRecheckInterval.Duration,
+
+		CachePrefetch:          options.CachePrefetch,
+		CachePrefetchMinHits:   options.CachePrefetchMinHits,
+		CachePrefetchThreshold: options.CachePrefetchThreshold,
+
+		CacheSnapshotPath: options.CacheSnapshot,
+
+		UpstreamStatsDecay: options.UpstreamStatsDecay,
+		HedgeDelay:         options.HedgeDelay.Duration,
+		HedgePercentile:    options.HedgePercentile,
+
+		ZoneFiles:  options.ZoneFiles,
+		HostsFiles: options.HostsFiles,
+
 		// TODO(e.burkov):  The following CIDRs are aimed to match any address.
 		// This is not quite proper approach to be used by default so think
 		// about configuring it.
@@ -456,6 +701,10 @@ func createProxyConfig(
 		}
 	}
 
+	if options.Cookies {
+		conf.Cookies = &proxy.CookieConfig{}
+	}
+
 	options.initBogusNXDomain(ctx, l, conf)
 
 	var errs []error
@@ -465,6 +714,13 @@ func createProxyConfig(
 	errs = append(errs, options.initDNSCryptConfig(conf))
 	errs = append(errs, options.initListenAddrs(conf))
 	errs = append(errs, options.initSubnets(conf))
+	errs = append(errs, options.initDNSSEC(conf))
+	errs = append(errs, options.initCacheStorage(conf))
+	errs = append(errs, options.initRPZ(conf))
+	errs = append(errs, options.initRewrites(conf))
+	errs = append(errs, options.initHealthCheck(conf))
+	errs = append(errs, options.initFailureRcodes(conf))
+	errs = append(errs, options.initFilter(l, conf))
 
 	return conf, errors.Join(errs...)
 }
@@ -515,6 +771,8 @@ func (opts *Options) initUpstreams(
 		InsecureSkipVerify: opts.Insecure,
 		Bootstrap:          boot,
 		Timeout:            timeout,
+		RandomizeCase:      opts.RandomizeCase,
+		Cookies:            opts.Cookies,
 	}
 	upstreams := loadServersList(opts.Upstreams)
 
@@ -550,6 +808,16 @@ func (opts *Options) initUpstreams(
 		config.Fallbacks = fallbacks
 	}
 
+	for i, vo := range opts.Views {
+		var v *proxy.View
+		v, err = vo.toView(upsOpts)
+		if err != nil {
+			return fmt.Errorf("view at index %d: %w", i, err)
+		}
+
+		config.Views = append(config.Views, v)
+	}
+
 	if opts.UpstreamMode != "" {
 		err = config.UpstreamMode.UnmarshalText([]byte(opts.UpstreamMode))
 		if err != nil {
@@ -564,6 +832,62 @@ func (opts *Options) initUpstreams(
 	return nil
 }
 
+// toView converts vo into the view configuration, using upsOpts to create its
+// upstreams.
+func (vo *viewOptions) toView(upsOpts *upstream.Options) (v *proxy.View, err error) {
+	v = &proxy.View{
+		Name:                   vo.Name,
+		CacheSizeBytes:         vo.CacheSizeBytes,
+		CacheEnabled:           vo.Cache,
+		EnableEDNSClientSubnet: vo.EnableEDNSSubnet,
+		UseDNS64:               vo.DNS64,
+	}
+
+	v.UpstreamConfig, err = proxy.ParseUpstreamsConfig(loadServersList(vo.Upstreams), upsOpts)
+	if err != nil {
+		return nil, fmt.Errorf("parsing upstreams configuration: %w", err)
+	}
+
+	for i, s := range vo.ClientSubnets {
+		var pref netip.Prefix
+		pref, err = proxynetutil.ParseSubnet(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing client subnet at index %d: %w", i, err)
+		}
+
+		v.ClientSubnets = append(v.ClientSubnets, pref)
+	}
+
+	for i, s := range vo.ListenAddrs {
+		var addr netip.AddrPort
+		addr, err = netip.ParseAddrPort(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing listen addr at index %d: %w", i, err)
+		}
+
+		v.ListenAddrs = append(v.ListenAddrs, addr)
+	}
+
+	for i, s := range vo.DNS64Prefix {
+		var pref netip.Prefix
+		pref, err = netip.ParsePrefix(s)
+		if err != nil {
+			return nil, fmt.Errorf("parsing dns64 prefix at index %d: %w", i, err)
+		}
+
+		v.DNS64Prefs = append(v.DNS64Prefs, pref)
+	}
+
+	if vo.EDNSAddr != "" {
+		v.EDNSAddr, err = netutil.ParseIP(vo.EDNSAddr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing edns-addr: %w", err)
+		}
+	}
+
+	return v, nil
+}
+
 // initBootstrap initializes the [upstream.Resolver] for bootstrapping upstream
 // servers.  It returns the default resolver if no bootstraps were specified.
 // The returned resolver will also use system hosts files first.
@@ -829,6 +1153,218 @@ func (opts *Options) initPrivateSubnets(conf *proxy.Config) (err error) {
 	return nil
 }
 
+// defaultRedisPort is the port of the Redis server used if the cache Redis URL
+// doesn't specify one.
+const defaultRedisPort = "6379"
+
+// initCacheStorage sets the external cache storage configuration into conf.
+func (opts *Options) initCacheStorage(conf *proxy.Config) (err error) {
+	if opts.CacheRedis == "" {
+		return nil
+	}
+
+	u, err := url.Parse(opts.CacheRedis)
+	if err != nil {
+		return fmt.Errorf("parsing cache redis url: %w", err)
+	} else if u.Scheme != "redis" {
+		return fmt.Errorf("cache redis url: bad scheme %q", u.Scheme)
+	}
+
+	redisConf := &proxy.RedisCacheStorageConfig{
+		Addr: u.Host,
+	}
+
+	if u.Port() == "" {
+		redisConf.Addr = net.JoinHostPort(u.Hostname(), defaultRedisPort)
+	}
+
+	if u.User != nil {
+		redisConf.Username = u.User.Username()
+		redisConf.Password, _ = u.User.Password()
+	}
+
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		redisConf.DB, err = strconv.Atoi(db)
+		if err != nil {
+			return fmt.Errorf("cache redis url: parsing db: %w", err)
+		}
+	}
+
+	conf.CacheStorage, err = proxy.NewRedisCacheStorage(redisConf)
+	if err != nil {
+		return fmt.Errorf("creating cache redis storage: %w", err)
+	}
+
+	return nil
+}
+
+// initRPZ sets the response policy zones configuration into conf.  The zones
+// from files take precedence over the transferred ones.
+func (opts *Options) initRPZ(conf *proxy.Config) (err error) {
+	for _, path := range opts.RPZFiles {
+		conf.ResponsePolicyZones = append(conf.ResponsePolicyZones, &proxy.RPZConfig{
+			Path: path,
+		})
+	}
+
+	for i, s := range opts.RPZTransfers {
+		name, addr, ok := strings.Cut(s, "@")
+		if !ok || name == "" || addr == "" {
+			return fmt.Errorf("rpz axfr at index %d: bad value %q", i, s)
+		}
+
+		conf.ResponsePolicyZones = append(conf.ResponsePolicyZones, &proxy.RPZConfig{
+			Name:    name,
+			Primary: addr,
+		})
+	}
+
+	return nil
+}
+
+// initRewrites sets the rewrites configuration into conf.
+func (opts *Options) initRewrites(conf *proxy.Config) (err error) {
+	conf.RewriteTTL = opts.RewriteTTL
+
+	for i, s := range opts.Rewrites {
+		parts := strings.Split(strings.TrimPrefix(s, "/"), "/")
+		if len(parts) < 2 {
+			return fmt.Errorf("rewrite at index %d: bad value %q", i, s)
+		}
+
+		answer := parts[len(parts)-1]
+		r := proxy.Rewrite{}
+		if addr, parseErr := netip.ParseAddr(answer); parseErr == nil {
+			r.Addr = addr
+		} else {
+			r.Target = answer
+		}
+
+		for _, domain := range parts[:len(parts)-1] {
+			rw := r
+			rw.Domain = domain
+			conf.Rewrites = append(conf.Rewrites, &rw)
+		}
+	}
+
+	return nil
+}
+
+// initHealthCheck sets the health checks configuration into conf, if enabled.
+func (opts *Options) initHealthCheck(conf *proxy.Config) (err error) {
+	if opts.HealthCheckInterval.Duration == 0 {
+		return nil
+	}
+
+	var qtype uint16
+	if opts.HealthCheckQtype != "" {
+		var ok bool
+		qtype, ok = dns.StringToType[strings.ToUpper(opts.HealthCheckQtype)]
+		if !ok {
+			return fmt.Errorf("health check: unknown query type %q", opts.HealthCheckQtype)
+		}
+	}
+
+	conf.HealthCheck = &proxy.HealthCheckConfig{
+		Domain:           opts.HealthCheckDomain,
+		Interval:         opts.HealthCheckInterval.Duration,
+		FailureThreshold: opts.HealthCheckFailures,
+		Qtype:            qtype,
+	}
+
+	return nil
+}
+
+// initFailureRcodes sets the response codes considered failures into conf.
+func (opts *Options) initFailureRcodes(conf *proxy.Config) (err error) {
+	conf.FailOnEmptyAnswer = opts.FailOnEmptyAnswer
+
+	for _, s := range opts.FailureRcodes {
+		rcode, ok := dns.StringToRcode[strings.ToUpper(s)]
+		if !ok {
+			return fmt.Errorf("unknown failure rcode %q", s)
+		}
+
+		conf.FailureRcodes = append(conf.FailureRcodes, rcode)
+	}
+
+	return nil
+}
+
+// initFilter sets the filter for the configured rule lists as the before
+// request handler into conf.
+func (opts *Options) initFilter(l *slog.Logger, conf *proxy.Config) (err error) {
+	if len(opts.FilterLists) == 0 {
+		return nil
+	}
+
+	fltConf := &filter.Config{
+		Logger:          l.With(slogutil.KeyPrefix, filter.LogPrefix),
+		Lists:           opts.FilterLists,
+		RefreshInterval: opts.FilterRefreshInterval.Duration,
+	}
+
+	if opts.FilterBlockingMode != "" {
+		err = fltConf.BlockingMode.UnmarshalText([]byte(opts.FilterBlockingMode))
+		if err != nil {
+			return fmt.Errorf("parsing filter blocking mode: %w", err)
+		}
+	}
+
+	if opts.FilterBlockingIPv4 != "" {
+		fltConf.BlockingIPv4, err = netip.ParseAddr(opts.FilterBlockingIPv4)
+		if err != nil {
+			return fmt.Errorf("parsing filter blocking ipv4: %w", err)
+		}
+	}
+
+	if opts.FilterBlockingIPv6 != "" {
+		fltConf.BlockingIPv6, err = netip.ParseAddr(opts.FilterBlockingIPv6)
+		if err != nil {
+			return fmt.Errorf("parsing filter blocking ipv6: %w", err)
+		}
+	}
+
+	flt, err := filter.New(fltConf)
+	if err != nil {
+		return fmt.Errorf("creating filter: %w", err)
+	}
+
+	conf.BeforeRequestHandler = flt
+
+	return nil
+}
+
+// initDNSSEC sets the DNSSEC validation configuration into conf.
+func (opts *Options) initDNSSEC(conf *proxy.Config) (err error) {
+	if conf.DNSSECValidation = opts.DNSSEC; !conf.DNSSECValidation {
+		return nil
+	}
+
+	var errs []error
+	for i, s := range opts.DNSSECTrustAnchors {
+		rr, rrErr := dns.NewRR(s)
+		if rrErr != nil {
+			errs = append(errs, fmt.Errorf("parsing dnssec trust anchor at index %d: %w", i, rrErr))
+
+			continue
+		}
+
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			errs = append(errs, fmt.Errorf("dnssec trust anchor at index %d: not a ds record", i))
+
+			continue
+		}
+
+		conf.DNSSECTrustAnchors = append(conf.DNSSECTrustAnchors, ds)
+	}
+
+	conf.DNSSECNegativeTrustAnchors = opts.DNSSECNegativeTrustAnchors
+
+	return errors.Join(errs...)
+}
+
 // ipv6Configuration represents IPv6 configuration.
 type ipv6Configuration struct {
 	// logger is used for logging during requests handling.  It is never nil.
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// badResponseError is returned when an upstream responds with a response
+// considered a failure, see [Config.FailureRcodes] and
+// [Config.FailOnEmptyAnswer].
+type badResponseError struct {
+	// resp is the bad response.  It is never nil.
+	resp *dns.Msg
+
+	// upstream is the upstream that sent the response.  It is never nil.
+	upstream upstream.Upstream
+}
+
+// type check
+var _ error = (*badResponseError)(nil)
+
+// Error implements the [error] interface for *badResponseError.
+func (err *badResponseError) Error() (msg string) {
+	if err.resp.Rcode == dns.RcodeSuccess {
+		return "bad response: empty answer"
+	}
+
+	return fmt.Sprintf("bad response: rcode %s", dns.RcodeToString[err.resp.Rcode])
+}
+
+// checkResponse returns a *badResponseError if resp received from u for req
+// should be considered a failure.
+func (p *Proxy) checkResponse(u upstream.Upstream, req, resp *dns.Msg) (err error) {
+	if resp == nil {
+		return nil
+	}
+
+	if slices.Contains(p.FailureRcodes, resp.Rcode) {
+		return &badResponseError{resp: resp, upstream: u}
+	}
+
+	if !p.FailOnEmptyAnswer || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) > 0 {
+		return nil
+	}
+
+	switch req.Question[0].Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		return &badResponseError{resp: resp, upstream: u}
+	default:
+		return nil
+	}
+}
+
+// checksResponses returns true if some of the responses are considered
+// failures.
+func (p *Proxy) checksResponses() (ok bool) {
+	return len(p.FailureRcodes) > 0 || p.FailOnEmptyAnswer
+}
+
+// checkedUpstream is an upstream returning a *badResponseError for the
+// responses considered failures.  It's used with the functions exchanging with
+// multiple upstreams at once, like [upstream.ExchangeParallel].
+type checkedUpstream struct {
+	// Upstream is the actual upstream.  It must not be nil.
+	upstream.Upstream
+
+	// proxy checks the responses.  It is never nil.
+	proxy *Proxy
+}
+
+// type check
+var _ upstream.Upstream = (*checkedUpstream)(nil)
+
+// Exchange implements the [upstream.Upstream] interface for *checkedUpstream.
+func (u *checkedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	resp, err = u.Upstream.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return resp, err
+	}
+
+	err = u.proxy.checkResponse(u.Upstream, req, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// checkedUpstreams returns ups wrapped into *checkedUpstream, if the responses
+// are checked at all.  Otherwise, it returns ups itself.
+func (p *Proxy) checkedUpstreams(ups []upstream.Upstream) (checked []upstream.Upstream) {
+	if !p.checksResponses() {
+		return ups
+	}
+
+	checked = make([]upstream.Upstream, 0, len(ups))
+	for _, u := range ups {
+		checked = append(checked, &checkedUpstream{Upstream: u, proxy: p})
+	}
+
+	return checked
+}
+
+// uncheckedUpstream returns the upstream wrapped into u, if it's
+// a *checkedUpstream.  Otherwise, it returns u itself.
+func uncheckedUpstream(u upstream.Upstream) (unwrapped upstream.Upstream) {
+	if cu, ok := u.(*checkedUpstream); ok {
+		return cu.Upstream
+	}
+
+	return u
+}
+
+// exchangeParallel is like [upstream.ExchangeParallel], but it considers the
+// bad responses to be failures.
+func (p *Proxy) exchangeParallel(
+	ups []upstream.Upstream,
+	req *dns.Msg,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	resp, u, err = upstream.ExchangeParallel(p.checkedUpstreams(ups), req)
+
+	return resp, uncheckedUpstream(u), err
+}
@@ -2,17 +2,19 @@ package proxy
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"log/slog"
 	"math"
 	"net"
+	"net/netip"
 	"slices"
 	"strings"
-	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	glcache "github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/mathutil"
 	"github.com/miekg/dns"
 )
@@ -20,25 +22,81 @@ import (
 // defaultCacheSize is the size of cache in bytes by default.
 const defaultCacheSize = 64 * 1024
 
+const (
+	// storageTimeout is the timeout of a single lookup, store, or removal of
+	// an item in the external storage.
+	storageTimeout = 1 * time.Second
+
+	// storageClearTimeout is the timeout of clearing the external storage.
+	storageClearTimeout = 1 * time.Minute
+)
+
 // cache is used to cache requests and used upstreams.
 type cache struct {
-	// itemsLock protects requests cache.
-	itemsLock *sync.RWMutex
-
-	// itemsWithSubnetLock protects requests cache.
-	itemsWithSubnetLock *sync.RWMutex
+	// logger is used to log the storage errors.  It is never nil.
+	logger *slog.Logger
 
 	// items is the requests cache.
-	items glcache.Cache
+	items CacheStorage
 
 	// itemsWithSubnet is the requests cache.
-	itemsWithSubnet glcache.Cache
+	itemsWithSubnet CacheStorage
+
+	// storage is the external storage shared by items and itemsWithSubnet.
+	// It's nil if the items are stored in memory.
+	storage CacheStorage
+
+	// optimisticMaxAge is the maximum time expired items are returned for
+	// after their expiration.  If zero, expired items are returned regardless
+	// of their age.  It's only used if optimistic is true.
+	optimisticMaxAge time.Duration
+
+	// optimisticTTL is the TTL of expired items returned in seconds.  It's
+	// only used if optimistic is true.
+	optimisticTTL uint32
+
+	// hits is the number of lookups which found an item in the storages which
+	// don't count those themselves.
+	hits atomic.Uint64
+
+	// misses is the number of lookups which found no item in the storages
+	// which don't count those themselves.
+	misses atomic.Uint64
 
 	// optimistic defines if the cache should return expired items and resolve
 	// those again.
 	optimistic bool
 }
 
+// cacheConfig is the configuration of the cache.
+type cacheConfig struct {
+	// logger is used to log the storage errors.  If nil, [slog.Default] is
+	// used.
+	logger *slog.Logger
+
+	// storage is the external storage of the items.  If nil, the in-memory
+	// storage of size is used.
+	storage CacheStorage
+
+	// size is the maximum size of the in-memory cache in bytes.  If not
+	// positive, the [defaultCacheSize] is used.
+	size int
+
+	// optimisticMaxAge is the maximum time expired items are returned for
+	// after their expiration.  If zero, there is no limit.
+	optimisticMaxAge time.Duration
+
+	// optimisticAnswerTTL is the TTL of expired items returned.  If zero, the
+	// [optimisticTTL] is used.
+	optimisticAnswerTTL time.Duration
+
+	// withECS defines if the cache for responses with ECS should be created.
+	withECS bool
+
+	// optimistic defines if the cache should return expired items.
+	optimistic bool
+}
+
 // cacheItem is a single cache entry.  It's a helper type to aggregate the
 // item-specific logic.
 type cacheItem struct {
@@ -83,6 +141,15 @@ const (
 
 	// minPackedLen is the minimum length of the packed cacheItem.
 	minPackedLen = expTimeSz + packedMsgLenSz
+
+	// maxUpsAddrLen is the maximum length of the upstream address within the
+	// packed cacheItem accepted from the outside of the process.  The actual
+	// addresses are never that long.
+	maxUpsAddrLen = dns.MaxMsgSize
+
+	// maxPackedLen is the maximum length of the packed cacheItem accepted from
+	// the outside of the process, e.g. from the cache snapshot.
+	maxPackedLen = minPackedLen + dns.MaxMsgSize + maxUpsAddrLen
 )
 
 // pack converts the ci into bytes slice.
@@ -111,7 +178,8 @@ const optimisticTTL = 10
 
 // unpackItem converts the data into cacheItem using req as a request message.
 // expired is true if the item exists but expired.  The expired cached items are
-// only returned if c is optimistic.  req must not be nil.
+// only returned if c is optimistic and they aren't older than the maximum age.
+// req must not be nil.
 func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bool) {
 	if len(data) < minPackedLen {
 		return nil, false
@@ -122,11 +190,11 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 	now := time.Now().Unix()
 	var ttl uint32
 	if expired = expire <= now; expired {
-		if !c.optimistic {
+		if !c.optimistic || c.isTooStale(now-expire) {
 			return nil, expired
 		}
 
-		ttl = optimisticTTL
+		ttl = c.optimisticTTL
 	} else {
 		ttl = uint32(expire - now)
 	}
@@ -161,6 +229,12 @@ func (c *cache) unpackItem(data []byte, req *dns.Msg) (ci *cacheItem, expired bo
 	}, expired
 }
 
+// isTooStale returns true if the item expired age seconds ago shouldn't be
+// returned anymore.
+func (c *cache) isTooStale(age int64) (ok bool) {
+	return c.optimisticMaxAge > 0 && age > int64(c.optimisticMaxAge/time.Second)
+}
+
 // CacheLogPrefix is a prefix for logging cache operations.
 const CacheLogPrefix = "cache"
 
@@ -175,46 +249,165 @@ func (p *Proxy) initCache() {
 	size := p.CacheSizeBytes
 	p.logger.Info("cache enabled", "size", size)
 
-	p.cache = newCache(size, p.EnableEDNSClientSubnet, p.CacheOptimistic)
-	p.shortFlighter = newOptimisticResolver(p)
+	p.cache = newCache(&cacheConfig{
+		logger:              p.logger.With(slogutil.KeyPrefix, CacheLogPrefix),
+		storage:             p.CacheStorage,
+		size:                size,
+		optimisticMaxAge:    p.CacheOptimisticMaxAge,
+		optimisticAnswerTTL: p.CacheOptimisticAnswerTTL,
+		withECS:             p.EnableEDNSClientSubnet,
+		optimistic:          p.CacheOptimistic,
+	})
+	p.shortFlighter = newOptimisticResolver(p, p.time, p.CacheOptimisticRecheckInterval)
+
+	if p.CachePrefetch {
+		p.prefetcher = newPrefetcher(
+			p.logger,
+			p,
+			p.time,
+			p.CachePrefetchMinHits,
+			p.CachePrefetchThreshold,
+		)
+	}
 }
 
-// newCache returns a properly initialized cache.  logger must not be nil.
-func newCache(size int, withECS, optimistic bool) (c *cache) {
+// newCache returns a properly initialized cache.  conf must not be nil.
+func newCache(conf *cacheConfig) (c *cache) {
+	ttl := uint32(optimisticTTL)
+	if conf.optimisticAnswerTTL > 0 {
+		ttl = uint32(max(conf.optimisticAnswerTTL/time.Second, 1))
+	}
+
+	l := conf.logger
+	if l == nil {
+		l = slog.Default()
+	}
+
 	c = &cache{
-		itemsLock:           &sync.RWMutex{},
-		itemsWithSubnetLock: &sync.RWMutex{},
-		items:               createCache(size),
-		optimistic:          optimistic,
+		logger:           l,
+		optimisticMaxAge: conf.optimisticMaxAge,
+		optimisticTTL:    ttl,
+		optimistic:       conf.optimistic,
+	}
+
+	if conf.storage != nil {
+		c.storage = conf.storage
+		c.items = &prefixedStorage{storage: conf.storage, prefix: []byte{storagePrefixItems}}
+		if conf.withECS {
+			c.itemsWithSubnet = &prefixedStorage{
+				storage: conf.storage,
+				prefix:  []byte{storagePrefixItemsWithSubnet},
+			}
+		}
+
+		return c
 	}
 
-	if withECS {
-		c.itemsWithSubnet = createCache(size)
+	c.items = createCache(conf.size)
+	if conf.withECS {
+		c.itemsWithSubnet = createCache(conf.size)
 	}
 
 	return c
 }
 
+// withECS returns true if c stores the responses with ECS separately.
+func (c *cache) withECS() (ok bool) {
+	return c.itemsWithSubnet != nil
+}
+
+// storageContext returns the context for a call to the storage of c, which is
+// canceled after timeout if the storage is external.  cancel must be called
+// when the call is finished.
+func (c *cache) storageContext(timeout time.Duration) (ctx context.Context, cancel context.CancelFunc) {
+	if c.storage == nil {
+		// Don't allocate a timer for each call to the in-memory storage.
+		return context.Background(), func() {}
+	}
+
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// lookup returns the value stored in items for key.  The storage errors are
+// logged and treated as the missing value.
+func (c *cache) lookup(items CacheStorage, key []byte) (data []byte) {
+	ctx, cancel := c.storageContext(storageTimeout)
+	defer cancel()
+
+	data, err := items.Get(ctx, key)
+	if err != nil {
+		c.logger.Debug("getting item", slogutil.KeyError, err)
+
+		return nil
+	}
+
+	return data
+}
+
+// store stores packed in items for key, so that it's kept for ttl after
+// the expiration in the optimistic mode.  The storage errors are logged.
+func (c *cache) store(items CacheStorage, key, packed []byte, ttl time.Duration) {
+	ctx, cancel := c.storageContext(storageTimeout)
+	defer cancel()
+
+	err := items.Set(ctx, key, packed, c.storageTTL(ttl))
+	if err != nil {
+		c.logger.Debug("setting item", slogutil.KeyError, err)
+	}
+}
+
+// drop removes the value stored in items for key.  The storage errors are
+// logged.
+func (c *cache) drop(items CacheStorage, key []byte) {
+	ctx, cancel := c.storageContext(storageTimeout)
+	defer cancel()
+
+	err := items.Delete(ctx, key)
+	if err != nil {
+		c.logger.Debug("deleting item", slogutil.KeyError, err)
+	}
+}
+
+// countLookup counts the lookup of key in items which found an item if found
+// is true and the one which found nothing otherwise.
+func (c *cache) countLookup(items CacheStorage, key []byte, found bool) {
+	if sc, ok := items.(cacheStatsCounter); ok {
+		sc.countLookup(key, found)
+	} else if found {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+// storageTTL returns the time for which the storage should keep the item
+// expiring in ttl.  Zero means that the item should be kept until evicted.
+func (c *cache) storageTTL(ttl time.Duration) (st time.Duration) {
+	if !c.optimistic {
+		return ttl
+	} else if c.optimisticMaxAge <= 0 {
+		return 0
+	}
+
+	return ttl + c.optimisticMaxAge
+}
+
 // get returns cached item for the req if it's found.  expired is true if the
 // item's TTL is expired.  key is the resulting key for req.  It's returned to
 // avoid recalculating it afterwards.
 func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
-	c.itemsLock.RLock()
-	defer c.itemsLock.RUnlock()
-
 	if !canLookUpInCache(c.items, req) {
 		return nil, false, nil
 	}
 
 	key = msgToKey(req)
-	data := c.items.Get(key)
-	if data == nil {
-		return nil, false, key
+	if data := c.lookup(c.items, key); data != nil {
+		if ci, expired = c.unpackItem(data, req); ci == nil {
+			c.drop(c.items, key)
+		}
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
-		c.items.Del(key)
-	}
+	c.countLookup(c.items, key, ci != nil)
 
 	return ci, expired, key
 }
@@ -226,9 +419,6 @@ func (c *cache) get(req *dns.Msg) (ci *cacheItem, expired bool, key []byte) {
 // Note that a slow longest-prefix-match algorithm is used, so cache searches
 // are performed up to mask+1 times.
 func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expired bool, k []byte) {
-	c.itemsWithSubnetLock.RLock()
-	defer c.itemsWithSubnetLock.RUnlock()
-
 	if !canLookUpInCache(c.itemsWithSubnet, req) {
 		return nil, false, nil
 	}
@@ -238,7 +428,7 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 	m, _ := n.Mask.Size()
 
 	k = msgToKeyWithSubnet(req, ecsIP, m)
-	data := c.itemsWithSubnet.Get(k)
+	data := c.lookup(c.itemsWithSubnet, k)
 
 	// In order to reduce allocations we apply mask on bits level.  As the key
 	// k has ecsIP in bytes slice representation, each iteration we can just
@@ -250,7 +440,7 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		// In case mask is zero, the key doesn't have IP in it.
 		if m == 0 {
 			k = slices.Delete(k, keyIPIndex, keyIPIndex+ipLen)
-			data = c.itemsWithSubnet.Get(k)
+			data = c.lookup(c.itemsWithSubnet, k)
 
 			continue
 		}
@@ -265,40 +455,26 @@ func (c *cache) getWithSubnet(req *dns.Msg, n *net.IPNet) (ci *cacheItem, expire
 		// Clear the last non-zero bit in the byte of the IP address.
 		k[keyIPIndex+m/8] &= bitmask
 
-		data = c.itemsWithSubnet.Get(k)
+		data = c.lookup(c.itemsWithSubnet, k)
 	}
 
-	if data == nil {
-		return nil, false, k
+	if data != nil {
+		if ci, expired = c.unpackItem(data, req); ci == nil {
+			c.drop(c.itemsWithSubnet, k)
+		}
 	}
 
-	if ci, expired = c.unpackItem(data, req); ci == nil {
-		c.itemsWithSubnet.Del(k)
-	}
+	c.countLookup(c.itemsWithSubnet, k, ci != nil)
 
 	return ci, expired, k
 }
 
 // canLookUpInCache returns true if these parameters could be used to make a
 // cache lookup.
-func canLookUpInCache(cache glcache.Cache, req *dns.Msg) (ok bool) {
+func canLookUpInCache(cache CacheStorage, req *dns.Msg) (ok bool) {
 	return cache != nil && req != nil && len(req.Question) == 1
 }
 
-// createCache returns new Cache with the given cacheSize.
-func createCache(cacheSize int) (glc glcache.Cache) {
-	conf := glcache.Config{
-		MaxSize:   defaultCacheSize,
-		EnableLRU: true,
-	}
-
-	if cacheSize > 0 {
-		conf.MaxSize = uint(cacheSize)
-	}
-
-	return glcache.New(conf)
-}
-
 // set stores response and upstream in the cache.  l must not be nil.
 func (c *cache) set(m *dns.Msg, u upstream.Upstream, l *slog.Logger) {
 	item := c.respToItem(m, u, l)
@@ -309,10 +485,7 @@ func (c *cache) set(m *dns.Msg, u upstream.Upstream, l *slog.Logger) {
 	key := msgToKey(m)
 	packed := item.pack()
 
-	c.itemsLock.Lock()
-	defer c.itemsLock.Unlock()
-
-	c.items.Set(key, packed)
+	c.store(c.items, key, packed, time.Duration(item.ttl)*time.Second)
 }
 
 // setWithSubnet stores response and upstream with subnet in the cache.  The
@@ -328,31 +501,191 @@ func (c *cache) setWithSubnet(m *dns.Msg, u upstream.Upstream, subnet *net.IPNet
 	key := msgToKeyWithSubnet(m, subnet.IP.Mask(subnet.Mask), pref)
 	packed := item.pack()
 
-	c.itemsWithSubnetLock.Lock()
-	defer c.itemsWithSubnetLock.Unlock()
+	c.store(c.itemsWithSubnet, key, packed, time.Duration(item.ttl)*time.Second)
+}
+
+// clear empties both the simple and the subnet caches.  The external storage
+// is shared by those, so it's only cleared once.
+func (c *cache) clear() {
+	ctx, cancel := c.storageContext(storageClearTimeout)
+	defer cancel()
+
+	storages := []CacheStorage{c.items, c.itemsWithSubnet}
+	if c.storage != nil {
+		storages = []CacheStorage{c.storage}
+	}
+
+	for _, s := range storages {
+		if s == nil {
+			// ECS disabled.
+			continue
+		}
 
-	c.itemsWithSubnet.Set(key, packed)
+		err := s.Clear(ctx)
+		if err != nil {
+			c.logger.Debug("clearing items", slogutil.KeyError, err)
+		}
+	}
 }
 
-// clearItems empties the simple cache.
-func (c *cache) clearItems() {
-	c.itemsLock.Lock()
-	defer c.itemsLock.Unlock()
+// entries returns the entries of c with the remaining TTLs calculated at now.
+// It returns nil if the storage can't be iterated over.
+func (c *cache) entries(now time.Time) (entries []*CacheEntry) {
+	items, ok := c.items.(cacheIterator)
+	if !ok {
+		return nil
+	}
+
+	items.rangeItems(func(_, val []byte) (cont bool) {
+		if e := unpackEntry(val, now); e != nil {
+			entries = append(entries, e)
+		}
+
+		return true
+	})
+
+	itemsWithSubnet, ok := c.itemsWithSubnet.(cacheIterator)
+	if !ok {
+		return entries
+	}
+
+	itemsWithSubnet.rangeItems(func(key, val []byte) (cont bool) {
+		if e := unpackEntry(val, now); e != nil {
+			e.Subnet = subnetFromKey(key, e.Name)
+			entries = append(entries, e)
+		}
 
-	c.items.Clear()
+		return true
+	})
+
+	return entries
 }
 
-// clearItemsWithSubnet empties the subnet cache, if any.
-func (c *cache) clearItemsWithSubnet() {
-	if c.itemsWithSubnet == nil {
-		// ECS disabled, return immediately.
-		return
+// evict removes the items for the name from c, as well as the items for its
+// subdomains if subtree is true.  If qtype is [dns.TypeNone], the items of all
+// types are removed.  name must be a lowercased FQDN.  n is the number of
+// removed items.  See [cache.evictKey] for the storages which can't be
+// iterated over.
+func (c *cache) evict(name string, qtype uint16, subtree bool) (n int) {
+	if _, ok := c.items.(cacheIterator); !ok {
+		return c.evictKey(name, qtype, subtree)
+	}
+
+	matches := func(val []byte) (ok bool) {
+		e := unpackEntry(val, time.Time{})
+		if e == nil || (qtype != dns.TypeNone && e.Qtype != qtype) {
+			return false
+		}
+
+		return e.Name == name || (subtree && (name == "." || strings.HasSuffix(e.Name, "."+name)))
+	}
+
+	return c.evictMatching(c.items, matches) + c.evictMatching(c.itemsWithSubnet, matches)
+}
+
+// evictKey removes the item for name and qtype of class IN without subnet,
+// since its key doesn't require iterating over the storage.  It removes nothing
+// if subtree is true or qtype is [dns.TypeNone].  n is the number of removed
+// items.
+func (c *cache) evictKey(name string, qtype uint16, subtree bool) (n int) {
+	if subtree || qtype == dns.TypeNone {
+		return 0
+	}
+
+	key := msgToKey((&dns.Msg{}).SetQuestion(name, qtype))
+	if c.lookup(c.items, key) == nil {
+		return 0
+	}
+
+	c.drop(c.items, key)
+
+	return 1
+}
+
+// evictMatching removes the items from storage for which matches returns true.
+// n is the number of removed items.
+func (c *cache) evictMatching(storage CacheStorage, matches func(val []byte) (ok bool)) (n int) {
+	items, ok := storage.(cacheIterator)
+	if !ok {
+		return 0
+	}
+
+	var keys [][]byte
+	items.rangeItems(func(key, val []byte) (cont bool) {
+		if matches(val) {
+			keys = append(keys, key)
+		}
+
+		return true
+	})
+
+	for _, k := range keys {
+		c.drop(items, k)
 	}
 
-	c.itemsWithSubnetLock.Lock()
-	defer c.itemsWithSubnetLock.Unlock()
+	return len(keys)
+}
+
+// stats returns the statistics of c.
+func (c *cache) stats() (s *CacheStats) {
+	s = &CacheStats{
+		Hits:   c.hits.Load(),
+		Misses: c.misses.Load(),
+	}
+
+	for _, items := range []CacheStorage{c.items, c.itemsWithSubnet} {
+		if sc, ok := items.(cacheStatsCounter); ok {
+			sc.addStats(s)
+		}
+	}
+
+	return s
+}
+
+// unpackEntry converts the packed item into the cache entry with the remaining
+// TTL calculated at now.  It returns nil if packed is malformed.
+func unpackEntry(packed []byte, now time.Time) (e *CacheEntry) {
+	if len(packed) < minPackedLen {
+		return nil
+	}
+
+	expire := time.Unix(int64(binary.BigEndian.Uint32(packed)), 0)
+	l := int(binary.BigEndian.Uint16(packed[expTimeSz:]))
+	if l == 0 || len(packed) < minPackedLen+l {
+		return nil
+	}
+
+	m := &dns.Msg{}
+	if m.Unpack(packed[minPackedLen:minPackedLen+l]) != nil || len(m.Question) != 1 {
+		return nil
+	}
+
+	q := m.Question[0]
+
+	return &CacheEntry{
+		Name:     strings.ToLower(q.Name),
+		Upstream: string(packed[minPackedLen+l:]),
+		TTL:      expire.Sub(now),
+		Qtype:    q.Qtype,
+		Qclass:   q.Qclass,
+	}
+}
+
+// subnetFromKey returns the ECS subnet from the key of the item with subnet for
+// the lowercased name.  It returns an invalid prefix if the key contains no
+// address, see [msgToKeyWithSubnet].
+func subnetFromKey(key []byte, name string) (subnet netip.Prefix) {
+	ipLen := len(key) - keyIPIndex - len(name)
+	if ipLen <= 0 {
+		return netip.Prefix{}
+	}
+
+	addr, ok := netip.AddrFromSlice(key[keyIPIndex : keyIPIndex+ipLen])
+	if !ok {
+		return netip.Prefix{}
+	}
 
-	c.itemsWithSubnet.Clear()
+	return netip.PrefixFrom(addr, int(key[keyMaskIndex]))
 }
 
 // cacheTTL returns the number of seconds for which m is valid to be cached.
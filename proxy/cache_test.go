@@ -2,10 +2,13 @@ package proxy
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/netip"
+	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -121,7 +124,7 @@ func TestCache_expired(t *testing.T) {
 		optimistic: true,
 	}}
 
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(&cacheConfig{size: testCacheSize})
 	for _, tc := range testCases {
 		ans.Hdr.Ttl = tc.ttl
 		req := (&dns.Msg{}).SetQuestion(host, dns.TypeA)
@@ -138,8 +141,9 @@ func TestCache_expired(t *testing.T) {
 				u:   testUpsAddr,
 				ttl: tc.ttl,
 			}).pack()
-			testCache.items.Set(key, data)
-			t.Cleanup(testCache.items.Clear)
+			err := testCache.items.Set(context.Background(), key, data, 0)
+			require.NoError(t, err)
+			t.Cleanup(testCache.clear)
 
 			r, expired, key := testCache.get(req)
 			assert.Equal(t, msgToKey(req), key)
@@ -158,7 +162,7 @@ func TestCache_expired(t *testing.T) {
 }
 
 func TestCacheDO(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(&cacheConfig{size: testCacheSize})
 
 	// Fill the cache.
 	reply := (&dns.Msg{
@@ -203,7 +207,7 @@ func TestCacheDO(t *testing.T) {
 func TestCacheCNAME(t *testing.T) {
 	l := slogutil.NewDiscardLogger()
 
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(&cacheConfig{size: testCacheSize})
 
 	// Fill the cache
 	reply := (&dns.Msg{
@@ -240,7 +244,7 @@ func TestCacheCNAME(t *testing.T) {
 }
 
 func TestCache_uncacheable(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(&cacheConfig{size: testCacheSize})
 
 	// Create a DNS request.
 	request := (&dns.Msg{}).SetQuestion("google.com.", dns.TypeA)
@@ -256,7 +260,7 @@ func TestCache_uncacheable(t *testing.T) {
 }
 
 func TestCache_concurrent(t *testing.T) {
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(&cacheConfig{size: testCacheSize})
 
 	hosts := map[string]string{
 		dns.Fqdn("yandex.com"):     "213.180.204.62",
@@ -535,7 +539,7 @@ func TestCache(t *testing.T) {
 func (tests testCases) run(t *testing.T) {
 	l := slogutil.NewDiscardLogger()
 
-	testCache := newCache(testCacheSize, false, false)
+	testCache := newCache(&cacheConfig{size: testCacheSize})
 
 	for _, res := range tests.cache {
 		reply := (&dns.Msg{
@@ -642,7 +646,7 @@ func TestCache_getWithSubnet(t *testing.T) {
 	mask24 := net.CIDRMask(24, netutil.IPv4BitLen)
 	l := slogutil.NewDiscardLogger()
 
-	c := newCache(testCacheSize, true, false)
+	c := newCache(&cacheConfig{size: testCacheSize, withECS: true})
 
 	t.Run("empty", func(t *testing.T) {
 		ci, expired, _ := c.getWithSubnet(req, &net.IPNet{IP: ip1234, Mask: mask24})
@@ -728,7 +732,7 @@ func TestCache_getWithSubnet_mask(t *testing.T) {
 
 	ansIP := net.IP{4, 4, 4, 4}
 
-	c := newCache(testCacheSize, true, true)
+	c := newCache(&cacheConfig{size: testCacheSize, withECS: true, optimistic: true})
 
 	req := (&dns.Msg{}).SetQuestion(testFQDN, dns.TypeA)
 	resp := (&dns.Msg{
@@ -972,3 +976,210 @@ func TestCache_IsCacheable_negative(t *testing.T) {
 		})
 	}
 }
+
+func TestCacheShardsNum(t *testing.T) {
+	testCases := []struct {
+		name  string
+		size  uint
+		procs int
+		want  int
+	}{{
+		name:  "default_size",
+		size:  defaultCacheSize,
+		procs: 32,
+		want:  1,
+	}, {
+		name:  "small_size",
+		size:  4 * minCacheShardSize,
+		procs: 32,
+		want:  4,
+	}, {
+		name:  "not_power_of_two",
+		size:  5 * minCacheShardSize,
+		procs: 32,
+		want:  4,
+	}, {
+		name:  "few_cpus",
+		size:  1024 * minCacheShardSize,
+		procs: 2,
+		want:  8,
+	}, {
+		name:  "max",
+		size:  1024 * minCacheShardSize,
+		procs: 128,
+		want:  maxCacheShards,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, cacheShardsNum(tc.size, tc.procs))
+		})
+	}
+}
+
+func TestShardedCache_sizeLimit(t *testing.T) {
+	const (
+		size      = 4 * minCacheShardSize
+		itemsNum  = 1_000
+		valueSize = 1_024
+	)
+
+	ctx := context.Background()
+	c := newShardedCache(size, 4)
+	val := make([]byte, valueSize)
+	for i := range itemsNum {
+		err := c.Set(ctx, []byte(fmt.Sprintf("key-%d", i)), val, 0)
+		require.NoError(t, err)
+	}
+
+	s := &CacheStats{}
+	c.addStats(s)
+	assert.LessOrEqual(t, s.Size, size)
+	assert.Less(t, s.Count, itemsNum)
+	assert.Equal(t, uint64(itemsNum-s.Count), s.Evictions)
+
+	// The most recently set item must not be evicted.
+	last, err := c.Get(ctx, []byte(fmt.Sprintf("key-%d", itemsNum-1)))
+	require.NoError(t, err)
+	assert.NotNil(t, last)
+}
+
+func TestIndexedCache_Set_overwriteLRUHead(t *testing.T) {
+	const size = 64
+
+	c := newIndexedCache(size)
+	key := []byte("aaaa")
+
+	c.Set(key, make([]byte, 20))
+	c.Set([]byte("bbbb"), make([]byte, 20))
+
+	// The new value doesn't fit without evicting the least recently used item,
+	// which is the previous value for the same key.
+	val := make([]byte, 30)
+	c.Set(key, val)
+	require.Equal(t, val, c.Get(key))
+
+	var keys [][]byte
+	c.rangeItems(func(k, _ []byte) (cont bool) {
+		keys = append(keys, k)
+
+		return true
+	})
+
+	assert.Contains(t, keys, key)
+}
+
+func TestIndexedCache_rangeItems_lru(t *testing.T) {
+	const itemsNum = 16
+
+	// Each item takes 4 bytes, so that the cache is full.
+	c := newIndexedCache(itemsNum * 4)
+	for i := range itemsNum {
+		c.Set([]byte(fmt.Sprintf("k%02d", i)), []byte{0})
+	}
+
+	c.rangeItems(func(_, _ []byte) (cont bool) { return true })
+
+	// The iteration must not affect the LRU order, so that the first item is
+	// evicted.
+	c.Set([]byte("new"), []byte{0})
+
+	keys := map[string]unit{}
+	c.rangeItems(func(k, _ []byte) (cont bool) {
+		keys[string(k)] = unit{}
+
+		return true
+	})
+
+	assert.Len(t, keys, itemsNum)
+	assert.NotContains(t, keys, "k00")
+	assert.Contains(t, keys, "new")
+}
+
+// newBenchResp returns a new response for host with a single A record.
+func newBenchResp(host string) (resp *dns.Msg) {
+	return (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   host,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    defaultTestTTL,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}},
+	}).SetQuestion(host, dns.TypeA)
+}
+
+// ciSink is a typed sink for benchmark results.  It's atomic, since the
+// results are stored from several goroutines.
+var ciSink atomic.Pointer[cacheItem]
+
+func BenchmarkCache_get(b *testing.B) {
+	const (
+		size     = 256 * minCacheShardSize
+		itemsNum = 10_000
+	)
+
+	l := slogutil.NewDiscardLogger()
+	reqs := make([]*dns.Msg, itemsNum)
+	for i := range reqs {
+		host := fmt.Sprintf("host%d.example.", i)
+		reqs[i] = (&dns.Msg{}).SetQuestion(host, dns.TypeA)
+	}
+
+	for _, n := range []int{1, cacheShardsNum(size, runtime.GOMAXPROCS(0))} {
+		c := newCache(&cacheConfig{size: size})
+		c.items = newShardedCache(size, n)
+
+		for _, req := range reqs {
+			c.set(newBenchResp(req.Question[0].Name), upstreamWithAddr, l)
+		}
+
+		b.Run(fmt.Sprintf("shards_%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				var ci *cacheItem
+				for i := 0; pb.Next(); i++ {
+					ci, _, _ = c.get(reqs[i%itemsNum])
+				}
+
+				ciSink.Store(ci)
+			})
+		})
+	}
+}
+
+func BenchmarkCache_set(b *testing.B) {
+	const (
+		size     = 256 * minCacheShardSize
+		itemsNum = 10_000
+	)
+
+	l := slogutil.NewDiscardLogger()
+	resps := make([]*dns.Msg, itemsNum)
+	for i := range resps {
+		resps[i] = newBenchResp(fmt.Sprintf("host%d.example.", i))
+	}
+
+	for _, n := range []int{1, cacheShardsNum(size, runtime.GOMAXPROCS(0))} {
+		c := newCache(&cacheConfig{size: size})
+		c.items = newShardedCache(size, n)
+
+		b.Run(fmt.Sprintf("shards_%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					c.set(resps[i%itemsNum], upstreamWithAddr, l)
+				}
+			})
+		})
+	}
+}
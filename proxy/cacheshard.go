@@ -0,0 +1,285 @@
+package proxy
+
+import (
+	"context"
+	"hash/maphash"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	glcache "github.com/AdguardTeam/golibs/cache"
+)
+
+const (
+	// minCacheShardSize is the minimum size of a single cache shard in bytes.
+	// It's the size of the default cache so that an item fitting the default
+	// cache also fits any shard.
+	minCacheShardSize = defaultCacheSize
+
+	// maxCacheShards is the maximum number of cache shards.
+	maxCacheShards = 256
+
+	// cacheShardsPerCPU is the number of cache shards per CPU the cache aims
+	// for.
+	cacheShardsPerCPU = 4
+)
+
+// createCache returns new Cache with the given cacheSize.  The number of shards
+// depends on the cacheSize and the number of CPUs.
+func createCache(cacheSize int) (c *shardedCache) {
+	size := uint(defaultCacheSize)
+	if cacheSize > 0 {
+		size = uint(cacheSize)
+	}
+
+	return newShardedCache(size, cacheShardsNum(size, runtime.GOMAXPROCS(0)))
+}
+
+// cacheShardsNum returns the number of shards for the cache of size bytes used
+// by procs CPUs.  It's a power of two so that the shards are evenly loaded.
+func cacheShardsNum(size uint, procs int) (n int) {
+	n = 1
+	for n < maxCacheShards && n < procs*cacheShardsPerCPU && size/uint(2*n) >= minCacheShardSize {
+		n *= 2
+	}
+
+	return n
+}
+
+// shardedCache is an in-memory [CacheStorage] split into shards by the hash of
+// the key, each with its own lock, to reduce the lock contention.  The size
+// limit is split evenly between the shards, so that the total size of the items
+// never exceeds it, and the least recently used items are evicted within each
+// shard.  It's safe for concurrent use.
+type shardedCache struct {
+	// seed is the seed for hashing the keys.
+	seed maphash.Seed
+
+	// shards are the parts of the cache.  The number of shards is a power of
+	// two.
+	shards []*indexedCache
+}
+
+// type check
+var (
+	_ CacheStorage      = (*shardedCache)(nil)
+	_ cacheIterator     = (*shardedCache)(nil)
+	_ cacheStatsCounter = (*shardedCache)(nil)
+)
+
+// newShardedCache returns a new *shardedCache with the total size limit of size
+// bytes split between n shards.  n must be a power of two.
+func newShardedCache(size uint, n int) (c *shardedCache) {
+	c = &shardedCache{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*indexedCache, n),
+	}
+
+	for i := range c.shards {
+		c.shards[i] = newIndexedCache(size / uint(n))
+	}
+
+	return c
+}
+
+// shard returns the shard for key.
+func (c *shardedCache) shard(key []byte) (s *indexedCache) {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+
+	h := maphash.Bytes(c.seed, key)
+
+	return c.shards[h&uint64(len(c.shards)-1)]
+}
+
+// Get implements the [CacheStorage] interface for *shardedCache.
+func (c *shardedCache) Get(_ context.Context, key []byte) (val []byte, err error) {
+	return c.shard(key).Get(key), nil
+}
+
+// Set implements the [CacheStorage] interface for *shardedCache.  ttl is
+// ignored, since the expired items are dropped on retrieval.
+func (c *shardedCache) Set(_ context.Context, key, val []byte, _ time.Duration) (err error) {
+	c.shard(key).Set(key, val)
+
+	return nil
+}
+
+// Delete implements the [CacheStorage] interface for *shardedCache.
+func (c *shardedCache) Delete(_ context.Context, key []byte) (err error) {
+	c.shard(key).Del(key)
+
+	return nil
+}
+
+// Clear implements the [CacheStorage] interface for *shardedCache.
+func (c *shardedCache) Clear(_ context.Context) (err error) {
+	for _, s := range c.shards {
+		s.Clear()
+	}
+
+	return nil
+}
+
+// countLookup implements the [cacheStatsCounter] interface for *shardedCache.
+func (c *shardedCache) countLookup(key []byte, found bool) {
+	s := c.shard(key)
+	if found {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+}
+
+// addStats implements the [cacheStatsCounter] interface for *shardedCache.
+func (c *shardedCache) addStats(s *CacheStats) {
+	for _, shard := range c.shards {
+		gs := shard.Stats()
+		s.Count += gs.Count
+		s.Size += gs.Size
+		s.Hits += shard.hits.Load()
+		s.Misses += shard.misses.Load()
+		s.Evictions += shard.evictions.Load()
+	}
+}
+
+// rangeItems implements the [cacheIterator] interface for *shardedCache.
+func (c *shardedCache) rangeItems(f func(key, val []byte) (cont bool)) {
+	for _, s := range c.shards {
+		if !s.rangeItems(f) {
+			return
+		}
+	}
+}
+
+// indexedCache is a [glcache.Cache] which also keeps its items in an index,
+// since the underlying cache can't be iterated over without affecting the LRU
+// order.  It's a single shard of
+// the [shardedCache].  It's safe for concurrent use.
+type indexedCache struct {
+	// cache stores the items.
+	cache glcache.Cache
+
+	// mu protects items.  It's also held during the calls to cache.Set, so
+	// that onEvict is able to modify items.
+	mu *sync.Mutex
+
+	// items maps the keys of the stored items to their values.  The values are
+	// shared with cache.
+	items map[string][]byte
+
+	// size is the size limit of cache in bytes.  The larger items are rejected
+	// by cache.
+	size uint
+
+	// hits is the number of lookups which found an item.
+	hits atomic.Uint64
+
+	// misses is the number of lookups which found no item.
+	misses atomic.Uint64
+
+	// evictions is the number of items evicted from cache to free space for
+	// the new ones.
+	evictions atomic.Uint64
+}
+
+// type check
+var _ glcache.Cache = (*indexedCache)(nil)
+
+// newIndexedCache returns a new LRU *indexedCache with the size limit of size
+// bytes.
+func newIndexedCache(size uint) (c *indexedCache) {
+	c = &indexedCache{
+		mu:    &sync.Mutex{},
+		items: map[string][]byte{},
+		size:  size,
+	}
+
+	c.cache = glcache.New(glcache.Config{
+		MaxSize:   size,
+		EnableLRU: true,
+		OnDelete:  c.onEvict,
+	})
+
+	return c
+}
+
+// Set implements the [glcache.Cache] interface for *indexedCache.
+func (c *indexedCache) Set(key, val []byte) (ok bool) {
+	if uint(len(key)+len(val)) > c.size {
+		// Don't index the items rejected by cache.
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ok = c.cache.Set(key, val)
+
+	// Index the item after setting it, since the previous item with the same
+	// key may be evicted to free space for the new one, and onEvict removes it
+	// from the index.
+	c.items[string(key)] = val
+
+	return ok
+}
+
+// Get implements the [glcache.Cache] interface for *indexedCache.
+func (c *indexedCache) Get(key []byte) (val []byte) {
+	return c.cache.Get(key)
+}
+
+// Del implements the [glcache.Cache] interface for *indexedCache.
+func (c *indexedCache) Del(key []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.items, string(key))
+	c.cache.Del(key)
+}
+
+// Clear implements the [glcache.Cache] interface for *indexedCache.
+func (c *indexedCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.items)
+	c.cache.Clear()
+}
+
+// Stats implements the [glcache.Cache] interface for *indexedCache.
+func (c *indexedCache) Stats() (s glcache.Stats) {
+	return c.cache.Stats()
+}
+
+// onEvict removes the item evicted from the underlying cache from the index and
+// counts the eviction.  It's only called within the calls to cache.Set, so c.mu
+// is already locked.
+func (c *indexedCache) onEvict(key, _ []byte) {
+	delete(c.items, string(key))
+	c.evictions.Add(1)
+}
+
+// rangeItems calls f for each stored item until it returns false.  cont is
+// false if f returned false.  It reads the items from the index, so it affects
+// neither the hit statistics nor the LRU order of the items.
+func (c *indexedCache) rangeItems(f func(key, val []byte) (cont bool)) (cont bool) {
+	c.mu.Lock()
+	keys := make([][]byte, 0, len(c.items))
+	vals := make([][]byte, 0, len(c.items))
+	for k, v := range c.items {
+		keys = append(keys, []byte(k))
+		vals = append(vals, v)
+	}
+	c.mu.Unlock()
+
+	for i, key := range keys {
+		if !f(key, vals[i]) {
+			return false
+		}
+	}
+
+	return true
+}
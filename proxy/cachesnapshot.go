@@ -0,0 +1,297 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+)
+
+// cacheSnapshotMagic is the beginning of every cache snapshot file.
+const cacheSnapshotMagic = "DNSPXCSN"
+
+// cacheSnapshotVersion is the version of the cache snapshot format.  It must be
+// incremented on any change of the format, including the format of the packed
+// [cacheItem].
+const cacheSnapshotVersion uint16 = 1
+
+// cacheSnapshotSection is the identifier of the cache an item in the snapshot
+// belongs to.
+type cacheSnapshotSection byte
+
+// Valid cacheSnapshotSection values.
+const (
+	cacheSnapshotSectionItems           cacheSnapshotSection = 0
+	cacheSnapshotSectionItemsWithSubnet cacheSnapshotSection = 1
+)
+
+const (
+	// errBadSnapshotMagic is returned when the file isn't a cache snapshot.
+	errBadSnapshotMagic errors.Error = "not a cache snapshot"
+
+	// errBadSnapshotSection is returned when the snapshot item belongs to an
+	// unknown section.
+	errBadSnapshotSection errors.Error = "bad snapshot section"
+
+	// errSnapshotItemTooLong is returned when the length of the snapshot item
+	// exceeds the maximum length of a packed cache item.
+	errSnapshotItemTooLong errors.Error = "snapshot item too long"
+)
+
+// writeSnapshot writes the items of c, which aren't going to be dropped on
+// retrieval, to w.  n is the number of written items.
+//
+// The snapshot consists of the [cacheSnapshotMagic], the big-endian
+// [cacheSnapshotVersion], and the items.  Each item is the section byte, the
+// big-endian uint16 key length, the key, the big-endian uint32 length of the
+// packed [cacheItem], and the packed item itself.
+func (c *cache) writeSnapshot(w io.Writer, now time.Time) (n int, err error) {
+	bw := bufio.NewWriter(w)
+
+	hdr := binary.BigEndian.AppendUint16([]byte(cacheSnapshotMagic), cacheSnapshotVersion)
+	if _, err = bw.Write(hdr); err != nil {
+		return 0, fmt.Errorf("writing header: %w", err)
+	}
+
+	n, err = c.writeSection(bw, cacheSnapshotSectionItems, now)
+	if err != nil {
+		return n, fmt.Errorf("writing items: %w", err)
+	}
+
+	subN, err := c.writeSection(bw, cacheSnapshotSectionItemsWithSubnet, now)
+	n += subN
+	if err != nil {
+		return n, fmt.Errorf("writing items with subnet: %w", err)
+	}
+
+	return n, bw.Flush()
+}
+
+// writeSection writes the items of the cache identified by sec to w.
+func (c *cache) writeSection(
+	w io.Writer,
+	sec cacheSnapshotSection,
+	now time.Time,
+) (n int, err error) {
+	items, ok := c.section(sec).(cacheIterator)
+	if !ok {
+		return 0, nil
+	}
+
+	buf := &bytes.Buffer{}
+	items.rangeItems(func(key, val []byte) (cont bool) {
+		if len(key) > math.MaxUint16 || !c.isRetrievable(val, now) {
+			return true
+		}
+
+		buf.Reset()
+		buf.WriteByte(byte(sec))
+		buf.Write(binary.BigEndian.AppendUint16(nil, uint16(len(key))))
+		buf.Write(key)
+		buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(val))))
+		buf.Write(val)
+
+		if _, err = w.Write(buf.Bytes()); err != nil {
+			return false
+		}
+
+		n++
+
+		return true
+	})
+
+	return n, err
+}
+
+// readSnapshot reads the items from the snapshot in r into c.  The items which
+// would be dropped on retrieval, as well as the items with subnet if c doesn't
+// store those, are skipped.  n is the number of stored items.
+func (c *cache) readSnapshot(r io.Reader, now time.Time) (n int, err error) {
+	br := bufio.NewReader(r)
+
+	hdr := make([]byte, len(cacheSnapshotMagic)+2)
+	if _, err = io.ReadFull(br, hdr); err != nil {
+		return 0, fmt.Errorf("reading header: %w", err)
+	}
+
+	if string(hdr[:len(cacheSnapshotMagic)]) != cacheSnapshotMagic {
+		return 0, errBadSnapshotMagic
+	}
+
+	if v := binary.BigEndian.Uint16(hdr[len(cacheSnapshotMagic):]); v != cacheSnapshotVersion {
+		return 0, fmt.Errorf("snapshot version: got %d, want %d", v, cacheSnapshotVersion)
+	}
+
+	for {
+		var stored bool
+		stored, err = c.readItem(br, now)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return n, nil
+			}
+
+			return n, fmt.Errorf("reading item at index %d: %w", n, err)
+		}
+
+		if stored {
+			n++
+		}
+	}
+}
+
+// readItem reads a single snapshot item from r and stores it into c, if
+// appropriate.  It returns [io.EOF] only if there are no more items in r.
+func (c *cache) readItem(r *bufio.Reader, now time.Time) (stored bool, err error) {
+	secByte, err := r.ReadByte()
+	if err != nil {
+		// Don't wrap the error since it's checked by the caller.
+		return false, err
+	}
+
+	lens := make([]byte, 2)
+	if _, err = io.ReadFull(r, lens); err != nil {
+		return false, fmt.Errorf("reading key length: %w", io.ErrUnexpectedEOF)
+	}
+
+	key := make([]byte, binary.BigEndian.Uint16(lens))
+	if _, err = io.ReadFull(r, key); err != nil {
+		return false, fmt.Errorf("reading key: %w", io.ErrUnexpectedEOF)
+	}
+
+	lens = make([]byte, 4)
+	if _, err = io.ReadFull(r, lens); err != nil {
+		return false, fmt.Errorf("reading item length: %w", io.ErrUnexpectedEOF)
+	}
+
+	// Don't trust the length from the file, since a corrupted one may lead to
+	// a huge allocation.
+	valLen := binary.BigEndian.Uint32(lens)
+	if valLen > maxPackedLen {
+		return false, fmt.Errorf("%w: %d bytes", errSnapshotItemTooLong, valLen)
+	}
+
+	val := make([]byte, valLen)
+	if _, err = io.ReadFull(r, val); err != nil {
+		return false, fmt.Errorf("reading item: %w", io.ErrUnexpectedEOF)
+	}
+
+	sec := cacheSnapshotSection(secByte)
+	switch sec {
+	case cacheSnapshotSectionItems, cacheSnapshotSectionItemsWithSubnet:
+		// Go on.
+	default:
+		return false, fmt.Errorf("%w: %d", errBadSnapshotSection, sec)
+	}
+
+	items := c.section(sec)
+	if items == nil || !c.isRetrievable(val, now) {
+		return false, nil
+	}
+
+	expire := time.Unix(int64(binary.BigEndian.Uint32(val)), 0)
+	c.store(items, key, val, expire.Sub(now))
+
+	return true, nil
+}
+
+// section returns the cache for sec.  It may be nil.
+func (c *cache) section(sec cacheSnapshotSection) (items CacheStorage) {
+	if sec == cacheSnapshotSectionItemsWithSubnet {
+		return c.itemsWithSubnet
+	}
+
+	return c.items
+}
+
+// isRetrievable returns true if the packed item isn't going to be dropped on
+// retrieval at now.
+func (c *cache) isRetrievable(packed []byte, now time.Time) (ok bool) {
+	if len(packed) < minPackedLen {
+		return false
+	}
+
+	expire := int64(binary.BigEndian.Uint32(packed))
+	if expire > now.Unix() {
+		return true
+	}
+
+	return c.optimistic && !c.isTooStale(now.Unix()-expire)
+}
+
+// loadCacheSnapshot loads the general cache from the snapshot file, if
+// configured and the cache is stored in memory.  The errors are logged since a
+// missing or a broken snapshot shouldn't prevent the proxy from starting.
+func (p *Proxy) loadCacheSnapshot(ctx context.Context) {
+	if p.cache == nil || p.CacheSnapshotPath == "" || p.CacheStorage != nil {
+		return
+	}
+
+	f, err := os.Open(p.CacheSnapshotPath)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			p.logger.DebugContext(ctx, "no cache snapshot", "path", p.CacheSnapshotPath)
+		} else {
+			p.logger.WarnContext(ctx, "opening cache snapshot", slogutil.KeyError, err)
+		}
+
+		return
+	}
+	defer slogutil.CloseAndLog(ctx, p.logger, f, slog.LevelDebug)
+
+	n, err := p.cache.readSnapshot(f, time.Now())
+	if err != nil {
+		p.logger.WarnContext(ctx, "loading cache snapshot", "loaded", n, slogutil.KeyError, err)
+
+		return
+	}
+
+	p.logger.InfoContext(ctx, "loaded cache snapshot", "items", n)
+}
+
+// saveCacheSnapshot saves the general cache to the snapshot file, if
+// configured and the cache is stored in memory.  The file is replaced
+// atomically.
+func (p *Proxy) saveCacheSnapshot(ctx context.Context) (err error) {
+	if p.cache == nil || p.CacheSnapshotPath == "" || p.CacheStorage != nil {
+		return nil
+	}
+
+	dir, base := filepath.Split(p.CacheSnapshotPath)
+	f, err := os.CreateTemp(dir, base+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating cache snapshot: %w", err)
+	}
+
+	tmpPath := f.Name()
+	defer func() {
+		if err != nil {
+			err = errors.WithDeferred(err, os.Remove(tmpPath))
+		}
+	}()
+
+	n, err := p.cache.writeSnapshot(f, time.Now())
+	err = errors.WithDeferred(err, f.Close())
+	if err != nil {
+		return fmt.Errorf("writing cache snapshot: %w", err)
+	}
+
+	err = os.Rename(tmpPath, p.CacheSnapshotPath)
+	if err != nil {
+		return fmt.Errorf("replacing cache snapshot: %w", err)
+	}
+
+	p.logger.InfoContext(ctx, "saved cache snapshot", "items", n)
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_cacheSnapshot(t *testing.T) {
+	const (
+		freshHost   = "fresh.example."
+		expiredHost = "expired.example."
+	)
+
+	snapshotPath := filepath.Join(t.TempDir(), "cache.bin")
+	newProxy := func(t *testing.T) (p *Proxy) {
+		t.Helper()
+
+		p = mustNew(t, &Config{
+			Logger:                 slogutil.NewDiscardLogger(),
+			UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			CacheEnabled:           true,
+			CacheSizeBytes:         testCacheSize,
+			EnableEDNSClientSubnet: true,
+			CacheSnapshotPath:      snapshotPath,
+		})
+
+		return p
+	}
+
+	newResp := func(host string) (resp *dns.Msg) {
+		resp = (&dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Response: true,
+			},
+			Answer: []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})},
+		}).SetQuestion(host, dns.TypeA)
+
+		return resp
+	}
+
+	subnet := &net.IPNet{IP: net.IP{1, 2, 3, 0}, Mask: net.CIDRMask(24, 32)}
+	ctx := context.Background()
+
+	saved := newProxy(t)
+	require.NoError(t, saved.Start(ctx))
+
+	l := slogutil.NewDiscardLogger()
+	saved.cache.set(newResp(freshHost), upstreamWithAddr, l)
+	saved.cache.setWithSubnet(newResp(freshHost), upstreamWithAddr, subnet, l)
+
+	expired := newResp(expiredHost)
+	data := (&cacheItem{m: expired, u: testUpsAddr}).pack()
+	binary.BigEndian.PutUint32(data, uint32(time.Now().Add(-time.Minute).Unix()))
+	require.NoError(t, saved.cache.items.Set(ctx, msgToKey(expired), data, 0))
+
+	require.NoError(t, saved.Shutdown(ctx))
+	require.FileExists(t, snapshotPath)
+
+	loaded := newProxy(t)
+	require.NoError(t, loaded.Start(ctx))
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return loaded.Shutdown(ctx) })
+
+	ci, exp, _ := loaded.cache.get(newReq(freshHost, dns.TypeA, dns.ClassINET))
+	require.NotNil(t, ci)
+	assert.False(t, exp)
+	assert.Equal(t, testUpsAddr, ci.u)
+	require.Len(t, ci.m.Answer, 1)
+
+	ci, _, _ = loaded.cache.getWithSubnet(newReq(freshHost, dns.TypeA, dns.ClassINET), subnet)
+	require.NotNil(t, ci)
+	assert.Equal(t, testUpsAddr, ci.u)
+
+	assert.Nil(t, loaded.cache.lookup(loaded.cache.items, msgToKey(expired)))
+}
+
+func TestCache_readSnapshot(t *testing.T) {
+	c := newCache(&cacheConfig{size: testCacheSize})
+
+	resp := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(t, "example.", dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})},
+	}).SetQuestion("example.", dns.TypeA)
+	c.set(resp, upstreamWithAddr, slogutil.NewDiscardLogger())
+
+	buf := &bytes.Buffer{}
+	n, err := c.writeSnapshot(buf, time.Now())
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	snapshot := buf.Bytes()
+
+	t.Run("success", func(t *testing.T) {
+		loaded := newCache(&cacheConfig{size: testCacheSize})
+		n, err = loaded.readSnapshot(bytes.NewReader(snapshot), time.Now())
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, n)
+		assert.NotNil(t, loaded.lookup(loaded.items, msgToKey(resp)))
+	})
+
+	t.Run("all_expired", func(t *testing.T) {
+		loaded := newCache(&cacheConfig{size: testCacheSize})
+		n, err = loaded.readSnapshot(
+			bytes.NewReader(snapshot),
+			time.Now().Add(2*defaultTestTTL*time.Second),
+		)
+		require.NoError(t, err)
+
+		assert.Zero(t, n)
+		assert.Nil(t, loaded.lookup(loaded.items, msgToKey(resp)))
+	})
+
+	t.Run("bad_version", func(t *testing.T) {
+		data := bytes.Clone(snapshot)
+		binary.BigEndian.PutUint16(data[len(cacheSnapshotMagic):], cacheSnapshotVersion+1)
+
+		loaded := newCache(&cacheConfig{size: testCacheSize})
+		n, err = loaded.readSnapshot(bytes.NewReader(data), time.Now())
+		testutil.AssertErrorMsg(t, "snapshot version: got 2, want 1", err)
+
+		assert.Zero(t, n)
+		assert.Nil(t, loaded.lookup(loaded.items, msgToKey(resp)))
+	})
+
+	t.Run("bad_magic", func(t *testing.T) {
+		loaded := newCache(&cacheConfig{size: testCacheSize})
+		n, err = loaded.readSnapshot(bytes.NewReader([]byte("garbage data")), time.Now())
+		assert.ErrorIs(t, err, errBadSnapshotMagic)
+		assert.Zero(t, n)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		loaded := newCache(&cacheConfig{size: testCacheSize})
+		n, err = loaded.readSnapshot(bytes.NewReader(snapshot[:len(snapshot)-1]), time.Now())
+		testutil.AssertErrorMsg(t, "reading item at index 0: reading item: unexpected EOF", err)
+		assert.Zero(t, n)
+	})
+
+	t.Run("huge_item", func(t *testing.T) {
+		data := binary.BigEndian.AppendUint16([]byte(cacheSnapshotMagic), cacheSnapshotVersion)
+		data = append(data, byte(cacheSnapshotSectionItems), 0, 1, 0xff)
+		data = binary.BigEndian.AppendUint32(data, 0xffff_ffff)
+
+		loaded := newCache(&cacheConfig{size: testCacheSize})
+		n, err = loaded.readSnapshot(bytes.NewReader(data), time.Now())
+		testutil.AssertErrorMsg(
+			t,
+			"reading item at index 0: snapshot item too long: 4294967295 bytes",
+			err,
+		)
+		assert.Zero(t, n)
+	})
+}
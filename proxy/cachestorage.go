@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"time"
+)
+
+// CacheStorage is a storage of the cached DNS responses.  The keys and the
+// values are opaque byte slices, the values contain their expiration time
+// themselves.  Implementations must be safe for concurrent use.
+type CacheStorage interface {
+	// Get returns the value stored for key.  val is nil if there is no such
+	// value.  The caller must not modify val.
+	Get(ctx context.Context, key []byte) (val []byte, err error)
+
+	// Set stores val for key.  If ttl is positive, the value may be removed
+	// after ttl passes, otherwise it's kept until evicted or deleted.  The
+	// implementation must not modify key and val.
+	Set(ctx context.Context, key, val []byte, ttl time.Duration) (err error)
+
+	// Delete removes the value stored for key, if any.
+	Delete(ctx context.Context, key []byte) (err error)
+
+	// Clear removes all the values stored.
+	Clear(ctx context.Context) (err error)
+}
+
+// cacheIterator is a [CacheStorage] which values can be iterated over.  It's
+// required for saving the cache snapshots, listing the cache entries, and
+// evicting them selectively.
+type cacheIterator interface {
+	CacheStorage
+
+	// rangeItems calls f for each stored value until it returns false.
+	rangeItems(f func(key, val []byte) (cont bool))
+}
+
+// cacheStatsCounter is a [CacheStorage] which counts the lookups and the
+// evictions itself.
+type cacheStatsCounter interface {
+	CacheStorage
+
+	// countLookup counts the lookup of key which found a value if found is
+	// true and the one which found nothing otherwise.
+	countLookup(key []byte, found bool)
+
+	// addStats adds the statistics of the storage to s.  s must not be nil.
+	addStats(s *CacheStats)
+}
+
+// Prefixes of the keys of the items with and without subnet in the external
+// [CacheStorage].
+const (
+	storagePrefixItems           byte = 'i'
+	storagePrefixItemsWithSubnet byte = 's'
+)
+
+// prefixedStorage is a [CacheStorage] which prepends a prefix to the keys of
+// the underlying storage.  It's used to keep the responses with and without
+// subnet in the same storage.
+type prefixedStorage struct {
+	// storage is the underlying storage.
+	storage CacheStorage
+
+	// prefix is prepended to each key.
+	prefix []byte
+}
+
+// type check
+var _ CacheStorage = (*prefixedStorage)(nil)
+
+// key returns the key of the underlying storage for k.
+func (s *prefixedStorage) key(k []byte) (pk []byte) {
+	pk = make([]byte, 0, len(s.prefix)+len(k))
+	pk = append(pk, s.prefix...)
+
+	return append(pk, k...)
+}
+
+// Get implements the [CacheStorage] interface for *prefixedStorage.
+func (s *prefixedStorage) Get(ctx context.Context, key []byte) (val []byte, err error) {
+	return s.storage.Get(ctx, s.key(key))
+}
+
+// Set implements the [CacheStorage] interface for *prefixedStorage.
+func (s *prefixedStorage) Set(ctx context.Context, key, val []byte, ttl time.Duration) (err error) {
+	return s.storage.Set(ctx, s.key(key), val, ttl)
+}
+
+// Delete implements the [CacheStorage] interface for *prefixedStorage.
+func (s *prefixedStorage) Delete(ctx context.Context, key []byte) (err error) {
+	return s.storage.Delete(ctx, s.key(key))
+}
+
+// Clear implements the [CacheStorage] interface for *prefixedStorage.  Note
+// that it clears the whole underlying storage.
+func (s *prefixedStorage) Clear(ctx context.Context) (err error) {
+	return s.storage.Clear(ctx)
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
 )
 
 // LogPrefix is a prefix for logging.
@@ -55,7 +56,8 @@ type Config struct {
 	PrivateSubnets netutil.SubnetSet
 
 	// MessageConstructor used to build DNS messages.  If nil, the default
-	// constructor will be used.
+	// constructor will be used.  It may also implement
+	// [ExtendedMessageConstructor], see [ExtendMessageConstructor].
 	MessageConstructor MessageConstructor
 
 	// BeforeRequestHandler is an optional custom handler called before each DNS
@@ -84,6 +86,13 @@ type Config struct {
 	// general set fails responding.
 	Fallbacks *UpstreamConfig
 
+	// FailureRcodes are the response codes of the upstreams' responses which
+	// are considered failures, so that the request is retried with the next
+	// upstream or the fallbacks.  Such responses are still sent to the client
+	// if no better ones are received, but they aren't cached.  It must not
+	// contain [dns.RcodeSuccess].
+	FailureRcodes []int
+
 	// Userinfo is the sole permitted userinfo for the DoH basic authentication.
 	// If Userinfo is set, all DoH queries are required to have this basic
 	// authentication information.
@@ -109,6 +118,25 @@ type Config struct {
 	// If not specified the [proxy.UpstreamModeLoadBalance] is used.
 	UpstreamMode UpstreamMode
 
+	// UpstreamStatsDecay is the smoothing factor of the moving averages of the
+	// round-trip time and the error rate of each upstream, used to weigh the
+	// upstreams in [UpstreamModeLoadBalance].  The greater values make the
+	// recent requests affect the weights more.  It must be in the range from 0
+	// to 1.  If zero, 0.05 is used.
+	UpstreamStatsDecay float64
+
+	// HedgeDelay is the delay after which the request is also sent to the next
+	// upstream in [UpstreamModeHedged] if no response has been received yet.
+	// If zero, the delay is derived from the round-trip times of the upstream
+	// being waited for, see HedgePercentile.  It must not be negative.
+	HedgeDelay time.Duration
+
+	// HedgePercentile is the percentile of the recent round-trip times of an
+	// upstream used as the hedging delay in [UpstreamModeHedged] when
+	// HedgeDelay is zero.  It must be in the range from 0 to 1.  If zero, 0.95
+	// is used.
+	HedgePercentile float64
+
 	// UDPListenAddr is the set of UDP addresses to listen for plain
 	// DNS-over-UDP requests.
 	UDPListenAddr []*net.UDPAddr
@@ -150,9 +178,76 @@ type Config struct {
 	// RatelimitWhitelist is a list of IP addresses excluded from rate limiting.
 	RatelimitWhitelist []netip.Addr
 
+	// DNSSECTrustAnchors are the DS records of the zones trusted when
+	// validating DNSSEC.  If empty, [DefaultDNSSECTrustAnchors] are used.  It
+	// is only used if DNSSECValidation is true.
+	DNSSECTrustAnchors []*dns.DS
+
+	// DNSSECNegativeTrustAnchors are the domain names for which the DNSSEC
+	// validation is disabled along with their subdomains.  See RFC 7646.  It
+	// is only used if DNSSECValidation is true.
+	DNSSECNegativeTrustAnchors []string
+
+	// ZoneFiles are the paths to the RFC 1035 zone files, each containing a
+	// single zone with an SOA record at its apex.  The requests within these
+	// zones are answered authoritatively instead of being sent to upstreams,
+	// except for the names delegated to other zones.  See [Proxy.ReloadZones].
+	ZoneFiles []string
+
+	// HostsFiles are the paths to the hosts files to answer the A, AAAA, and
+	// PTR requests from instead of sending them to upstreams.  The files are
+	// checked for changes periodically and reloaded.
+	HostsFiles []string
+
+	// ResponsePolicyZones are the response policy zones applied to the
+	// requests and responses, in the order of their precedence.  See
+	// [Proxy.ReloadRPZ].
+	ResponsePolicyZones []*RPZConfig
+
+	// HealthCheck is the configuration of the active health checks of the
+	// upstreams from UpstreamConfig, PrivateRDNSUpstreamConfig, and Views.
+	// The upstreams failing the checks are skipped until those succeed again,
+	// unless all the upstreams selected for a request are failing.  nil
+	// disables the health checks.  See [Proxy.UpstreamsHealth].
+	HealthCheck *HealthCheckConfig
+
+	// Cookies is the configuration of the DNS cookies, see RFC 7873, for the
+	// requests received over plain DNS.  The clients sending valid server
+	// cookies aren't ratelimited.  nil disables the cookies.
+	Cookies *CookieConfig
+
+	// Views are the sets of settings applied to the requests from particular
+	// clients instead of the upstreams, cache, ECS, and DNS64 settings of the
+	// proxy.  The first matching view is selected for each request and set as
+	// its [DNSContext.CustomUpstreamConfig], which the request handlers may
+	// still override.
+	Views []*View
+
+	// Rewrites are the rules answering the requests for some domains and
+	// their subdomains locally.  The rule for the closest domain is applied.
+	Rewrites []*Rewrite
+
+	// RewriteTTL is the TTL of the records in the rewritten responses.  If
+	// zero, 10 seconds are used.
+	RewriteTTL uint32
+
 	// EDNSAddr is the ECS IP used in request.
 	EDNSAddr net.IP
 
+	// CacheStorage is the external storage of the cached responses, for
+	// example [RedisCacheStorage], which may be shared between several
+	// proxies.  If nil, the responses are stored in memory within the limit of
+	// CacheSizeBytes.  It is only used if CacheEnabled is true.  Proxy doesn't
+	// close it, so the caller should close it after shutting down the proxy, if
+	// needed.  Note that [Proxy.ClearCache] clears the whole shared storage.
+	CacheStorage CacheStorage
+
+	// CacheSnapshotPath is the path to the file the general response cache is
+	// saved to on shutdown and loaded from on start.  If empty, the cache isn't
+	// persisted.  It is only used if CacheEnabled is true and CacheStorage is
+	// nil.
+	CacheSnapshotPath string
+
 	// TODO(s.chzhen):  Extract ratelimit settings to a separate structure.
 
 	// RatelimitSubnetLenIPv4 is a subnet length for IPv4 addresses used for
@@ -176,6 +271,42 @@ type Config struct {
 	// CacheMaxTTL is the maximum TTL for cached DNS responses in seconds.
 	CacheMaxTTL uint32
 
+	// CacheOptimisticAnswerTTL is the TTL of the expired cached responses
+	// served when CacheOptimistic is true.  If not positive, 10 seconds are
+	// used.  RFC 8767 recommends 30 seconds.
+	CacheOptimisticAnswerTTL time.Duration
+
+	// CacheOptimisticMaxAge is the maximum time after expiration for which the
+	// cached responses are served when CacheOptimistic is true.  If zero, the
+	// expired responses are served until they're evicted from cache.
+	CacheOptimisticMaxAge time.Duration
+
+	// CachePrefetchThreshold is the fraction of the original TTL of a cached
+	// response remaining at which it's prefetched when CachePrefetch is true.
+	// It must not be greater than 1.  If not positive, 0.1 is used.
+	CachePrefetchThreshold float64
+
+	// CachePrefetchMinHits is the minimum number of cache hits of a response
+	// within its TTL to prefetch it when CachePrefetch is true.  If zero, 2 is
+	// used.
+	CachePrefetchMinHits uint
+
+	// CacheOptimisticClientTimeout is the time to wait for the upstream to
+	// refresh an expired cached response before serving the expired one, when
+	// CacheOptimistic is true.  If zero, the expired response is served
+	// immediately and refreshed in background.
+	//
+	// See https://datatracker.ietf.org/doc/html/rfc8767#section-5.
+	CacheOptimisticClientTimeout time.Duration
+
+	// CacheOptimisticRecheckInterval is the time during which the expired
+	// cached response is served without trying to refresh it, after the
+	// previous refresh has failed, when CacheOptimistic is true.  If zero,
+	// every request for an expired response triggers a refresh.
+	//
+	// See https://datatracker.ietf.org/doc/html/rfc8767#section-5.
+	CacheOptimisticRecheckInterval time.Duration
+
 	// MaxGoroutines is the maximum number of goroutines processing DNS
 	// requests.  Important for mobile users.
 	//
@@ -198,6 +329,11 @@ type Config struct {
 	// HTTP3 enables HTTP/3 support for HTTPS server.
 	HTTP3 bool
 
+	// FailOnEmptyAnswer makes the NOERROR responses without answers to A and
+	// AAAA requests considered failures, the same way as the ones with
+	// FailureRcodes.
+	FailOnEmptyAnswer bool
+
 	// Enable EDNS Client Subnet option DNS requests to the upstream server will
 	// contain an OPT record with Client Subnet option.  If the original request
 	// already has this option set, we pass it through as is.  Otherwise, we set
@@ -226,6 +362,12 @@ type Config struct {
 	// CacheOptimistic defines if the optimistic cache mechanism should be used.
 	CacheOptimistic bool
 
+	// CachePrefetch defines if the frequently requested responses from the
+	// general cache should be resolved again before they expire.  At most
+	// 10,000 responses are tracked for prefetching at a time, the ones cached
+	// after reaching the limit are never prefetched and their number is logged.
+	CachePrefetch bool
+
 	// UseDNS64 enables DNS64 handling.  If true, proxy will translate IPv4
 	// answers into IPv6 answers using first of DNS64Prefs.  Note also that PTR
 	// requests for addresses within the specified networks are considered
@@ -242,6 +384,13 @@ type Config struct {
 	// PreferIPv6 tells the proxy to prefer IPv6 addresses when bootstrapping
 	// upstreams that use hostnames.
 	PreferIPv6 bool
+
+	// DNSSECValidation makes the proxy validate the DNSSEC signatures of the
+	// upstream responses.  Validated responses are marked with the AD flag,
+	// and bogus ones are replaced with SERVFAIL responses with the Extended
+	// DNS Error code 6 (DNSSEC Bogus).  Requests with the CD flag set aren't
+	// validated.
+	DNSSECValidation bool
 }
 
 // validateConfig verifies that the supplied configuration is valid and returns
@@ -271,10 +420,38 @@ func (p *Proxy) validateConfig() (err error) {
 		return fmt.Errorf("validating ratelimit: %w", err)
 	}
 
+	if p.CachePrefetchThreshold > 1 {
+		return fmt.Errorf("cache prefetch threshold %v is greater than 1", p.CachePrefetchThreshold)
+	}
+
+	if !(p.UpstreamStatsDecay >= 0 && p.UpstreamStatsDecay <= 1) {
+		return fmt.Errorf("upstream stats decay %v is not in range from 0 to 1", p.UpstreamStatsDecay)
+	}
+
+	for _, rc := range p.FailureRcodes {
+		if _, ok := dns.RcodeToString[rc]; !ok || rc == dns.RcodeSuccess {
+			return fmt.Errorf("failure rcode %d: %w", rc, errors.Error("bad rcode"))
+		}
+	}
+
+	if p.HedgeDelay < 0 {
+		return fmt.Errorf("hedge delay %s: %w", p.HedgeDelay, errors.Error("must not be negative"))
+	}
+
+	if !(p.HedgePercentile >= 0 && p.HedgePercentile <= 1) {
+		return fmt.Errorf("hedge percentile %v is not in range from 0 to 1", p.HedgePercentile)
+	}
+
 	switch p.UpstreamMode {
 	case "":
 		// Go on.
-	case UpstreamModeFastestAddr, UpstreamModeLoadBalance, UpstreamModeParallel:
+	case
+		UpstreamModeFastestAddr,
+		UpstreamModeLoadBalance,
+		UpstreamModeParallel,
+		UpstreamModeHedged,
+		UpstreamModeStrictOrder,
+		UpstreamModeRoundRobin:
 		// Go on.
 	default:
 		return fmt.Errorf("bad upstream mode: %q", p.UpstreamMode)
@@ -1,6 +1,11 @@
 package proxy
 
-import "github.com/miekg/dns"
+import (
+	"net"
+	"net/netip"
+
+	"github.com/miekg/dns"
+)
 
 // MessageConstructor creates DNS messages.
 type MessageConstructor interface {
@@ -17,27 +22,97 @@ type MessageConstructor interface {
 	NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.Msg)
 }
 
-// defaultMessageConstructor is a default implementation of MessageConstructor.
-type defaultMessageConstructor struct{}
+// ExtendedMessageConstructor is a [MessageConstructor] which also creates the
+// responses for filtering, rewriting, and response policies.  Implementing it
+// is optional, see [ExtendMessageConstructor].
+type ExtendedMessageConstructor interface {
+	MessageConstructor
+
+	// NewMsgREFUSED creates a new response message replying to req with the
+	// REFUSED code.
+	NewMsgREFUSED(req *dns.Msg) (resp *dns.Msg)
+
+	// NewMsgNODATA creates a new response message replying to req with the
+	// NOERROR code and no answers.
+	NewMsgNODATA(req *dns.Msg) (resp *dns.Msg)
+
+	// NewMsgAddrs creates a new response message replying to req with the
+	// addresses from addrs of the family requested by the A or AAAA question,
+	// each with the TTL of ttl.  It's a NODATA response if there are no such
+	// addresses or the question has another type.
+	NewMsgAddrs(req *dns.Msg, ttl uint32, addrs []netip.Addr) (resp *dns.Msg)
+}
+
+// ExtendMessageConstructor returns mc as an [ExtendedMessageConstructor].  If
+// mc doesn't implement it, the methods it lacks are implemented by
+// [DefaultMessageConstructor].  If mc is nil, [DefaultMessageConstructor] is
+// returned.
+func ExtendMessageConstructor(mc MessageConstructor) (emc ExtendedMessageConstructor) {
+	switch mc := mc.(type) {
+	case nil:
+		return DefaultMessageConstructor{}
+	case ExtendedMessageConstructor:
+		return mc
+	default:
+		return defaultExtendedMessageConstructor{MessageConstructor: mc}
+	}
+}
+
+// defaultExtendedMessageConstructor is an [ExtendedMessageConstructor] which
+// uses [DefaultMessageConstructor] for the methods missing from the embedded
+// [MessageConstructor].
+type defaultExtendedMessageConstructor struct {
+	MessageConstructor
+}
+
+// type check
+var _ ExtendedMessageConstructor = defaultExtendedMessageConstructor{}
+
+// NewMsgREFUSED implements the [ExtendedMessageConstructor] interface for
+// defaultExtendedMessageConstructor.
+func (defaultExtendedMessageConstructor) NewMsgREFUSED(req *dns.Msg) (resp *dns.Msg) {
+	return DefaultMessageConstructor{}.NewMsgREFUSED(req)
+}
+
+// NewMsgNODATA implements the [ExtendedMessageConstructor] interface for
+// defaultExtendedMessageConstructor.
+func (defaultExtendedMessageConstructor) NewMsgNODATA(req *dns.Msg) (resp *dns.Msg) {
+	return DefaultMessageConstructor{}.NewMsgNODATA(req)
+}
+
+// NewMsgAddrs implements the [ExtendedMessageConstructor] interface for
+// defaultExtendedMessageConstructor.
+func (defaultExtendedMessageConstructor) NewMsgAddrs(
+	req *dns.Msg,
+	ttl uint32,
+	addrs []netip.Addr,
+) (resp *dns.Msg) {
+	return DefaultMessageConstructor{}.NewMsgAddrs(req, ttl, addrs)
+}
+
+// DefaultMessageConstructor is a default implementation of
+// ExtendedMessageConstructor.  It's used by [Proxy] if
+// [Config.MessageConstructor] is nil.
+type DefaultMessageConstructor struct{}
 
 // type check
-var _ MessageConstructor = defaultMessageConstructor{}
+var _ ExtendedMessageConstructor = DefaultMessageConstructor{}
 
 // NewMsgNXDOMAIN implements the [MessageConstructor] interface for
-// defaultMessageConstructor.
-func (defaultMessageConstructor) NewMsgNXDOMAIN(req *dns.Msg) (resp *dns.Msg) {
+// DefaultMessageConstructor.
+func (DefaultMessageConstructor) NewMsgNXDOMAIN(req *dns.Msg) (resp *dns.Msg) {
 	return reply(req, dns.RcodeNameError)
 }
 
 // NewMsgSERVFAIL implements the [MessageConstructor] interface for
-// defaultMessageConstructor.
-func (defaultMessageConstructor) NewMsgSERVFAIL(req *dns.Msg) (resp *dns.Msg) {
+// DefaultMessageConstructor.
+func (DefaultMessageConstructor) NewMsgSERVFAIL(req *dns.Msg) (resp *dns.Msg) {
 	return reply(req, dns.RcodeServerFailure)
 }
 
 // NewMsgNOTIMPLEMENTED implements the [MessageConstructor] interface for
-// defaultMessageConstructor.
-func (defaultMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.Msg) {
+// DefaultMessageConstructor.
+func (DefaultMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.Msg) {
 	resp = reply(req, dns.RcodeNotImplemented)
 
 	// Most of the Internet and especially the inner core has an MTU of at least
@@ -54,6 +129,47 @@ func (defaultMessageConstructor) NewMsgNOTIMPLEMENTED(req *dns.Msg) (resp *dns.M
 	return resp
 }
 
+// NewMsgREFUSED implements the [ExtendedMessageConstructor] interface for
+// DefaultMessageConstructor.
+func (DefaultMessageConstructor) NewMsgREFUSED(req *dns.Msg) (resp *dns.Msg) {
+	return reply(req, dns.RcodeRefused)
+}
+
+// NewMsgNODATA implements the [ExtendedMessageConstructor] interface for
+// DefaultMessageConstructor.
+func (DefaultMessageConstructor) NewMsgNODATA(req *dns.Msg) (resp *dns.Msg) {
+	return reply(req, dns.RcodeSuccess)
+}
+
+// NewMsgAddrs implements the [ExtendedMessageConstructor] interface for
+// DefaultMessageConstructor.
+func (DefaultMessageConstructor) NewMsgAddrs(
+	req *dns.Msg,
+	ttl uint32,
+	addrs []netip.Addr,
+) (resp *dns.Msg) {
+	resp = reply(req, dns.RcodeSuccess)
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{
+		Name:   q.Name,
+		Rrtype: q.Qtype,
+		Class:  dns.ClassINET,
+		Ttl:    ttl,
+	}
+
+	for _, addr := range addrs {
+		switch {
+		case q.Qtype == dns.TypeA && addr.Is4():
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+		case q.Qtype == dns.TypeAAAA && addr.Is6() && !addr.Is4In6():
+			resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IP(addr.AsSlice())})
+		}
+	}
+
+	return resp
+}
+
 // reply creates a new response message replying to req with the given code.
 func reply(req *dns.Msg, code int) (resp *dns.Msg) {
 	resp = (&dns.Msg{}).SetRcode(req, code)
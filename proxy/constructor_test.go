@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtendMessageConstructor(t *testing.T) {
+	req := newReq("example.org.", dns.TypeA, dns.ClassINET)
+	nxdomain := (&dns.Msg{}).SetRcode(req, dns.RcodeNameError)
+
+	mc := &testMessageConstructor{
+		onNewMsgNXDOMAIN:       func(_ *dns.Msg) (resp *dns.Msg) { return nxdomain },
+		onNewMsgSERVFAIL:       func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+		onNewMsgNOTIMPLEMENTED: func(_ *dns.Msg) (_ *dns.Msg) { panic("not implemented") },
+	}
+
+	assert.Equal(t, DefaultMessageConstructor{}, ExtendMessageConstructor(nil))
+	assert.Equal(t, DefaultMessageConstructor{}, ExtendMessageConstructor(DefaultMessageConstructor{}))
+
+	emc := ExtendMessageConstructor(mc)
+	assert.Same(t, nxdomain, emc.NewMsgNXDOMAIN(req))
+	assert.Equal(t, dns.RcodeRefused, emc.NewMsgREFUSED(req).Rcode)
+
+	resp := emc.NewMsgNODATA(req)
+	assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+	assert.Empty(t, resp.Answer)
+}
+
+func TestDefaultMessageConstructor_NewMsgAddrs(t *testing.T) {
+	const ttl = 10
+
+	addrs := []netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("::ffff:192.0.2.2"),
+		netip.MustParseAddr("2001:db8::1"),
+	}
+
+	testCases := []struct {
+		name  string
+		want  []string
+		qtype uint16
+	}{{
+		name:  "a",
+		want:  []string{"192.0.2.1"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "aaaa",
+		want:  []string{"2001:db8::1"},
+		qtype: dns.TypeAAAA,
+	}, {
+		name:  "other",
+		want:  nil,
+		qtype: dns.TypeTXT,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newReq("example.org.", tc.qtype, dns.ClassINET)
+			resp := DefaultMessageConstructor{}.NewMsgAddrs(req, ttl, addrs)
+			require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+
+			var got []string
+			for _, rr := range resp.Answer {
+				assert.Equal(t, uint32(ttl), rr.Header().Ttl)
+
+				switch rr := rr.(type) {
+				case *dns.A:
+					got = append(got, rr.A.String())
+				case *dns.AAAA:
+					got = append(got, rr.AAAA.String())
+				}
+			}
+
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
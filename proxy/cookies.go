@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCookieSecretRotation is the default interval of rotating the
+	// secret used to generate the server cookies.
+	defaultCookieSecretRotation = 24 * time.Hour
+
+	// clientCookieLen is the length of a client cookie, see RFC 7873.
+	clientCookieLen = 8
+
+	// serverCookieLen is the length of the server cookies generated by the
+	// proxy, see RFC 9018.
+	serverCookieLen = 16
+
+	// minServerCookieLen and maxServerCookieLen are the bounds of the length
+	// of a server cookie.
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+
+	// serverCookieVersion is the version of the server cookie format.
+	serverCookieVersion = 1
+
+	// cookieSecretLen is the length of the secret used to generate the server
+	// cookies.
+	cookieSecretLen = 16
+
+	// serverCookieLifetime is the time a server cookie is considered valid
+	// for.
+	serverCookieLifetime = time.Hour
+
+	// serverCookieRefresh is the age of a valid server cookie after which
+	// a new one is generated.
+	serverCookieRefresh = serverCookieLifetime / 2
+
+	// serverCookieClockSkew is the allowed difference between the timestamp of
+	// a server cookie in the future and the current time.
+	serverCookieClockSkew = 5 * time.Minute
+)
+
+// CookieConfig is the configuration of the DNS cookies, see RFC 7873, for the
+// requests received over plain DNS.
+type CookieConfig struct {
+	// SecretRotation is the interval of rotating the secret used to generate
+	// the server cookies.  The cookies generated with the previous secret are
+	// still accepted.  If zero, 24 hours is used.
+	SecretRotation time.Duration
+}
+
+// cookieSecret is a secret used to generate the server cookies.
+type cookieSecret [cookieSecretLen]byte
+
+// cookieServer generates and verifies the server cookies using the layout from
+// RFC 9018, with HMAC-SHA256 truncated to 8 bytes as the hash.  It's safe for
+// concurrent use.
+type cookieServer struct {
+	// clock is used to get the timestamps of the cookies and to rotate the
+	// secrets.
+	clock clock
+
+	// mu protects current, previous, and rotated.
+	mu *sync.Mutex
+
+	// rotated is the time of the last rotation of the secrets.
+	rotated time.Time
+
+	// current is the secret used to generate the server cookies.
+	current cookieSecret
+
+	// previous is the secret used before the last rotation.  The cookies
+	// generated with it are still accepted.
+	previous cookieSecret
+
+	// rotation is the interval of rotating the secrets.
+	rotation time.Duration
+}
+
+// newCookieServer returns a new properly initialized *cookieServer.  conf must
+// not be nil.
+func newCookieServer(c clock, conf *CookieConfig) (cs *cookieServer) {
+	cs = &cookieServer{
+		clock:    c,
+		mu:       &sync.Mutex{},
+		rotated:  c.Now(),
+		rotation: conf.SecretRotation,
+	}
+
+	if cs.rotation <= 0 {
+		cs.rotation = defaultCookieSecretRotation
+	}
+
+	// Don't check the errors since those are always nil.
+	_, _ = rand.Read(cs.current[:])
+	_, _ = rand.Read(cs.previous[:])
+
+	return cs
+}
+
+// secrets returns the current and the previous secrets, rotating those if
+// needed.
+func (cs *cookieServer) secrets(now time.Time) (current, previous cookieSecret) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if now.Sub(cs.rotated) >= cs.rotation {
+		cs.previous = cs.current
+
+		// Don't check the error since it's always nil.
+		_, _ = rand.Read(cs.current[:])
+
+		cs.rotated = now
+	}
+
+	return cs.current, cs.previous
+}
+
+// serverCookie returns the server cookie for client cookie and client's ip,
+// generated at ts with secret.
+func serverCookie(secret cookieSecret, client []byte, ip netip.Addr, ts uint32) (cookie []byte) {
+	cookie = make([]byte, 8, serverCookieLen)
+	cookie[0] = serverCookieVersion
+	binary.BigEndian.PutUint32(cookie[4:], ts)
+
+	mac := hmac.New(sha256.New, secret[:])
+
+	// Don't check the errors since those are always nil.
+	_, _ = mac.Write(client)
+	_, _ = mac.Write(cookie)
+	_, _ = mac.Write(ip.AsSlice())
+
+	return mac.Sum(cookie)[:serverCookieLen]
+}
+
+// process handles the COOKIE option of req received from ip.  It removes the
+// option from req and returns the option to add to the response, which is nil
+// if req has no COOKIE option.  valid is true if req has a valid server cookie.
+// malformed is true if the option is malformed, in which case the request
+// should be answered with FORMERR.
+func (cs *cookieServer) process(
+	req *dns.Msg,
+	ip netip.Addr,
+) (respCookie *dns.EDNS0_COOKIE, valid, malformed bool) {
+	o := req.IsEdns0()
+	if o == nil {
+		return nil, false, false
+	}
+
+	var cookie []byte
+	found := false
+	options := o.Option[:0]
+	for _, e := range o.Option {
+		c, ok := e.(*dns.EDNS0_COOKIE)
+		if !ok {
+			options = append(options, e)
+
+			continue
+		}
+
+		var err error
+		cookie, err = hex.DecodeString(c.Cookie)
+		found, malformed = true, malformed || err != nil
+	}
+
+	o.Option = options
+	if !found {
+		return nil, false, false
+	}
+
+	l := len(cookie)
+	if malformed ||
+		l < clientCookieLen ||
+		(l > clientCookieLen && l < clientCookieLen+minServerCookieLen) ||
+		l > clientCookieLen+maxServerCookieLen {
+		return nil, false, true
+	}
+
+	client, server := cookie[:clientCookieLen], cookie[clientCookieLen:]
+	ip = ip.Unmap()
+	now := cs.clock.Now()
+	current, previous := cs.secrets(now)
+
+	valid, fresh := verifyServerCookie(server, client, ip, now, current, previous)
+	if !fresh {
+		server = serverCookie(current, client, ip, uint32(now.Unix()))
+	}
+
+	return &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(slices.Concat(client, server)),
+	}, valid, false
+}
+
+// verifyServerCookie returns true if server is a valid server cookie for client
+// and ip at now, generated with current or previous secret.  fresh is true if
+// it's valid and doesn't need to be refreshed yet.
+func verifyServerCookie(
+	server []byte,
+	client []byte,
+	ip netip.Addr,
+	now time.Time,
+	current cookieSecret,
+	previous cookieSecret,
+) (valid, fresh bool) {
+	if len(server) != serverCookieLen || server[0] != serverCookieVersion {
+		return false, false
+	}
+
+	ts := binary.BigEndian.Uint32(server[4:8])
+	age := now.Sub(time.Unix(int64(ts), 0))
+	if age > serverCookieLifetime || age < -serverCookieClockSkew {
+		return false, false
+	}
+
+	valid = hmac.Equal(server, serverCookie(current, client, ip, ts)) ||
+		hmac.Equal(server, serverCookie(previous, client, ip, ts))
+
+	return valid, valid && age < serverCookieRefresh
+}
+
+// handleCookie processes the COOKIE option of the request from d, if the
+// cookies are enabled for its protocol.  It returns true if the request has
+// a valid server cookie.  d.Res is set to FORMERR if the option is malformed.
+func (p *Proxy) handleCookie(d *DNSContext) (valid bool) {
+	if p.cookies == nil || (d.Proto != ProtoUDP && d.Proto != ProtoTCP) {
+		return false
+	}
+
+	var malformed bool
+	d.cookie, valid, malformed = p.cookies.process(d.Req, d.Addr.Addr())
+	if malformed {
+		p.logger.Debug("malformed cookie", "addr", d.Addr)
+
+		d.Res = (&dns.Msg{}).SetRcodeFormatError(d.Req)
+	}
+
+	return valid
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCookieMsg returns a new A request with the COOKIE option containing
+// cookie, hex-encoded.
+func newCookieMsg(cookie string) (req *dns.Msg) {
+	req = newHostTestMessage("example")
+	req.SetEdns0(dns.MinMsgSize, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: cookie,
+	})
+
+	return req
+}
+
+// msgCookie returns the hex-encoded COOKIE option of msg or an empty string.
+func msgCookie(msg *dns.Msg) (cookie string) {
+	if o := msg.IsEdns0(); o != nil {
+		for _, e := range o.Option {
+			if c, ok := e.(*dns.EDNS0_COOKIE); ok {
+				return c.Cookie
+			}
+		}
+	}
+
+	return ""
+}
+
+func TestCookieServer_process(t *testing.T) {
+	const (
+		client    = "0102030405060708"
+		rotation  = 2 * time.Hour
+		clientLen = 2 * clientCookieLen
+	)
+
+	now := time.Unix(1_000_000, 0)
+	cs := newCookieServer(&fakeClock{
+		onNow: func() (n time.Time) { return now },
+	}, &CookieConfig{
+		SecretRotation: rotation,
+	})
+
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	// issue returns the cookie issued for a request with client cookie only.
+	issue := func(t *testing.T) (cookie string) {
+		t.Helper()
+
+		respCookie, valid, malformed := cs.process(newCookieMsg(client), ip)
+		require.NotNil(t, respCookie)
+		require.False(t, valid)
+		require.False(t, malformed)
+
+		cookie = respCookie.Cookie
+		require.Len(t, cookie, 2*(clientCookieLen+serverCookieLen))
+		require.Equal(t, client, cookie[:clientLen])
+
+		return cookie
+	}
+
+	issued := issue(t)
+
+	testCases := []struct {
+		ip            netip.Addr
+		advance       time.Duration
+		name          string
+		cookie        string
+		wantValid     bool
+		wantMalformed bool
+	}{{
+		ip:            ip,
+		advance:       0,
+		name:          "valid",
+		cookie:        issued,
+		wantValid:     true,
+		wantMalformed: false,
+	}, {
+		ip:            netip.MustParseAddr("192.0.2.2"),
+		advance:       0,
+		name:          "other_ip",
+		cookie:        issued,
+		wantValid:     false,
+		wantMalformed: false,
+	}, {
+		ip:            ip,
+		advance:       0,
+		name:          "other_client",
+		cookie:        "ff" + issued[2:],
+		wantValid:     false,
+		wantMalformed: false,
+	}, {
+		ip:            ip,
+		advance:       serverCookieLifetime + time.Second,
+		name:          "expired",
+		cookie:        issued,
+		wantValid:     false,
+		wantMalformed: false,
+	}, {
+		ip:            ip,
+		advance:       0,
+		name:          "short_client",
+		cookie:        "01020304",
+		wantValid:     false,
+		wantMalformed: true,
+	}, {
+		ip:            ip,
+		advance:       0,
+		name:          "short_server",
+		cookie:        client + "0102",
+		wantValid:     false,
+		wantMalformed: true,
+	}, {
+		ip:            ip,
+		advance:       0,
+		name:          "bad_hex",
+		cookie:        "not hex",
+		wantValid:     false,
+		wantMalformed: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			now = now.Add(tc.advance)
+			t.Cleanup(func() { now = now.Add(-tc.advance) })
+
+			req := newCookieMsg(tc.cookie)
+			_, valid, malformed := cs.process(req, tc.ip)
+			assert.Equal(t, tc.wantValid, valid)
+			assert.Equal(t, tc.wantMalformed, malformed)
+
+			assert.Empty(t, msgCookie(req))
+		})
+	}
+}
+
+func TestCookieServer_process_rotation(t *testing.T) {
+	const rotation = 20 * time.Minute
+
+	now := time.Unix(1_000_000, 0)
+	cs := newCookieServer(&fakeClock{
+		onNow: func() (n time.Time) { return now },
+	}, &CookieConfig{
+		SecretRotation: rotation,
+	})
+
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	// Issue a cookie right before the rotation, so that it's generated with
+	// the previous secret after it.
+	now = now.Add(rotation - time.Minute)
+	respCookie, _, _ := cs.process(newCookieMsg("0102030405060708"), ip)
+	require.NotNil(t, respCookie)
+
+	cookie := respCookie.Cookie
+
+	now = now.Add(time.Minute)
+	_, valid, _ := cs.process(newCookieMsg(cookie), ip)
+	assert.True(t, valid)
+
+	// The cookie isn't expired yet, but its secret is rotated out.
+	now = now.Add(rotation)
+	_, valid, _ = cs.process(newCookieMsg(cookie), ip)
+	assert.False(t, valid)
+}
+
+func TestProxy_cookies_ratelimit(t *testing.T) {
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		Ratelimit:              1,
+		Cookies:                &CookieConfig{},
+	})
+
+	ctx := context.Background()
+	err := p.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return p.Shutdown(ctx) })
+
+	addr := p.Addr(ProtoUDP).String()
+	client := &dns.Client{
+		Net:     string(ProtoUDP),
+		Timeout: 200 * time.Millisecond,
+	}
+
+	resp, _, err := client.Exchange(newCookieMsg("0102030405060708"), addr)
+	require.NoError(t, err)
+
+	cookie := msgCookie(resp)
+	require.NotEmpty(t, cookie)
+
+	for range 3 {
+		resp, _, err = client.Exchange(newCookieMsg(cookie), addr)
+		require.NoError(t, err)
+
+		assert.Equal(t, cookie, msgCookie(resp))
+	}
+
+	_, _, err = client.Exchange(newCookieMsg("0102030405060708"), addr)
+	assert.Error(t, err)
+
+	_, _, err = client.Exchange(newCookieMsg(hex.EncodeToString([]byte{1, 2, 3, 4})), addr)
+	assert.Error(t, err)
+}
@@ -30,47 +30,66 @@ const (
 	maxDNS64SynTTL uint32 = 600
 )
 
-// setupDNS64 initializes DNS64 settings, the NAT64 prefixes in particular.  If
-// the DNS64 feature is enabled and no prefixes are configured, the default
+// setupDNS64 initializes DNS64 settings, the NAT64 prefixes in particular.
+func (p *Proxy) setupDNS64() (err error) {
+	p.dns64Prefs, err = newDNS64Prefs(p.UseDNS64, p.DNS64Prefs)
+
+	return err
+}
+
+// newDNS64Prefs returns the validated set of NAT64 prefixes for DNS64.  If the
+// DNS64 feature is enabled and no prefixes are configured, the default
 // Well-Known Prefix is used, just like Section 5.2 of RFC 6147 prescribes.  Any
 // configured set of prefixes discards the default Well-Known prefix unless it
 // is specified explicitly.  Each prefix also validated to be a valid IPv6 CIDR
 // with a maximum length of 96 bits.  The first specified prefix is then used to
-// synthesize AAAA records.
-func (p *Proxy) setupDNS64() (err error) {
-	if !p.Config.UseDNS64 {
-		return nil
+// synthesize AAAA records.  prefs is nil if DNS64 is disabled.
+func newDNS64Prefs(enabled bool, conf []netip.Prefix) (prefs netutil.SliceSubnetSet, err error) {
+	if !enabled {
+		return nil, nil
 	}
 
-	if len(p.Config.DNS64Prefs) == 0 {
-		p.dns64Prefs = netutil.SliceSubnetSet{dns64WellKnownPref}
-
-		return nil
+	if len(conf) == 0 {
+		return netutil.SliceSubnetSet{dns64WellKnownPref}, nil
 	}
 
-	for i, pref := range p.Config.DNS64Prefs {
+	for i, pref := range conf {
 		if !pref.Addr().Is6() {
-			return fmt.Errorf("prefix at index %d: %q is not an IPv6 prefix", i, pref)
+			return nil, fmt.Errorf("prefix at index %d: %q is not an IPv6 prefix", i, pref)
 		}
 
 		if pref.Bits() > maxNAT64PrefixBitLen {
-			return fmt.Errorf("prefix at index %d: %q is too long for DNS64", i, pref)
+			return nil, fmt.Errorf("prefix at index %d: %q is too long for DNS64", i, pref)
 		}
 
-		p.dns64Prefs = append(p.dns64Prefs, pref.Masked())
+		prefs = append(prefs, pref.Masked())
 	}
 
-	return nil
+	return prefs, nil
+}
+
+// dns64PrefsFor returns the NAT64 prefixes to use for d.  It's empty if DNS64
+// is disabled for d.
+func (p *Proxy) dns64PrefsFor(d *DNSContext) (prefs netutil.SliceSubnetSet) {
+	if d.view != nil {
+		return d.view.dns64Prefs
+	}
+
+	return p.dns64Prefs
 }
 
 // checkDNS64 checks if DNS64 should be performed.  It returns a DNS64 request
 // to resolve or nil if DNS64 is not desired.  It also filters resp to not
-// contain any NAT64 excluded addresses in the answer section, if needed.  Both
-// req and resp must not be nil.
+// contain any NAT64 excluded addresses from prefs in the answer section, if
+// needed.  Both req and resp must not be nil.
 //
 // See https://datatracker.ietf.org/doc/html/rfc6147.
-func (p *Proxy) checkDNS64(req, resp *dns.Msg) (dns64Req *dns.Msg) {
-	if len(p.dns64Prefs) == 0 {
+func (p *Proxy) checkDNS64(
+	req *dns.Msg,
+	resp *dns.Msg,
+	prefs netutil.SliceSubnetSet,
+) (dns64Req *dns.Msg) {
+	if len(prefs) == 0 {
 		return nil
 	}
 
@@ -93,7 +112,7 @@ func (p *Proxy) checkDNS64(req, resp *dns.Msg) (dns64Req *dns.Msg) {
 		// only the AAAA record(s) that do not contain any of the addresses
 		// inside the excluded ranges.
 		var hasAnswers bool
-		if resp.Answer, hasAnswers = p.filterNAT64Answers(resp.Answer); hasAnswers {
+		if resp.Answer, hasAnswers = p.filterNAT64Answers(resp.Answer, prefs); hasAnswers {
 			return nil
 		}
 	default:
@@ -111,9 +130,10 @@ func (p *Proxy) checkDNS64(req, resp *dns.Msg) (dns64Req *dns.Msg) {
 // filterNAT64Answers filters out AAAA records that are within one of NAT64
 // exclusion prefixes.  hasAnswers is true if the filtered slice contains at
 // least a single AAAA answer not within the prefixes or a CNAME.
-//
-// TODO(e.burkov):  Remove prefs from args when old API is removed.
-func (p *Proxy) filterNAT64Answers(rrs []dns.RR) (filtered []dns.RR, hasAnswers bool) {
+func (p *Proxy) filterNAT64Answers(
+	rrs []dns.RR,
+	prefs netutil.SliceSubnetSet,
+) (filtered []dns.RR, hasAnswers bool) {
 	filtered = make([]dns.RR, 0, len(rrs))
 	for _, ans := range rrs {
 		switch ans := ans.(type) {
@@ -121,7 +141,7 @@ func (p *Proxy) filterNAT64Answers(rrs []dns.RR) (filtered []dns.RR, hasAnswers
 			addr, err := netutil.IPToAddrNoMapped(ans.AAAA)
 			if err != nil {
 				p.logger.Error("bad aaaa record", slogutil.KeyError, err)
-			} else if p.dns64Prefs.Contains(addr) {
+			} else if prefs.Contains(addr) {
 				// Filter the record.
 				continue
 			} else {
@@ -145,9 +165,14 @@ func (p *Proxy) filterNAT64Answers(rrs []dns.RR) (filtered []dns.RR, hasAnswers
 }
 
 // synthDNS64 synthesizes a DNS64 response using the original response as a
-// basis and modifying it with data from resp.  It returns true if the response
-// was actually modified.
-func (p *Proxy) synthDNS64(origReq, origResp, resp *dns.Msg) (ok bool) {
+// basis and modifying it with data from resp using the first prefix of prefs.
+// It returns true if the response was actually modified.
+func (p *Proxy) synthDNS64(
+	origReq *dns.Msg,
+	origResp *dns.Msg,
+	resp *dns.Msg,
+	prefs netutil.SliceSubnetSet,
+) (ok bool) {
 	if len(resp.Answer) == 0 {
 		// If there is an empty answer, then the DNS64 responds to the original
 		// querying client with the answer the DNS64 received to the original
@@ -170,7 +195,7 @@ func (p *Proxy) synthDNS64(origReq, origResp, resp *dns.Msg) (ok bool) {
 
 	newAns := make([]dns.RR, 0, len(resp.Answer))
 	for _, ans := range resp.Answer {
-		rr := p.synthRR(ans, soaTTL)
+		rr := p.synthRR(ans, soaTTL, prefs[0])
 		if rr == nil {
 			// The error should have already been logged.
 			return false
@@ -190,9 +215,9 @@ func (p *Proxy) synthDNS64(origReq, origResp, resp *dns.Msg) (ok bool) {
 // DNS64.  See https://datatracker.ietf.org/doc/html/rfc6052#section-2.1.
 var dns64WellKnownPref = netip.MustParsePrefix("64:ff9b::/96")
 
-// shouldStripDNS64 returns true if DNS64 is enabled and req is a PTR for a
-// reversed address within either one of custom DNS64 prefixes or the Well-Known
-// one.
+// shouldStripDNS64 returns true if DNS64 is enabled, i.e. prefs aren't empty,
+// and req is a PTR for a reversed address within either one of prefs or the
+// Well-Known prefix.
 //
 // The requirement is to match any Pref64::/n used at the site, and not merely
 // the locally configured Pref64::/n.  This is because end clients could ask for
@@ -200,8 +225,8 @@ var dns64WellKnownPref = netip.MustParsePrefix("64:ff9b::/96")
 // DNS64.
 //
 // See https://datatracker.ietf.org/doc/html/rfc6147#section-5.3.1.
-func (p *Proxy) shouldStripDNS64(req *dns.Msg) (ok bool) {
-	if len(p.dns64Prefs) == 0 {
+func (p *Proxy) shouldStripDNS64(req *dns.Msg, prefs netutil.SliceSubnetSet) (ok bool) {
+	if len(prefs) == 0 {
 		return false
 	}
 
@@ -219,7 +244,7 @@ func (p *Proxy) shouldStripDNS64(req *dns.Msg) (ok bool) {
 	}
 
 	switch {
-	case p.dns64Prefs.Contains(ip):
+	case prefs.Contains(ip):
 		p.logger.Debug("the ip is within dns64 custom prefix set", "ip", ip)
 	case dns64WellKnownPref.Contains(ip):
 		p.logger.Debug("the ip is within dns64 well-known prefix", "ip", ip)
@@ -230,15 +255,12 @@ func (p *Proxy) shouldStripDNS64(req *dns.Msg) (ok bool) {
 	return true
 }
 
-// mapDNS64 maps addr to IPv6 address using configured DNS64 prefix.  addr must
-// be a valid IPv4.  It panics, if there are no configured DNS64 prefixes,
-// because synthesis should not be performed unless DNS64 function enabled.
-//
-// TODO(e.burkov):  Remove pref from args when old API is removed.
-func (p *Proxy) mapDNS64(addr netip.Addr) (mapped net.IP) {
+// mapDNS64 maps addr to IPv6 address using the DNS64 prefix pref.  addr must be
+// a valid IPv4.
+func mapDNS64(addr netip.Addr, pref netip.Prefix) (mapped net.IP) {
 	// Don't mask the address here since it should have already been masked on
 	// initialization stage.
-	prefData := p.dns64Prefs[0].Addr().As16()
+	prefData := pref.Addr().As16()
 	addrData := addr.As4()
 
 	mapped = make(net.IP, net.IPv6len)
@@ -251,8 +273,9 @@ func (p *Proxy) mapDNS64(addr netip.Addr) (mapped net.IP) {
 // synthRR synthesizes a DNS64 resource record in compliance with RFC 6147.  If
 // rr is not an A record, it's returned as is.  A records are modified to become
 // a DNS64-synthesized AAAA records, and the TTL is set according to the
-// original TTL of a record and soaTTL.  It returns nil on invalid A records.
-func (p *Proxy) synthRR(rr dns.RR, soaTTL uint32) (result dns.RR) {
+// original TTL of a record and soaTTL, and the address is mapped using pref.
+// It returns nil on invalid A records.
+func (p *Proxy) synthRR(rr dns.RR, soaTTL uint32, pref netip.Prefix) (result dns.RR) {
 	aResp, ok := rr.(*dns.A)
 	if !ok {
 		return rr
@@ -272,24 +295,25 @@ func (p *Proxy) synthRR(rr dns.RR, soaTTL uint32) (result dns.RR) {
 			Class:  aResp.Hdr.Class,
 			Ttl:    min(aResp.Hdr.Ttl, soaTTL),
 		},
-		AAAA: p.mapDNS64(addr),
+		AAAA: mapDNS64(addr, pref),
 	}
 
 	return aaaa
 }
 
-// performDNS64 returns the upstream that was used to perform DNS64 request, or
-// nil, if the request was not performed.
+// performDNS64 returns the upstream that was used to perform DNS64 request with
+// prefs, or nil, if the request was not performed.
 func (p *Proxy) performDNS64(
 	origReq *dns.Msg,
 	origResp *dns.Msg,
 	upstreams []upstream.Upstream,
+	prefs netutil.SliceSubnetSet,
 ) (u upstream.Upstream) {
 	if origResp == nil {
 		return nil
 	}
 
-	dns64Req := p.checkDNS64(origReq, origResp)
+	dns64Req := p.checkDNS64(origReq, origResp, prefs)
 	if dns64Req == nil {
 		return nil
 	}
@@ -304,7 +328,7 @@ func (p *Proxy) performDNS64(
 		return nil
 	}
 
-	if dns64Resp != nil && p.synthDNS64(origReq, origResp, dns64Resp) {
+	if dns64Resp != nil && p.synthDNS64(origReq, origResp, dns64Resp, prefs) {
 		p.logger.Debug("synthesized aaaa response", "host", host)
 
 		return u
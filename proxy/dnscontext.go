@@ -47,6 +47,10 @@ type DNSContext struct {
 	// servers if it's not nil.
 	CustomUpstreamConfig *CustomUpstreamConfig
 
+	// view is the view selected for the request, if any.  It also defines the
+	// ECS and DNS64 settings for the request.
+	view *view
+
 	// Req is the request message.
 	Req *dns.Msg
 	// Res is the response message.
@@ -58,6 +62,12 @@ type DNSContext struct {
 	// cached with.  It's empty for responses resolved by the upstream server.
 	CachedUpstreamAddr string
 
+	// ede is the Extended DNS Error to add to the response, if any.
+	ede *dns.EDNS0_EDE
+
+	// cookie is the DNS cookie to add to the response, if any.
+	cookie *dns.EDNS0_COOKIE
+
 	// RequestedPrivateRDNS is the subnet extracted from the ARPA domain of
 	// request's question if it's a PTR, SOA, or NS query for a private IP
 	// address.  It can be a single-address subnet as well as a zero-length one.
@@ -99,6 +109,10 @@ type DNSContext struct {
 
 	// doBit is the DNSSEC OK flag from request's EDNS0 RR if presented.
 	doBit bool
+
+	// padded is true if the request contained the EDNS(0) Padding option, in
+	// which case the response over an encrypted protocol is padded as well.
+	padded bool
 }
 
 // newDNSContext returns a new properly initialized *DNSContext.
@@ -148,6 +162,14 @@ func (dctx *DNSContext) scrub() {
 		dctx.Res.SetEdns0(dctx.udpSize, dctx.doBit)
 	}
 
+	if o := dctx.Res.IsEdns0(); o != nil && dctx.ede != nil {
+		o.Option = append(o.Option, dctx.ede)
+	}
+
+	if o := dctx.Res.IsEdns0(); o != nil && dctx.cookie != nil {
+		o.Option = append(o.Option, dctx.cookie)
+	}
+
 	dctx.Res.Truncate(int(dnsSize(dctx.Proto == ProtoUDP, dctx.Req)))
 	// Some devices require DNS message compression.
 	dctx.Res.Compress = true
@@ -204,7 +226,10 @@ func NewCustomUpstreamConfig(
 	var customCache *cache
 	if cacheEnabled {
 		// TODO(d.kolyshev): Support optimistic with newOptimisticResolver.
-		customCache = newCache(cacheSize, enableEDNSClientSubnet, false)
+		customCache = newCache(&cacheConfig{
+			size:    cacheSize,
+			withECS: enableEDNSClientSubnet,
+		})
 	}
 
 	return &CustomUpstreamConfig{
@@ -228,6 +253,5 @@ func (c *CustomUpstreamConfig) ClearCache() {
 		return
 	}
 
-	c.cache.clearItems()
-	c.cache.clearItemsWithSubnet()
+	c.cache.clear()
 }
@@ -0,0 +1,972 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/container"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+// DefaultDNSSECTrustAnchors returns the DS records of the root zone key signing
+// keys, KSK-2017 and KSK-2024, published by IANA.  These are used when
+// [Config.DNSSECTrustAnchors] is empty.
+//
+// See https://data.iana.org/root-anchors/root-anchors.xml.
+func DefaultDNSSECTrustAnchors() (anchors []*dns.DS) {
+	return []*dns.DS{{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeDS,
+			Class:  dns.ClassINET,
+		},
+		KeyTag:     20326,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	}, {
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeDS,
+			Class:  dns.ClassINET,
+		},
+		KeyTag:     38696,
+		Algorithm:  dns.RSASHA256,
+		DigestType: dns.SHA256,
+		Digest:     "683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+	}}
+}
+
+// dnssecResult is the result of the DNSSEC validation of a response.
+type dnssecResult uint8
+
+const (
+	// dnssecInsecure means that the response is known to come from an
+	// unsigned zone, isn't covered by any trust anchor, or is covered by a
+	// negative trust anchor.
+	dnssecInsecure dnssecResult = iota
+
+	// dnssecSecure means that all the RRsets of the response are signed and
+	// the signatures are chained up to a trust anchor.
+	dnssecSecure
+
+	// dnssecBogus means that the response should have been signed, but its
+	// signatures are missing, expired, or invalid.
+	dnssecBogus
+)
+
+// String implements the [fmt.Stringer] interface for dnssecResult.
+func (r dnssecResult) String() (s string) {
+	switch r {
+	case dnssecInsecure:
+		return "insecure"
+	case dnssecSecure:
+		return "secure"
+	case dnssecBogus:
+		return "bogus"
+	default:
+		return fmt.Sprintf("!bad_dnssec_result_%d", r)
+	}
+}
+
+// dnssecExchangeFunc sends an auxiliary DNSSEC request, e.g. for DS or DNSKEY
+// RRsets, and returns the response.
+type dnssecExchangeFunc func(req *dns.Msg) (resp *dns.Msg, err error)
+
+// delegationKind is the kind of a name with respect to zone cuts.
+type delegationKind uint8
+
+const (
+	// delegationNone means that the name isn't a zone cut.
+	delegationNone delegationKind = iota
+
+	// delegationSecure means that the name is a zone cut with a validated DS
+	// RRset and, therefore, a validated DNSKEY RRset.
+	delegationSecure
+
+	// delegationInsecure means that the name is a zone cut proven to have no
+	// DS RRset or only the DS records with unsupported algorithms or digest
+	// types, so that the zone below it is treated as unsigned.
+	delegationInsecure
+
+	// delegationNXDomain means that the name is proven not to exist.
+	delegationNXDomain
+)
+
+// dnssecState is a validated state of a single domain name.
+type dnssecState struct {
+	// expire is the time after which the state should be revalidated.
+	expire time.Time
+
+	// keys are the validated DNSKEY records of the zone, if kind is
+	// [delegationSecure].
+	keys []*dns.DNSKEY
+
+	// kind is the kind of the name.
+	kind delegationKind
+}
+
+const (
+	// maxDNSSECStateTTL is the maximum duration for which a validated DNSSEC
+	// state of a name is kept.
+	maxDNSSECStateTTL = 1 * time.Hour
+
+	// maxDNSSECStates is the maximum number of stored validated states.  The
+	// storage is simply cleared when it grows larger.
+	//
+	// TODO:  Use LRU.
+	maxDNSSECStates = 10_000
+)
+
+// Errors returned by the DNSSEC validation.
+const (
+	errDNSSECNoRRSIG      errors.Error = "no rrsig for rrset in signed zone"
+	errDNSSECNoValidSig   errors.Error = "no valid signature"
+	errDNSSECSigPeriod    errors.Error = "signature is expired or not yet valid"
+	errDNSSECNoKeys       errors.Error = "no dnskey matches ds"
+	errDNSSECNoDenial     errors.Error = "no denial of existence proof"
+	errDNSSECBadSigner    errors.Error = "bad signer name"
+	errDNSSECDSInBitmap   errors.Error = "nsec claims ds exists"
+	errDNSSECUnexpRcode   errors.Error = "unexpected response code"
+	errDNSSECNoResponse   errors.Error = "no response"
+	errDNSSECUnsignedSet  errors.Error = "unsigned rrset in signed section"
+	errDNSSECTypeInBitmap errors.Error = "denial claims type exists"
+	errDNSSECDelegation   errors.Error = "denial from delegation point"
+	errDNSSECBadLabels    errors.Error = "rrsig labels exceed owner labels"
+)
+
+// dnssecValidator validates the DNSSEC signatures of the upstream responses
+// against the configured trust anchors.  It's safe for concurrent use.
+type dnssecValidator struct {
+	// logger is used to log the validation process.  It is never nil.
+	logger *slog.Logger
+
+	// clock is used to check the validity periods of signatures and the
+	// expiration of the stored states.
+	clock clock
+
+	// anchors maps the canonical names of zones to the DS records trusted for
+	// those.
+	anchors map[string][]*dns.DS
+
+	// ntas is the set of the canonical names of negative trust anchors.
+	ntas *container.MapSet[string]
+
+	// statesLock protects states.
+	statesLock *sync.Mutex
+
+	// states maps the canonical names to their validated states.
+	states map[string]*dnssecState
+}
+
+// newDNSSECValidator returns a new properly initialized *dnssecValidator.  If
+// anchors is empty, [DefaultDNSSECTrustAnchors] are used.
+func newDNSSECValidator(
+	l *slog.Logger,
+	c clock,
+	anchors []*dns.DS,
+	ntas []string,
+) (v *dnssecValidator, err error) {
+	if len(anchors) == 0 {
+		anchors = DefaultDNSSECTrustAnchors()
+	}
+
+	v = &dnssecValidator{
+		logger:     l,
+		clock:      c,
+		anchors:    map[string][]*dns.DS{},
+		ntas:       container.NewMapSet[string](),
+		statesLock: &sync.Mutex{},
+		states:     map[string]*dnssecState{},
+	}
+
+	for i, ds := range anchors {
+		if ds == nil {
+			return nil, fmt.Errorf("trust anchor at index %d is nil", i)
+		}
+
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		v.anchors[zone] = append(v.anchors[zone], ds)
+	}
+
+	for _, nta := range ntas {
+		v.ntas.Add(dns.CanonicalName(nta))
+	}
+
+	return v, nil
+}
+
+// validate checks the DNSSEC signatures of resp, which is the response for req.
+// exch is used to request the auxiliary DS and DNSKEY RRsets.  err is only
+// non-nil if res is [dnssecBogus].
+func (v *dnssecValidator) validate(
+	exch dnssecExchangeFunc,
+	req *dns.Msg,
+	resp *dns.Msg,
+) (res dnssecResult, err error) {
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+		// Go on.
+	default:
+		return dnssecInsecure, nil
+	}
+
+	// The authority section of a positive response is only validated for the
+	// NSEC and NSEC3 records, which prove the wildcard expansions.
+	sections := [][]dns.RR{resp.Answer, denialRecords(resp.Ns)}
+	if len(resp.Answer) == 0 {
+		sections[1] = resp.Ns
+	}
+
+	secure := true
+	var expanded []*dns.RRSIG
+	sets, sigs := groupRRsets(sections...)
+	for _, set := range sets {
+		hdr := set[0].Header()
+		anchor, ok := v.anchorFor(dns.CanonicalName(hdr.Name))
+		if !ok {
+			secure = false
+
+			continue
+		}
+
+		var sig *dns.RRSIG
+		sig, err = v.validateRRset(exch, anchor, set, sigs[newRRsetKey(set[0])])
+		if err != nil {
+			return dnssecBogus, fmt.Errorf(
+				"validating %s %s: %w",
+				hdr.Name,
+				dns.Type(hdr.Rrtype),
+				err,
+			)
+		}
+
+		if sig != nil && isWildcardExpansion(sig, hdr.Name) {
+			expanded = append(expanded, sig)
+		}
+
+		secure = secure && sig != nil
+	}
+
+	for _, sig := range expanded {
+		err = checkWildcardProof(resp.Ns, sig)
+		if err != nil {
+			return dnssecBogus, fmt.Errorf("validating expansion of %s: %w", sig.Hdr.Name, err)
+		}
+	}
+
+	if len(resp.Answer) == 0 {
+		q := req.Question[0]
+		anchor, ok := v.anchorFor(dns.CanonicalName(q.Name))
+		if !ok {
+			return dnssecInsecure, nil
+		}
+
+		var denialSecure bool
+		denialSecure, err = v.validateDenial(exch, anchor, q, resp)
+		if err != nil {
+			return dnssecBogus, fmt.Errorf("validating denial of %s: %w", q.Name, err)
+		}
+
+		secure = secure && denialSecure
+	}
+
+	if secure && len(sets) > 0 {
+		return dnssecSecure, nil
+	}
+
+	return dnssecInsecure, nil
+}
+
+// anchorFor returns the closest trust anchor zone of name.  ok is false if
+// there is no such anchor or name is covered by a negative trust anchor.  name
+// must be canonical.
+func (v *dnssecValidator) anchorFor(name string) (anchor string, ok bool) {
+	if v.isNegativeAnchor(name) {
+		v.logger.Debug("domain is under a negative trust anchor", "name", name)
+
+		return "", false
+	}
+
+	return v.closestAnchor(name)
+}
+
+// isNegativeAnchor returns true if name is a subdomain of any of the negative
+// trust anchors.  name must be canonical.
+func (v *dnssecValidator) isNegativeAnchor(name string) (ok bool) {
+	for n := name; ; {
+		if v.ntas.Has(n) {
+			return true
+		}
+
+		if n == "." {
+			return false
+		}
+
+		n = parentName(n)
+	}
+}
+
+// closestAnchor returns the closest trust anchor zone of name.  name must be
+// canonical.
+func (v *dnssecValidator) closestAnchor(name string) (zone string, ok bool) {
+	for n := name; ; {
+		if _, ok = v.anchors[n]; ok {
+			return n, true
+		}
+
+		if n == "." {
+			return "", false
+		}
+
+		n = parentName(n)
+	}
+}
+
+// validateRRset validates the signatures of set using the keys of the signer
+// zone and returns the valid signature.  sig is nil if set belongs to an
+// unsigned zone.
+func (v *dnssecValidator) validateRRset(
+	exch dnssecExchangeFunc,
+	anchor string,
+	set []dns.RR,
+	sigs []*dns.RRSIG,
+) (sig *dns.RRSIG, err error) {
+	name := dns.CanonicalName(set[0].Header().Name)
+	if len(sigs) == 0 {
+		keys, _, keysErr := v.closestKeys(exch, anchor, name)
+		if keysErr != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return nil, keysErr
+		} else if keys != nil {
+			return nil, errDNSSECNoRRSIG
+		}
+
+		return nil, nil
+	}
+
+	var errs []error
+	for _, s := range sigs {
+		signer := dns.CanonicalName(s.SignerName)
+		if !dns.IsSubDomain(anchor, signer) || !dns.IsSubDomain(signer, name) {
+			errs = append(errs, fmt.Errorf("%w: %q", errDNSSECBadSigner, signer))
+
+			continue
+		}
+
+		keys, zone, keysErr := v.closestKeys(exch, anchor, signer)
+		switch {
+		case keysErr != nil:
+			errs = append(errs, keysErr)
+		case keys == nil:
+			// The signer zone is proven to be unsigned.
+			return nil, nil
+		case zone != signer:
+			errs = append(errs, fmt.Errorf("%w: %q is not a zone apex", errDNSSECBadSigner, signer))
+		default:
+			keysErr = v.verify(s, keys, set)
+			if keysErr == nil {
+				return s, nil
+			}
+
+			errs = append(errs, keysErr)
+		}
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// verify checks if sig is a currently valid signature of set made by any of the
+// keys.
+func (v *dnssecValidator) verify(sig *dns.RRSIG, keys []*dns.DNSKEY, set []dns.RR) (err error) {
+	if !sig.ValidityPeriod(v.clock.Now()) {
+		return errDNSSECSigPeriod
+	} else if int(sig.Labels) > rrsigLabels(dns.CanonicalName(set[0].Header().Name)) {
+		return errDNSSECBadLabels
+	}
+
+	for _, k := range keys {
+		if k.Algorithm != sig.Algorithm || k.KeyTag() != sig.KeyTag {
+			continue
+		}
+
+		if sig.Verify(k, set) == nil {
+			return nil
+		}
+	}
+
+	return errDNSSECNoValidSig
+}
+
+// validateDenial checks the denial of existence proof in the authority section
+// of resp, which has no answers to q.  secure is false if the name belongs to
+// an unsigned zone or the proof relies on an Opt-Out NSEC3 record.
+func (v *dnssecValidator) validateDenial(
+	exch dnssecExchangeFunc,
+	anchor string,
+	q dns.Question,
+	resp *dns.Msg,
+) (secure bool, err error) {
+	qname := dns.CanonicalName(q.Name)
+	keys, _, err := v.closestKeys(exch, anchor, qname)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	} else if keys == nil {
+		return false, nil
+	}
+
+	nsecs, nsec3s := splitDenialRecords(resp.Ns)
+	nxdomain := resp.Rcode == dns.RcodeNameError
+	switch {
+	case len(nsecs) > 0 && nxdomain:
+		err = checkNSECNameError(nsecs, qname)
+	case len(nsecs) > 0:
+		err = checkNSECNoData(nsecs, qname, q.Qtype)
+	case len(nsec3s) > 0 && nxdomain:
+		return checkNSEC3NameError(nsec3s, qname)
+	case len(nsec3s) > 0:
+		return checkNSEC3NoData(nsec3s, qname, q.Qtype)
+	default:
+		err = errDNSSECNoDenial
+	}
+
+	return err == nil, err
+}
+
+// closestKeys returns the validated keys of the closest zone enclosing name
+// within the zone of anchor as well as the name of that zone.  keys are nil if
+// the zone is proven to be unsigned.  name must be canonical.
+func (v *dnssecValidator) closestKeys(
+	exch dnssecExchangeFunc,
+	anchor string,
+	name string,
+) (keys []*dns.DNSKEY, zone string, err error) {
+	st, err := v.anchorState(exch, anchor)
+	if err != nil {
+		return nil, "", fmt.Errorf("validating trust anchor %q: %w", anchor, err)
+	}
+
+	keys, zone = st.keys, anchor
+	for _, n := range namesBetween(anchor, name) {
+		st, err = v.delegation(exch, n, zone, keys)
+		if err != nil {
+			return nil, "", fmt.Errorf("validating delegation of %q: %w", n, err)
+		}
+
+		switch st.kind {
+		case delegationSecure:
+			keys, zone = st.keys, n
+		case delegationInsecure:
+			return nil, n, nil
+		case delegationNXDomain:
+			return keys, zone, nil
+		default:
+			// Go on.
+		}
+	}
+
+	return keys, zone, nil
+}
+
+// anchorState returns the validated state of the trust anchor zone.
+func (v *dnssecValidator) anchorState(
+	exch dnssecExchangeFunc,
+	anchor string,
+) (st *dnssecState, err error) {
+	if st = v.state(anchor); st != nil {
+		return st, nil
+	}
+
+	keys, ttl, err := v.validateKeys(exch, anchor, v.anchors[anchor])
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	st = &dnssecState{
+		keys: keys,
+		kind: delegationSecure,
+	}
+	v.setState(anchor, st, ttl)
+
+	return st, nil
+}
+
+// delegation returns the validated state of name, which is a subdomain of zone
+// having the given keys.
+func (v *dnssecValidator) delegation(
+	exch dnssecExchangeFunc,
+	name string,
+	zone string,
+	keys []*dns.DNSKEY,
+) (st *dnssecState, err error) {
+	if st = v.state(name); st != nil {
+		return st, nil
+	}
+
+	resp, err := exch(newDNSSECRequest(name, dns.TypeDS))
+	if err != nil {
+		return nil, fmt.Errorf("requesting ds: %w", err)
+	}
+
+	st = &dnssecState{}
+	ttl := uint32(maxDNSSECStateTTL.Seconds())
+	switch resp.Rcode {
+	case dns.RcodeNameError:
+		st.kind = delegationNXDomain
+		err = v.verifySection(resp.Ns, zone, keys)
+	case dns.RcodeSuccess:
+		st.kind, st.keys, ttl, err = v.validateDS(exch, name, zone, keys, resp)
+	default:
+		err = fmt.Errorf("%w: %s", errDNSSECUnexpRcode, dns.RcodeToString[resp.Rcode])
+	}
+
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	v.setState(name, st, min(ttl, calculateTTL(resp)))
+
+	return st, nil
+}
+
+// validateDS validates the NOERROR response for DS RRset of name, which is a
+// subdomain of zone having the given keys.
+func (v *dnssecValidator) validateDS(
+	exch dnssecExchangeFunc,
+	name string,
+	zone string,
+	keys []*dns.DNSKEY,
+	resp *dns.Msg,
+) (kind delegationKind, childKeys []*dns.DNSKEY, ttl uint32, err error) {
+	var dss []*dns.DS
+	for _, rr := range resp.Answer {
+		if ds, ok := rr.(*dns.DS); ok && dns.CanonicalName(ds.Hdr.Name) == name {
+			dss = append(dss, ds)
+		}
+	}
+
+	if len(dss) == 0 {
+		if hasCNAME(resp.Answer, name) {
+			// A CNAME can't coexist with a zone cut, so there is no need to
+			// validate it, since it doesn't make the validation less strict.
+			return delegationNone, nil, calculateTTL(resp), nil
+		}
+
+		err = v.verifySection(resp.Ns, zone, keys)
+		if err != nil {
+			return delegationNone, nil, 0, err
+		}
+
+		kind, err = delegationFromProof(resp.Ns, name)
+
+		return kind, nil, calculateTTL(resp), err
+	}
+
+	err = v.verifySection(resp.Answer, zone, keys)
+	if err != nil {
+		return delegationNone, nil, 0, err
+	}
+
+	dss = slices.DeleteFunc(dss, isUnsupportedDS)
+	if len(dss) == 0 {
+		// The zone is treated as unsigned if none of the DS records can be
+		// used.
+		//
+		// See RFC 4035 Section 5.2.
+		return delegationInsecure, nil, calculateTTL(resp), nil
+	}
+
+	childKeys, ttl, err = v.validateKeys(exch, name, dss)
+	if err != nil {
+		return delegationNone, nil, 0, err
+	}
+
+	return delegationSecure, childKeys, ttl, nil
+}
+
+// verifySection checks that every RRset in rrs is signed by zone with one of
+// keys.
+func (v *dnssecValidator) verifySection(rrs []dns.RR, zone string, keys []*dns.DNSKEY) (err error) {
+	sets, sigs := groupRRsets(rrs)
+	for _, set := range sets {
+		setSigs := sigs[newRRsetKey(set[0])]
+		if len(setSigs) == 0 {
+			return fmt.Errorf("%s: %w", set[0].Header().Name, errDNSSECUnsignedSet)
+		}
+
+		var errs []error
+		for _, sig := range setSigs {
+			if dns.CanonicalName(sig.SignerName) != zone {
+				errs = append(errs, fmt.Errorf("%w: %q", errDNSSECBadSigner, sig.SignerName))
+
+				continue
+			}
+
+			sigErr := v.verify(sig, keys, set)
+			if sigErr == nil {
+				errs = nil
+
+				break
+			}
+
+			errs = append(errs, sigErr)
+		}
+
+		if len(errs) > 0 {
+			return errors.Join(errs...)
+		}
+	}
+
+	return nil
+}
+
+// validateKeys requests the DNSKEY RRset of zone and validates it using the
+// DS records.  ttl is the TTL of the validated RRset.
+func (v *dnssecValidator) validateKeys(
+	exch dnssecExchangeFunc,
+	zone string,
+	dss []*dns.DS,
+) (keys []*dns.DNSKEY, ttl uint32, err error) {
+	resp, err := exch(newDNSSECRequest(zone, dns.TypeDNSKEY))
+	if err != nil {
+		return nil, 0, fmt.Errorf("requesting dnskey: %w", err)
+	} else if resp.Rcode != dns.RcodeSuccess {
+		return nil, 0, fmt.Errorf("%w: %s", errDNSSECUnexpRcode, dns.RcodeToString[resp.Rcode])
+	}
+
+	var set []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range resp.Answer {
+		if dns.CanonicalName(rr.Header().Name) != zone {
+			continue
+		}
+
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			set = append(set, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+
+	trusted := trustedKeys(keys, dss)
+	if len(trusted) == 0 {
+		return nil, 0, errDNSSECNoKeys
+	}
+
+	for _, sig := range sigs {
+		if v.verify(sig, trusted, set) == nil {
+			return keys, calculateTTL(resp), nil
+		}
+	}
+
+	return nil, 0, errDNSSECNoValidSig
+}
+
+// state returns the stored state for name, if it's not expired.
+func (v *dnssecValidator) state(name string) (st *dnssecState) {
+	v.statesLock.Lock()
+	defer v.statesLock.Unlock()
+
+	st = v.states[name]
+	if st != nil && !v.clock.Now().Before(st.expire) {
+		delete(v.states, name)
+
+		return nil
+	}
+
+	return st
+}
+
+// setState stores st for name for ttl seconds.
+func (v *dnssecValidator) setState(name string, st *dnssecState, ttl uint32) {
+	st.expire = v.clock.Now().Add(min(time.Duration(ttl)*time.Second, maxDNSSECStateTTL))
+
+	v.statesLock.Lock()
+	defer v.statesLock.Unlock()
+
+	if len(v.states) >= maxDNSSECStates {
+		clear(v.states)
+	}
+
+	v.states[name] = st
+}
+
+// isUnsupportedDS returns true if either the algorithm or the digest type of ds
+// isn't supported by the validator.
+func isUnsupportedDS(ds *dns.DS) (ok bool) {
+	switch ds.Algorithm {
+	case
+		dns.RSASHA1,
+		dns.RSASHA1NSEC3SHA1,
+		dns.RSASHA256,
+		dns.RSASHA512,
+		dns.ECDSAP256SHA256,
+		dns.ECDSAP384SHA384,
+		dns.ED25519:
+		// Go on.
+	default:
+		return true
+	}
+
+	switch ds.DigestType {
+	case dns.SHA1, dns.SHA256, dns.SHA384:
+		return false
+	default:
+		return true
+	}
+}
+
+// trustedKeys returns the keys matching any of dss.
+func trustedKeys(keys []*dns.DNSKEY, dss []*dns.DS) (trusted []*dns.DNSKEY) {
+	for _, k := range keys {
+		for _, ds := range dss {
+			if k.Algorithm != ds.Algorithm || k.KeyTag() != ds.KeyTag {
+				continue
+			}
+
+			kds := k.ToDS(ds.DigestType)
+			if kds != nil && strings.EqualFold(kds.Digest, ds.Digest) {
+				trusted = append(trusted, k)
+
+				break
+			}
+		}
+	}
+
+	return trusted
+}
+
+// delegationFromProof returns the kind of name according to the NSEC or NSEC3
+// records within rrs.
+func delegationFromProof(rrs []dns.RR, name string) (kind delegationKind, err error) {
+	for _, rr := range rrs {
+		var bitmap []uint16
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if dns.CanonicalName(rr.Hdr.Name) == name {
+				bitmap = rr.TypeBitMap
+			} else if nsecCovers(rr, name) {
+				// An empty non-terminal.
+				return delegationNone, nil
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				bitmap = rr.TypeBitMap
+			} else if rr.Cover(name) && rr.Flags&nsec3OptOut != 0 {
+				return delegationInsecure, nil
+			}
+		}
+
+		switch {
+		case bitmap == nil:
+			// Go on.
+		case hasType(bitmap, dns.TypeDS):
+			return delegationNone, errDNSSECDSInBitmap
+		case hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA):
+			return delegationInsecure, nil
+		default:
+			return delegationNone, nil
+		}
+	}
+
+	return delegationNone, errDNSSECNoDenial
+}
+
+// hasCNAME returns true if rrs contain a CNAME record owned by name.  name must
+// be canonical.
+func hasCNAME(rrs []dns.RR, name string) (ok bool) {
+	for _, rr := range rrs {
+		if cname, isCNAME := rr.(*dns.CNAME); isCNAME && dns.CanonicalName(cname.Hdr.Name) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nsec3OptOut is the Opt-Out flag of NSEC3 record.
+//
+// See https://datatracker.ietf.org/doc/html/rfc5155#section-3.1.2.1.
+const nsec3OptOut = 1
+
+// hasType returns true if bitmap contains any of types.
+func hasType(bitmap []uint16, types ...uint16) (ok bool) {
+	for _, t := range bitmap {
+		for _, want := range types {
+			if t == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// nsecCovers returns true if name falls between the owner and the next name of
+// nsec in the canonical order.  name must be canonical.
+func nsecCovers(nsec *dns.NSEC, name string) (ok bool) {
+	owner := dns.CanonicalName(nsec.Hdr.Name)
+	next := dns.CanonicalName(nsec.NextDomain)
+
+	if compareCanonical(owner, next) < 0 {
+		return compareCanonical(owner, name) < 0 && compareCanonical(name, next) < 0
+	}
+
+	// The last NSEC in the zone points to the apex.
+	return compareCanonical(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// compareCanonical compares two canonical domain names in the canonical DNS
+// order.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4034#section-6.1.
+func compareCanonical(a, b string) (res int) {
+	al, bl := dns.SplitDomainName(a), dns.SplitDomainName(b)
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if res = strings.Compare(al[i], bl[j]); res != 0 {
+			return res
+		}
+	}
+
+	return len(al) - len(bl)
+}
+
+// parentName returns the name of the parent domain of the canonical name.
+func parentName(name string) (parent string) {
+	_, parent, _ = strings.Cut(name, ".")
+	if parent == "" {
+		return "."
+	}
+
+	return parent
+}
+
+// namesBetween returns the names of subdomains of zone which are the
+// superdomains of name, including name itself, from the closest to zone.
+func namesBetween(zone, name string) (names []string) {
+	if !dns.IsSubDomain(zone, name) {
+		return nil
+	}
+
+	offs := dns.Split(name)
+	zoneLabels := dns.CountLabel(zone)
+	for i := len(offs) - zoneLabels - 1; i >= 0; i-- {
+		names = append(names, name[offs[i]:])
+	}
+
+	return names
+}
+
+// rrsetKey is the key to group resource records into RRsets.
+type rrsetKey struct {
+	name   string
+	rrtype uint16
+}
+
+// newRRsetKey returns the key of the RRset rr belongs to.
+func newRRsetKey(rr dns.RR) (k rrsetKey) {
+	hdr := rr.Header()
+	if sig, ok := rr.(*dns.RRSIG); ok {
+		return rrsetKey{name: dns.CanonicalName(hdr.Name), rrtype: sig.TypeCovered}
+	}
+
+	return rrsetKey{name: dns.CanonicalName(hdr.Name), rrtype: hdr.Rrtype}
+}
+
+// groupRRsets groups the resource records from sections into RRsets and their
+// signatures.  OPT records are skipped.  sets are ordered as they appear.
+func groupRRsets(sections ...[]dns.RR) (sets [][]dns.RR, sigs map[rrsetKey][]*dns.RRSIG) {
+	sigs = map[rrsetKey][]*dns.RRSIG{}
+	indices := map[rrsetKey]int{}
+	for _, sec := range sections {
+		for _, rr := range sec {
+			switch rr := rr.(type) {
+			case *dns.OPT:
+				continue
+			case *dns.RRSIG:
+				k := newRRsetKey(rr)
+				sigs[k] = append(sigs[k], rr)
+
+				continue
+			}
+
+			k := newRRsetKey(rr)
+			if i, ok := indices[k]; ok {
+				sets[i] = append(sets[i], rr)
+			} else {
+				indices[k] = len(sets)
+				sets = append(sets, []dns.RR{rr})
+			}
+		}
+	}
+
+	return sets, sigs
+}
+
+// newDNSSECRequest returns a new request with DO bit set for the name and the
+// type.
+func newDNSSECRequest(name string, qtype uint16) (req *dns.Msg) {
+	req = (&dns.Msg{}).SetQuestion(name, qtype)
+	req.SetEdns0(defaultUDPBufSize, true)
+
+	return req
+}
+
+// dnssecExchange returns the function to request the auxiliary DNSSEC RRsets
+// using the same upstreams as the ones used to resolve dctx.
+func (p *Proxy) dnssecExchange(dctx *DNSContext) (exch dnssecExchangeFunc) {
+	return func(req *dns.Msg) (resp *dns.Msg, err error) {
+		ups, _ := p.selectUpstreams(&DNSContext{
+			Req:                  req,
+			CustomUpstreamConfig: dctx.CustomUpstreamConfig,
+		})
+		if len(ups) == 0 {
+			return nil, upstream.ErrNoUpstreams
+		}
+
+		resp, _, err = p.exchangeUpstreams(req, ups)
+		if err == nil && resp == nil {
+			err = errDNSSECNoResponse
+		}
+
+		return resp, err
+	}
+}
+
+// validateDNSSEC validates the response in dctx and modifies it accordingly.
+// It returns false if the response is bogus and has been replaced with a
+// SERVFAIL one, which shouldn't be cached.
+func (p *Proxy) validateDNSSEC(dctx *DNSContext) (ok bool) {
+	res, err := p.dnssec.validate(p.dnssecExchange(dctx), dctx.Req, dctx.Res)
+	p.logger.Debug("dnssec validation finished", "question", &dctx.Req.Question[0], "result", res)
+
+	switch res {
+	case dnssecSecure:
+		dctx.Res.AuthenticatedData = true
+	case dnssecBogus:
+		p.logger.Debug("bogus response", slogutil.KeyError, err)
+
+		dctx.Res = p.messages.NewMsgSERVFAIL(dctx.Req)
+		dctx.ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeDNSBogus}
+
+		return false
+	default:
+		dctx.Res.AuthenticatedData = false
+	}
+
+	return true
+}
@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"crypto"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZoneSigner signs the resource records of a test zone.
+type testZoneSigner struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+	zone string
+}
+
+// newTestZoneSigner generates a new key for zone and returns a signer using it.
+func newTestZoneSigner(t *testing.T, zone string) (s *testZoneSigner) {
+	t.Helper()
+
+	key := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+
+	priv, err := key.Generate(256)
+	require.NoError(t, err)
+	require.Implements(t, (*crypto.Signer)(nil), priv)
+
+	return &testZoneSigner{
+		key:  key,
+		priv: priv.(crypto.Signer),
+		zone: zone,
+	}
+}
+
+// sign returns the rrset followed by its signature.
+func (s *testZoneSigner) sign(t *testing.T, rrset ...dns.RR) (signed []dns.RR) {
+	t.Helper()
+
+	now := time.Now()
+	sig := &dns.RRSIG{
+		Hdr: dns.RR_Header{
+			Ttl: rrset[0].Header().Ttl,
+		},
+		Algorithm:  s.key.Algorithm,
+		Expiration: uint32(now.Add(time.Hour).Unix()),
+		Inception:  uint32(now.Add(-time.Hour).Unix()),
+		KeyTag:     s.key.KeyTag(),
+		SignerName: s.zone,
+	}
+
+	err := sig.Sign(s.priv, rrset)
+	require.NoError(t, err)
+
+	return append(rrset, sig)
+}
+
+// newTestNSEC returns a new NSEC record for name with the given types.
+func newTestNSEC(name, next string, types ...uint16) (rr *dns.NSEC) {
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// newTestDS returns a new DS record for zone with the given algorithm and
+// digest type and an arbitrary digest.
+func newTestDS(zone string, alg, digestType uint8) (rr *dns.DS) {
+	return &dns.DS{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeDS,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		KeyTag:     1,
+		Algorithm:  alg,
+		DigestType: digestType,
+		Digest:     "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef",
+	}
+}
+
+// newTestExpansion returns the A record for name synthesized from the wildcard
+// immediately above it, followed by its signature.
+func newTestExpansion(t *testing.T, s *testZoneSigner, name string, ip net.IP) (rrs []dns.RR) {
+	t.Helper()
+
+	wildcard := wildcardName(parentName(name))
+	rrs = s.sign(t, newRR(t, wildcard, dns.TypeA, 3600, ip))
+	for _, rr := range rrs {
+		rr.Header().Name = name
+	}
+
+	return rrs
+}
+
+func TestProxy_Resolve_dnssec(t *testing.T) {
+	const (
+		zone         = "example."
+		secureName   = "www.example."
+		bogusName    = "bad.example."
+		unsignedName = "unsigned.example."
+		ntaName      = "nta.example."
+		insecureZone = "sub.example."
+		insecureName = "www.sub.example."
+		unsuppZone   = "unsupp.example."
+		unsuppName   = "www.unsupp.example."
+		missingName  = "missing.example."
+		wildName     = "a.wild.example."
+		noProofName  = "b.wild.example."
+		noAnchorName = "www.other."
+		lastName     = "zz.example."
+	)
+
+	signer := newTestZoneSigner(t, zone)
+	badSigner := newTestZoneSigner(t, zone)
+
+	ip := net.IP{1, 2, 3, 4}
+	soa := newRR(t, zone, dns.TypeSOA, 3600, nil)
+
+	// answers maps the question names to the answer sections for A requests.
+	answers := map[string][]dns.RR{
+		secureName:   signer.sign(t, newRR(t, secureName, dns.TypeA, 3600, ip)),
+		bogusName:    badSigner.sign(t, newRR(t, bogusName, dns.TypeA, 3600, ip)),
+		unsignedName: {newRR(t, unsignedName, dns.TypeA, 3600, ip)},
+		ntaName:      {newRR(t, ntaName, dns.TypeA, 3600, ip)},
+		insecureName: {newRR(t, insecureName, dns.TypeA, 3600, ip)},
+		unsuppName:   {newRR(t, unsuppName, dns.TypeA, 3600, ip)},
+		noAnchorName: {newRR(t, noAnchorName, dns.TypeA, 3600, ip)},
+		wildName:     newTestExpansion(t, signer, wildName, ip),
+		noProofName:  newTestExpansion(t, signer, noProofName, ip),
+	}
+
+	// authorities maps the question names to the authority sections for A
+	// requests.
+	authorities := map[string][]dns.RR{
+		wildName: signer.sign(t, newTestNSEC(
+			"*.wild.example.",
+			lastName,
+			dns.TypeA,
+			dns.TypeRRSIG,
+			dns.TypeNSEC,
+		)),
+	}
+
+	// unsuppDSs are the DS records of unsuppZone with either an unsupported
+	// algorithm or an unsupported digest type.
+	unsuppDSs := []dns.RR{
+		newTestDS(unsuppZone, dns.ED448, dns.SHA256),
+		newTestDS(unsuppZone, dns.ECDSAP256SHA256, dns.GOST94),
+	}
+
+	pt := testutil.PanicT{}
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			q := req.Question[0]
+			resp = (&dns.Msg{}).SetReply(req)
+
+			switch q.Qtype {
+			case dns.TypeDNSKEY:
+				if q.Name == unsuppZone {
+					// The keys must not be requested, so respond with no keys
+					// to make the response bogus otherwise.
+					break
+				}
+
+				require.Equal(pt, zone, q.Name)
+
+				resp.Answer = signer.sign(t, signer.key)
+			case dns.TypeA:
+				ans, ok := answers[q.Name]
+				if ok {
+					resp.Answer = ans
+					resp.Ns = authorities[q.Name]
+				} else {
+					resp.Rcode = dns.RcodeNameError
+					resp.Ns = append(
+						signer.sign(t, soa),
+						signer.sign(t, newTestNSEC(zone, lastName, dns.TypeSOA))...,
+					)
+				}
+			case dns.TypeDS:
+				if q.Name == unsuppZone {
+					resp.Answer = signer.sign(t, unsuppDSs...)
+
+					break
+				}
+
+				types := []uint16{dns.TypeA, dns.TypeRRSIG, dns.TypeNSEC}
+				if q.Name == insecureZone {
+					types = []uint16{dns.TypeNS, dns.TypeRRSIG, dns.TypeNSEC}
+				}
+
+				resp.Ns = append(
+					signer.sign(t, soa),
+					signer.sign(t, newTestNSEC(q.Name, lastName, types...))...,
+				)
+			default:
+				require.Failf(pt, "unexpected question", "%s", q.String())
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+
+		DNSSECValidation:           true,
+		DNSSECTrustAnchors:         []*dns.DS{signer.key.ToDS(dns.SHA256)},
+		DNSSECNegativeTrustAnchors: []string{ntaName},
+	})
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+
+	testCases := []struct {
+		name      string
+		qname     string
+		wantRcode int
+		wantAD    bool
+		wantEDE   bool
+		cd        bool
+	}{{
+		name:      "secure",
+		qname:     secureName,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    true,
+		wantEDE:   false,
+		cd:        false,
+	}, {
+		name:      "secure_nxdomain",
+		qname:     missingName,
+		wantRcode: dns.RcodeNameError,
+		wantAD:    true,
+		wantEDE:   false,
+		cd:        false,
+	}, {
+		name:      "secure_wildcard",
+		qname:     wildName,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    true,
+		wantEDE:   false,
+		cd:        false,
+	}, {
+		name:      "wildcard_no_proof",
+		qname:     noProofName,
+		wantRcode: dns.RcodeServerFailure,
+		wantAD:    false,
+		wantEDE:   true,
+		cd:        false,
+	}, {
+		name:      "bogus",
+		qname:     bogusName,
+		wantRcode: dns.RcodeServerFailure,
+		wantAD:    false,
+		wantEDE:   true,
+		cd:        false,
+	}, {
+		name:      "bogus_cd",
+		qname:     bogusName,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+		wantEDE:   false,
+		cd:        true,
+	}, {
+		name:      "unsigned",
+		qname:     unsignedName,
+		wantRcode: dns.RcodeServerFailure,
+		wantAD:    false,
+		wantEDE:   true,
+		cd:        false,
+	}, {
+		name:      "negative_anchor",
+		qname:     ntaName,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+		wantEDE:   false,
+		cd:        false,
+	}, {
+		name:      "insecure_delegation",
+		qname:     insecureName,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+		wantEDE:   false,
+		cd:        false,
+	}, {
+		name:      "unsupported_ds",
+		qname:     unsuppName,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+		wantEDE:   false,
+		cd:        false,
+	}, {
+		name:      "no_anchor",
+		qname:     noAnchorName,
+		wantRcode: dns.RcodeSuccess,
+		wantAD:    false,
+		wantEDE:   false,
+		cd:        false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.qname, dns.TypeA)
+			req.CheckingDisabled = tc.cd
+			req.SetEdns0(defaultUDPBufSize, true)
+
+			dctx := &DNSContext{Req: req, Addr: cli}
+			err := p.Resolve(dctx)
+			require.NoError(t, err)
+
+			res := dctx.Res
+			require.NotNil(t, res)
+
+			assert.Equal(t, tc.wantRcode, res.Rcode)
+			assert.Equal(t, tc.wantAD, res.AuthenticatedData)
+
+			opt := res.IsEdns0()
+			require.NotNil(t, opt)
+
+			var ede *dns.EDNS0_EDE
+			for _, o := range opt.Option {
+				if e, ok := o.(*dns.EDNS0_EDE); ok {
+					ede = e
+				}
+			}
+
+			if !tc.wantEDE {
+				assert.Nil(t, ede)
+
+				return
+			}
+
+			require.NotNil(t, ede)
+			assert.Equal(t, dns.ExtendedErrorCodeDNSBogus, ede.InfoCode)
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// denialRecords returns the NSEC and NSEC3 records from rrs along with their
+// signatures.
+func denialRecords(rrs []dns.RR) (denial []dns.RR) {
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			t = sig.TypeCovered
+		}
+
+		if t == dns.TypeNSEC || t == dns.TypeNSEC3 {
+			denial = append(denial, rr)
+		}
+	}
+
+	return denial
+}
+
+// splitDenialRecords returns the NSEC and NSEC3 records from rrs.
+func splitDenialRecords(rrs []dns.RR) (nsecs []*dns.NSEC, nsec3s []*dns.NSEC3) {
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			nsecs = append(nsecs, rr)
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+
+	return nsecs, nsec3s
+}
+
+// rrsigLabels returns the number of labels of the canonical name as counted in
+// the Labels field of RRSIG, i.e. not counting the leading wildcard label.
+func rrsigLabels(name string) (n int) {
+	n = dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		n--
+	}
+
+	return n
+}
+
+// isWildcardExpansion returns true if sig is a signature of an RRset owned by
+// name, which is synthesized from a wildcard.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4035#section-5.3.4.
+func isWildcardExpansion(sig *dns.RRSIG, name string) (ok bool) {
+	return int(sig.Labels) < rrsigLabels(dns.CanonicalName(name))
+}
+
+// ancestorName returns the ancestor of the canonical name having n labels.
+func ancestorName(name string, n int) (ancestor string) {
+	offs := dns.Split(name)
+	switch {
+	case n <= 0:
+		return "."
+	case n >= len(offs):
+		return name
+	default:
+		return name[offs[len(offs)-n]:]
+	}
+}
+
+// wildcardName returns the name of the wildcard immediately below the canonical
+// name.
+func wildcardName(name string) (wildcard string) {
+	if name == "." {
+		return "*."
+	}
+
+	return "*." + name
+}
+
+// checkWildcardProof checks that the records in the authority section ns prove
+// that there is no closer match for the name of the RRset signed with sig,
+// which is synthesized from a wildcard.
+//
+// See RFC 4035 Section 5.3.4 and RFC 5155 Section 8.8.
+func checkWildcardProof(ns []dns.RR, sig *dns.RRSIG) (err error) {
+	name := dns.CanonicalName(sig.Hdr.Name)
+	source := ancestorName(name, int(sig.Labels))
+
+	nsecs, nsec3s := splitDenialRecords(ns)
+	if len(nsecs) > 0 {
+		nsec := coveringNSEC(nsecs, name)
+		if nsec == nil {
+			return fmt.Errorf("%w: no nsec covers %q", errDNSSECNoDenial, name)
+		} else if ce := nsecClosestEncloser(nsec, name); ce != source {
+			return fmt.Errorf("%w: closest encloser %q is not %q", errDNSSECNoDenial, ce, source)
+		}
+
+		return nil
+	}
+
+	nextCloser := ancestorName(name, int(sig.Labels)+1)
+	if coveringNSEC3(nsec3s, nextCloser) == nil {
+		return fmt.Errorf("%w: no nsec3 covers next closer %q", errDNSSECNoDenial, nextCloser)
+	}
+
+	return nil
+}
+
+// checkNoDataBitmap checks that bitmap of the NSEC or NSEC3 record matching the
+// name proves that there is no RRset of qtype for it.
+func checkNoDataBitmap(bitmap []uint16, qtype uint16) (err error) {
+	if hasType(bitmap, qtype, dns.TypeCNAME) {
+		return fmt.Errorf("%w: %s", errDNSSECTypeInBitmap, dns.Type(qtype))
+	} else if qtype != dns.TypeDS && isDelegationBitmap(bitmap) {
+		// The record is from the parent side of a zone cut, so it can't prove
+		// anything about the child zone.
+		return errDNSSECDelegation
+	}
+
+	return nil
+}
+
+// isDelegationBitmap returns true if bitmap belongs to a zone cut.
+func isDelegationBitmap(bitmap []uint16) (ok bool) {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// coveringNSEC returns the record from nsecs covering the canonical name, if
+// any.  The records owned by the zone cuts above name are skipped, since those
+// come from the parent zone.
+func coveringNSEC(nsecs []*dns.NSEC, name string) (nsec *dns.NSEC) {
+	for _, n := range nsecs {
+		owner := dns.CanonicalName(n.Hdr.Name)
+		if dns.IsSubDomain(owner, name) &&
+			(isDelegationBitmap(n.TypeBitMap) || hasType(n.TypeBitMap, dns.TypeDNAME)) {
+			continue
+		}
+
+		if nsecCovers(n, name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsecClosestEncloser returns the closest encloser of the canonical name
+// according to nsec covering it.
+func nsecClosestEncloser(nsec *dns.NSEC, name string) (ce string) {
+	n := max(
+		dns.CompareDomainName(name, nsec.Hdr.Name),
+		dns.CompareDomainName(name, nsec.NextDomain),
+	)
+
+	return ancestorName(name, n)
+}
+
+// checkNSECNameError checks that nsecs prove that the canonical name doesn't
+// exist and can't be synthesized from a wildcard.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4035#section-5.4.
+func checkNSECNameError(nsecs []*dns.NSEC, name string) (err error) {
+	nsec := coveringNSEC(nsecs, name)
+	if nsec == nil {
+		return fmt.Errorf("%w: no nsec covers %q", errDNSSECNoDenial, name)
+	} else if dns.IsSubDomain(name, dns.CanonicalName(nsec.NextDomain)) {
+		return fmt.Errorf("%w: %q is an empty non-terminal", errDNSSECNoDenial, name)
+	}
+
+	wildcard := wildcardName(nsecClosestEncloser(nsec, name))
+	if coveringNSEC(nsecs, wildcard) == nil {
+		return fmt.Errorf("%w: no nsec covers wildcard %q", errDNSSECNoDenial, wildcard)
+	}
+
+	return nil
+}
+
+// checkNSECNoData checks that nsecs prove that there is no RRset of qtype for
+// the canonical name, either existing or synthesized from a wildcard.
+//
+// See https://datatracker.ietf.org/doc/html/rfc4035#section-5.4.
+func checkNSECNoData(nsecs []*dns.NSEC, name string, qtype uint16) (err error) {
+	for _, n := range nsecs {
+		if dns.CanonicalName(n.Hdr.Name) == name {
+			return checkNoDataBitmap(n.TypeBitMap, qtype)
+		}
+	}
+
+	nsec := coveringNSEC(nsecs, name)
+	if nsec == nil {
+		return fmt.Errorf("%w: no nsec matches or covers %q", errDNSSECNoDenial, name)
+	} else if dns.IsSubDomain(name, dns.CanonicalName(nsec.NextDomain)) {
+		// An empty non-terminal.
+		return nil
+	}
+
+	wildcard := wildcardName(nsecClosestEncloser(nsec, name))
+	for _, n := range nsecs {
+		if dns.CanonicalName(n.Hdr.Name) == wildcard {
+			return checkNoDataBitmap(n.TypeBitMap, qtype)
+		}
+	}
+
+	return fmt.Errorf("%w: no nsec matches wildcard %q", errDNSSECNoDenial, wildcard)
+}
+
+// matchingNSEC3 returns the record from nsec3s matching the canonical name, if
+// any.
+func matchingNSEC3(nsec3s []*dns.NSEC3, name string) (nsec3 *dns.NSEC3) {
+	for _, n := range nsec3s {
+		if n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// coveringNSEC3 returns the record from nsec3s covering the canonical name, if
+// any.
+func coveringNSEC3(nsec3s []*dns.NSEC3, name string) (nsec3 *dns.NSEC3) {
+	for _, n := range nsec3s {
+		// [dns.NSEC3.Cover] also reports the matching name as covered.
+		if n.Cover(name) && !n.Match(name) {
+			return n
+		}
+	}
+
+	return nil
+}
+
+// nsec3ClosestEncloser returns the closest provable encloser of the canonical
+// name and the record from nsec3s covering the next closer name.
+//
+// See https://datatracker.ietf.org/doc/html/rfc5155#section-8.3.
+func nsec3ClosestEncloser(
+	nsec3s []*dns.NSEC3,
+	name string,
+) (ce string, nextCloser *dns.NSEC3, err error) {
+	next := ""
+	for sname := name; ; sname = parentName(sname) {
+		if m := matchingNSEC3(nsec3s, sname); m != nil {
+			if isDelegationBitmap(m.TypeBitMap) || hasType(m.TypeBitMap, dns.TypeDNAME) {
+				return "", nil, fmt.Errorf("%w: %q", errDNSSECDelegation, sname)
+			} else if next == "" {
+				return "", nil, fmt.Errorf("%w: nsec3 matches %q", errDNSSECNoDenial, name)
+			}
+
+			nextCloser = coveringNSEC3(nsec3s, next)
+			if nextCloser == nil {
+				return "", nil, fmt.Errorf("%w: no nsec3 covers next closer %q", errDNSSECNoDenial, next)
+			}
+
+			return sname, nextCloser, nil
+		}
+
+		if sname == "." {
+			return "", nil, fmt.Errorf("%w: no closest encloser of %q", errDNSSECNoDenial, name)
+		}
+
+		next = sname
+	}
+}
+
+// checkNSEC3NameError checks that nsec3s prove that the canonical name doesn't
+// exist and can't be synthesized from a wildcard.  secure is false if the next
+// closer name is covered by an Opt-Out record, since an unsigned delegation may
+// exist there.
+//
+// See https://datatracker.ietf.org/doc/html/rfc5155#section-8.4.
+func checkNSEC3NameError(nsec3s []*dns.NSEC3, name string) (secure bool, err error) {
+	ce, nextCloser, err := nsec3ClosestEncloser(nsec3s, name)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	}
+
+	wildcard := wildcardName(ce)
+	if coveringNSEC3(nsec3s, wildcard) == nil {
+		return false, fmt.Errorf("%w: no nsec3 covers wildcard %q", errDNSSECNoDenial, wildcard)
+	}
+
+	return nextCloser.Flags&nsec3OptOut == 0, nil
+}
+
+// checkNSEC3NoData checks that nsec3s prove that there is no RRset of qtype for
+// the canonical name, either existing or synthesized from a wildcard.  secure
+// is false if the proof for a DS RRset relies on an Opt-Out record.
+//
+// See RFC 5155 Sections 8.5, 8.6, and 8.7.
+func checkNSEC3NoData(nsec3s []*dns.NSEC3, name string, qtype uint16) (secure bool, err error) {
+	if m := matchingNSEC3(nsec3s, name); m != nil {
+		err = checkNoDataBitmap(m.TypeBitMap, qtype)
+
+		return err == nil, err
+	}
+
+	ce, nextCloser, err := nsec3ClosestEncloser(nsec3s, name)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return false, err
+	} else if qtype == dns.TypeDS && nextCloser.Flags&nsec3OptOut != 0 {
+		return false, nil
+	}
+
+	wildcard := wildcardName(ce)
+	m := matchingNSEC3(nsec3s, wildcard)
+	if m == nil {
+		return false, fmt.Errorf("%w: no nsec3 matches wildcard %q", errDNSSECNoDenial, wildcard)
+	}
+
+	err = checkNoDataBitmap(m.TypeBitMap, qtype)
+
+	return err == nil, err
+}
@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testProofZone is the zone used to test the denial of existence proofs.
+const testProofZone = "example."
+
+// testProofNames maps the names of [testProofZone] to their types.  The empty
+// non-terminal wild.example. only has an NSEC3 record.
+var testProofNames = map[string][]uint16{
+	testProofZone:     {dns.TypeSOA, dns.TypeNS},
+	"www.example.":    {dns.TypeA},
+	"*.wild.example.": {dns.TypeA},
+	"sub.example.":    {dns.TypeNS},
+}
+
+// newTestNSECChain returns the NSEC chain of [testProofZone].
+func newTestNSECChain() (nsecs []*dns.NSEC) {
+	names := make([]string, 0, len(testProofNames))
+	for name := range testProofNames {
+		names = append(names, name)
+	}
+
+	slices.SortFunc(names, compareCanonical)
+	for i, name := range names {
+		next := names[(i+1)%len(names)]
+		nsecs = append(nsecs, newTestNSEC(name, next, testProofNames[name]...))
+	}
+
+	return nsecs
+}
+
+// newTestNSEC3Chain returns the NSEC3 chain of [testProofZone].
+func newTestNSEC3Chain(optOut bool) (nsec3s []*dns.NSEC3) {
+	var flags uint8
+	if optOut {
+		flags = nsec3OptOut
+	}
+
+	names := map[string][]uint16{"wild.example.": nil}
+	hashes := []string{dns.HashName("wild.example.", dns.SHA1, 0, "")}
+	for name, types := range testProofNames {
+		names[name] = types
+		hashes = append(hashes, dns.HashName(name, dns.SHA1, 0, ""))
+	}
+
+	slices.Sort(hashes)
+	for name, types := range names {
+		hash := dns.HashName(name, dns.SHA1, 0, "")
+		i := slices.Index(hashes, hash)
+		nsec3s = append(nsec3s, &dns.NSEC3{
+			Hdr: dns.RR_Header{
+				Name:   strings.ToLower(hash) + "." + testProofZone,
+				Rrtype: dns.TypeNSEC3,
+				Class:  dns.ClassINET,
+				Ttl:    3600,
+			},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			NextDomain: hashes[(i+1)%len(hashes)],
+			TypeBitMap: types,
+		})
+	}
+
+	return nsec3s
+}
+
+func TestCheckNSECNameError(t *testing.T) {
+	nsecs := newTestNSECChain()
+
+	testCases := []struct {
+		name       string
+		qname      string
+		wantErrMsg string
+	}{{
+		name:       "missing",
+		qname:      "missing.example.",
+		wantErrMsg: "",
+	}, {
+		name:       "wildcard",
+		qname:      "a.wild.example.",
+		wantErrMsg: `no denial of existence proof: no nsec covers wildcard "*.wild.example."`,
+	}, {
+		name:       "existing",
+		qname:      "www.example.",
+		wantErrMsg: `no denial of existence proof: no nsec covers "www.example."`,
+	}, {
+		name:       "empty_non_terminal",
+		qname:      "wild.example.",
+		wantErrMsg: `no denial of existence proof: "wild.example." is an empty non-terminal`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkNSECNameError(nsecs, tc.qname)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestCheckNSECNoData(t *testing.T) {
+	nsecs := newTestNSECChain()
+
+	testCases := []struct {
+		name       string
+		qname      string
+		wantErrMsg string
+		qtype      uint16
+	}{{
+		name:       "no_type",
+		qname:      "www.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeAAAA,
+	}, {
+		name:       "has_type",
+		qname:      "www.example.",
+		wantErrMsg: "denial claims type exists: A",
+		qtype:      dns.TypeA,
+	}, {
+		name:       "empty_non_terminal",
+		qname:      "wild.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+	}, {
+		name:       "wildcard_no_type",
+		qname:      "a.wild.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeAAAA,
+	}, {
+		name:       "wildcard_has_type",
+		qname:      "a.wild.example.",
+		wantErrMsg: "denial claims type exists: A",
+		qtype:      dns.TypeA,
+	}, {
+		name:       "missing",
+		qname:      "missing.example.",
+		wantErrMsg: `no denial of existence proof: no nsec matches wildcard "*.example."`,
+		qtype:      dns.TypeA,
+	}, {
+		name:       "delegation",
+		qname:      "sub.example.",
+		wantErrMsg: "denial from delegation point",
+		qtype:      dns.TypeA,
+	}, {
+		name:       "below_delegation",
+		qname:      "www.sub.example.",
+		wantErrMsg: `no denial of existence proof: no nsec matches or covers "www.sub.example."`,
+		qtype:      dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkNSECNoData(nsecs, tc.qname, tc.qtype)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestCheckNSEC3NameError(t *testing.T) {
+	testCases := []struct {
+		name       string
+		qname      string
+		wantErrMsg string
+		optOut     bool
+		wantSecure bool
+	}{{
+		name:       "missing",
+		qname:      "missing.example.",
+		wantErrMsg: "",
+		optOut:     false,
+		wantSecure: true,
+	}, {
+		name:       "missing_opt_out",
+		qname:      "missing.example.",
+		wantErrMsg: "",
+		optOut:     true,
+		wantSecure: false,
+	}, {
+		name:       "wildcard",
+		qname:      "a.wild.example.",
+		wantErrMsg: `no denial of existence proof: no nsec3 covers wildcard "*.wild.example."`,
+		optOut:     false,
+		wantSecure: false,
+	}, {
+		name:       "existing",
+		qname:      "www.example.",
+		wantErrMsg: `no denial of existence proof: nsec3 matches "www.example."`,
+		optOut:     false,
+		wantSecure: false,
+	}, {
+		name:       "below_delegation",
+		qname:      "www.sub.example.",
+		wantErrMsg: `denial from delegation point: "sub.example."`,
+		optOut:     false,
+		wantSecure: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			secure, err := checkNSEC3NameError(newTestNSEC3Chain(tc.optOut), tc.qname)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantSecure, secure)
+		})
+	}
+}
+
+func TestCheckNSEC3NoData(t *testing.T) {
+	testCases := []struct {
+		name       string
+		qname      string
+		wantErrMsg string
+		qtype      uint16
+		optOut     bool
+		wantSecure bool
+	}{{
+		name:       "no_type",
+		qname:      "www.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeAAAA,
+		optOut:     false,
+		wantSecure: true,
+	}, {
+		name:       "has_type",
+		qname:      "www.example.",
+		wantErrMsg: "denial claims type exists: A",
+		qtype:      dns.TypeA,
+		optOut:     false,
+		wantSecure: false,
+	}, {
+		name:       "empty_non_terminal",
+		qname:      "wild.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeA,
+		optOut:     false,
+		wantSecure: true,
+	}, {
+		name:       "wildcard_no_type",
+		qname:      "a.wild.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeAAAA,
+		optOut:     false,
+		wantSecure: true,
+	}, {
+		name:       "wildcard_has_type",
+		qname:      "a.wild.example.",
+		wantErrMsg: "denial claims type exists: A",
+		qtype:      dns.TypeA,
+		optOut:     false,
+		wantSecure: false,
+	}, {
+		name:       "ds_opt_out",
+		qname:      "unsigned.example.",
+		wantErrMsg: "",
+		qtype:      dns.TypeDS,
+		optOut:     true,
+		wantSecure: false,
+	}, {
+		name:       "ds_missing",
+		qname:      "unsigned.example.",
+		wantErrMsg: `no denial of existence proof: no nsec3 matches wildcard "*.example."`,
+		qtype:      dns.TypeDS,
+		optOut:     false,
+		wantSecure: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			nsec3s := newTestNSEC3Chain(tc.optOut)
+			secure, err := checkNSEC3NoData(nsec3s, tc.qname, tc.qtype)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			assert.Equal(t, tc.wantSecure, secure)
+		})
+	}
+}
+
+func TestCheckWildcardProof(t *testing.T) {
+	var nsecProof, nsec3Proof []dns.RR
+	for _, nsec := range newTestNSECChain() {
+		nsecProof = append(nsecProof, nsec)
+	}
+
+	for _, nsec3 := range newTestNSEC3Chain(false) {
+		nsec3Proof = append(nsec3Proof, nsec3)
+	}
+
+	testCases := []struct {
+		name       string
+		owner      string
+		wantErrMsg string
+		proof      []dns.RR
+		labels     uint8
+	}{{
+		name:       "nsec",
+		owner:      "a.wild.example.",
+		wantErrMsg: "",
+		proof:      nsecProof,
+		labels:     2,
+	}, {
+		name:       "nsec_existing",
+		owner:      "www.example.",
+		wantErrMsg: `no denial of existence proof: no nsec covers "www.example."`,
+		proof:      nsecProof,
+		labels:     1,
+	}, {
+		name:  "nsec_closer",
+		owner: "a.wild.example.",
+		wantErrMsg: `no denial of existence proof: ` +
+			`closest encloser "wild.example." is not "example."`,
+		proof:  nsecProof,
+		labels: 1,
+	}, {
+		name:       "nsec3",
+		owner:      "a.wild.example.",
+		wantErrMsg: "",
+		proof:      nsec3Proof,
+		labels:     2,
+	}, {
+		name:       "nsec3_existing",
+		owner:      "www.example.",
+		wantErrMsg: `no denial of existence proof: no nsec3 covers next closer "www.example."`,
+		proof:      nsec3Proof,
+		labels:     1,
+	}, {
+		name:       "no_proof",
+		owner:      "a.wild.example.",
+		wantErrMsg: `no denial of existence proof: no nsec3 covers next closer "a.wild.example."`,
+		proof:      nil,
+		labels:     2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sig := &dns.RRSIG{
+				Hdr: dns.RR_Header{
+					Name:   tc.owner,
+					Rrtype: dns.TypeRRSIG,
+					Class:  dns.ClassINET,
+				},
+				TypeCovered: dns.TypeA,
+				Labels:      tc.labels,
+			}
+
+			assert.True(t, isWildcardExpansion(sig, tc.owner))
+
+			err := checkWildcardProof(tc.proof, sig)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -1,7 +1,9 @@
 package proxy
 
 import (
+	"cmp"
 	"fmt"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -13,21 +15,62 @@ import (
 
 // exchangeUpstreams resolves req using the given upstreams.  It returns the DNS
 // response, the upstream that successfully resolved the request, and the error
-// if any.
+// if any.  The upstreams of each priority tier are only used if all the
+// upstreams of the previous tiers failed.
 func (p *Proxy) exchangeUpstreams(
 	req *dns.Msg,
 	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	tiers := upstreamTiers(ups)
+	if len(tiers) == 1 {
+		return p.exchangeTier(req, ups)
+	}
+
+	var errs []error
+	for _, tier := range tiers {
+		resp, u, err = p.exchangeTier(req, tier)
+		if err == nil {
+			return resp, u, nil
+		}
+
+		p.logger.Debug("upstream tier failed", "tier", upstreamTier(tier[0]), slogutil.KeyError, err)
+
+		errs = append(errs, err)
+	}
+
+	return nil, nil, fmt.Errorf("all upstream tiers failed: %w", errors.Join(errs...))
+}
+
+// exchangeTier resolves req using the upstreams of a single priority tier
+// according to the upstream mode.
+func (p *Proxy) exchangeTier(
+	req *dns.Msg,
+	ups []upstream.Upstream,
 ) (resp *dns.Msg, u upstream.Upstream, err error) {
 	switch p.UpstreamMode {
 	case UpstreamModeParallel:
-		return upstream.ExchangeParallel(ups, req)
+		return p.exchangeParallel(ups, req)
 	case UpstreamModeFastestAddr:
 		switch req.Question[0].Qtype {
 		case dns.TypeA, dns.TypeAAAA:
-			return p.fastestAddr.ExchangeFastest(req, ups)
+			resp, u, err = p.fastestAddr.ExchangeFastest(req, p.checkedUpstreams(ups))
+
+			return resp, uncheckedUpstream(u), err
 		default:
 			// Go on to the load-balancing mode.
 		}
+	case UpstreamModeHedged:
+		if len(ups) > 1 {
+			return p.exchangeHedged(req, ups)
+		}
+	case UpstreamModeStrictOrder:
+		if len(ups) > 1 {
+			return p.exchangeInOrder(req, ups)
+		}
+	case UpstreamModeRoundRobin:
+		if len(ups) > 1 {
+			return p.exchangeInOrder(req, p.rotateUpstreams(ups))
+		}
 	default:
 		// Go on to the load-balancing mode.
 	}
@@ -47,17 +90,35 @@ func (p *Proxy) exchangeUpstreams(
 
 		var elapsed time.Duration
 		resp, elapsed, err = p.exchange(u, req, p.time)
+		p.updateStats(u.Address(), elapsed, err != nil)
 		if err == nil {
-			p.updateRTT(u.Address(), elapsed)
-
 			return resp, u, nil
 		}
 
 		errs = append(errs, err)
+	}
+
+	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
+
+	return nil, nil, err
+}
 
-		// TODO(e.burkov):  Use the actual configured timeout or, perhaps, the
-		// actual measured elapsed time.
-		p.updateRTT(u.Address(), defaultTimeout)
+// exchangeInOrder resolves req using ups one by one in the given order.  It
+// returns the first successful response.
+func (p *Proxy) exchangeInOrder(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	var errs []error
+	for _, u = range ups {
+		var elapsed time.Duration
+		resp, elapsed, err = p.exchange(u, req, p.time)
+		p.updateStats(u.Address(), elapsed, err != nil)
+		if err == nil {
+			return resp, u, nil
+		}
+
+		errs = append(errs, err)
 	}
 
 	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
@@ -65,6 +126,17 @@ func (p *Proxy) exchangeUpstreams(
 	return nil, nil, err
 }
 
+// rotateUpstreams returns a copy of ups rotated so that each call starts with
+// the upstream following the one the previous call started with.
+func (p *Proxy) rotateUpstreams(ups []upstream.Upstream) (rotated []upstream.Upstream) {
+	i := int((p.roundRobinIdx.Add(1) - 1) % uint64(len(ups)))
+
+	rotated = make([]upstream.Upstream, 0, len(ups))
+	rotated = append(rotated, ups[i:]...)
+
+	return append(rotated, ups[:i]...)
+}
+
 // exchange returns the result of the DNS request exchange with the given
 // upstream and the elapsed time in milliseconds.  It uses the given clock to
 // measure the request duration.
@@ -75,6 +147,12 @@ func (p *Proxy) exchange(
 ) (resp *dns.Msg, dur time.Duration, err error) {
 	startTime := c.Now()
 	resp, err = u.Exchange(req)
+	if err == nil {
+		err = p.checkResponse(u, req, resp)
+		if err != nil {
+			resp = nil
+		}
+	}
 
 	// Don't use [time.Since] because it uses [time.Now].
 	dur = c.Now().Sub(startTime)
@@ -101,56 +179,150 @@ func (p *Proxy) exchange(
 	return resp, dur, err
 }
 
-// upstreamRTTStats is the statistics for a single upstream's round-trip time.
+// defaultStatsDecay is the default smoothing factor of the upstream
+// statistics.
+const defaultStatsDecay = 0.05
+
+// upstreamRTTStats is the decaying statistics of a single upstream's
+// round-trip time and error rate.  The values are exponentially weighted moving
+// averages, which are the plain averages until the number of samples reaches
+// the reciprocal of the smoothing factor.
 type upstreamRTTStats struct {
-	// rttSum is the sum of all the round-trip times in microseconds.  The
-	// float64 type is used since it's capable of representing about 285 years
-	// in microseconds.
-	rttSum float64
+	// rtt is the average round-trip time of the successful requests in
+	// microseconds.
+	rtt float64
+
+	// errRate is the average rate of the failed requests, from 0 to 1.
+	errRate float64
+
+	// rttNum is the number of the successful requests to the upstream.  The
+	// float64 type is used to avoid unnecessary type conversions.
+	rttNum float64
 
 	// reqNum is the number of requests to the upstream.  The float64 type is
-	// used since to avoid unnecessary type conversions.
+	// used to avoid unnecessary type conversions.
 	reqNum float64
 }
 
-// update returns updated stats after adding given RTT.
-func (stats upstreamRTTStats) update(rtt time.Duration) (updated upstreamRTTStats) {
-	return upstreamRTTStats{
-		rttSum: stats.rttSum + float64(rtt.Microseconds()),
+// update returns updated stats after adding the result of a request that took
+// rtt and failed if failed is true.  decay is the smoothing factor.
+func (stats *upstreamRTTStats) update(
+	rtt time.Duration,
+	failed bool,
+	decay float64,
+) (updated *upstreamRTTStats) {
+	updated = &upstreamRTTStats{
+		rtt:    stats.rtt,
+		rttNum: stats.rttNum,
 		reqNum: stats.reqNum + 1,
 	}
+
+	var failure float64
+	if failed {
+		failure = 1
+	} else {
+		updated.rttNum++
+		updated.rtt = ewma(stats.rtt, float64(rtt.Microseconds()), updated.rttNum, decay)
+	}
+
+	updated.errRate = ewma(stats.errRate, failure, updated.reqNum, decay)
+
+	return updated
+}
+
+// ewma returns the exponentially weighted moving average avg updated with the
+// n-th sample val.  The plain average is used while 1/n is greater than the
+// smoothing factor decay.
+func ewma(avg, val, n, decay float64) (updated float64) {
+	alpha := max(1/n, decay)
+
+	return avg + alpha*(val-avg)
+}
+
+// weight returns the weight of the upstream with stats, inversely proportional
+// to its expected round-trip time.  Each failed request is considered to take
+// [defaultTimeout].
+//
+// TODO(e.burkov):  Use the actual configured timeout.
+func (stats *upstreamRTTStats) weight() (w float64) {
+	const timeoutMicro = float64(defaultTimeout / time.Microsecond)
+
+	expected := (1-stats.errRate)*stats.rtt + stats.errRate*timeoutMicro
+	if expected == 0 {
+		// Use 1 as the default weight.
+		return 1
+	}
+
+	return 1 / expected
+}
+
+// upstreamStats holds the statistics of a single upstream.  It's safe for
+// concurrent use.
+type upstreamStats struct {
+	// current is the current statistics, replaced entirely on each update so
+	// that reading it never blocks.
+	current atomic.Pointer[upstreamRTTStats]
+
+	// latencies are the round-trip times of the recent successful requests,
+	// used to calculate the hedging delay in [UpstreamModeHedged].  It is
+	// never nil.
+	latencies *latencyWindow
 }
 
 // calcWeights returns the slice of weights, each corresponding to the upstream
-// with the same index in the given slice.
+// with the same index in the given slice.  The weight calculated from the
+// statistics is multiplied by the static weight of the upstream.
 func (p *Proxy) calcWeights(ups []upstream.Upstream) (weights []float64) {
 	weights = make([]float64, 0, len(ups))
 
-	p.rttLock.Lock()
-	defer p.rttLock.Unlock()
+	p.rttLock.RLock()
+	defer p.rttLock.RUnlock()
 
 	for _, u := range ups {
-		stat := p.upstreamRTTStats[u.Address()]
-		if stat.rttSum == 0 || stat.reqNum == 0 {
-			// Use 1 as the default weight.
-			weights = append(weights, 1)
-		} else {
-			weights = append(weights, 1/(stat.rttSum/stat.reqNum))
+		w := upstreamWeight(u)
+		if us := p.upstreamRTTStats[u.Address()]; us != nil {
+			w *= us.current.Load().weight()
 		}
+
+		weights = append(weights, w)
 	}
 
 	return weights
 }
 
-// updateRTT updates the round-trip time in [upstreamRTTStats] for given
-// address.
-func (p *Proxy) updateRTT(address string, rtt time.Duration) {
-	p.rttLock.Lock()
-	defer p.rttLock.Unlock()
+// updateStats updates the statistics in [upstreamRTTStats] for given address
+// with the result of a request that took rtt and failed if failed is true.
+func (p *Proxy) updateStats(address string, rtt time.Duration, failed bool) {
+	p.rttLock.RLock()
+	us := p.upstreamRTTStats[address]
+	p.rttLock.RUnlock()
+
+	if us == nil {
+		p.rttLock.Lock()
+		if p.upstreamRTTStats == nil {
+			p.upstreamRTTStats = map[string]*upstreamStats{}
+		}
+
+		us = p.upstreamRTTStats[address]
+		if us == nil {
+			us = &upstreamStats{
+				latencies: newLatencyWindow(),
+			}
+			us.current.Store(&upstreamRTTStats{})
+			p.upstreamRTTStats[address] = us
+		}
+		p.rttLock.Unlock()
+	}
 
-	if p.upstreamRTTStats == nil {
-		p.upstreamRTTStats = map[string]upstreamRTTStats{}
+	if !failed {
+		us.latencies.add(rtt)
 	}
 
-	p.upstreamRTTStats[address] = p.upstreamRTTStats[address].update(rtt)
+	decay := cmp.Or(p.UpstreamStatsDecay, defaultStatsDecay)
+	for {
+		cur := us.current.Load()
+		if us.current.CompareAndSwap(cur, cur.update(rtt, failed, decay)) {
+			return
+		}
+	}
 }
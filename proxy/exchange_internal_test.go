@@ -10,8 +10,10 @@ import (
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/rand"
 )
 
@@ -184,18 +186,18 @@ func TestProxy_Exchange_loadBalance(t *testing.T) {
 		servers: []upstream.Upstream{err2Ups, err1Ups},
 	}, {
 		wantStat: map[string]int64{
-			fastUps.Address():    7803,
-			slowerUps.Address():  833,
-			fastestUps.Address(): 1365,
+			fastUps.Address():    5481,
+			slowerUps.Address():  612,
+			fastestUps.Address(): 3908,
 		},
 		clock:   zeroingClock,
 		name:    "error_once",
 		servers: []upstream.Upstream{fastUps, slowerUps, fastestUps},
 	}, {
 		wantStat: map[string]int64{
-			each200.Address(): 5316,
-			each100.Address(): 3090,
-			each50.Address():  1683,
+			each200.Address(): 5295,
+			each100.Address(): 3027,
+			each50.Address():  1769,
 		},
 		clock:   constClock,
 		name:    "error_each_nth",
@@ -240,3 +242,285 @@ func TestProxy_Exchange_loadBalance(t *testing.T) {
 		})
 	}
 }
+
+func TestUpstreamRTTStats_update(t *testing.T) {
+	const (
+		fastRTT = 1 * time.Millisecond
+		slowRTT = 100 * time.Millisecond
+
+		samplesNum = 100
+	)
+
+	testCases := []struct {
+		name        string
+		wantRTT     float64
+		wantErrRate float64
+		decay       float64
+	}{{
+		name:        "cumulative",
+		wantRTT:     float64((fastRTT + slowRTT) / 2 / time.Microsecond),
+		wantErrRate: 1.0 / 3,
+		decay:       0,
+	}, {
+		name:        "decaying",
+		wantRTT:     float64(slowRTT / time.Microsecond),
+		wantErrRate: 0.5,
+		decay:       0.05,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stats := &upstreamRTTStats{}
+			for range samplesNum {
+				stats = stats.update(fastRTT, false, tc.decay)
+			}
+
+			for range samplesNum {
+				stats = stats.update(slowRTT, false, tc.decay)
+				stats = stats.update(0, true, tc.decay)
+			}
+
+			assert.InDelta(t, tc.wantRTT, stats.rtt, float64(slowRTT/time.Microsecond)/100)
+			assert.InDelta(t, tc.wantErrRate, stats.errRate, 0.03)
+		})
+	}
+}
+
+func TestProxy_Exchange_tiers(t *testing.T) {
+	stats := map[string]int64{}
+	newMeasured := func(name string, fail bool) (u upstream.Upstream) {
+		return measuredUpstream{
+			Upstream: &fakeUpstream{
+				onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					if fail {
+						return nil, assert.AnError
+					}
+
+					return (&dns.Msg{}).SetReply(req), nil
+				},
+				onAddress: func() (addr string) { return name },
+				onClose:   func() (_ error) { panic("not implemented") },
+			},
+			stats: stats,
+		}
+	}
+
+	good1 := newMeasured("good1", false)
+	good2 := newMeasured("good2", false)
+	bad1 := newMeasured("bad1", true)
+	bad2 := newMeasured("bad2", true)
+
+	testCases := []struct {
+		wantStat   map[string]int64
+		name       string
+		wantErrMsg string
+		wantAddr   string
+		servers    []upstream.Upstream
+	}{{
+		wantStat:   map[string]int64{"good1": 1},
+		name:       "first_tier",
+		wantErrMsg: "",
+		wantAddr:   "good1",
+		servers: []upstream.Upstream{
+			&WeightedUpstream{Upstream: good2, Tier: 2},
+			good1,
+		},
+	}, {
+		wantStat:   map[string]int64{"bad1": 1, "bad2": 1, "good2": 1},
+		name:       "second_tier",
+		wantErrMsg: "",
+		wantAddr:   "good2",
+		servers: []upstream.Upstream{
+			&WeightedUpstream{Upstream: good2, Tier: 2},
+			&WeightedUpstream{Upstream: bad1, Tier: 1},
+			bad2,
+		},
+	}, {
+		wantStat: map[string]int64{"bad1": 1, "bad2": 1},
+		name:     "all_bad",
+		wantErrMsg: "all upstream tiers failed: " +
+			assert.AnError.Error() + "\n" + assert.AnError.Error(),
+		wantAddr: "",
+		servers: []upstream.Upstream{
+			&WeightedUpstream{Upstream: bad2, Tier: 3},
+			bad1,
+		},
+	}}
+
+	req := newTestMessage()
+
+	for _, tc := range testCases {
+		p := mustNew(t, &Config{
+			Logger:        slogutil.NewDiscardLogger(),
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: tc.servers,
+			},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+		})
+
+		t.Run(tc.name, func(t *testing.T) {
+			clear(stats)
+
+			_, u, err := p.exchangeUpstreams(req, tc.servers)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.wantAddr != "" {
+				assert.Equal(t, tc.wantAddr, u.Address())
+			}
+
+			assert.Equal(t, tc.wantStat, stats)
+		})
+	}
+}
+
+func TestProxy_Exchange_weights(t *testing.T) {
+	const requestsNum = 10_000
+
+	stats := map[string]int64{}
+	newMeasured := func(name string) (u upstream.Upstream) {
+		return measuredUpstream{
+			Upstream: &fakeUpstream{
+				onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					return (&dns.Msg{}).SetReply(req), nil
+				},
+				onAddress: func() (addr string) { return name },
+				onClose:   func() (_ error) { panic("not implemented") },
+			},
+			stats: stats,
+		}
+	}
+
+	ups := []upstream.Upstream{
+		newMeasured("default"),
+		&WeightedUpstream{Upstream: newMeasured("heavy"), Weight: 3},
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: ups,
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	// Make the test deterministic and make all the upstreams respond
+	// instantly, so that only the static weights matter.
+	p.randSrc = rand.NewSource(42)
+	p.time = &fakeClock{
+		onNow: func() (now time.Time) { return time.Unix(0, 0) },
+	}
+
+	req := newTestMessage()
+	for range requestsNum {
+		_, _, err := p.exchangeUpstreams(req, ups)
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, map[string]int64{"default": 2477, "heavy": 7523}, stats)
+}
+
+func TestProxy_Exchange_ordered(t *testing.T) {
+	stats := map[string]int64{}
+	newMeasured := func(name string, fail bool) (u upstream.Upstream) {
+		return measuredUpstream{
+			Upstream: &fakeUpstream{
+				onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+					if fail {
+						return nil, assert.AnError
+					}
+
+					return (&dns.Msg{}).SetReply(req), nil
+				},
+				onAddress: func() (addr string) { return name },
+				onClose:   func() (_ error) { panic("not implemented") },
+			},
+			stats: stats,
+		}
+	}
+
+	ups := []upstream.Upstream{
+		newMeasured("first", false),
+		newMeasured("bad", true),
+		newMeasured("third", false),
+	}
+
+	testCases := []struct {
+		wantStat  map[string]int64
+		name      string
+		mode      UpstreamMode
+		wantAddrs []string
+	}{{
+		wantStat:  map[string]int64{"first": 6},
+		name:      "strict_order",
+		mode:      UpstreamModeStrictOrder,
+		wantAddrs: []string{"first", "first", "first", "first", "first", "first"},
+	}, {
+		wantStat:  map[string]int64{"first": 2, "bad": 2, "third": 4},
+		name:      "round_robin",
+		mode:      UpstreamModeRoundRobin,
+		wantAddrs: []string{"first", "third", "third", "first", "third", "third"},
+	}}
+
+	req := newTestMessage()
+
+	for _, tc := range testCases {
+		p := mustNew(t, &Config{
+			Logger:        slogutil.NewDiscardLogger(),
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: ups,
+			},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			UpstreamMode:           tc.mode,
+		})
+
+		t.Run(tc.name, func(t *testing.T) {
+			clear(stats)
+
+			addrs := make([]string, 0, len(tc.wantAddrs))
+			for range tc.wantAddrs {
+				_, u, err := p.exchangeUpstreams(req, ups)
+				require.NoError(t, err)
+
+				addrs = append(addrs, u.Address())
+			}
+
+			assert.Equal(t, tc.wantAddrs, addrs)
+			assert.Equal(t, tc.wantStat, stats)
+		})
+	}
+
+	t.Run("all_fail", func(t *testing.T) {
+		p := mustNew(t, &Config{
+			Logger:        slogutil.NewDiscardLogger(),
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: ups,
+			},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			UpstreamMode:           UpstreamModeStrictOrder,
+		})
+
+		bad := []upstream.Upstream{ups[1], ups[1]}
+		_, _, err := p.exchangeUpstreams(req, bad)
+		testutil.AssertErrorMsg(
+			t,
+			"all upstreams failed to exchange request: "+
+				assert.AnError.Error()+"\n"+assert.AnError.Error(),
+			err,
+		)
+	})
+}
@@ -0,0 +1,360 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// defaultHealthCheckFailures is the default number of consecutive failed
+// probes after which an upstream is considered unhealthy.
+const defaultHealthCheckFailures = 3
+
+// HealthCheckConfig is the configuration of the active health checks of the
+// upstreams.
+type HealthCheckConfig struct {
+	// Domain is the domain name queried to probe the upstreams.  If empty, the
+	// root domain is used.
+	Domain string
+
+	// Interval is the interval between the probes.  It must be positive.
+	Interval time.Duration
+
+	// FailureThreshold is the number of consecutive failed probes after which
+	// an upstream is considered unhealthy and isn't used until a probe
+	// succeeds again.  If zero, 3 is used.
+	FailureThreshold uint
+
+	// Qtype is the type of the probing query.  If zero, [dns.TypeNS] is used.
+	Qtype uint16
+}
+
+// UpstreamHealth is the state of the health checks of a single upstream.
+type UpstreamHealth struct {
+	// LastCheck is the time of the last probe of the upstream.  It's zero if
+	// the upstream hasn't been probed yet.
+	LastCheck time.Time
+
+	// LastError is the error of the last probe of the upstream.  It's nil if
+	// the probe succeeded.
+	LastError error
+
+	// Address is the address of the upstream.
+	Address string
+
+	// ConsecutiveFailures is the number of the failed probes since the last
+	// successful one.
+	ConsecutiveFailures uint
+
+	// Healthy is false if the upstream is excluded from use due to the failed
+	// probes.
+	Healthy bool
+}
+
+// upstreamHealth is the mutable state of the health checks of a single
+// upstream.
+type upstreamHealth struct {
+	// lastCheck is the time of the last probe.
+	lastCheck time.Time
+
+	// lastErr is the error of the last probe.
+	lastErr error
+
+	// failures is the number of the failed probes since the last successful
+	// one.
+	failures uint
+}
+
+// healthChecker periodically probes the upstreams and tracks their health,
+// opening the circuit for the upstreams failing repeatedly.  It's safe for
+// concurrent use.
+type healthChecker struct {
+	// logger is used to log the health changes.  It is never nil.
+	logger *slog.Logger
+
+	// clock is used to get the time of the probes.
+	clock clock
+
+	// mu protects states and done.
+	mu *sync.RWMutex
+
+	// states maps the addresses of the upstreams to their health states.
+	states map[string]*upstreamHealth
+
+	// done is closed to stop the health checks.  It's nil if the checker isn't
+	// running.
+	done chan unit
+
+	// domain is the domain name of the probing query.
+	domain string
+
+	// ups are the probed upstreams with unique addresses.
+	ups []upstream.Upstream
+
+	// interval is the interval between the probes.
+	interval time.Duration
+
+	// threshold is the number of consecutive failed probes after which an
+	// upstream is considered unhealthy.
+	threshold uint
+
+	// qtype is the type of the probing query.
+	qtype uint16
+}
+
+// newHealthChecker returns a new properly initialized *healthChecker probing
+// ups.  conf must not be nil.
+func newHealthChecker(
+	l *slog.Logger,
+	c clock,
+	conf *HealthCheckConfig,
+	ups []upstream.Upstream,
+) (hc *healthChecker, err error) {
+	if conf.Interval <= 0 {
+		return nil, fmt.Errorf("interval %s: %w", conf.Interval, errors.Error("must be positive"))
+	}
+
+	domain := dns.Fqdn(strings.ToLower(conf.Domain))
+	if domain != "." {
+		err = netutil.ValidateDomainName(strings.TrimSuffix(domain, "."))
+		if err != nil {
+			return nil, fmt.Errorf("domain: %w", err)
+		}
+	}
+
+	hc = &healthChecker{
+		logger:    l,
+		clock:     c,
+		mu:        &sync.RWMutex{},
+		states:    map[string]*upstreamHealth{},
+		domain:    domain,
+		interval:  conf.Interval,
+		threshold: cmp.Or(conf.FailureThreshold, defaultHealthCheckFailures),
+		qtype:     cmp.Or(conf.Qtype, dns.TypeNS),
+	}
+
+	for _, u := range ups {
+		addr := u.Address()
+		if _, ok := hc.states[addr]; !ok {
+			hc.states[addr] = &upstreamHealth{}
+			hc.ups = append(hc.ups, u)
+		}
+	}
+
+	return hc, nil
+}
+
+// start starts the health checks in a separate goroutine.  It must not be
+// called concurrently with stop.
+func (hc *healthChecker) start() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if hc.done != nil {
+		return
+	}
+
+	hc.done = make(chan unit)
+
+	go hc.loop(hc.done)
+}
+
+// stop stops the health checks.  It must not be called concurrently with
+// start.
+func (hc *healthChecker) stop() {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if hc.done != nil {
+		close(hc.done)
+		hc.done = nil
+	}
+}
+
+// loop probes the upstreams immediately and then each interval until done is
+// closed.
+func (hc *healthChecker) loop(done chan unit) {
+	defer slogutil.RecoverAndLog(context.TODO(), hc.logger)
+
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		hc.check()
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			// Go on.
+		}
+	}
+}
+
+// check probes all the upstreams concurrently and updates their states.
+func (hc *healthChecker) check() {
+	errs := make([]error, len(hc.ups))
+
+	wg := &sync.WaitGroup{}
+	for i, u := range hc.ups {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			defer slogutil.RecoverAndLog(context.TODO(), hc.logger)
+
+			errs[i] = hc.probe(u)
+		}()
+	}
+
+	wg.Wait()
+
+	now := hc.clock.Now()
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	for i, u := range hc.ups {
+		hc.update(u.Address(), errs[i], now)
+	}
+}
+
+// probe sends the probing query to u and returns an error if it fails.
+func (hc *healthChecker) probe(u upstream.Upstream) (err error) {
+	req := (&dns.Msg{}).SetQuestion(hc.domain, hc.qtype)
+
+	resp, err := u.Exchange(req)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	switch resp.Rcode {
+	case dns.RcodeServerFailure, dns.RcodeRefused:
+		return fmt.Errorf("bad rcode: %s", dns.RcodeToString[resp.Rcode])
+	default:
+		return nil
+	}
+}
+
+// update sets the result of the probe of the upstream with addr into its state
+// and logs the changes of its health.  hc.mu must be locked.
+func (hc *healthChecker) update(addr string, probeErr error, now time.Time) {
+	st := hc.states[addr]
+	wasHealthy := st.failures < hc.threshold
+
+	st.lastCheck, st.lastErr = now, probeErr
+	if probeErr == nil {
+		st.failures = 0
+	} else {
+		st.failures++
+	}
+
+	switch isHealthy := st.failures < hc.threshold; {
+	case wasHealthy && !isHealthy:
+		hc.logger.Warn("upstream is unhealthy", "upstream", addr, slogutil.KeyError, probeErr)
+	case !wasHealthy && isHealthy:
+		hc.logger.Info("upstream is healthy again", "upstream", addr)
+	case probeErr != nil:
+		hc.logger.Debug("probe failed", "upstream", addr, slogutil.KeyError, probeErr)
+	default:
+		// Go on.
+	}
+}
+
+// isHealthy returns false if u has failed too many probes.  hc.mu must be
+// locked for reading.
+func (hc *healthChecker) isHealthy(u upstream.Upstream) (ok bool) {
+	st := hc.states[u.Address()]
+
+	return st == nil || st.failures < hc.threshold
+}
+
+// filter returns the healthy upstreams of ups.  It returns ups itself if all
+// of those are healthy or if none of them are, so that the requests are still
+// attempted.
+func (hc *healthChecker) filter(ups []upstream.Upstream) (healthy []upstream.Upstream) {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	if !slices.ContainsFunc(ups, func(u upstream.Upstream) (ok bool) { return !hc.isHealthy(u) }) {
+		return ups
+	}
+
+	healthy = make([]upstream.Upstream, 0, len(ups))
+	for _, u := range ups {
+		if hc.isHealthy(u) {
+			healthy = append(healthy, u)
+		}
+	}
+
+	if len(healthy) == 0 {
+		return ups
+	}
+
+	return healthy
+}
+
+// health returns the health states of all the probed upstreams sorted by their
+// addresses.
+func (hc *healthChecker) health() (hs []*UpstreamHealth) {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	hs = make([]*UpstreamHealth, 0, len(hc.states))
+	for addr, st := range hc.states {
+		hs = append(hs, &UpstreamHealth{
+			LastCheck:           st.lastCheck,
+			LastError:           st.lastErr,
+			Address:             addr,
+			ConsecutiveFailures: st.failures,
+			Healthy:             st.failures < hc.threshold,
+		})
+	}
+
+	slices.SortFunc(hs, func(a, b *UpstreamHealth) (res int) {
+		return strings.Compare(a.Address, b.Address)
+	})
+
+	return hs
+}
+
+// initHealthChecker sets up the health checks of the upstreams of p, if
+// configured.
+func (p *Proxy) initHealthChecker() (err error) {
+	if p.HealthCheck == nil {
+		return nil
+	}
+
+	ups := p.UpstreamConfig.appendAll(nil)
+	ups = p.PrivateRDNSUpstreamConfig.appendAll(ups)
+	for _, v := range p.views {
+		ups = v.upstream.upstream.appendAll(ups)
+	}
+
+	p.health, err = newHealthChecker(p.logger, p.time, p.HealthCheck, ups)
+
+	// Don't wrap the error since it's informative enough as is.
+	return err
+}
+
+// UpstreamsHealth returns the health states of the upstreams of p sorted by
+// their addresses.  It returns nil if the health checks are disabled.
+func (p *Proxy) UpstreamsHealth() (hs []*UpstreamHealth) {
+	if p.health == nil {
+		return nil
+	}
+
+	return p.health.health()
+}
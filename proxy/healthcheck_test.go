@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newProbedUpstream returns a fake upstream with addr answering the requests
+// with an error while failing is true.
+func newProbedUpstream(addr string, failing *atomic.Bool) (ups *fakeUpstream) {
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if failing.Load() {
+				return nil, assert.AnError
+			}
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (a string) { return addr },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_UpstreamsHealth(t *testing.T) {
+	badFailing, goodFailing := &atomic.Bool{}, &atomic.Bool{}
+	badFailing.Store(true)
+
+	bad := newProbedUpstream("bad", badFailing)
+	good := newProbedUpstream("good", goodFailing)
+
+	checkTime := time.Unix(1, 0)
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{bad, good},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		HealthCheck: &HealthCheckConfig{
+			Interval:         time.Hour,
+			FailureThreshold: 2,
+		},
+	})
+	p.health.clock = &fakeClock{onNow: func() (now time.Time) { return checkTime }}
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+	selectAddrs := func(t *testing.T, want []string) {
+		t.Helper()
+
+		ups, _ := p.selectUpstreams(&DNSContext{
+			Req:  newReq("example.", dns.TypeA, dns.ClassINET),
+			Addr: cli,
+		})
+		assertUpstreamsAddrs(t, ups, want)
+	}
+
+	require.Equal(t, []*UpstreamHealth{{
+		Address: "bad",
+		Healthy: true,
+	}, {
+		Address: "good",
+		Healthy: true,
+	}}, p.UpstreamsHealth())
+
+	t.Run("single_failure", func(t *testing.T) {
+		p.health.check()
+
+		selectAddrs(t, []string{"bad", "good"})
+	})
+
+	t.Run("open", func(t *testing.T) {
+		p.health.check()
+
+		assert.Equal(t, []*UpstreamHealth{{
+			LastCheck:           checkTime,
+			LastError:           assert.AnError,
+			Address:             "bad",
+			ConsecutiveFailures: 2,
+			Healthy:             false,
+		}, {
+			LastCheck: checkTime,
+			Address:   "good",
+			Healthy:   true,
+		}}, p.UpstreamsHealth())
+
+		selectAddrs(t, []string{"good"})
+	})
+
+	t.Run("all_open", func(t *testing.T) {
+		goodFailing.Store(true)
+		p.health.check()
+		p.health.check()
+
+		selectAddrs(t, []string{"bad", "good"})
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		badFailing.Store(false)
+		p.health.check()
+
+		selectAddrs(t, []string{"bad"})
+	})
+}
+
+func TestNewHealthChecker(t *testing.T) {
+	testCases := []struct {
+		conf       *HealthCheckConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       &HealthCheckConfig{},
+		name:       "no_interval",
+		wantErrMsg: "interval 0s: must be positive",
+	}, {
+		conf: &HealthCheckConfig{
+			Domain:   "bad domain",
+			Interval: time.Second,
+		},
+		name: "bad_domain",
+		wantErrMsg: `domain: bad domain name "bad domain": ` +
+			`bad top-level domain name label "bad domain": ` +
+			`bad top-level domain name label rune ' '`,
+	}, {
+		conf: &HealthCheckConfig{
+			Domain:   "Example.ORG",
+			Interval: time.Second,
+		},
+		name:       "success",
+		wantErrMsg: "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newHealthChecker(slogutil.NewDiscardLogger(), realClock{}, tc.conf, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"cmp"
+	"fmt"
+	"math"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultHedgePercentile is the default percentile of the recent
+	// round-trip times of an upstream used as the hedging delay.
+	defaultHedgePercentile = 0.95
+
+	// defaultHedgeDelay is the hedging delay used for the upstreams without
+	// any measured round-trip times.
+	defaultHedgeDelay = 100 * time.Millisecond
+
+	// latencyWindowSize is the number of the recent round-trip times kept for
+	// each upstream.
+	latencyWindowSize = 100
+)
+
+// latencyWindow is a ring buffer of the round-trip times of the recent
+// successful requests to an upstream.  It's safe for concurrent use.
+type latencyWindow struct {
+	// mu protects rtts and next.
+	mu *sync.Mutex
+
+	// rtts are the recorded round-trip times.  Its length never exceeds
+	// [latencyWindowSize].
+	rtts []time.Duration
+
+	// next is the index in rtts to write the next round-trip time into.
+	next int
+}
+
+// newLatencyWindow returns a new properly initialized *latencyWindow.
+func newLatencyWindow() (w *latencyWindow) {
+	return &latencyWindow{
+		mu:   &sync.Mutex{},
+		rtts: make([]time.Duration, 0, latencyWindowSize),
+	}
+}
+
+// add records rtt, replacing the oldest one if the window is full.
+func (w *latencyWindow) add(rtt time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.rtts) < latencyWindowSize {
+		w.rtts = append(w.rtts, rtt)
+	} else {
+		w.rtts[w.next] = rtt
+	}
+
+	w.next = (w.next + 1) % latencyWindowSize
+}
+
+// percentile returns the q-th percentile of the recorded round-trip times using
+// the nearest-rank method.  q must be in the range from 0 to 1.  ok is false if
+// there are no recorded round-trip times.
+func (w *latencyWindow) percentile(q float64) (rtt time.Duration, ok bool) {
+	w.mu.Lock()
+	sorted := slices.Clone(w.rtts)
+	w.mu.Unlock()
+
+	if len(sorted) == 0 {
+		return 0, false
+	}
+
+	slices.Sort(sorted)
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+
+	return sorted[max(0, min(i, len(sorted)-1))], true
+}
+
+// hedgedResult is the result of a single exchange within a hedged request.
+type hedgedResult struct {
+	// resp is the response, if any.
+	resp *dns.Msg
+
+	// err is the error of the exchange, if any.
+	err error
+
+	// u is the upstream the request has been sent to.
+	u upstream.Upstream
+}
+
+// exchangeHedged resolves req using ups in [UpstreamModeHedged].  It sends req
+// to the best upstream first and then to the next one each time the hedging
+// delay of the last used upstream passes without a successful response, or
+// immediately after a failure.  It returns the first successful response.
+func (p *Proxy) exchangeHedged(
+	req *dns.Msg,
+	ups []upstream.Upstream,
+) (resp *dns.Msg, u upstream.Upstream, err error) {
+	ups = p.rankUpstreams(ups)
+
+	// Make the channel buffered so that the late results don't block the
+	// goroutines after returning.
+	results := make(chan *hedgedResult, len(ups))
+	sent := 0
+	send := func() (delay time.Duration) {
+		next := ups[sent]
+		sent++
+
+		go p.exchangeAsync(next, req, results)
+
+		return p.hedgeDelay(next)
+	}
+
+	timer := time.NewTimer(send())
+	defer timer.Stop()
+
+	errs := make([]error, 0, len(ups))
+	for len(errs) < len(ups) {
+		select {
+		case res := <-results:
+			if res.err == nil {
+				return res.resp, res.u, nil
+			}
+
+			errs = append(errs, res.err)
+			if sent < len(ups) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+
+				timer.Reset(send())
+			}
+		case <-timer.C:
+			if sent < len(ups) {
+				p.logger.Debug("hedging request", "upstream", ups[sent].Address())
+
+				timer.Reset(send())
+			}
+		}
+	}
+
+	err = fmt.Errorf("all upstreams failed to exchange request: %w", errors.Join(errs...))
+
+	return nil, nil, err
+}
+
+// exchangeAsync exchanges req with u, updates the statistics of u, and sends
+// the result to results.
+func (p *Proxy) exchangeAsync(u upstream.Upstream, req *dns.Msg, results chan<- *hedgedResult) {
+	resp, elapsed, err := p.exchange(u, req, p.time)
+	p.updateStats(u.Address(), elapsed, err != nil)
+
+	results <- &hedgedResult{
+		resp: resp,
+		err:  err,
+		u:    u,
+	}
+}
+
+// hedgeDelay returns the delay to wait for the response from u before sending
+// the request to the next upstream.
+func (p *Proxy) hedgeDelay(u upstream.Upstream) (delay time.Duration) {
+	if p.HedgeDelay > 0 {
+		return p.HedgeDelay
+	}
+
+	p.rttLock.RLock()
+	us := p.upstreamRTTStats[u.Address()]
+	p.rttLock.RUnlock()
+
+	if us != nil {
+		rtt, ok := us.latencies.percentile(cmp.Or(p.HedgePercentile, defaultHedgePercentile))
+		if ok {
+			return rtt
+		}
+	}
+
+	return defaultHedgeDelay
+}
+
+// rankUpstreams returns a copy of ups sorted by their weights in descending
+// order.  The upstreams with equal weights keep their original order.
+func (p *Proxy) rankUpstreams(ups []upstream.Upstream) (ranked []upstream.Upstream) {
+	weights := p.calcWeights(ups)
+	indices := make([]int, len(ups))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	slices.SortStableFunc(indices, func(a, b int) (res int) {
+		return cmp.Compare(weights[b], weights[a])
+	})
+
+	ranked = make([]upstream.Upstream, 0, len(ups))
+	for _, i := range indices {
+		ranked = append(ranked, ups[i])
+	}
+
+	return ranked
+}
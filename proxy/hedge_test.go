@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Exchange_hedged(t *testing.T) {
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+
+	// newCounted returns an upstream with addr counting its requests in
+	// counter and answering them using exchange.
+	newCounted := func(
+		addr string,
+		counter *atomic.Int64,
+		exchange func(req *dns.Msg) (resp *dns.Msg, err error),
+	) (u upstream.Upstream) {
+		return &fakeUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				counter.Add(1)
+
+				return exchange(req)
+			},
+			onAddress: func() (a string) { return addr },
+			onClose:   func() (err error) { return nil },
+		}
+	}
+
+	answer := func(req *dns.Msg) (resp *dns.Msg, err error) {
+		return (&dns.Msg{}).SetReply(req), nil
+	}
+	fail := func(_ *dns.Msg) (resp *dns.Msg, err error) {
+		return nil, assert.AnError
+	}
+	hang := func(_ *dns.Msg) (resp *dns.Msg, err error) {
+		<-unblock
+
+		return nil, assert.AnError
+	}
+
+	testCases := []struct {
+		first      func(req *dns.Msg) (resp *dns.Msg, err error)
+		second     func(req *dns.Msg) (resp *dns.Msg, err error)
+		name       string
+		wantAddr   string
+		wantErrMsg string
+		delay      time.Duration
+		wantSecond int64
+	}{{
+		first:      answer,
+		second:     answer,
+		name:       "first_answers",
+		wantAddr:   "first",
+		wantErrMsg: "",
+		delay:      time.Hour,
+		wantSecond: 0,
+	}, {
+		first:      hang,
+		second:     answer,
+		name:       "hedged",
+		wantAddr:   "second",
+		wantErrMsg: "",
+		delay:      10 * time.Millisecond,
+		wantSecond: 1,
+	}, {
+		first:      fail,
+		second:     answer,
+		name:       "first_fails",
+		wantAddr:   "second",
+		wantErrMsg: "",
+		delay:      time.Hour,
+		wantSecond: 1,
+	}, {
+		first:    fail,
+		second:   fail,
+		name:     "all_fail",
+		wantAddr: "",
+		wantErrMsg: "all upstreams failed to exchange request: " +
+			assert.AnError.Error() + "\n" + assert.AnError.Error(),
+		delay:      time.Hour,
+		wantSecond: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			firstNum, secondNum := &atomic.Int64{}, &atomic.Int64{}
+			ups := []upstream.Upstream{
+				newCounted("first", firstNum, tc.first),
+				newCounted("second", secondNum, tc.second),
+			}
+
+			p := mustNew(t, &Config{
+				Logger:        slogutil.NewDiscardLogger(),
+				UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: ups,
+				},
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+				UpstreamMode:           UpstreamModeHedged,
+				HedgeDelay:             tc.delay,
+			})
+
+			_, u, err := p.exchangeUpstreams(newTestMessage(), ups)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			if tc.wantAddr != "" {
+				require.NotNil(t, u)
+				assert.Equal(t, tc.wantAddr, u.Address())
+			}
+
+			assert.Equal(t, int64(1), firstNum.Load())
+			assert.Equal(t, tc.wantSecond, secondNum.Load())
+		})
+	}
+}
+
+func TestLatencyWindow_percentile(t *testing.T) {
+	w := newLatencyWindow()
+
+	_, ok := w.percentile(defaultHedgePercentile)
+	require.False(t, ok)
+
+	for i := range latencyWindowSize {
+		w.add(time.Duration(i+1) * time.Millisecond)
+	}
+
+	testCases := []struct {
+		name string
+		want time.Duration
+		q    float64
+	}{{
+		name: "min",
+		want: 1 * time.Millisecond,
+		q:    0,
+	}, {
+		name: "median",
+		want: 50 * time.Millisecond,
+		q:    0.5,
+	}, {
+		name: "default",
+		want: 95 * time.Millisecond,
+		q:    defaultHedgePercentile,
+	}, {
+		name: "max",
+		want: 100 * time.Millisecond,
+		q:    1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rtt, rttOK := w.percentile(tc.q)
+			require.True(t, rttOK)
+
+			assert.Equal(t, tc.want, rtt)
+		})
+	}
+
+	t.Run("overwritten", func(t *testing.T) {
+		for range latencyWindowSize / 2 {
+			w.add(time.Second)
+		}
+
+		rtt, rttOK := w.percentile(0)
+		require.True(t, rttOK)
+
+		assert.Equal(t, 51*time.Millisecond, rtt)
+	})
+}
@@ -0,0 +1,281 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/hostsfile"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// hostsCheckInterval is the interval between the checks of the hosts
+	// files for changes.
+	hostsCheckInterval = 5 * time.Second
+
+	// hostsTTL is the TTL of the records in the responses from the hosts
+	// files.
+	hostsTTL = 10
+)
+
+// hostsWatcher answers the requests using the data from the hosts files and
+// reloads it when the files change.
+type hostsWatcher struct {
+	// logger is used to log the reloading of the hosts files.
+	logger *slog.Logger
+
+	// storage is the data parsed from the hosts files.  It's never nil.
+	storage atomic.Pointer[hostsfile.DefaultStorage]
+
+	// mu protects stamps and done.
+	mu *sync.Mutex
+
+	// stamps are the states of the files at paths at the time of the last
+	// reload.
+	stamps []fileStamp
+
+	// done is closed to stop the watching.  It's nil if the watcher isn't
+	// running.
+	done chan unit
+
+	// paths are the paths to the hosts files.
+	paths []string
+
+	// interval is the interval between the checks of the files for changes.
+	interval time.Duration
+}
+
+// fileStamp is the state of a file used to detect its changes.
+type fileStamp struct {
+	// modTime is the modification time of the file.
+	modTime time.Time
+
+	// size is the size of the file in bytes.
+	size int64
+
+	// exists is true if the file exists.
+	exists bool
+}
+
+// newFileStamp returns the current state of the file at path.
+func newFileStamp(path string) (s fileStamp) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+
+	return fileStamp{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		exists:  true,
+	}
+}
+
+// newHostsWatcher returns a new properly initialized *hostsWatcher with the
+// data from the files at paths.  All the files must exist.
+func newHostsWatcher(l *slog.Logger, paths []string) (hw *hostsWatcher, err error) {
+	hw = &hostsWatcher{
+		logger:   l,
+		mu:       &sync.Mutex{},
+		stamps:   make([]fileStamp, len(paths)),
+		paths:    paths,
+		interval: hostsCheckInterval,
+	}
+
+	for i, p := range paths {
+		hw.stamps[i] = newFileStamp(p)
+	}
+
+	err = hw.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return hw, nil
+}
+
+// reload parses the hosts files and replaces the stored data with the parsed
+// one.  If any of the files fails to parse, the stored data is kept.
+func (hw *hostsWatcher) reload() (err error) {
+	strg, _ := hostsfile.NewDefaultStorage()
+	for _, p := range hw.paths {
+		err = parseHostsFile(strg, p)
+		if err != nil {
+			return fmt.Errorf("hosts file %q: %w", p, err)
+		}
+	}
+
+	hw.storage.Store(strg)
+
+	return nil
+}
+
+// parseHostsFile parses the hosts file at path into strg.
+func parseHostsFile(strg *hostsfile.DefaultStorage, path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	return hostsfile.Parse(strg, f, nil)
+}
+
+// start starts watching the files in a separate goroutine.  It must not be
+// called concurrently with stop.
+func (hw *hostsWatcher) start() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	if hw.done != nil {
+		return
+	}
+
+	hw.done = make(chan unit)
+
+	go hw.loop(hw.done)
+}
+
+// stop stops watching the files.  It must not be called concurrently with
+// start.
+func (hw *hostsWatcher) stop() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	if hw.done != nil {
+		close(hw.done)
+		hw.done = nil
+	}
+}
+
+// loop checks the files for changes each interval until done is closed.
+func (hw *hostsWatcher) loop(done chan unit) {
+	defer slogutil.RecoverAndLog(context.TODO(), hw.logger)
+
+	ticker := time.NewTicker(hw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			hw.check()
+		}
+	}
+}
+
+// check reloads the files if any of them has changed since the last check.
+// The errors are logged, and the previously loaded data is kept in that case.
+func (hw *hostsWatcher) check() {
+	hw.mu.Lock()
+	defer hw.mu.Unlock()
+
+	changed := false
+	for i, p := range hw.paths {
+		s := newFileStamp(p)
+		if s != hw.stamps[i] {
+			hw.stamps[i] = s
+			changed = true
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	err := hw.reload()
+	if err != nil {
+		hw.logger.Error("reloading hosts files", slogutil.KeyError, err)
+
+		return
+	}
+
+	hw.logger.Info("hosts files reloaded")
+}
+
+// answer returns the response to req from the hosts files or nil if there is
+// no data for the request.
+func (hw *hostsWatcher) answer(req *dns.Msg) (resp *dns.Msg) {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return nil
+	}
+
+	strg := hw.storage.Load()
+
+	var ans []dns.RR
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addrs := strg.ByName(strings.TrimSuffix(q.Name, "."))
+		if len(addrs) == 0 {
+			return nil
+		}
+
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: q.Qtype,
+			Class:  dns.ClassINET,
+			Ttl:    hostsTTL,
+		}
+		for _, addr := range addrs {
+			if q.Qtype == dns.TypeA && addr.Is4() {
+				ans = append(ans, &dns.A{Hdr: hdr, A: addr.AsSlice()})
+			} else if q.Qtype == dns.TypeAAAA && addr.Is6() {
+				ans = append(ans, &dns.AAAA{Hdr: hdr, AAAA: net.IP(addr.AsSlice())})
+			}
+		}
+	case dns.TypePTR:
+		addr, err := netutil.IPFromReversedAddr(q.Name)
+		if err != nil {
+			return nil
+		}
+
+		names := strg.ByAddr(addr.Unmap())
+		if len(names) == 0 {
+			return nil
+		}
+
+		hdr := dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    hostsTTL,
+		}
+		for _, name := range names {
+			ans = append(ans, &dns.PTR{Hdr: hdr, Ptr: dns.Fqdn(name)})
+		}
+	default:
+		return nil
+	}
+
+	// Reply with NODATA if the host is known but has no addresses of the
+	// requested family.
+	resp = reply(req, dns.RcodeSuccess)
+	resp.Answer = ans
+
+	return resp
+}
+
+// replyFromHosts sets the response from the hosts files into d, if there is
+// one.  ok is true if the response is set.
+func (p *Proxy) replyFromHosts(d *DNSContext) (ok bool) {
+	if p.hosts == nil {
+		return false
+	}
+
+	d.Res = p.hosts.answer(d.Req)
+
+	return d.Res != nil
+}
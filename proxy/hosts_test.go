@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_hosts(t *testing.T) {
+	const hostsData = `# Comment.
+192.0.2.1    host.example Alias.Example
+2001:db8::1  host.example
+192.0.2.2    v4only.example
+`
+
+	var exchanges atomic.Uint32
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	hostsPath := filepath.Join(t.TempDir(), "hosts")
+	require.NoError(t, os.WriteFile(hostsPath, []byte(hostsData), 0o600))
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		HostsFiles:             []string{hostsPath},
+	})
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+
+	// resolve returns the string representations of the answer to the request
+	// for host of qtype.
+	resolve := func(t *testing.T, host string, qtype uint16) (answer []string) {
+		t.Helper()
+
+		dctx := &DNSContext{
+			Req:  newReq(host, qtype, dns.ClassINET),
+			Addr: cli,
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+		require.Equal(t, dns.RcodeSuccess, dctx.Res.Rcode)
+
+		for _, rr := range dctx.Res.Answer {
+			answer = append(answer, rr.String())
+		}
+
+		return answer
+	}
+
+	testCases := []struct {
+		name  string
+		host  string
+		want  []string
+		qtype uint16
+	}{{
+		name:  "a",
+		host:  "host.example.",
+		want:  []string{"host.example.\t10\tIN\tA\t192.0.2.1"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "aaaa",
+		host:  "host.example.",
+		want:  []string{"host.example.\t10\tIN\tAAAA\t2001:db8::1"},
+		qtype: dns.TypeAAAA,
+	}, {
+		name:  "case_insensitive",
+		host:  "alias.EXAMPLE.",
+		want:  []string{"alias.EXAMPLE.\t10\tIN\tA\t192.0.2.1"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "nodata",
+		host:  "v4only.example.",
+		want:  nil,
+		qtype: dns.TypeAAAA,
+	}, {
+		name: "ptr",
+		host: "1.2.0.192.in-addr.arpa.",
+		want: []string{
+			"1.2.0.192.in-addr.arpa.\t10\tIN\tPTR\thost.example.",
+			"1.2.0.192.in-addr.arpa.\t10\tIN\tPTR\tAlias.Example.",
+		},
+		qtype: dns.TypePTR,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, resolve(t, tc.host, tc.qtype))
+		})
+	}
+
+	require.Zero(t, exchanges.Load())
+
+	t.Run("unknown", func(t *testing.T) {
+		assert.Empty(t, resolve(t, "unknown.example.", dns.TypeA))
+		assert.Equal(t, uint32(1), exchanges.Load())
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		err := os.WriteFile(hostsPath, []byte("192.0.2.100 new.example\n"), 0o600)
+		require.NoError(t, err)
+
+		p.hosts.check()
+
+		want := []string{"new.example.\t10\tIN\tA\t192.0.2.100"}
+		assert.Equal(t, want, resolve(t, "new.example.", dns.TypeA))
+
+		exchanges.Store(0)
+		assert.Empty(t, resolve(t, "host.example.", dns.TypeA))
+		assert.Equal(t, uint32(1), exchanges.Load())
+	})
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// errResolvePanic is returned to the requests waiting for the resolving which
+// panicked.
+const errResolvePanic errors.Error = "resolving panicked"
+
+// inflightKey is the key of a request being resolved.
+type inflightKey struct {
+	// cache is the cache the response is going to be stored in, since
+	// different caches imply different upstreams.
+	cache *cache
+
+	// key is the cache key of the request.
+	key string
+}
+
+// inflightCall is a single resolving of a request shared between all the
+// identical requests arrived during it.
+type inflightCall struct {
+	// done is closed when the call is finished.
+	done chan unit
+
+	// res is the resolved response.  It must not be modified, only copied.
+	res *dns.Msg
+
+	// ede is the Extended DNS Error to add to the response, if any.
+	ede *dns.EDNS0_EDE
+
+	// upstream is the upstream which resolved the request.
+	upstream upstream.Upstream
+
+	// err is the error occurred during the resolving.
+	err error
+
+	// queryDuration is the duration of the upstream exchange.
+	queryDuration time.Duration
+
+	// dups is the number of requests waiting for the call.
+	dups int
+
+	// ok is true if the request has been resolved and the response may be
+	// cached.
+	ok bool
+
+	// noEDNS is true if the response shouldn't have an OPT record.
+	noEDNS bool
+}
+
+// inflightGroup deduplicates the concurrent resolving of identical requests
+// missing the cache, so that only a single upstream exchange is performed for
+// all of them.  It's safe for concurrent use.
+type inflightGroup struct {
+	// mu protects calls.
+	mu *sync.Mutex
+
+	// calls are the requests being resolved.
+	calls map[inflightKey]*inflightCall
+}
+
+// newInflightGroup returns a new properly initialized *inflightGroup.
+func newInflightGroup() (g *inflightGroup) {
+	return &inflightGroup{
+		mu:    &sync.Mutex{},
+		calls: map[inflightKey]*inflightCall{},
+	}
+}
+
+// resolveFunc resolves the request from dctx.  ok is true if the response may
+// be cached.
+type resolveFunc func(dctx *DNSContext) (ok bool, err error)
+
+// do resolves the request from dctx with resolve unless the identical request
+// with the same key is already being resolved.  In the latter case, it waits
+// for that request and fills dctx with a copy of its result.
+func (g *inflightGroup) do(k inflightKey, dctx *DNSContext, resolve resolveFunc) (ok bool, err error) {
+	g.mu.Lock()
+	if c, found := g.calls[k]; found {
+		c.dups++
+		g.mu.Unlock()
+
+		<-c.done
+
+		return c.fill(dctx)
+	}
+
+	c := &inflightCall{
+		done: make(chan unit),
+	}
+	g.calls[k] = c
+	g.mu.Unlock()
+
+	defer func() {
+		v := recover()
+		if v != nil {
+			c.err = fmt.Errorf("%w: %v", errResolvePanic, v)
+		}
+
+		g.mu.Lock()
+		delete(g.calls, k)
+		close(c.done)
+		g.mu.Unlock()
+
+		if v != nil {
+			// Repanic so that the panic is handled the same way as without
+			// the deduplication, while the waiting requests fail.
+			panic(v)
+		}
+	}()
+
+	ok, err = resolve(dctx)
+
+	// Store a copy since the response of dctx is modified afterwards.
+	if dctx.Res != nil {
+		c.res = dctx.Res.Copy()
+	}
+	c.ede = dctx.ede
+	c.upstream = dctx.Upstream
+	c.err = err
+	c.queryDuration = dctx.QueryDuration
+	c.ok = ok
+	c.noEDNS = !dctx.hasEDNS0
+
+	return ok, err
+}
+
+// fill sets the result of c to dctx.
+func (c *inflightCall) fill(dctx *DNSContext) (ok bool, err error) {
+	if c.res != nil {
+		dctx.Res = c.res.Copy()
+		dctx.Res.Id = dctx.Req.Id
+		dctx.Res.Question = append(dctx.Res.Question[:0], dctx.Req.Question...)
+	}
+
+	dctx.ede = c.ede
+	dctx.Upstream = c.upstream
+	dctx.QueryDuration = c.queryDuration
+	if c.noEDNS {
+		dctx.hasEDNS0 = false
+	}
+
+	return c.ok, c.err
+}
+
+// inflightKey returns the key to deduplicate the resolving of the request from
+// dctx.  It must only be called when the cache works for dctx.
+func (p *Proxy) inflightKey(dctx *DNSContext) (k inflightKey) {
+	k.cache = p.cacheForContext(dctx)
+
+	if ecs := dctx.ReqECS; k.cache.withECS() && ecs != nil {
+		ones, _ := ecs.Mask.Size()
+		k.key = string(msgToKeyWithSubnet(dctx.Req, ecs.IP.Mask(ecs.Mask), ones))
+	} else {
+		k.key = string(msgToKey(dctx.Req))
+	}
+
+	return k
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_coalesce(t *testing.T) {
+	const (
+		reqsNum = 10
+		host    = "coalesced.example."
+	)
+
+	var exchanges atomic.Uint32
+	release := make(chan unit)
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+			<-release
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   req.Question[0].Name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    defaultTestTTL,
+				},
+				A: net.IP{1, 2, 3, 4},
+			}}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+	})
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+	dctxs := make([]*DNSContext, reqsNum)
+	for i := range dctxs {
+		dctxs[i] = &DNSContext{
+			Req:  newReq(host, dns.TypeA, dns.ClassINET),
+			Addr: cli,
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	errs := make([]error, reqsNum)
+	for i, dctx := range dctxs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			errs[i] = p.Resolve(dctx)
+		}()
+	}
+
+	// Wait for all the requests to join the first one.
+	require.Eventually(t, func() (ok bool) {
+		p.inflight.mu.Lock()
+		defer p.inflight.mu.Unlock()
+
+		for _, c := range p.inflight.calls {
+			return c.dups == reqsNum-1
+		}
+
+		return false
+	}, testTimeout, testTimeout/100)
+
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, uint32(1), exchanges.Load())
+
+	for i, dctx := range dctxs {
+		require.NoError(t, errs[i])
+
+		res := dctx.Res
+		require.NotNil(t, res)
+
+		assert.Equal(t, dctx.Req.Id, res.Id)
+		assert.Equal(t, dctx.Req.Question, res.Question)
+		require.Len(t, res.Answer, 1)
+	}
+
+	// The subsequent request should be served from cache.
+	dctx := &DNSContext{
+		Req:  newReq(host, dns.TypeA, dns.ClassINET),
+		Addr: cli,
+	}
+	require.NoError(t, p.Resolve(dctx))
+
+	assert.Equal(t, uint32(1), exchanges.Load())
+	assert.Empty(t, p.inflight.calls)
+}
+
+func TestInflightGroup_do_panic(t *testing.T) {
+	const panicVal = "test panic"
+
+	g := newInflightGroup()
+	k := inflightKey{key: "key"}
+
+	release := make(chan unit)
+	recovered := make(chan any, 1)
+	go func() {
+		defer func() { recovered <- recover() }()
+
+		_, _ = g.do(k, &DNSContext{}, func(_ *DNSContext) (ok bool, err error) {
+			<-release
+
+			panic(panicVal)
+		})
+	}()
+
+	require.Eventually(t, func() (ok bool) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		_, ok = g.calls[k]
+
+		return ok
+	}, testTimeout, testTimeout/100)
+
+	var ok bool
+	var err error
+	done := make(chan unit)
+	go func() {
+		defer close(done)
+
+		ok, err = g.do(k, &DNSContext{}, func(_ *DNSContext) (_ bool, _ error) {
+			panic("not implemented")
+		})
+	}()
+
+	// Wait for the second request to join the first one.
+	require.Eventually(t, func() (joined bool) {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		return g.calls[k].dups == 1
+	}, testTimeout, testTimeout/100)
+
+	close(release)
+	<-done
+
+	assert.False(t, ok)
+	assert.ErrorIs(t, err, errResolvePanic)
+	assert.Equal(t, panicVal, <-recovered)
+	assert.Empty(t, g.calls)
+}
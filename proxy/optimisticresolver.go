@@ -5,17 +5,19 @@ import (
 	"encoding/hex"
 	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
 )
 
 // cachingResolver is the DNS resolver that is also able to cache responses.
 type cachingResolver interface {
-	// replyFromUpstream returns true if the request from dctx is successfully
+	// resolveUpstream returns true if the request from dctx is successfully
 	// resolved and the response may be cached.
 	//
 	// TODO(e.burkov):  Find out when ok can be false with nil err.
-	replyFromUpstream(dctx *DNSContext) (ok bool, err error)
+	resolveUpstream(dctx *DNSContext) (ok bool, err error)
 
 	// cacheResp caches the response from dctx.
 	cacheResp(dctx *DNSContext)
@@ -26,41 +28,148 @@ var _ cachingResolver = (*Proxy)(nil)
 
 // optimisticResolver is used to eventually resolve expired cached requests.
 type optimisticResolver struct {
+	// reqs maps the hexed keys of the requests being resolved to the channels
+	// closed when the resolving is finished.
 	reqs *sync.Map
-	cr   cachingResolver
+
+	// failures maps the hexed keys of the requests failed to be resolved to
+	// the time of the failure.  The failures older than recheckInterval are
+	// swept periodically, see [optimisticResolver.storeFailure].
+	failures *sync.Map
+
+	// sweepLock protects lastSweep.
+	sweepLock *sync.Mutex
+
+	// lastSweep is the time when the outdated failures were last removed.
+	lastSweep time.Time
+
+	// cr resolves and caches the requests.
+	cr cachingResolver
+
+	// clock is used to track the failures.
+	clock clock
+
+	// recheckInterval is the time after a failure during which the request
+	// isn't resolved again.  If zero, the failures aren't tracked.
+	recheckInterval time.Duration
 }
 
 // newOptimisticResolver returns the new resolver for expired cached requests.
-// cr must not be nil.
-func newOptimisticResolver(cr cachingResolver) (s *optimisticResolver) {
+// cr must not be nil.  c must not be nil if recheckInterval is positive.
+func newOptimisticResolver(
+	cr cachingResolver,
+	c clock,
+	recheckInterval time.Duration,
+) (s *optimisticResolver) {
 	return &optimisticResolver{
-		reqs: &sync.Map{},
-		cr:   cr,
+		reqs:            &sync.Map{},
+		failures:        &sync.Map{},
+		sweepLock:       &sync.Mutex{},
+		cr:              cr,
+		clock:           c,
+		recheckInterval: recheckInterval,
 	}
 }
 
 // unit is a convenient alias for struct{}.
 type unit = struct{}
 
-// resolveOnce tries to resolve the request from dctx but only a single request
-// with the same key at the same period of time.  It runs in a separate
-// goroutine.  Do not pass the *DNSContext which is used elsewhere since it
-// isn't intended to be used concurrently.
-func (s *optimisticResolver) resolveOnce(dctx *DNSContext, key []byte, l *slog.Logger) {
-	defer slogutil.RecoverAndLog(context.TODO(), l)
-
+// refresh starts resolving the request from dctx in a separate goroutine unless
+// the request with the same key is already being resolved.  done is closed
+// when the resolving is finished.  Do not pass the *DNSContext which is used
+// elsewhere since it isn't intended to be used concurrently.
+func (s *optimisticResolver) refresh(
+	dctx *DNSContext,
+	key []byte,
+	l *slog.Logger,
+) (done <-chan unit) {
 	keyHexed := hex.EncodeToString(key)
-	if _, ok := s.reqs.LoadOrStore(keyHexed, unit{}); ok {
-		return
+
+	ch := make(chan unit)
+	if running, ok := s.reqs.LoadOrStore(keyHexed, ch); ok {
+		return running.(chan unit)
 	}
+
+	go s.resolve(dctx, keyHexed, ch, l)
+
+	return ch
+}
+
+// resolve resolves the request from dctx and caches the response, if it's
+// successful.  It closes done when finished.
+func (s *optimisticResolver) resolve(
+	dctx *DNSContext,
+	keyHexed string,
+	done chan unit,
+	l *slog.Logger,
+) {
+	defer close(done)
 	defer s.reqs.Delete(keyHexed)
+	defer slogutil.RecoverAndLog(context.TODO(), l)
 
-	ok, err := s.cr.replyFromUpstream(dctx)
+	ok, err := s.cr.resolveUpstream(dctx)
 	if err != nil {
 		l.Debug("resolving request for optimistic cache", slogutil.KeyError, err)
 	}
 
-	if ok {
-		s.cr.cacheResp(dctx)
+	// Keep serving the expired response instead of the failure one.
+	//
+	// See https://datatracker.ietf.org/doc/html/rfc8767#section-4.
+	if !ok || (dctx.Res != nil && dctx.Res.Rcode == dns.RcodeServerFailure) {
+		if s.recheckInterval > 0 {
+			s.storeFailure(keyHexed)
+		}
+
+		return
 	}
+
+	s.failures.Delete(keyHexed)
+	s.cr.cacheResp(dctx)
+}
+
+// storeFailure remembers the failure of the request with keyHexed.  It also
+// removes the failures older than the recheck interval, at most once per the
+// interval, so that the keys of the requests which are no longer made don't
+// stay forever.
+func (s *optimisticResolver) storeFailure(keyHexed string) {
+	now := s.clock.Now()
+	s.failures.Store(keyHexed, now)
+
+	s.sweepLock.Lock()
+	defer s.sweepLock.Unlock()
+
+	if now.Sub(s.lastSweep) < s.recheckInterval {
+		return
+	}
+
+	s.lastSweep = now
+	s.failures.Range(func(k, v any) (cont bool) {
+		if now.Sub(v.(time.Time)) >= s.recheckInterval {
+			s.failures.CompareAndDelete(k, v)
+		}
+
+		return true
+	})
+}
+
+// recentlyFailed returns true if the request with key has failed to be
+// resolved within the recheck interval.
+func (s *optimisticResolver) recentlyFailed(key []byte) (ok bool) {
+	if s.recheckInterval <= 0 {
+		return false
+	}
+
+	keyHexed := hex.EncodeToString(key)
+	v, ok := s.failures.Load(keyHexed)
+	if !ok {
+		return false
+	}
+
+	if s.clock.Now().Sub(v.(time.Time)) < s.recheckInterval {
+		return true
+	}
+
+	s.failures.CompareAndDelete(keyHexed, v)
+
+	return false
 }
@@ -5,6 +5,7 @@ import (
 	"log/slog"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
@@ -14,14 +15,14 @@ import (
 // testCachingResolver is a stub implementation of the cachingResolver interface
 // to simplify testing.
 type testCachingResolver struct {
-	onReplyFromUpstream func(dctx *DNSContext) (ok bool, err error)
-	onCacheResp         func(dctx *DNSContext)
+	onResolveUpstream func(dctx *DNSContext) (ok bool, err error)
+	onCacheResp       func(dctx *DNSContext)
 }
 
-// replyFromUpstream implements the cachingResolver interface for
+// resolveUpstream implements the cachingResolver interface for
 // *testCachingResolver.
-func (tcr *testCachingResolver) replyFromUpstream(dctx *DNSContext) (ok bool, err error) {
-	return tcr.onReplyFromUpstream(dctx)
+func (tcr *testCachingResolver) resolveUpstream(dctx *DNSContext) (ok bool, err error) {
+	return tcr.onResolveUpstream(dctx)
 }
 
 // cacheResp implements the cachingResolver interface for *testCachingResolver.
@@ -29,12 +30,12 @@ func (tcr *testCachingResolver) cacheResp(dctx *DNSContext) {
 	tcr.onCacheResp(dctx)
 }
 
-func TestOptimisticResolver_ResolveOnce(t *testing.T) {
+func TestOptimisticResolver_Refresh(t *testing.T) {
 	in, out := make(chan unit), make(chan unit)
 	var timesResolved, timesSet int
 
 	tcr := &testCachingResolver{
-		onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) {
+		onResolveUpstream: func(_ *DNSContext) (ok bool, err error) {
 			timesResolved++
 
 			return true, nil
@@ -49,11 +50,11 @@ func TestOptimisticResolver_ResolveOnce(t *testing.T) {
 		},
 	}
 
-	s := newOptimisticResolver(tcr)
+	s := newOptimisticResolver(tcr, nil, 0)
 	sameKey := []byte{1, 2, 3}
 
 	// Start the primary goroutine.
-	go s.resolveOnce(nil, sameKey, slogutil.NewDiscardLogger())
+	done := s.refresh(&DNSContext{}, sameKey, slogutil.NewDiscardLogger())
 	// Block until the primary goroutine reaches the resolve function.
 	<-out
 
@@ -65,7 +66,7 @@ func TestOptimisticResolver_ResolveOnce(t *testing.T) {
 		go func() {
 			defer wg.Done()
 
-			s.resolveOnce(nil, sameKey, slogutil.NewDiscardLogger())
+			s.refresh(&DNSContext{}, sameKey, slogutil.NewDiscardLogger())
 		}()
 	}
 
@@ -73,12 +74,13 @@ func TestOptimisticResolver_ResolveOnce(t *testing.T) {
 	wg.Wait()
 	// Pass the signal to terminate the primary goroutine.
 	in <- unit{}
+	<-done
 
 	assert.Equal(t, 1, timesResolved)
 	assert.Equal(t, 1, timesSet)
 }
 
-func TestOptimisticResolver_ResolveOnce_unsuccessful(t *testing.T) {
+func TestOptimisticResolver_Refresh_unsuccessful(t *testing.T) {
 	key := []byte{1, 2, 3}
 
 	t.Run("error", func(t *testing.T) {
@@ -94,10 +96,10 @@ func TestOptimisticResolver_ResolveOnce_unsuccessful(t *testing.T) {
 
 		cached := false
 		s := newOptimisticResolver(&testCachingResolver{
-			onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return true, rErr },
-			onCacheResp:         func(_ *DNSContext) { cached = true },
-		})
-		s.resolveOnce(nil, key, l)
+			onResolveUpstream: func(_ *DNSContext) (ok bool, err error) { return true, rErr },
+			onCacheResp:       func(_ *DNSContext) { cached = true },
+		}, nil, 0)
+		<-s.refresh(&DNSContext{}, key, l)
 
 		assert.True(t, cached)
 		assert.Contains(t, logOutput.String(), rErr.Error())
@@ -106,11 +108,48 @@ func TestOptimisticResolver_ResolveOnce_unsuccessful(t *testing.T) {
 	t.Run("not_ok", func(t *testing.T) {
 		cached := false
 		s := newOptimisticResolver(&testCachingResolver{
-			onReplyFromUpstream: func(_ *DNSContext) (ok bool, err error) { return false, nil },
-			onCacheResp:         func(_ *DNSContext) { cached = true },
-		})
-		s.resolveOnce(nil, key, slogutil.NewDiscardLogger())
+			onResolveUpstream: func(_ *DNSContext) (ok bool, err error) { return false, nil },
+			onCacheResp:       func(_ *DNSContext) { cached = true },
+		}, nil, 0)
+		<-s.refresh(&DNSContext{}, key, slogutil.NewDiscardLogger())
 
 		assert.False(t, cached)
 	})
 }
+
+func TestOptimisticResolver_failuresSweep(t *testing.T) {
+	const recheck = time.Minute
+
+	now := time.Unix(0, 0)
+	s := newOptimisticResolver(&testCachingResolver{
+		onResolveUpstream: func(_ *DNSContext) (ok bool, err error) { return false, nil },
+		onCacheResp:       func(_ *DNSContext) {},
+	}, &fakeClock{
+		onNow: func() (n time.Time) { return now },
+	}, recheck)
+
+	l := slogutil.NewDiscardLogger()
+	for i := range byte(10) {
+		<-s.refresh(&DNSContext{}, []byte{i}, l)
+	}
+
+	assert.Equal(t, 10, syncMapLen(s.failures))
+
+	now = now.Add(recheck)
+	<-s.refresh(&DNSContext{}, []byte{0xff}, l)
+
+	assert.Equal(t, 1, syncMapLen(s.failures))
+	assert.True(t, s.recentlyFailed([]byte{0xff}))
+	assert.False(t, s.recentlyFailed([]byte{0}))
+}
+
+// syncMapLen returns the number of entries in m.
+func syncMapLen(m *sync.Map) (n int) {
+	m.Range(func(_, _ any) (cont bool) {
+		n++
+
+		return true
+	})
+
+	return n
+}
@@ -0,0 +1,291 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultPrefetchMinHits is the default minimum number of cache hits of a
+	// response to prefetch it.
+	defaultPrefetchMinHits = 2
+
+	// defaultPrefetchThreshold is the default fraction of the original TTL
+	// remaining at which a response is prefetched.
+	defaultPrefetchThreshold = 0.1
+
+	// prefetchCheckInterval is the interval between the checks for the
+	// responses to prefetch.
+	prefetchCheckInterval = 1 * time.Second
+
+	// maxPrefetchEntries is the maximum number of tracked responses.  The
+	// responses cached after reaching the limit aren't tracked until some of
+	// the tracked ones expire, and their number is logged on the next check.
+	maxPrefetchEntries = 10_000
+)
+
+// prefetchEntry is a single tracked cached response.
+type prefetchEntry struct {
+	// expire is the time when the cached response expires.
+	expire time.Time
+
+	// question is the question of the cached response.
+	question dns.Question
+
+	// ttl is the original TTL of the cached response.
+	ttl time.Duration
+
+	// hits is the number of cache hits of the response.
+	hits uint
+
+	// inProgress is true if the response is being prefetched.
+	inProgress bool
+}
+
+// prefetcher tracks the cache hits of the responses from the general cache and
+// resolves the frequently requested ones again before they expire.  It's safe
+// for concurrent use.
+type prefetcher struct {
+	// logger is used to log the prefetching.  It is never nil.
+	logger *slog.Logger
+
+	// cr resolves and caches the requests.
+	cr cachingResolver
+
+	// clock is used to check the expiration of the responses.
+	clock clock
+
+	// mu protects entries, done, and dropped.
+	mu *sync.Mutex
+
+	// entries maps the cache keys of the responses to their entries.
+	entries map[string]*prefetchEntry
+
+	// done is closed to stop the prefetching.  It's nil if the prefetcher
+	// isn't running.
+	done chan unit
+
+	// interval is the interval between the checks for the responses to
+	// prefetch.
+	interval time.Duration
+
+	// threshold is the fraction of the original TTL remaining at which a
+	// response is prefetched.
+	threshold float64
+
+	// minHits is the minimum number of cache hits of a response to prefetch
+	// it.
+	minHits uint
+
+	// dropped is the number of responses not tracked since the last check due
+	// to reaching maxPrefetchEntries.
+	dropped uint
+}
+
+// newPrefetcher returns a new properly initialized *prefetcher.  If minHits or
+// threshold are zero, the defaults are used.
+func newPrefetcher(
+	l *slog.Logger,
+	cr cachingResolver,
+	c clock,
+	minHits uint,
+	threshold float64,
+) (pf *prefetcher) {
+	if minHits == 0 {
+		minHits = defaultPrefetchMinHits
+	}
+
+	if threshold <= 0 {
+		threshold = defaultPrefetchThreshold
+	}
+
+	return &prefetcher{
+		logger:    l,
+		cr:        cr,
+		clock:     c,
+		mu:        &sync.Mutex{},
+		entries:   map[string]*prefetchEntry{},
+		interval:  prefetchCheckInterval,
+		threshold: threshold,
+		minHits:   minHits,
+	}
+}
+
+// track starts tracking the response m cached for ttl under key, resetting the
+// previous tracking of key, if any.
+func (pf *prefetcher) track(key []byte, m *dns.Msg, ttl time.Duration) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	k := string(key)
+	if _, ok := pf.entries[k]; !ok && len(pf.entries) >= maxPrefetchEntries {
+		pf.dropped++
+
+		return
+	}
+
+	pf.entries[k] = &prefetchEntry{
+		expire:   pf.clock.Now().Add(ttl),
+		question: m.Question[0],
+		ttl:      ttl,
+	}
+}
+
+// hit counts the cache hit of the response cached under key.
+func (pf *prefetcher) hit(key []byte) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if e, ok := pf.entries[string(key)]; ok {
+		e.hits++
+	}
+}
+
+// start starts the prefetching in a separate goroutine.  It must not be called
+// concurrently with stop.
+func (pf *prefetcher) start() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.done != nil {
+		return
+	}
+
+	pf.done = make(chan unit)
+
+	go pf.loop(pf.done)
+}
+
+// stop stops the prefetching.  It must not be called concurrently with start.
+func (pf *prefetcher) stop() {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.done != nil {
+		close(pf.done)
+		pf.done = nil
+	}
+}
+
+// loop checks for the responses to prefetch each interval until done is
+// closed.
+func (pf *prefetcher) loop(done chan unit) {
+	defer slogutil.RecoverAndLog(context.TODO(), pf.logger)
+
+	ticker := time.NewTicker(pf.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			pf.check()
+		}
+	}
+}
+
+// check starts prefetching the responses that are frequently hit and close to
+// expiration, and stops tracking the expired ones.  It also logs the number of
+// responses not tracked due to the limit since the previous check.
+func (pf *prefetcher) check() {
+	now := pf.clock.Now()
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	if pf.dropped > 0 {
+		pf.logger.Warn(
+			"too many responses to track for prefetching",
+			"limit", maxPrefetchEntries,
+			"dropped", pf.dropped,
+		)
+
+		pf.dropped = 0
+	}
+
+	for k, e := range pf.entries {
+		left := e.expire.Sub(now)
+		if left <= 0 {
+			delete(pf.entries, k)
+
+			continue
+		}
+
+		if e.inProgress || e.hits < pf.minHits {
+			continue
+		}
+
+		threshold := time.Duration(float64(e.ttl) * pf.threshold)
+		if left > max(threshold, pf.interval) {
+			continue
+		}
+
+		e.inProgress = true
+
+		go pf.prefetch(k, e.question)
+	}
+}
+
+// prefetch resolves the request with q again and caches the response.
+func (pf *prefetcher) prefetch(key string, q dns.Question) {
+	defer slogutil.RecoverAndLog(context.TODO(), pf.logger)
+
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{q},
+	}
+	addDO(req)
+
+	pf.logger.Debug("prefetching", "question", &q)
+
+	dctx := &DNSContext{Req: req}
+	ok, err := pf.cr.resolveUpstream(dctx)
+	if ok && dctx.Res.Rcode != dns.RcodeServerFailure {
+		// Caching the response resets the tracking.
+		pf.cr.cacheResp(dctx)
+
+		return
+	}
+
+	pf.logger.Debug("prefetching failed", "question", &q, slogutil.KeyError, err)
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+
+	delete(pf.entries, key)
+}
+
+// trackPrefetch starts tracking the response from d cached in c for
+// prefetching, if it's enabled and the response is stored in the general
+// cache.
+func (p *Proxy) trackPrefetch(d *DNSContext, c *cache) {
+	if p.prefetcher == nil || c != p.cache {
+		return
+	}
+
+	ttl := calculateTTL(d.Res)
+	if ttl == 0 || len(d.Res.Question) != 1 {
+		return
+	}
+
+	p.prefetcher.track(msgToKey(d.Res), d.Res, time.Duration(ttl)*time.Second)
+}
+
+// countHit counts the hit of the response from general cache c under key for
+// prefetching, if it's enabled.
+func (p *Proxy) countHit(d *DNSContext, c *cache, key []byte) {
+	if p.prefetcher == nil || c != p.cache || (p.EnableEDNSClientSubnet && d.ReqECS != nil) {
+		return
+	}
+
+	p.prefetcher.hit(key)
+}
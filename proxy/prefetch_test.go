@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefetcher_check(t *testing.T) {
+	const (
+		host = "prefetch.example."
+		ttl  = 100 * time.Second
+	)
+
+	start := time.Unix(1_000_000, 0)
+	now := start
+	clock := &fakeClock{onNow: func() (n time.Time) { return now }}
+
+	resolved := make(chan *dns.Msg, 1)
+	cached := make(chan unit, 1)
+	pf := newPrefetcher(slogutil.NewDiscardLogger(), &testCachingResolver{
+		onResolveUpstream: func(dctx *DNSContext) (ok bool, err error) {
+			dctx.Res = (&dns.Msg{}).SetReply(dctx.Req)
+			resolved <- dctx.Req
+
+			return true, nil
+		},
+		onCacheResp: func(_ *DNSContext) { cached <- unit{} },
+	}, clock, 2, 0.1)
+
+	resp := newReq(host, dns.TypeA, dns.ClassINET)
+	key := msgToKey(resp)
+	pf.track(key, resp, ttl)
+
+	// requireNoPrefetch checks that the prefetching hasn't been started.
+	requireNoPrefetch := func(t *testing.T) {
+		t.Helper()
+
+		pf.check()
+		require.Never(t, func() (ok bool) { return len(resolved) > 0 }, testTimeout/10, testTimeout/100)
+	}
+
+	t.Run("not_enough_hits", func(t *testing.T) {
+		pf.hit(key)
+		now = start.Add(ttl - time.Second)
+
+		requireNoPrefetch(t)
+	})
+
+	t.Run("not_expiring", func(t *testing.T) {
+		pf.hit(key)
+		now = start.Add(ttl / 2)
+
+		requireNoPrefetch(t)
+	})
+
+	t.Run("prefetch", func(t *testing.T) {
+		now = start.Add(ttl - ttl/20)
+		pf.check()
+
+		var req *dns.Msg
+		require.Eventually(t, func() (ok bool) {
+			select {
+			case req = <-resolved:
+				return true
+			default:
+				return false
+			}
+		}, testTimeout, testTimeout/100)
+
+		require.Len(t, req.Question, 1)
+		assert.Equal(t, resp.Question[0], req.Question[0])
+
+		opt := req.IsEdns0()
+		require.NotNil(t, opt)
+		assert.True(t, opt.Do())
+
+		require.Eventually(t, func() (ok bool) { return len(cached) > 0 }, testTimeout, testTimeout/100)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		now = start.Add(2 * ttl)
+		pf.check()
+
+		pf.mu.Lock()
+		defer pf.mu.Unlock()
+
+		assert.Empty(t, pf.entries)
+	})
+}
+
+func TestPrefetcher_track_limit(t *testing.T) {
+	const (
+		ttl        = 100 * time.Second
+		droppedNum = 3
+	)
+
+	clock := &fakeClock{onNow: func() (n time.Time) { return time.Unix(1_000_000, 0) }}
+	pf := newPrefetcher(slogutil.NewDiscardLogger(), &testCachingResolver{}, clock, 2, 0.1)
+
+	for i := range maxPrefetchEntries + droppedNum {
+		resp := newReq(fmt.Sprintf("host-%d.example.", i), dns.TypeA, dns.ClassINET)
+		pf.track(msgToKey(resp), resp, ttl)
+	}
+
+	assert.Len(t, pf.entries, maxPrefetchEntries)
+	assert.Equal(t, uint(droppedNum), pf.dropped)
+
+	pf.check()
+	assert.Zero(t, pf.dropped)
+}
@@ -84,7 +84,7 @@ type Proxy struct {
 	randSrc rand.Source
 
 	// messages constructs DNS messages.
-	messages MessageConstructor
+	messages ExtendedMessageConstructor
 
 	// beforeRequestHandler handles the request's context before it is resolved.
 	beforeRequestHandler BeforeRequestHandler
@@ -110,6 +110,46 @@ type Proxy struct {
 	// repetitions.
 	shortFlighter *optimisticResolver
 
+	// health tracks the health of the upstreams.  It's nil if the health
+	// checks are disabled.
+	health *healthChecker
+
+	// cookies generates and verifies the server DNS cookies.  It's nil if the
+	// cookies are disabled.
+	cookies *cookieServer
+
+	// prefetcher resolves the frequently requested cached responses before
+	// they expire.  It is nil if the prefetching is disabled.
+	prefetcher *prefetcher
+
+	// dnssec validates the DNSSEC signatures of the upstream responses.  It is
+	// nil if [Config.DNSSECValidation] is false.
+	dnssec *dnssecValidator
+
+	// zones are the local authoritative zones loaded from
+	// [Config.ZoneFiles].  It holds nil if there are no zones.
+	zones atomic.Pointer[zoneSet]
+
+	// rpz is the policy loaded from [Config.ResponsePolicyZones].  It holds
+	// nil if there are no response policy zones.
+	rpz atomic.Pointer[rpzPolicy]
+
+	// hosts answers the requests using the data from [Config.HostsFiles].  It
+	// is nil if there are no hosts files.
+	hosts *hostsWatcher
+
+	// rewriter answers the requests using [Config.Rewrites].  It is nil if
+	// there are no rewrites.
+	rewriter *rewriter
+
+	// views are the views from [Config.Views] in the order of their
+	// precedence.
+	views []*view
+
+	// inflight deduplicates the concurrent resolving of identical requests
+	// missing the cache.
+	inflight *inflightGroup
+
 	// recDetector detects recursive requests that may appear when resolving
 	// requests for private addresses.
 	recDetector *recursionDetector
@@ -159,10 +199,10 @@ type Proxy struct {
 	// dnsCryptTCPListen are the listened TCP connections for DNSCrypt.
 	dnsCryptTCPListen []net.Listener
 
-	// upstreamRTTStats maps the upstream address to its round-trip time
-	// statistics.  It's holds the statistics for all upstreams to perform a
-	// weighted random selection when using the load balancing mode.
-	upstreamRTTStats map[string]upstreamRTTStats
+	// upstreamRTTStats maps the upstream address to its round-trip time and
+	// error rate statistics.  It's holds the statistics for all upstreams to
+	// perform a weighted random selection when using the load balancing mode.
+	upstreamRTTStats map[string]*upstreamStats
 
 	// dns64Prefs is a set of NAT64 prefixes that are used to detect and
 	// construct DNS64 responses.  The DNS64 function is disabled if it is
@@ -180,6 +220,10 @@ type Proxy struct {
 	// counter counts message contexts created with [Proxy.newDNSContext].
 	counter atomic.Uint64
 
+	// roundRobinIdx is the number of requests resolved in
+	// [UpstreamModeRoundRobin], used to choose the first upstream to try.
+	roundRobinIdx atomic.Uint64
+
 	// RWMutex protects the whole proxy.
 	//
 	// TODO(e.burkov):  Find out what exactly it protects and name it properly.
@@ -189,10 +233,12 @@ type Proxy struct {
 	// ratelimitLock protects ratelimitBuckets.
 	ratelimitLock sync.Mutex
 
-	// rttLock protects upstreamRTTStats.
+	// rttLock protects upstreamRTTStats.  The statistics themselves are safe
+	// for concurrent use, so it's only locked for writing when adding the
+	// statistics for a new upstream.
 	//
 	// TODO(e.burkov):  Make it a pointer.
-	rttLock sync.Mutex
+	rttLock sync.RWMutex
 
 	// started indicates if the proxy has been started.
 	started bool
@@ -212,8 +258,8 @@ func New(c *Config) (p *Proxy, err error) {
 			c.BeforeRequestHandler,
 			noopRequestHandler{},
 		),
-		upstreamRTTStats: map[string]upstreamRTTStats{},
-		rttLock:          sync.Mutex{},
+		upstreamRTTStats: map[string]*upstreamStats{},
+		rttLock:          sync.RWMutex{},
 		ratelimitLock:    sync.Mutex{},
 		RWMutex:          sync.RWMutex{},
 		bytesPool: &sync.Pool{
@@ -224,13 +270,11 @@ func New(c *Config) (p *Proxy, err error) {
 				return &b
 			},
 		},
-		udpOOBSize: proxynetutil.UDPGetOOBSize(),
-		time:       realClock{},
-		messages: cmp.Or[MessageConstructor](
-			c.MessageConstructor,
-			defaultMessageConstructor{},
-		),
+		udpOOBSize:  proxynetutil.UDPGetOOBSize(),
+		time:        realClock{},
+		messages:    ExtendMessageConstructor(c.MessageConstructor),
 		recDetector: newRecursionDetector(recursionTTL, cachedRecurrentReqNum),
+		inflight:    newInflightGroup(),
 	}
 
 	if c.Logger != nil {
@@ -276,6 +320,56 @@ func New(c *Config) (p *Proxy, err error) {
 		return nil, fmt.Errorf("setting up DNS64: %w", err)
 	}
 
+	if p.DNSSECValidation {
+		p.dnssec, err = newDNSSECValidator(
+			p.logger,
+			p.time,
+			p.DNSSECTrustAnchors,
+			p.DNSSECNegativeTrustAnchors,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("setting up dnssec validation: %w", err)
+		}
+	}
+
+	err = p.ReloadZones()
+	if err != nil {
+		return nil, fmt.Errorf("setting up zones: %w", err)
+	}
+
+	err = p.ReloadRPZ()
+	if err != nil {
+		return nil, fmt.Errorf("setting up rpz: %w", err)
+	}
+
+	if len(p.HostsFiles) > 0 {
+		p.hosts, err = newHostsWatcher(p.logger, p.HostsFiles)
+		if err != nil {
+			return nil, fmt.Errorf("setting up hosts files: %w", err)
+		}
+	}
+
+	p.views, err = newViews(p.Views)
+	if err != nil {
+		return nil, fmt.Errorf("setting up views: %w", err)
+	}
+
+	err = p.initHealthChecker()
+	if err != nil {
+		return nil, fmt.Errorf("setting up health checks: %w", err)
+	}
+
+	if p.Cookies != nil {
+		p.cookies = newCookieServer(p.time, p.Cookies)
+	}
+
+	if len(p.Rewrites) > 0 {
+		p.rewriter, err = newRewriter(p.Rewrites, p.RewriteTTL)
+		if err != nil {
+			return nil, fmt.Errorf("setting up rewrites: %w", err)
+		}
+	}
+
 	p.RatelimitWhitelist = slices.Clone(p.RatelimitWhitelist)
 	slices.SortFunc(p.RatelimitWhitelist, netip.Addr.Compare)
 
@@ -330,7 +424,22 @@ func (p *Proxy) Start(ctx context.Context) (err error) {
 		return fmt.Errorf("configuring listeners: %w", err)
 	}
 
+	p.loadCacheSnapshot(ctx)
+
 	p.startListeners()
+
+	if p.prefetcher != nil {
+		p.prefetcher.start()
+	}
+
+	if p.health != nil {
+		p.health.start()
+	}
+
+	if p.hosts != nil {
+		p.hosts.start()
+	}
+
 	p.started = true
 
 	return nil
@@ -362,6 +471,18 @@ func (p *Proxy) Shutdown(ctx context.Context) (err error) {
 		return nil
 	}
 
+	if p.prefetcher != nil {
+		p.prefetcher.stop()
+	}
+
+	if p.health != nil {
+		p.health.stop()
+	}
+
+	if p.hosts != nil {
+		p.hosts.stop()
+	}
+
 	errs := closeAll(nil, p.tcpListen...)
 	p.tcpListen = nil
 
@@ -412,6 +533,15 @@ func (p *Proxy) Shutdown(ctx context.Context) (err error) {
 		}
 	}
 
+	for _, v := range p.views {
+		errs = closeAll(errs, v.upstream)
+	}
+
+	err = p.saveCacheSnapshot(ctx)
+	if err != nil {
+		errs = append(errs, err)
+	}
+
 	p.started = false
 
 	p.logger.InfoContext(ctx, "stopped dns proxy server")
@@ -502,39 +632,45 @@ func (p *Proxy) Addr(proto Proto) (addr net.Addr) {
 	}
 }
 
-// selectUpstreams returns the upstreams to use for the specified host.  It
-// firstly considers custom upstreams if those aren't empty and then the
+// selectUpstreams returns the healthy upstreams to use for the specified host.
+// It firstly considers custom upstreams if those aren't empty and then the
 // configured ones.  The returned slice may be empty or nil.
 func (p *Proxy) selectUpstreams(d *DNSContext) (upstreams []upstream.Upstream, isPrivate bool) {
+	upstreams, isPrivate = p.selectAllUpstreams(d)
+	if p.health != nil {
+		upstreams = p.health.filter(upstreams)
+	}
+
+	return upstreams, isPrivate
+}
+
+// selectAllUpstreams returns the upstreams to use for the specified host
+// regardless of their health.
+func (p *Proxy) selectAllUpstreams(d *DNSContext) (upstreams []upstream.Upstream, isPrivate bool) {
 	q := d.Req.Question[0]
-	host := q.Name
 
-	if d.RequestedPrivateRDNS != (netip.Prefix{}) || p.shouldStripDNS64(d.Req) {
+	dns64Prefs := p.dns64PrefsFor(d)
+	if d.RequestedPrivateRDNS != (netip.Prefix{}) || p.shouldStripDNS64(d.Req, dns64Prefs) {
 		// Use private upstreams.
 		private := p.PrivateRDNSUpstreamConfig
 		if p.UsePrivateRDNS && d.IsPrivateClient && private != nil {
 			// This may only be a PTR, SOA, and NS request.
-			upstreams = private.getUpstreamsForDomain(host)
+			upstreams = private.getUpstreamsForQuestion(q)
 		}
 
 		return upstreams, true
 	}
 
-	getUpstreams := (*UpstreamConfig).getUpstreamsForDomain
-	if q.Qtype == dns.TypeDS {
-		getUpstreams = (*UpstreamConfig).getUpstreamsForDS
-	}
-
 	if custom := d.CustomUpstreamConfig; custom != nil {
 		// Try to use custom.
-		upstreams = getUpstreams(custom.upstream, host)
+		upstreams = custom.upstream.getUpstreamsForQuestion(q)
 		if len(upstreams) > 0 {
 			return upstreams, false
 		}
 	}
 
 	// Use configured.
-	return getUpstreams(p.UpstreamConfig, host), false
+	return p.UpstreamConfig.getUpstreamsForQuestion(q), false
 }
 
 // replyFromUpstream tries to resolve the request via configured upstream
@@ -558,7 +694,7 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 
 	// Perform the DNS request.
 	resp, u, err := p.exchangeUpstreams(req, upstreams)
-	if dns64Ups := p.performDNS64(req, resp, upstreams); dns64Ups != nil {
+	if dns64Ups := p.performDNS64(req, resp, upstreams, p.dns64PrefsFor(d)); dns64Ups != nil {
 		u = dns64Ups
 	} else if p.isBogusNXDomain(resp) {
 		p.logger.Debug("response contains bogus-nxdomain ip")
@@ -576,13 +712,22 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 		// creating proxy.
 		upstreams = p.Fallbacks.getUpstreamsForDomain(req.Question[0].Name)
 
-		resp, u, err = upstream.ExchangeParallel(upstreams, req)
+		resp, u, err = p.exchangeParallel(upstreams, req)
 	}
 
 	if err != nil {
 		p.logger.Debug("resolving err", "src", src, slogutil.KeyError, err)
 	}
 
+	// Pass the bad response to the client if there is no better one, but
+	// don't consider the request resolved, so that the response isn't cached.
+	badErr := &badResponseError{}
+	if resp == nil && errors.As(err, &badErr) {
+		p.handleExchangeResult(d, req, badErr.resp, badErr.upstream)
+
+		return false, err
+	}
+
 	if resp != nil {
 		d.QueryDuration = time.Since(start)
 		p.logger.Debug("resolved", "src", src, "rtt", d.QueryDuration)
@@ -593,6 +738,73 @@ func (p *Proxy) replyFromUpstream(d *DNSContext) (ok bool, err error) {
 	return resp != nil, err
 }
 
+// resolveSubrequest resolves the request for name of qtype on behalf of d using
+// the upstreams selected for name.  Just like the requests of the clients, it's
+// answered from the cache, if it works, and the identical subrequests share the
+// upstream exchange.  The DNSSEC records are only kept in resp if d requested
+// those.  It returns nil if the request fails.
+func (p *Proxy) resolveSubrequest(d *DNSContext, name string, qtype uint16) (resp *dns.Msg) {
+	sub := &DNSContext{
+		Proto: d.Proto,
+		Req: &dns.Msg{
+			MsgHdr: dns.MsgHdr{
+				Id:               dns.Id(),
+				RecursionDesired: true,
+			},
+			Question: []dns.Question{{
+				Name:   name,
+				Qtype:  qtype,
+				Qclass: dns.ClassINET,
+			}},
+		},
+		Addr:                 d.Addr,
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+		view:                 d.view,
+	}
+
+	var ok bool
+	var err error
+	switch {
+	case !p.cacheWorks(sub):
+		ok, err = p.resolveUpstream(sub)
+	case p.replyFromCache(sub):
+		ok = true
+	default:
+		addDO(sub.Req)
+		ok, err = p.inflight.do(p.inflightKey(sub), sub, p.resolveAndCache)
+	}
+
+	if !ok || sub.Res == nil {
+		p.logger.Debug("subrequest failed", "name", name, slogutil.KeyError, err)
+
+		return nil
+	}
+
+	filterMsg(sub.Res, sub.Res, d.adBit, d.doBit, 0)
+
+	return sub.Res
+}
+
+// replyWithCNAME returns the response to d with cname, which must be owned by
+// the requested name, in the answer section followed by the records of the
+// requested type resolved for its target.
+func (p *Proxy) replyWithCNAME(d *DNSContext, cname *dns.CNAME) (resp *dns.Msg) {
+	resp = p.messages.NewMsgNODATA(d.Req)
+	resp.Answer = append(resp.Answer, cname)
+
+	q := d.Req.Question[0]
+	if q.Qtype == dns.TypeCNAME {
+		return resp
+	}
+
+	if targetResp := p.resolveSubrequest(d, cname.Target, q.Qtype); targetResp != nil {
+		resp.Rcode = targetResp.Rcode
+		resp.Answer = append(resp.Answer, targetResp.Answer...)
+	}
+
+	return resp
+}
+
 // handleExchangeResult handles the result after the upstream exchange.  It sets
 // the response to d and sets the upstream that have resolved the request.  If
 // the response is nil, it generates a server failure response.
@@ -637,18 +849,40 @@ const defaultUDPBufSize = 2048
 // Resolve is the default resolving method used by the DNS proxy to query
 // upstream servers.  It expects dctx is filled with the request, the client's
 func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
-	if p.EnableEDNSClientSubnet {
-		dctx.processECS(p.EDNSAddr, p.logger)
+	if ecsEnabled, ednsAddr := p.ecsSettings(dctx); ecsEnabled {
+		dctx.processECS(ednsAddr, p.logger)
 	}
 
 	dctx.calcFlagsAndSize()
 
+	// Answer from the hosts files, authoritatively for the local zones, and
+	// using the rewrites.  Such responses aren't cached, since the data may be
+	// reloaded at any time.
+	if p.replyFromHosts(dctx) || p.replyFromZones(dctx) || p.replyFromRewrites(dctx) {
+		dctx.scrub()
+
+		return nil
+	}
+
+	// Apply the response policy triggered by the request itself, unless the
+	// response may trigger a rule from a preceding zone.  The passthru action
+	// disables the policy of the following zones for the response as well.
+	rule, ruleZone, final := p.rpzBefore(dctx)
+	if final && rule.action != rpzActionPassthru {
+		p.applyRPZ(dctx, rule)
+		dctx.scrub()
+
+		return nil
+	}
+
 	// Also don't lookup the cache for responses with DNSSEC checking disabled
 	// since only validated responses are cached and those may be not the
 	// desired result for user specifying CD flag.
 	cacheWorks := p.cacheWorks(dctx)
 	if cacheWorks {
 		if p.replyFromCache(dctx) {
+			p.applyRPZAfter(dctx, rule, ruleZone)
+
 			// Complete the response from cache.
 			dctx.scrub()
 
@@ -658,21 +892,16 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 		// On cache miss request for DNSSEC from the upstream to cache it
 		// afterwards.
 		addDO(dctx.Req)
-	}
-
-	var ok bool
-	ok, err = p.replyFromUpstream(dctx)
 
-	// Don't cache the responses having CD flag, just like Dnsmasq does.  It
-	// prevents the cache from being poisoned with unvalidated answers which may
-	// differ from validated ones.
-	//
-	// See https://github.com/imp/dnsmasq/blob/770bce967cfc9967273d0acfb3ea018fb7b17522/src/forward.c#L1169-L1172.
-	if cacheWorks && ok && !dctx.Res.CheckingDisabled {
-		// Cache the response with DNSSEC RRs.
-		p.cacheResp(dctx)
+		// Share the upstream exchange between the identical requests missing
+		// the cache at the same time.
+		_, err = p.inflight.do(p.inflightKey(dctx), dctx, p.resolveAndCache)
+	} else {
+		_, err = p.resolveUpstream(dctx)
 	}
 
+	p.applyRPZAfter(dctx, rule, ruleZone)
+
 	// It is possible that the response is nil if the upstream hasn't been
 	// chosen.
 	if dctx.Res != nil {
@@ -689,17 +918,50 @@ func (p *Proxy) Resolve(dctx *DNSContext) (err error) {
 	return err
 }
 
+// resolveUpstream resolves the request from dctx using the upstreams and
+// validates the response, if needed.  ok is true if the response may be cached.
+func (p *Proxy) resolveUpstream(dctx *DNSContext) (ok bool, err error) {
+	// Don't validate the responses from the private upstreams, since those
+	// are intended for locally-served zones.
+	validates := p.dnssec != nil &&
+		!dctx.Req.CheckingDisabled &&
+		dctx.RequestedPrivateRDNS == netip.Prefix{}
+	if validates {
+		// Signatures are required for validation.
+		addDO(dctx.Req)
+	}
+
+	ok, err = p.replyFromUpstream(dctx)
+	if ok && validates {
+		ok = p.validateDNSSEC(dctx)
+	}
+
+	return ok, err
+}
+
+// resolveAndCache resolves the request from dctx, which has missed the cache,
+// and caches the response.
+func (p *Proxy) resolveAndCache(dctx *DNSContext) (ok bool, err error) {
+	ok, err = p.resolveUpstream(dctx)
+
+	// Don't cache the responses having CD flag, just like Dnsmasq does.  It
+	// prevents the cache from being poisoned with unvalidated answers which may
+	// differ from validated ones.
+	//
+	// See https://github.com/imp/dnsmasq/blob/770bce967cfc9967273d0acfb3ea018fb7b17522/src/forward.c#L1169-L1172.
+	if ok && !dctx.Res.CheckingDisabled {
+		// Cache the response with DNSSEC RRs.
+		p.cacheResp(dctx)
+	}
+
+	return ok, err
+}
+
 // cacheWorks returns true if the cache works for the given context.  If not, it
 // returns false and logs the reason why.
 func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 	var reason string
 	switch {
-	case p.cache == nil:
-		reason = "disabled"
-	case dctx.RequestedPrivateRDNS != netip.Prefix{}:
-		// Don't cache the requests intended for local upstream servers, those
-		// should be fast enough as is.
-		reason = "requested address is private"
 	case dctx.CustomUpstreamConfig != nil && dctx.CustomUpstreamConfig.cache == nil:
 		// In case of custom upstream cache is not configured, the global proxy
 		// cache cannot be used because different upstreams can return different
@@ -709,6 +971,14 @@ func (p *Proxy) cacheWorks(dctx *DNSContext) (ok bool) {
 		//
 		// TODO(e.burkov):  It probably should be decided after resolve.
 		reason = "custom upstreams cache is not configured"
+	case dctx.CustomUpstreamConfig == nil && p.cache == nil:
+		// The custom upstream cache, e.g. the one of a view, works regardless
+		// of the global one.
+		reason = "disabled"
+	case dctx.RequestedPrivateRDNS != netip.Prefix{}:
+		// Don't cache the requests intended for local upstream servers, those
+		// should be fast enough as is.
+		reason = "requested address is private"
 	case dctx.Req.CheckingDisabled:
 		reason = "dnssec check disabled"
 	default:
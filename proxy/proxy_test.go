@@ -13,11 +13,11 @@ import (
 	"net/netip"
 	"net/url"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
-	glcache "github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
@@ -543,7 +543,7 @@ func TestProxy_Resolve_dnssecCache(t *testing.T) {
 		dctx := newDNSContext(ansHdr.Name, ansHdr.Rrtype, ansHdr.Class, tc.edns, txtDataLen/2)
 
 		t.Run(tc.name, func(t *testing.T) {
-			t.Cleanup(p.cache.items.Clear)
+			t.Cleanup(p.cache.clear)
 
 			err := p.Resolve(dctx)
 			require.NoError(t, err)
@@ -1068,6 +1068,160 @@ func TestProxy_ReplyFromUpstream_badResponse(t *testing.T) {
 	assert.Equal(t, d.Req.Question[0], d.Res.Question[0])
 }
 
+func TestProxy_Resolve_failureRcodes(t *testing.T) {
+	// newRcodeUpstream returns an upstream with addr responding with rcode,
+	// with an A record if withAnswer is true, and counting the requests in
+	// counter.
+	newRcodeUpstream := func(
+		addr string,
+		rcode int,
+		withAnswer bool,
+		counter *atomic.Int64,
+	) (u upstream.Upstream) {
+		return &fakeUpstream{
+			onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+				counter.Add(1)
+
+				resp = (&dns.Msg{}).SetRcode(req, rcode)
+				if withAnswer {
+					resp.Answer = append(resp.Answer, &dns.A{
+						Hdr: dns.RR_Header{
+							Name:   req.Question[0].Name,
+							Rrtype: dns.TypeA,
+							Class:  dns.ClassINET,
+							Ttl:    60,
+						},
+						A: net.IP{1, 2, 3, 4},
+					})
+				}
+
+				return resp, nil
+			},
+			onAddress: func() (a string) { return addr },
+			onClose:   func() (err error) { return nil },
+		}
+	}
+
+	testCases := []struct {
+		name         string
+		wantErrMsg   string
+		primaryRcode int
+		primaryAns   bool
+		fallbackCode int
+		wantRcode    int
+		wantUpstream string
+		wantPrimary  int64
+		wantFallback int64
+	}{{
+		name:         "success",
+		wantErrMsg:   "",
+		primaryRcode: dns.RcodeSuccess,
+		primaryAns:   true,
+		fallbackCode: dns.RcodeSuccess,
+		wantRcode:    dns.RcodeSuccess,
+		wantUpstream: "primary",
+		wantPrimary:  1,
+		wantFallback: 0,
+	}, {
+		name:         "not_failure",
+		wantErrMsg:   "",
+		primaryRcode: dns.RcodeNameError,
+		primaryAns:   false,
+		fallbackCode: dns.RcodeSuccess,
+		wantRcode:    dns.RcodeNameError,
+		wantUpstream: "primary",
+		wantPrimary:  2,
+		wantFallback: 0,
+	}, {
+		name:         "failure_rcode",
+		wantErrMsg:   "",
+		primaryRcode: dns.RcodeServerFailure,
+		primaryAns:   false,
+		fallbackCode: dns.RcodeSuccess,
+		wantRcode:    dns.RcodeSuccess,
+		wantUpstream: "fallback",
+		wantPrimary:  1,
+		wantFallback: 1,
+	}, {
+		name:         "empty_answer",
+		wantErrMsg:   "",
+		primaryRcode: dns.RcodeSuccess,
+		primaryAns:   false,
+		fallbackCode: dns.RcodeSuccess,
+		wantRcode:    dns.RcodeSuccess,
+		wantUpstream: "fallback",
+		wantPrimary:  1,
+		wantFallback: 1,
+	}, {
+		name:         "all_fail",
+		wantErrMsg:   "bad response: rcode REFUSED",
+		primaryRcode: dns.RcodeServerFailure,
+		primaryAns:   false,
+		fallbackCode: dns.RcodeRefused,
+		wantRcode:    dns.RcodeRefused,
+		wantUpstream: "fallback",
+		wantPrimary:  2,
+		wantFallback: 2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			primaryNum, fallbackNum := &atomic.Int64{}, &atomic.Int64{}
+
+			p := mustNew(t, &Config{
+				Logger:        slogutil.NewDiscardLogger(),
+				UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+				TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+				UpstreamConfig: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{
+						newRcodeUpstream("primary", tc.primaryRcode, tc.primaryAns, primaryNum),
+					},
+				},
+				Fallbacks: &UpstreamConfig{
+					Upstreams: []upstream.Upstream{
+						newRcodeUpstream("fallback", tc.fallbackCode, true, fallbackNum),
+					},
+				},
+				TrustedProxies:         defaultTrustedProxies,
+				RatelimitSubnetLenIPv4: 24,
+				RatelimitSubnetLenIPv6: 64,
+				CacheEnabled:           true,
+				FailureRcodes:          []int{dns.RcodeServerFailure, dns.RcodeRefused},
+				FailOnEmptyAnswer:      true,
+			})
+
+			d := &DNSContext{
+				Req:  newHostTestMessage("example"),
+				Addr: netip.MustParseAddrPort("1.2.3.4:1234"),
+			}
+
+			err := p.Resolve(d)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			require.NotNil(t, d.Res)
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+
+			require.NotNil(t, d.Upstream)
+			assert.Equal(t, tc.wantUpstream, d.Upstream.Address())
+
+			// Resolve again to make sure the bad responses aren't cached.
+			d = &DNSContext{
+				Req:  newHostTestMessage("example"),
+				Addr: netip.MustParseAddrPort("1.2.3.4:1234"),
+			}
+
+			err = p.Resolve(d)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+
+			require.NotNil(t, d.Res)
+			assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+
+			assert.Equal(t, tc.wantPrimary, primaryNum.Load())
+			assert.Equal(t, tc.wantFallback, fallbackNum.Load())
+		})
+	}
+}
+
 func TestExchangeCustomUpstreamConfig(t *testing.T) {
 	prx := mustStartDefaultProxy(t)
 
@@ -1450,7 +1604,7 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	p.initCache()
 	out, in := make(chan unit), make(chan unit)
 	p.shortFlighter.cr = &testCachingResolver{
-		onReplyFromUpstream: func(dctx *DNSContext) (ok bool, err error) {
+		onResolveUpstream: func(dctx *DNSContext) (ok bool, err error) {
 			dctx.Res = buildResp(dctx.Req, nonOptimisticTTL)
 
 			return true, nil
@@ -1479,10 +1633,8 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 		m: buildResp(req, 0),
 		u: testUpsAddr,
 	}).pack()
-	items := glcache.New(glcache.Config{
-		EnableLRU: true,
-	})
-	items.Set(key, data)
+	items := createCache(0)
+	require.NoError(t, items.Set(context.Background(), key, data, 0))
 	p.cache.items = items
 
 	err := p.Resolve(firstCtx)
@@ -1505,7 +1657,7 @@ func TestProxy_Resolve_withOptimisticResolver(t *testing.T) {
 	<-out
 
 	// Should be served from cache.
-	data = p.cache.items.Get(msgToKey(firstCtx.Req))
+	data = p.cache.lookup(p.cache.items, msgToKey(firstCtx.Req))
 	unpacked, expired := p.cache.unpackItem(data, firstCtx.Req)
 	require.False(t, expired)
 	require.NotNil(t, unpacked)
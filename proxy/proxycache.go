@@ -2,9 +2,13 @@ package proxy
 
 import (
 	"net"
+	"net/netip"
 	"slices"
+	"strings"
+	"time"
 
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/miekg/dns"
 )
 
 // cacheForContext returns cache object for the given context.
@@ -21,51 +25,105 @@ func (p *Proxy) cacheForContext(d *DNSContext) (c *cache) {
 func (p *Proxy) replyFromCache(d *DNSContext) (hit bool) {
 	dctxCache := p.cacheForContext(d)
 
-	var ci *cacheItem
+	ci, expired, key := p.getFromCache(d, dctxCache)
+	if hit = ci != nil; !hit {
+		return hit
+	}
+
+	d.Res = ci.m
+	d.CachedUpstreamAddr = ci.u
+
+	if !expired {
+		p.countHit(d, dctxCache, key)
+
+		return hit
+	} else if !dctxCache.optimistic {
+		return hit
+	}
+
+	if p.shortFlighter.recentlyFailed(key) {
+		p.logger.Debug("serving stale response after recent failure", slogutil.KeyPrefix, CacheLogPrefix)
+	} else if p.refreshExpired(d, dctxCache, key) {
+		return hit
+	}
+
+	d.ede = &dns.EDNS0_EDE{InfoCode: dns.ExtendedErrorCodeStaleAnswer}
+
+	return hit
+}
+
+// getFromCache looks up the response for d in c.  expired is true if the item's
+// TTL is expired.  key is the resulting key for d.
+func (p *Proxy) getFromCache(d *DNSContext, c *cache) (ci *cacheItem, expired bool, key []byte) {
 	var cacheSource string
-	var expired bool
-	var key []byte
 
-	// TODO(d.kolyshev): Use EnableEDNSClientSubnet from dctxCache.
-	if p.Config.EnableEDNSClientSubnet && d.ReqECS != nil {
-		ci, expired, key = dctxCache.getWithSubnet(d.Req, d.ReqECS)
+	if c.withECS() && d.ReqECS != nil {
+		ci, expired, key = c.getWithSubnet(d.Req, d.ReqECS)
 		cacheSource = "subnet cache"
 	} else {
-		ci, expired, key = dctxCache.get(d.Req)
+		ci, expired, key = c.get(d.Req)
 		cacheSource = "general cache"
 	}
 
-	if hit = ci != nil; !hit {
-		return hit
+	if ci != nil {
+		p.logger.Debug(
+			"replying from cache",
+			slogutil.KeyPrefix, CacheLogPrefix,
+			"source", cacheSource,
+			"ecs_enabled", c.withECS(),
+			"expired", expired,
+		)
 	}
 
-	d.Res = ci.m
-	d.CachedUpstreamAddr = ci.u
+	return ci, expired, key
+}
 
-	p.logger.Debug(
-		"replying from cache",
-		slogutil.KeyPrefix, CacheLogPrefix,
-		"source", cacheSource,
-		"ecs_enabled", p.Config.EnableEDNSClientSubnet,
-	)
+// refreshExpired starts resolving the request from d, which has an expired
+// response in c, again.  If [Config.CacheOptimisticClientTimeout] is positive,
+// it waits for the resolving for that time and returns true if d has been
+// updated with the refreshed response.
+func (p *Proxy) refreshExpired(d *DNSContext, c *cache, key []byte) (refreshed bool) {
+	// Build a reduced clone of the current context to avoid data race.
+	minCtxClone := &DNSContext{
+		// It is only read inside the optimistic resolver.
+		CustomUpstreamConfig: d.CustomUpstreamConfig,
+		view:                 d.view,
+		ReqECS:               cloneIPNet(d.ReqECS),
+		IsPrivateClient:      d.IsPrivateClient,
+	}
+	if d.Req != nil {
+		minCtxClone.Req = d.Req.Copy()
+		addDO(minCtxClone.Req)
+	}
 
-	if dctxCache.optimistic && expired {
-		// Build a reduced clone of the current context to avoid data race.
-		minCtxClone := &DNSContext{
-			// It is only read inside the optimistic resolver.
-			CustomUpstreamConfig: d.CustomUpstreamConfig,
-			ReqECS:               cloneIPNet(d.ReqECS),
-			IsPrivateClient:      d.IsPrivateClient,
-		}
-		if d.Req != nil {
-			minCtxClone.Req = d.Req.Copy()
-			addDO(minCtxClone.Req)
-		}
+	done := p.shortFlighter.refresh(minCtxClone, key, p.logger)
 
-		go p.shortFlighter.resolveOnce(minCtxClone, key, p.logger)
+	timeout := p.CacheOptimisticClientTimeout
+	if timeout <= 0 {
+		return false
 	}
 
-	return hit
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		// Go on.
+	case <-timer.C:
+		p.logger.Debug("refreshing timed out", slogutil.KeyPrefix, CacheLogPrefix)
+
+		return false
+	}
+
+	ci, expired, _ := p.getFromCache(d, c)
+	if ci == nil || expired {
+		return false
+	}
+
+	d.Res = ci.m
+	d.CachedUpstreamAddr = ci.u
+
+	return true
 }
 
 // cloneIPNet returns a deep clone of n.
@@ -85,8 +143,9 @@ func cloneIPNet(n *net.IPNet) (clone *net.IPNet) {
 func (p *Proxy) cacheResp(d *DNSContext) {
 	dctxCache := p.cacheForContext(d)
 
-	if !p.EnableEDNSClientSubnet {
+	if !dctxCache.withECS() {
 		dctxCache.set(d.Res, d.Upstream, p.logger)
+		p.trackPrefetch(d, dctxCache)
 
 		return
 	}
@@ -134,14 +193,110 @@ func (p *Proxy) cacheResp(d *DNSContext) {
 		dctxCache.setWithSubnet(d.Res, d.Upstream, &net.IPNet{IP: nil, Mask: nil}, p.logger)
 	default:
 		dctxCache.set(d.Res, d.Upstream, p.logger)
+		p.trackPrefetch(d, dctxCache)
+	}
+}
+
+// CacheEntry is a single entry of the DNS cache.
+type CacheEntry struct {
+	// Subnet is the EDNS Client Subnet the response is cached for.  It's
+	// invalid for the responses cached regardless of the client subnet and for
+	// the ones cached for the zero-length subnet.
+	Subnet netip.Prefix
+
+	// Name is the lowercased FQDN from the question of the cached response.
+	Name string
+
+	// Upstream is the address of the upstream which resolved the response.  It
+	// may be empty.
+	Upstream string
+
+	// TTL is the time left until the response expires.  It's not positive for
+	// the expired responses kept for the optimistic cache.
+	TTL time.Duration
+
+	// Qtype is the type from the question of the cached response.
+	Qtype uint16
+
+	// Qclass is the class from the question of the cached response.
+	Qclass uint16
+}
+
+// CacheStats are the statistics of the DNS cache.
+type CacheStats struct {
+	// Hits is the number of lookups which found a response.
+	Hits uint64
+
+	// Misses is the number of lookups which found no response.
+	Misses uint64
+
+	// Evictions is the number of responses removed from the cache to free
+	// space for the new ones.
+	Evictions uint64
+
+	// Count is the number of cached responses.
+	Count int
+
+	// Size is the total size of the cached responses in bytes.
+	Size int
+}
+
+// CacheEntries returns the entries of the DNS cache of p.  It returns nil if
+// the cache is disabled or its storage can't be iterated over, which is the
+// case for [RedisCacheStorage].  It doesn't affect the order in which the
+// entries are evicted from the cache.
+func (p *Proxy) CacheEntries() (entries []*CacheEntry) {
+	if p.cache == nil {
+		return nil
+	}
+
+	return p.cache.entries(time.Now())
+}
+
+// EvictCache removes the responses for name from the DNS cache of p, as well as
+// the ones for its subdomains if subtree is true.  If qtype is [dns.TypeNone],
+// the responses of all types are removed.  n is the number of removed
+// responses.
+//
+// If the storage of the cache can't be iterated over, which is the case for
+// [RedisCacheStorage], only the response for exactly name and qtype of class IN
+// without subnet is removed.  Nothing is removed if subtree is true or qtype is
+// [dns.TypeNone] in that case.
+func (p *Proxy) EvictCache(name string, qtype uint16, subtree bool) (n int) {
+	if p.cache == nil {
+		return 0
+	}
+
+	name = dns.Fqdn(strings.ToLower(name))
+	n = p.cache.evict(name, qtype, subtree)
+	p.logger.Debug(
+		"evicted",
+		slogutil.KeyPrefix, CacheLogPrefix,
+		"name", name,
+		"qtype", dns.Type(qtype),
+		"subtree", subtree,
+		"count", n,
+	)
+
+	return n
+}
+
+// CacheStats returns the statistics of the DNS cache of p.  It returns nil if
+// the cache is disabled.  Only the hits and the misses are counted for the
+// external storages, such as [RedisCacheStorage].
+func (p *Proxy) CacheStats() (s *CacheStats) {
+	if p.cache == nil {
+		return nil
 	}
+
+	return p.cache.stats()
 }
 
-// ClearCache clears the DNS cache of p.
+// ClearCache clears the DNS cache of p.  If [Config.CacheStorage] is shared
+// between several proxies, it's cleared for all of them.
 func (p *Proxy) ClearCache() {
 	if p.cache != nil {
-		p.cache.clearItems()
-		p.cache.clearItemsWithSubnet()
+		p.cache.clear()
 		p.logger.Debug("cleared", slogutil.KeyPrefix, CacheLogPrefix)
 	}
 }
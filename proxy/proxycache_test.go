@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_serveStale(t *testing.T) {
+	const (
+		host       = "stale.example."
+		freshTTL   = 3600
+		staleTTL   = 30
+		maxAge     = time.Hour
+		cliTimeout = testTimeout / 10
+	)
+
+	newResp := func(req *dns.Msg, ttl uint32) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   host,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}}
+
+		return resp
+	}
+
+	// onExchange is replaced by each test case.
+	var onExchange atomic.Pointer[func(req *dns.Msg) (resp *dns.Msg, err error)]
+	var exchanges atomic.Uint32
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			return (*onExchange.Load())(req)
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+
+		CacheOptimistic:                true,
+		CacheOptimisticAnswerTTL:       staleTTL * time.Second,
+		CacheOptimisticMaxAge:          maxAge,
+		CacheOptimisticClientTimeout:   cliTimeout,
+		CacheOptimisticRecheckInterval: time.Hour,
+	})
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+
+	// setExpired puts the response expired age ago into the cache.
+	setExpired := func(t *testing.T, age time.Duration) {
+		t.Helper()
+
+		req := newReq(host, dns.TypeA, dns.ClassINET)
+		data := (&cacheItem{
+			m: newResp(req, 0),
+			u: testUpsAddr,
+		}).pack()
+		binary.BigEndian.PutUint32(data, uint32(time.Now().Add(-age).Unix()))
+
+		p.ClearCache()
+		require.NoError(t, p.cache.items.Set(context.Background(), msgToKey(req), data, 0))
+	}
+
+	// resolve resolves the request for host and returns the response along
+	// with the extended error, if any.
+	resolve := func(t *testing.T) (res *dns.Msg, ede *dns.EDNS0_EDE) {
+		t.Helper()
+
+		req := newReq(host, dns.TypeA, dns.ClassINET)
+		req.SetEdns0(defaultUDPBufSize, false)
+
+		dctx := &DNSContext{Req: req, Addr: cli}
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		for _, o := range dctx.Res.IsEdns0().Option {
+			if e, ok := o.(*dns.EDNS0_EDE); ok {
+				ede = e
+			}
+		}
+
+		return dctx.Res, ede
+	}
+
+	t.Run("refreshed", func(t *testing.T) {
+		setExpired(t, time.Minute)
+		exchanges.Store(0)
+
+		fresh := func(req *dns.Msg) (resp *dns.Msg, err error) { return newResp(req, freshTTL), nil }
+		onExchange.Store(&fresh)
+
+		res, ede := resolve(t)
+		assert.Equal(t, uint32(freshTTL), res.Answer[0].Header().Ttl)
+		assert.Nil(t, ede)
+		assert.Equal(t, uint32(1), exchanges.Load())
+	})
+
+	t.Run("timed_out", func(t *testing.T) {
+		setExpired(t, time.Minute)
+		exchanges.Store(0)
+
+		release := make(chan unit)
+		slow := func(req *dns.Msg) (resp *dns.Msg, err error) {
+			<-release
+
+			return newResp(req, freshTTL), nil
+		}
+		onExchange.Store(&slow)
+
+		res, ede := resolve(t)
+		close(release)
+
+		assert.Equal(t, uint32(staleTTL), res.Answer[0].Header().Ttl)
+		require.NotNil(t, ede)
+		assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, ede.InfoCode)
+
+		// Wait for the refresh to be cached.
+		require.Eventually(t, func() (ok bool) {
+			res, ede = resolve(t)
+
+			return ede == nil
+		}, testTimeout, testTimeout/10)
+		assert.Equal(t, uint32(1), exchanges.Load())
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		setExpired(t, time.Minute)
+		exchanges.Store(0)
+
+		servFail := func(req *dns.Msg) (resp *dns.Msg, err error) {
+			return (&dns.Msg{}).SetRcode(req, dns.RcodeServerFailure), nil
+		}
+		onExchange.Store(&servFail)
+
+		for range 3 {
+			res, ede := resolve(t)
+			assert.Equal(t, uint32(staleTTL), res.Answer[0].Header().Ttl)
+			require.NotNil(t, ede)
+			assert.Equal(t, dns.ExtendedErrorCodeStaleAnswer, ede.InfoCode)
+		}
+
+		// The subsequent requests shouldn't be refreshed within the recheck
+		// interval.
+		assert.Equal(t, uint32(1), exchanges.Load())
+	})
+
+	t.Run("too_stale", func(t *testing.T) {
+		setExpired(t, 2*maxAge)
+		exchanges.Store(0)
+
+		fresh := func(req *dns.Msg) (resp *dns.Msg, err error) { return newResp(req, freshTTL), nil }
+		onExchange.Store(&fresh)
+
+		res, ede := resolve(t)
+		assert.Equal(t, uint32(freshTTL), res.Answer[0].Header().Ttl)
+		assert.Nil(t, ede)
+		assert.Equal(t, uint32(1), exchanges.Load())
+	})
+}
+
+func TestProxy_CacheEntries(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+		EnableEDNSClientSubnet: true,
+	})
+
+	l := slogutil.NewDiscardLogger()
+	resp := (&dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Response: true,
+		},
+		Answer: []dns.RR{newRR(t, "Example.ORG.", dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})},
+	}).SetQuestion("Example.ORG.", dns.TypeA)
+	p.cache.set(resp, upstreamWithAddr, l)
+
+	subnet := &net.IPNet{IP: net.IP{1, 2, 3, 0}, Mask: net.CIDRMask(24, 32)}
+	p.cache.setWithSubnet(resp, upstreamWithAddr, subnet, l)
+
+	entries := p.CacheEntries()
+	require.Len(t, entries, 2)
+
+	if entries[0].Subnet.IsValid() {
+		entries[0], entries[1] = entries[1], entries[0]
+	}
+
+	for _, e := range entries {
+		assert.Equal(t, "example.org.", e.Name)
+		assert.Equal(t, dns.TypeA, e.Qtype)
+		assert.Equal(t, uint16(dns.ClassINET), e.Qclass)
+		assert.Equal(t, testUpsAddr, e.Upstream)
+		assert.InDelta(t, defaultTestTTL*time.Second, e.TTL, float64(2*time.Second))
+	}
+
+	assert.False(t, entries[0].Subnet.IsValid())
+	assert.Equal(t, netip.MustParsePrefix("1.2.3.0/24"), entries[1].Subnet)
+}
+
+func TestProxy_EvictCache(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         testCacheSize,
+	})
+
+	l := slogutil.NewDiscardLogger()
+	hosts := []string{"example.org.", "sub.example.org.", "notexample.org."}
+
+	// fill puts the A and AAAA responses for hosts into the cache.
+	fill := func(t *testing.T) {
+		t.Helper()
+
+		p.ClearCache()
+		for _, h := range hosts {
+			a := (&dns.Msg{
+				MsgHdr: dns.MsgHdr{Response: true},
+				Answer: []dns.RR{newRR(t, h, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})},
+			}).SetQuestion(h, dns.TypeA)
+			p.cache.set(a, upstreamWithAddr, l)
+
+			aaaa := (&dns.Msg{
+				MsgHdr: dns.MsgHdr{Response: true},
+				Answer: []dns.RR{newRR(t, h, dns.TypeAAAA, defaultTestTTL, net.IPv6loopback)},
+			}).SetQuestion(h, dns.TypeAAAA)
+			p.cache.set(aaaa, upstreamWithAddr, l)
+		}
+	}
+
+	testCases := []struct {
+		name    string
+		evict   string
+		wantN   int
+		qtype   uint16
+		subtree bool
+	}{{
+		name:    "name",
+		evict:   "EXAMPLE.org",
+		wantN:   2,
+		qtype:   dns.TypeNone,
+		subtree: false,
+	}, {
+		name:    "name_qtype",
+		evict:   "example.org.",
+		wantN:   1,
+		qtype:   dns.TypeAAAA,
+		subtree: false,
+	}, {
+		name:    "subtree",
+		evict:   "example.org.",
+		wantN:   4,
+		qtype:   dns.TypeNone,
+		subtree: true,
+	}, {
+		name:    "subtree_qtype",
+		evict:   "example.org.",
+		wantN:   2,
+		qtype:   dns.TypeA,
+		subtree: true,
+	}, {
+		name:    "root",
+		evict:   ".",
+		wantN:   6,
+		qtype:   dns.TypeNone,
+		subtree: true,
+	}, {
+		name:    "not_found",
+		evict:   "example.com.",
+		wantN:   0,
+		qtype:   dns.TypeNone,
+		subtree: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fill(t)
+
+			n := p.EvictCache(tc.evict, tc.qtype, tc.subtree)
+			assert.Equal(t, tc.wantN, n)
+			assert.Len(t, p.CacheEntries(), 2*len(hosts)-tc.wantN)
+		})
+	}
+}
+
+func TestProxy_CacheStats(t *testing.T) {
+	p := mustNew(t, &Config{
+		Logger:                 slogutil.NewDiscardLogger(),
+		UDPListenAddr:          []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr:          []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig:         newTestUpstreamConfig(t, defaultTimeout, testDefaultUpstreamAddr),
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		CacheSizeBytes:         1024,
+	})
+
+	l := slogutil.NewDiscardLogger()
+	newResp := func(i int) (resp *dns.Msg) {
+		host := fmt.Sprintf("host%d.example.", i)
+
+		return (&dns.Msg{
+			MsgHdr: dns.MsgHdr{Response: true},
+			Answer: []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})},
+		}).SetQuestion(host, dns.TypeA)
+	}
+
+	const respNum = 50
+	for i := range respNum {
+		p.cache.set(newResp(i), upstreamWithAddr, l)
+	}
+
+	ci, _, _ := p.cache.get(newResp(respNum - 1))
+	require.NotNil(t, ci)
+
+	ci, _, _ = p.cache.get(newResp(respNum))
+	require.Nil(t, ci)
+
+	s := p.CacheStats()
+	require.NotNil(t, s)
+
+	assert.Equal(t, uint64(1), s.Hits)
+	assert.Equal(t, uint64(1), s.Misses)
+	assert.Positive(t, s.Evictions)
+	assert.Equal(t, respNum-int(s.Evictions), s.Count)
+	assert.Positive(t, s.Size)
+	assert.Len(t, p.CacheEntries(), s.Count)
+}
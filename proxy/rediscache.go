@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/redis"
+)
+
+const (
+	// DefaultRedisCachePrefix is the default prefix of the keys of the cached
+	// responses in Redis.
+	DefaultRedisCachePrefix = "dnsproxy:"
+
+	// redisScanCount is the number of keys requested per SCAN command.
+	redisScanCount = 1000
+
+	// redisMaxArrayLen is the maximum number of elements of an array reply.
+	// SCAN may return more keys than requested, so it's set well above
+	// [redisScanCount].
+	redisMaxArrayLen = 16 * redisScanCount
+)
+
+// RedisCacheStorageConfig is the configuration of the [RedisCacheStorage].
+type RedisCacheStorageConfig struct {
+	// Addr is the address of the Redis server in the host:port form.  It must
+	// not be empty.
+	Addr string
+
+	// Username is the name of the Redis user to authenticate as.  If empty,
+	// the default user is used.
+	Username string
+
+	// Password is the password to authenticate with.  If empty, no
+	// authentication is performed.
+	Password string
+
+	// Prefix is prepended to the keys of the cached responses.  It separates
+	// those from the other data in the same database.  If empty,
+	// [DefaultRedisCachePrefix] is used.
+	Prefix string
+
+	// Timeout is the timeout of dialing and of each command.  If not positive,
+	// a second is used.
+	Timeout time.Duration
+
+	// DB is the number of the Redis database to use.
+	DB int
+
+	// MaxIdleConns is the maximum number of idle connections kept open.  If
+	// not positive, 16 is used.
+	MaxIdleConns int
+}
+
+// RedisCacheStorage is a [CacheStorage] which keeps the cached responses in
+// Redis, so that they are shared between several proxies.  It's safe for
+// concurrent use.
+type RedisCacheStorage struct {
+	// client is used to send the commands to Redis.
+	client *redis.Client
+
+	// prefix is prepended to the keys.
+	prefix []byte
+}
+
+// type check
+var (
+	_ CacheStorage = (*RedisCacheStorage)(nil)
+	_ io.Closer    = (*RedisCacheStorage)(nil)
+)
+
+// NewRedisCacheStorage returns a new properly initialized *RedisCacheStorage.
+// The connections are established on demand.  conf must not be nil.
+func NewRedisCacheStorage(conf *RedisCacheStorageConfig) (s *RedisCacheStorage, err error) {
+	client, err := redis.New(&redis.Config{
+		Addr:         conf.Addr,
+		Username:     conf.Username,
+		Password:     conf.Password,
+		Timeout:      conf.Timeout,
+		DB:           conf.DB,
+		MaxIdleConns: conf.MaxIdleConns,
+		// The values are the packed cache items, and the keys are way shorter
+		// than those.
+		MaxBulkLen:  maxPackedLen,
+		MaxArrayLen: redisMaxArrayLen,
+	})
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return nil, err
+	}
+
+	prefix := conf.Prefix
+	if prefix == "" {
+		prefix = DefaultRedisCachePrefix
+	}
+
+	return &RedisCacheStorage{
+		client: client,
+		prefix: []byte(prefix),
+	}, nil
+}
+
+// key returns the Redis key for k.
+func (s *RedisCacheStorage) key(k []byte) (rk []byte) {
+	rk = make([]byte, 0, len(s.prefix)+len(k))
+	rk = append(rk, s.prefix...)
+
+	return append(rk, k...)
+}
+
+// Get implements the [CacheStorage] interface for *RedisCacheStorage.
+func (s *RedisCacheStorage) Get(ctx context.Context, key []byte) (val []byte, err error) {
+	reply, err := s.client.Do(ctx, []byte("GET"), s.key(key))
+	if err != nil {
+		return nil, fmt.Errorf("redis get: %w", err)
+	}
+
+	switch reply := reply.(type) {
+	case nil:
+		return nil, nil
+	case []byte:
+		return reply, nil
+	default:
+		return nil, fmt.Errorf("redis get: unexpected reply type %T", reply)
+	}
+}
+
+// Set implements the [CacheStorage] interface for *RedisCacheStorage.  The
+// values with ttl shorter than a millisecond are stored without expiration.
+func (s *RedisCacheStorage) Set(
+	ctx context.Context,
+	key []byte,
+	val []byte,
+	ttl time.Duration,
+) (err error) {
+	args := [][]byte{[]byte("SET"), s.key(key), val}
+	if ms := ttl.Milliseconds(); ms > 0 {
+		args = append(args, []byte("PX"), strconv.AppendInt(nil, ms, 10))
+	}
+
+	_, err = s.client.Do(ctx, args...)
+	if err != nil {
+		return fmt.Errorf("redis set: %w", err)
+	}
+
+	return nil
+}
+
+// Delete implements the [CacheStorage] interface for *RedisCacheStorage.
+func (s *RedisCacheStorage) Delete(ctx context.Context, key []byte) (err error) {
+	_, err = s.client.Do(ctx, []byte("DEL"), s.key(key))
+	if err != nil {
+		return fmt.Errorf("redis del: %w", err)
+	}
+
+	return nil
+}
+
+// Clear implements the [CacheStorage] interface for *RedisCacheStorage.  It
+// removes all the keys with the configured prefix, so clearing the cache of a
+// single proxy, e.g. with [Proxy.ClearCache], clears it for every proxy sharing
+// the same Redis server and prefix.
+func (s *RedisCacheStorage) Clear(ctx context.Context) (err error) {
+	pattern := append(escapeRedisGlob(s.prefix), '*')
+	count := strconv.AppendInt(nil, redisScanCount, 10)
+
+	cursor := []byte("0")
+	for {
+		var keys [][]byte
+		cursor, keys, err = s.scan(ctx, cursor, pattern, count)
+		if err != nil {
+			return fmt.Errorf("redis scan: %w", err)
+		}
+
+		if len(keys) > 0 {
+			_, err = s.client.Do(ctx, append([][]byte{[]byte("DEL")}, keys...)...)
+			if err != nil {
+				return fmt.Errorf("redis del: %w", err)
+			}
+		}
+
+		if string(cursor) == "0" {
+			return nil
+		}
+	}
+}
+
+// scan performs a single SCAN command and returns the next cursor and the found
+// keys.
+func (s *RedisCacheStorage) scan(
+	ctx context.Context,
+	cursor []byte,
+	pattern []byte,
+	count []byte,
+) (next []byte, keys [][]byte, err error) {
+	reply, err := s.client.Do(
+		ctx,
+		[]byte("SCAN"),
+		cursor,
+		[]byte("MATCH"),
+		pattern,
+		[]byte("COUNT"),
+		count,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	arr, ok := reply.([]any)
+	if !ok || len(arr) != 2 {
+		return nil, nil, fmt.Errorf("unexpected reply %v", reply)
+	}
+
+	next, ok = arr[0].([]byte)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected cursor type %T", arr[0])
+	}
+
+	found, ok := arr[1].([]any)
+	if !ok {
+		return nil, nil, fmt.Errorf("unexpected keys type %T", arr[1])
+	}
+
+	keys = make([][]byte, 0, len(found))
+	for i, k := range found {
+		kb, isBytes := k.([]byte)
+		if !isBytes {
+			return nil, nil, fmt.Errorf("key at index %d: unexpected type %T", i, k)
+		}
+
+		keys = append(keys, kb)
+	}
+
+	return next, keys, nil
+}
+
+// Close implements the [io.Closer] interface for *RedisCacheStorage.  It
+// closes the idle connections.
+func (s *RedisCacheStorage) Close() (err error) {
+	return s.client.Close()
+}
+
+// escapeRedisGlob escapes the special characters of the Redis glob patterns in
+// s.
+func escapeRedisGlob(s []byte) (escaped []byte) {
+	escaped = make([]byte, 0, len(s))
+	for _, b := range s {
+		switch b {
+		case '*', '?', '[', ']', '\\':
+			escaped = append(escaped, '\\')
+		}
+
+		escaped = append(escaped, b)
+	}
+
+	return escaped
+}
@@ -0,0 +1,400 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/internal/redis"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRedis is an in-process stand-in for the Redis server.  It only supports
+// the commands used by [RedisCacheStorage].
+type testRedis struct {
+	// mu protects values, ttls, and scans.
+	mu *sync.Mutex
+
+	// values maps the keys to the stored values.
+	values map[string][]byte
+
+	// ttls maps the keys to the TTLs they were set with.
+	ttls map[string]time.Duration
+
+	// password is the password required to authenticate, if any.
+	password string
+
+	// scans is the number of SCAN commands handled.
+	scans int
+}
+
+// newTestRedis starts a new *testRedis requiring password, if not empty, and
+// returns its address.
+func newTestRedis(t *testing.T, password string) (r *testRedis, addr string) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, l.Close)
+
+	r = &testRedis{
+		mu:       &sync.Mutex{},
+		values:   map[string][]byte{},
+		ttls:     map[string]time.Duration{},
+		password: password,
+	}
+
+	go func() {
+		for {
+			conn, acceptErr := l.Accept()
+			if acceptErr != nil {
+				return
+			}
+
+			go r.serve(conn)
+		}
+	}()
+
+	return r, l.Addr().String()
+}
+
+// serve handles the commands from conn until it's closed.
+func (r *testRedis) serve(conn net.Conn) {
+	defer func() { _ = conn.Close() }()
+
+	rr := redis.NewReader(conn, maxPackedLen, redisMaxArrayLen)
+	authed := r.password == ""
+	for {
+		req, err := rr.ReadReply()
+		if err != nil {
+			return
+		}
+
+		arr, _ := req.([]any)
+		args := make([]string, 0, len(arr))
+		for _, a := range arr {
+			b, _ := a.([]byte)
+			args = append(args, string(b))
+		}
+
+		var resp string
+		if len(args) == 0 {
+			resp = "-ERR empty command\r\n"
+		} else if cmd := strings.ToUpper(args[0]); cmd == "AUTH" {
+			authed = args[len(args)-1] == r.password
+			resp = "+OK\r\n"
+			if !authed {
+				resp = "-WRONGPASS invalid password\r\n"
+			}
+		} else if !authed {
+			resp = "-NOAUTH Authentication required.\r\n"
+		} else {
+			resp = r.handle(cmd, args[1:])
+		}
+
+		if _, err = io.WriteString(conn, resp); err != nil {
+			return
+		}
+	}
+}
+
+// handle returns the encoded reply to cmd with args.
+func (r *testRedis) handle(cmd string, args []string) (resp string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch cmd {
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		v, ok := r.values[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+	case "SET":
+		r.values[args[0]] = []byte(args[1])
+		r.ttls[args[0]] = 0
+		if len(args) == 4 && strings.EqualFold(args[2], "PX") {
+			ms, _ := strconv.Atoi(args[3])
+			r.ttls[args[0]] = time.Duration(ms) * time.Millisecond
+		}
+
+		return "+OK\r\n"
+	case "DEL":
+		n := 0
+		for _, k := range args {
+			if _, ok := r.values[k]; ok {
+				delete(r.values, k)
+				delete(r.ttls, k)
+				n++
+			}
+		}
+
+		return fmt.Sprintf(":%d\r\n", n)
+	case "SCAN":
+		r.scans++
+
+		b := &strings.Builder{}
+		var keys []string
+		for k := range r.values {
+			if ok, _ := path.Match(args[2], k); ok {
+				keys = append(keys, k)
+			}
+		}
+
+		_, _ = fmt.Fprintf(b, "*2\r\n$1\r\n0\r\n*%d\r\n", len(keys))
+		for _, k := range keys {
+			_, _ = fmt.Fprintf(b, "$%d\r\n%s\r\n", len(k), k)
+		}
+
+		return b.String()
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// value returns the value stored for key and its TTL.
+func (r *testRedis) value(key string) (val []byte, ttl time.Duration, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	val, ok = r.values[key]
+
+	return val, r.ttls[key], ok
+}
+
+func TestRedisCacheStorage(t *testing.T) {
+	const (
+		password = "secret"
+		prefix   = "test:"
+	)
+
+	r, addr := newTestRedis(t, password)
+	s, err := NewRedisCacheStorage(&RedisCacheStorageConfig{
+		Addr:     addr,
+		Password: password,
+		Prefix:   prefix,
+		Timeout:  testTimeout,
+		DB:       1,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	ctx := context.Background()
+	key, val := []byte("key"), []byte("value\r\nwith\x00binary")
+
+	t.Run("set_get", func(t *testing.T) {
+		err = s.Set(ctx, key, val, time.Minute)
+		require.NoError(t, err)
+
+		stored, ttl, ok := r.value(prefix + string(key))
+		require.True(t, ok)
+		assert.Equal(t, val, stored)
+		assert.Equal(t, time.Minute, ttl)
+
+		var got []byte
+		got, err = s.Get(ctx, key)
+		require.NoError(t, err)
+		assert.Equal(t, val, got)
+	})
+
+	t.Run("no_ttl", func(t *testing.T) {
+		err = s.Set(ctx, key, val, 0)
+		require.NoError(t, err)
+
+		_, ttl, ok := r.value(prefix + string(key))
+		require.True(t, ok)
+		assert.Zero(t, ttl)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		require.NoError(t, s.Set(ctx, key, val, 0))
+		require.NoError(t, s.Delete(ctx, key))
+
+		got, getErr := s.Get(ctx, key)
+		require.NoError(t, getErr)
+		assert.Nil(t, got)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		r.handle("SET", []string{"other:key", "value"})
+		for i := range 3 {
+			require.NoError(t, s.Set(ctx, []byte(fmt.Sprintf("key%d", i)), val, 0))
+		}
+
+		require.NoError(t, s.Clear(ctx))
+
+		for i := range 3 {
+			got, getErr := s.Get(ctx, []byte(fmt.Sprintf("key%d", i)))
+			require.NoError(t, getErr)
+			assert.Nil(t, got)
+		}
+
+		_, _, ok := r.value("other:key")
+		assert.True(t, ok)
+	})
+
+	t.Run("wrong_password", func(t *testing.T) {
+		bad, newErr := NewRedisCacheStorage(&RedisCacheStorageConfig{
+			Addr:     addr,
+			Password: "wrong",
+			Timeout:  testTimeout,
+		})
+		require.NoError(t, newErr)
+		testutil.CleanupAndRequireSuccess(t, bad.Close)
+
+		_, err = bad.Get(ctx, key)
+		testutil.AssertErrorMsg(
+			t,
+			"redis get: authenticating: redis: WRONGPASS invalid password",
+			err,
+		)
+	})
+}
+
+// scanCount returns the number of SCAN commands handled by r.
+func (r *testRedis) scanCount() (n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.scans
+}
+
+func TestCache_redisStorage(t *testing.T) {
+	const host = "evict.example."
+
+	r, addr := newTestRedis(t, "")
+	s, err := NewRedisCacheStorage(&RedisCacheStorageConfig{
+		Addr:    addr,
+		Timeout: testTimeout,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, s.Close)
+
+	c := newCache(&cacheConfig{
+		logger:  slogutil.NewDiscardLogger(),
+		storage: s,
+		withECS: true,
+	})
+
+	l := slogutil.NewDiscardLogger()
+	_, subnet, err := net.ParseCIDR("1.2.3.0/24")
+	require.NoError(t, err)
+
+	// setResp stores the response to the A request for host with and without
+	// subnet.
+	setResp := func(t *testing.T) {
+		t.Helper()
+
+		resp := (&dns.Msg{}).SetReply(newReq(host, dns.TypeA, dns.ClassINET))
+		resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+
+		c.set(resp, nil, l)
+		c.setWithSubnet(resp, nil, subnet, l)
+	}
+
+	t.Run("evict", func(t *testing.T) {
+		setResp(t)
+
+		assert.Zero(t, c.evict(host, dns.TypeA, true))
+		assert.Zero(t, c.evict(host, dns.TypeNone, false))
+		assert.Zero(t, c.evict(host, dns.TypeAAAA, false))
+		assert.Equal(t, 1, c.evict(host, dns.TypeA, false))
+		assert.Zero(t, c.evict(host, dns.TypeA, false))
+
+		ci, _, _ := c.get(newReq(host, dns.TypeA, dns.ClassINET))
+		assert.Nil(t, ci)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		setResp(t)
+
+		before := r.scanCount()
+		c.clear()
+		assert.Equal(t, before+1, r.scanCount())
+
+		ci, _, _ := c.get(newReq(host, dns.TypeA, dns.ClassINET))
+		assert.Nil(t, ci)
+
+		ci, _, _ = c.getWithSubnet(newReq(host, dns.TypeA, dns.ClassINET), subnet)
+		assert.Nil(t, ci)
+	})
+}
+
+func TestProxy_Resolve_redisCache(t *testing.T) {
+	const host = "shared.example."
+
+	_, addr := newTestRedis(t, "")
+
+	var exchanges atomic.Uint32
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			resp = (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{newRR(t, host, dns.TypeA, defaultTestTTL, net.IP{1, 2, 3, 4})}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	// newProxy returns a new proxy with its own connections to the shared
+	// Redis.
+	newProxy := func(t *testing.T) (p *Proxy) {
+		t.Helper()
+
+		s, err := NewRedisCacheStorage(&RedisCacheStorageConfig{
+			Addr:    addr,
+			Timeout: testTimeout,
+		})
+		require.NoError(t, err)
+		testutil.CleanupAndRequireSuccess(t, s.Close)
+
+		return mustNew(t, &Config{
+			Logger:        slogutil.NewDiscardLogger(),
+			UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+			TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{ups},
+			},
+			TrustedProxies:         defaultTrustedProxies,
+			RatelimitSubnetLenIPv4: 24,
+			RatelimitSubnetLenIPv6: 64,
+			CacheEnabled:           true,
+			CacheStorage:           s,
+		})
+	}
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+	for i, p := range []*Proxy{newProxy(t), newProxy(t)} {
+		dctx := &DNSContext{
+			Req:  newReq(host, dns.TypeA, dns.ClassINET),
+			Addr: cli,
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+		require.Len(t, dctx.Res.Answer, 1)
+
+		assert.Equalf(t, uint32(1), exchanges.Load(), "proxy at index %d", i)
+	}
+}
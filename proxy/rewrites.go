@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
+)
+
+// defaultRewriteTTL is the TTL of the rewritten records used if
+// [Config.RewriteTTL] is zero.
+const defaultRewriteTTL = 10
+
+// Rewrite is a rule answering the requests for a domain and its subdomains
+// locally, like the address option of dnsmasq.
+type Rewrite struct {
+	// Addr is the address to answer the A or AAAA requests with.  It's only
+	// used if Target is empty.
+	Addr netip.Addr
+
+	// Domain is the domain, the requests for which and for its subdomains are
+	// rewritten.
+	Domain string
+
+	// Target is the domain name to answer the requests with a CNAME record
+	// to.  The target itself is resolved using the upstreams.
+	Target string
+}
+
+// rewriteRule is the combination of all the rewrites for a single domain.
+type rewriteRule struct {
+	// target is the canonical name to answer with.  It's empty if the rule
+	// answers with addrs.
+	target string
+
+	// addrs are the addresses to answer with.
+	addrs []netip.Addr
+}
+
+// rewriter answers the requests using the configured rewrites.  It's immutable
+// and safe for concurrent use.
+type rewriter struct {
+	// rules maps the lowercased fully-qualified domains to their rules.
+	rules map[string]*rewriteRule
+
+	// ttl is the TTL of the rewritten records.
+	ttl uint32
+}
+
+// newRewriter returns a new properly initialized *rewriter for rws.  If ttl is
+// zero, defaultRewriteTTL is used.
+func newRewriter(rws []*Rewrite, ttl uint32) (rw *rewriter, err error) {
+	rw = &rewriter{
+		rules: make(map[string]*rewriteRule, len(rws)),
+		ttl:   ttl,
+	}
+
+	if rw.ttl == 0 {
+		rw.ttl = defaultRewriteTTL
+	}
+
+	for i, r := range rws {
+		err = rw.add(r)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite at index %d: %w", i, err)
+		}
+	}
+
+	return rw, nil
+}
+
+// add validates r and adds it to the rules.
+func (rw *rewriter) add(r *Rewrite) (err error) {
+	domain := strings.ToLower(strings.TrimSuffix(r.Domain, "."))
+	err = netutil.ValidateDomainName(domain)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return err
+	}
+
+	domain = dns.Fqdn(domain)
+	rule := rw.rules[domain]
+	if rule == nil {
+		rule = &rewriteRule{}
+		rw.rules[domain] = rule
+	}
+
+	switch {
+	case r.Target != "":
+		err = netutil.ValidateDomainName(strings.TrimSuffix(r.Target, "."))
+		if err != nil {
+			return fmt.Errorf("target: %w", err)
+		} else if len(rule.addrs) > 0 || rule.target != "" {
+			return fmt.Errorf("domain %q: cname conflicts with other rewrites", domain)
+		}
+
+		rule.target = dns.Fqdn(r.Target)
+	case r.Addr.IsValid():
+		if rule.target != "" {
+			return fmt.Errorf("domain %q: address conflicts with cname", domain)
+		}
+
+		rule.addrs = append(rule.addrs, r.Addr.Unmap())
+	default:
+		return errors.Error("no address or target")
+	}
+
+	return nil
+}
+
+// match returns the rule for the lowercased fully-qualified name or its
+// closest parent domain, if any.
+func (rw *rewriter) match(name string) (r *rewriteRule) {
+	for ; name != "."; name = parentName(name) {
+		if r = rw.rules[name]; r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// replyFromRewrites sets the response for d from the rewrites matching the
+// requested name, if any.  It returns true if the response is set.
+func (p *Proxy) replyFromRewrites(d *DNSContext) (ok bool) {
+	if p.rewriter == nil {
+		return false
+	}
+
+	q := d.Req.Question[0]
+	if q.Qclass != dns.ClassINET {
+		return false
+	}
+
+	r := p.rewriter.match(strings.ToLower(q.Name))
+	if r == nil {
+		return false
+	}
+
+	if r.target == "" {
+		d.Res = p.messages.NewMsgAddrs(d.Req, p.rewriter.ttl, r.addrs)
+
+		return true
+	}
+
+	d.Res = p.replyWithCNAME(d, &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Name:   q.Name,
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    p.rewriter.ttl,
+		},
+		Target: r.target,
+	})
+
+	return true
+}
@@ -0,0 +1,187 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAddrUpstream returns a fake upstream answering the A requests with addr.
+func newAddrUpstream(t *testing.T, addr net.IP) (ups *fakeUpstream) {
+	t.Helper()
+
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			q := req.Question[0]
+			if q.Qtype == dns.TypeA {
+				resp.Answer = append(resp.Answer, newRR(t, q.Name, dns.TypeA, 60, addr))
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+func TestProxy_Resolve_rewrites(t *testing.T) {
+	defaultUps := newAddrUpstream(t, net.IP{192, 0, 2, 1})
+	lanUps := newAddrUpstream(t, net.IP{192, 0, 2, 2})
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{defaultUps},
+			DomainReservedUpstreams: map[string][]upstream.Upstream{
+				"target.lan.": {lanUps},
+			},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		Rewrites: []*Rewrite{{
+			Domain: "example.lan",
+			Addr:   netip.MustParseAddr("10.0.0.5"),
+		}, {
+			Domain: "example.lan",
+			Addr:   netip.MustParseAddr("fd00::5"),
+		}, {
+			Domain: "v4.example.lan",
+			Addr:   netip.MustParseAddr("10.0.0.4"),
+		}, {
+			Domain: "alias.lan.",
+			Target: "host.target.lan",
+		}, {
+			Domain: "ALIAS.org",
+			Target: "example.org",
+		}},
+		RewriteTTL: 60,
+	})
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+
+	testCases := []struct {
+		name    string
+		host    string
+		wantAns []string
+		qtype   uint16
+	}{{
+		name:    "address",
+		host:    "example.lan.",
+		wantAns: []string{"example.lan.\t60\tIN\tA\t10.0.0.5"},
+		qtype:   dns.TypeA,
+	}, {
+		name:    "address_ipv6",
+		host:    "example.lan.",
+		wantAns: []string{"example.lan.\t60\tIN\tAAAA\tfd00::5"},
+		qtype:   dns.TypeAAAA,
+	}, {
+		name:    "subdomain",
+		host:    "Sub.Example.lan.",
+		wantAns: []string{"Sub.Example.lan.\t60\tIN\tA\t10.0.0.5"},
+		qtype:   dns.TypeA,
+	}, {
+		name:    "closest",
+		host:    "sub.v4.example.lan.",
+		wantAns: []string{"sub.v4.example.lan.\t60\tIN\tA\t10.0.0.4"},
+		qtype:   dns.TypeA,
+	}, {
+		name:    "closest_nodata",
+		host:    "v4.example.lan.",
+		wantAns: nil,
+		qtype:   dns.TypeAAAA,
+	}, {
+		name: "cname_routed",
+		host: "alias.lan.",
+		wantAns: []string{
+			"alias.lan.\t60\tIN\tCNAME\thost.target.lan.",
+			"host.target.lan.\t60\tIN\tA\t192.0.2.2",
+		},
+		qtype: dns.TypeA,
+	}, {
+		name: "cname_default",
+		host: "www.alias.org.",
+		wantAns: []string{
+			"www.alias.org.\t60\tIN\tCNAME\texample.org.",
+			"example.org.\t60\tIN\tA\t192.0.2.1",
+		},
+		qtype: dns.TypeA,
+	}, {
+		name:    "cname_only",
+		host:    "alias.org.",
+		wantAns: []string{"alias.org.\t60\tIN\tCNAME\texample.org."},
+		qtype:   dns.TypeCNAME,
+	}, {
+		name:    "not_rewritten",
+		host:    "lan.",
+		wantAns: []string{"lan.\t60\tIN\tA\t192.0.2.1"},
+		qtype:   dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req:  newReq(tc.host, tc.qtype, dns.ClassINET),
+				Addr: cli,
+			}
+
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+
+			var ans []string
+			for _, rr := range d.Res.Answer {
+				ans = append(ans, rr.String())
+			}
+			assert.Equal(t, tc.wantAns, ans)
+		})
+	}
+}
+
+func TestNewRewriter(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		rws        []*Rewrite
+	}{{
+		name:       "empty",
+		wantErrMsg: "rewrite at index 0: no address or target",
+		rws:        []*Rewrite{{Domain: "example.lan"}},
+	}, {
+		name: "bad_domain",
+		wantErrMsg: `rewrite at index 0: bad domain name "bad domain": ` +
+			`bad top-level domain name label "bad domain": ` +
+			`bad top-level domain name label rune ' '`,
+		rws: []*Rewrite{{Domain: "bad domain", Target: "example.lan"}},
+	}, {
+		name:       "conflict",
+		wantErrMsg: `rewrite at index 1: domain "example.lan.": address conflicts with cname`,
+		rws: []*Rewrite{{
+			Domain: "example.lan",
+			Target: "example.org",
+		}, {
+			Domain: "example.lan",
+			Addr:   netip.MustParseAddr("10.0.0.5"),
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newRewriter(tc.rws, 0)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
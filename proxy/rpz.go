@@ -0,0 +1,614 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+// RPZConfig is the configuration of a single response policy zone, see
+// https://datatracker.ietf.org/doc/html/draft-vixie-dnsop-dns-rpz.
+type RPZConfig struct {
+	// Name is the name of the zone.  It's required if the zone is transferred
+	// from Primary.
+	Name string
+
+	// Path is the path to the zone file.  If empty, the zone is transferred
+	// from Primary.
+	Path string
+
+	// Primary is the address of the primary server to transfer the zone from
+	// via AXFR.  If it has no port, 53 is used.  It's only used if Path is
+	// empty.
+	Primary string
+}
+
+// Special names of the RPZ triggers and actions.
+const (
+	rpzClientIPLabel = "rpz-client-ip"
+	rpzIPLabel       = "rpz-ip"
+	rpzNSDNameLabel  = "rpz-nsdname"
+	rpzNSIPLabel     = "rpz-nsip"
+
+	rpzPassthruName = "rpz-passthru."
+	rpzDropName     = "rpz-drop."
+	rpzTCPOnlyName  = "rpz-tcp-only."
+)
+
+// rpzTransferTimeout is the timeout for each network operation of a zone
+// transfer.
+const rpzTransferTimeout = 10 * time.Second
+
+// rpzAction is the action of an RPZ rule.
+type rpzAction uint8
+
+const (
+	// rpzActionNXDOMAIN makes the proxy respond with NXDOMAIN.
+	rpzActionNXDOMAIN rpzAction = iota
+
+	// rpzActionNODATA makes the proxy respond with NODATA.
+	rpzActionNODATA
+
+	// rpzActionPassthru makes the proxy resolve the request as usual, without
+	// checking the other rules.
+	rpzActionPassthru
+
+	// rpzActionDrop makes the proxy not respond at all.
+	rpzActionDrop
+
+	// rpzActionLocalData makes the proxy respond with the records of the rule.
+	rpzActionLocalData
+)
+
+// rpzRule is a single rule of a response policy zone.
+type rpzRule struct {
+	// records are the local data records of the rule, owned by the trigger
+	// name.  Those are only used with rpzActionLocalData.
+	records []dns.RR
+
+	// action is the action to take when the rule is triggered.
+	action rpzAction
+}
+
+// newRPZRule returns the rule with the action encoded by rrs, the records of a
+// single trigger.  ok is false if the action isn't supported.
+func newRPZRule(rrs []dns.RR) (r *rpzRule, ok bool) {
+	if len(rrs) == 1 {
+		if cname, isCNAME := rrs[0].(*dns.CNAME); isCNAME {
+			switch strings.ToLower(cname.Target) {
+			case ".":
+				return &rpzRule{action: rpzActionNXDOMAIN}, true
+			case "*.":
+				return &rpzRule{action: rpzActionNODATA}, true
+			case rpzPassthruName:
+				return &rpzRule{action: rpzActionPassthru}, true
+			case rpzDropName:
+				return &rpzRule{action: rpzActionDrop}, true
+			case rpzTCPOnlyName:
+				return nil, false
+			}
+		}
+	}
+
+	return &rpzRule{
+		records: rrs,
+		action:  rpzActionLocalData,
+	}, true
+}
+
+// rpzPrefixRule is an RPZ rule triggered by an IP address within a subnet.
+type rpzPrefixRule struct {
+	// rule is the triggered rule.
+	rule *rpzRule
+
+	// prefix is the subnet of the trigger.
+	prefix netip.Prefix
+}
+
+// rpzZone is a single parsed response policy zone.  All the trigger names are
+// lowercased and relative to the zone apex, with the trailing dot.
+type rpzZone struct {
+	// qnames are the rules triggered by the exact requested names.
+	qnames map[string]*rpzRule
+
+	// qnameWildcards are the rules triggered by the subdomains of the names.
+	qnameWildcards map[string]*rpzRule
+
+	// nsdnames are the rules triggered by the exact names of the name
+	// servers of the requested domain.
+	nsdnames map[string]*rpzRule
+
+	// nsdnameWildcards are the rules triggered by the subdomains of the names
+	// of the name servers of the requested domain.
+	nsdnameWildcards map[string]*rpzRule
+
+	// clientIPs are the rules triggered by the addresses of the clients.
+	clientIPs []rpzPrefixRule
+
+	// respIPs are the rules triggered by the addresses in the responses.
+	respIPs []rpzPrefixRule
+}
+
+// newRPZZone returns the response policy zone with the rules from z.
+// unsupported is the number of the rules skipped since their triggers or
+// actions aren't supported.
+func newRPZZone(z *zone) (rz *rpzZone, unsupported int, err error) {
+	rz = &rpzZone{
+		qnames:           map[string]*rpzRule{},
+		qnameWildcards:   map[string]*rpzRule{},
+		nsdnames:         map[string]*rpzRule{},
+		nsdnameWildcards: map[string]*rpzRule{},
+	}
+
+	for name, rrsets := range z.records {
+		if name == z.origin {
+			// Skip the SOA and NS records of the apex.
+			continue
+		}
+
+		var rrs []dns.RR
+		for _, set := range rrsets {
+			rrs = append(rrs, set...)
+		}
+
+		r, ok := newRPZRule(rrs)
+		if !ok {
+			unsupported++
+
+			continue
+		}
+
+		trigger := strings.TrimSuffix(name, z.origin)
+		err = rz.add(trigger, r)
+		if errors.Is(err, errors.ErrUnsupported) {
+			unsupported++
+		} else if err != nil {
+			return nil, 0, fmt.Errorf("trigger %q: %w", name, err)
+		}
+	}
+
+	return rz, unsupported, nil
+}
+
+// add adds the rule triggered by the lowercased trigger name relative to the
+// zone apex.
+func (rz *rpzZone) add(trigger string, r *rpzRule) (err error) {
+	labels := strings.Split(strings.TrimSuffix(trigger, "."), ".")
+	switch last := len(labels) - 1; labels[last] {
+	case rpzClientIPLabel, rpzIPLabel:
+		var pref netip.Prefix
+		pref, err = parseRPZPrefix(labels[:last])
+		if err != nil {
+			return err
+		}
+
+		pr := rpzPrefixRule{rule: r, prefix: pref}
+		if labels[last] == rpzClientIPLabel {
+			rz.clientIPs = append(rz.clientIPs, pr)
+		} else {
+			rz.respIPs = append(rz.respIPs, pr)
+		}
+	case rpzNSDNameLabel:
+		addRPZName(rz.nsdnames, rz.nsdnameWildcards, strings.Join(labels[:last], ".")+".", r)
+	case rpzNSIPLabel:
+		return errors.ErrUnsupported
+	default:
+		addRPZName(rz.qnames, rz.qnameWildcards, trigger, r)
+	}
+
+	return nil
+}
+
+// addRPZName adds r triggered by name to exact, or to wildcards if name is a
+// wildcard.
+func addRPZName(exact, wildcards map[string]*rpzRule, name string, r *rpzRule) {
+	if base, ok := strings.CutPrefix(name, "*."); ok {
+		wildcards[base] = r
+	} else {
+		exact[name] = r
+	}
+}
+
+// parseRPZPrefix parses the subnet encoded in the labels of an IP trigger: the
+// prefix length followed by the reversed IPv4 octets or IPv6 hextets, where
+// "zz" stands for the longest run of zero hextets.
+func parseRPZPrefix(labels []string) (pref netip.Prefix, err error) {
+	if len(labels) < 2 {
+		return netip.Prefix{}, errors.Error("bad ip trigger")
+	}
+
+	addr := make([]string, 0, len(labels)-1)
+	for i := len(labels) - 1; i > 0; i-- {
+		addr = append(addr, labels[i])
+	}
+
+	var s string
+	if len(addr) == 4 && !strings.ContainsAny(strings.Join(addr, ""), "abcdefz") {
+		s = strings.Join(addr, ".")
+	} else {
+		for i, l := range addr {
+			if l == "zz" {
+				addr[i] = ""
+			}
+		}
+
+		s = strings.Join(addr, ":")
+		if strings.HasPrefix(s, ":") {
+			s = ":" + s
+		}
+
+		if strings.HasSuffix(s, ":") {
+			s += ":"
+		}
+	}
+
+	return netip.ParsePrefix(s + "/" + labels[0])
+}
+
+// matchRPZName returns the rule triggered by the lowercased name in exact or
+// wildcards, preferring the exact match and the closest wildcard.
+func matchRPZName(exact, wildcards map[string]*rpzRule, name string) (r *rpzRule) {
+	if r = exact[name]; r != nil {
+		return r
+	}
+
+	for n := name; n != "."; {
+		n = parentName(n)
+		if r = wildcards[n]; r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// matchRPZPrefix returns the rule triggered by addr from rules, preferring the
+// longest prefix.
+func matchRPZPrefix(rules []rpzPrefixRule, addr netip.Addr) (r *rpzRule) {
+	bits := -1
+	for _, pr := range rules {
+		if pr.prefix.Bits() > bits && pr.prefix.Contains(addr) {
+			r, bits = pr.rule, pr.prefix.Bits()
+		}
+	}
+
+	return r
+}
+
+// matchBefore returns the rule triggered by the client address or by the
+// lowercased requested name.
+func (rz *rpzZone) matchBefore(client netip.Addr, name string) (r *rpzRule) {
+	if r = matchRPZPrefix(rz.clientIPs, client); r != nil {
+		return r
+	}
+
+	return matchRPZName(rz.qnames, rz.qnameWildcards, name)
+}
+
+// matchResponse returns the rule triggered by the addresses in resp.
+func (rz *rpzZone) matchResponse(resp *dns.Msg) (r *rpzRule) {
+	if len(rz.respIPs) == 0 {
+		return nil
+	}
+
+	for _, rr := range resp.Answer {
+		var ip net.IP
+		switch rr := rr.(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		default:
+			continue
+		}
+
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			continue
+		}
+
+		if r = matchRPZPrefix(rz.respIPs, addr.Unmap()); r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// hasNSDName returns true if rz has NSDNAME triggers.
+func (rz *rpzZone) hasNSDName() (ok bool) {
+	return len(rz.nsdnames)+len(rz.nsdnameWildcards) > 0
+}
+
+// hasResponseTriggers returns true if rz has the triggers matched against the
+// response, i.e. the response IP and NSDNAME ones.
+func (rz *rpzZone) hasResponseTriggers() (ok bool) {
+	return len(rz.respIPs) > 0 || rz.hasNSDName()
+}
+
+// matchNSDName returns the rule triggered by any of the lowercased name server
+// names.
+func (rz *rpzZone) matchNSDName(nsNames []string) (r *rpzRule) {
+	for _, ns := range nsNames {
+		if r = matchRPZName(rz.nsdnames, rz.nsdnameWildcards, ns); r != nil {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// rpzPolicy is an immutable set of response policy zones.
+type rpzPolicy struct {
+	// zones are the zones in the order of their precedence.
+	zones []*rpzZone
+}
+
+// loadRPZ loads the response policy zones configured by confs.
+func (p *Proxy) loadRPZ(confs []*RPZConfig) (pol *rpzPolicy, err error) {
+	pol = &rpzPolicy{
+		zones: make([]*rpzZone, 0, len(confs)),
+	}
+
+	for i, c := range confs {
+		var z *zone
+		if c.Path != "" {
+			z, err = loadZoneFile(c.Path)
+		} else {
+			z, err = transferZone(c.Name, c.Primary)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rpz at index %d: %w", i, err)
+		}
+
+		var rz *rpzZone
+		var unsupported int
+		rz, unsupported, err = newRPZZone(z)
+		if err != nil {
+			return nil, fmt.Errorf("rpz %q: %w", z.origin, err)
+		}
+
+		if unsupported > 0 {
+			p.logger.Warn("rpz has unsupported rules", "zone", z.origin, "count", unsupported)
+		}
+
+		pol.zones = append(pol.zones, rz)
+	}
+
+	return pol, nil
+}
+
+// transferZone transfers the zone with name from the primary server at addr
+// via AXFR.
+func transferZone(name, addr string) (z *zone, err error) {
+	if name == "" || addr == "" {
+		return nil, errors.Error("no zone file, or zone name and primary")
+	}
+
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+
+	tr := &dns.Transfer{
+		DialTimeout:  rpzTransferTimeout,
+		ReadTimeout:  rpzTransferTimeout,
+		WriteTimeout: rpzTransferTimeout,
+	}
+
+	envs, err := tr.In((&dns.Msg{}).SetAxfr(dns.Fqdn(name)), addr)
+	if err != nil {
+		return nil, fmt.Errorf("transferring zone %q: %w", name, err)
+	}
+
+	var rrs []dns.RR
+	for env := range envs {
+		if env.Error != nil {
+			return nil, fmt.Errorf("transferring zone %q: %w", name, env.Error)
+		}
+
+		rrs = append(rrs, env.RR...)
+	}
+
+	// The transfer ends with the SOA record it starts with.
+	if len(rrs) > 1 && rrs[len(rrs)-1].Header().Rrtype == dns.TypeSOA {
+		rrs = rrs[:len(rrs)-1]
+	}
+
+	return newZone(rrs)
+}
+
+// ReloadRPZ loads the zones from [Config.ResponsePolicyZones] again and
+// replaces the applied policy with the loaded one.  If any of the zones fails
+// to load, the previously loaded policy is kept.  It is safe for concurrent
+// use.
+func (p *Proxy) ReloadRPZ() (err error) {
+	if len(p.ResponsePolicyZones) == 0 {
+		return nil
+	}
+
+	pol, err := p.loadRPZ(p.ResponsePolicyZones)
+	if err != nil {
+		return fmt.Errorf("loading rpz: %w", err)
+	}
+
+	p.rpz.Store(pol)
+
+	p.logger.Info("rpz loaded", "count", len(pol.zones))
+
+	return nil
+}
+
+// rpzBefore returns the rule triggered by the client address or the requested
+// name of d, if any, and the index of its zone.  zoneIdx is the number of zones
+// if there is no such rule.  final is true if r takes precedence over any rule
+// the response could trigger, since the zones preceding its one have no
+// triggers matched against the response.
+//
+// An earlier zone takes precedence over all the triggers of the later zones, so
+// if final is false, r must be passed to [Proxy.applyRPZAfter] along with
+// zoneIdx.
+func (p *Proxy) rpzBefore(d *DNSContext) (r *rpzRule, zoneIdx int, final bool) {
+	pol := p.rpz.Load()
+	if pol == nil {
+		return nil, 0, false
+	}
+
+	client := d.Addr.Addr().Unmap()
+	name := strings.ToLower(d.Req.Question[0].Name)
+	final = true
+	for i, rz := range pol.zones {
+		if r = rz.matchBefore(client, name); r != nil {
+			return r, i, final
+		}
+
+		final = final && !rz.hasResponseTriggers()
+	}
+
+	return nil, len(pol.zones), false
+}
+
+// rpzAfter returns the rule triggered by the addresses in the response of d or
+// by the names of the name servers of the requested domain in the zones
+// preceding the one at index beforeZone.  If there is none, before is
+// returned, which is the rule triggered by the request in that zone, see
+// [Proxy.rpzBefore].
+func (p *Proxy) rpzAfter(d *DNSContext, before *rpzRule, beforeZone int) (r *rpzRule) {
+	pol := p.rpz.Load()
+	if pol == nil || d.Res == nil {
+		return before
+	}
+
+	// The policy may have been reloaded since the request was matched.
+	zones := pol.zones[:min(beforeZone, len(pol.zones))]
+
+	var nsNames []string
+	nsResolved := false
+	for _, rz := range zones {
+		if r = rz.matchResponse(d.Res); r != nil {
+			return r
+		}
+
+		if !rz.hasNSDName() {
+			continue
+		}
+
+		// Only resolve the name servers when there are triggers for those.
+		if !nsResolved {
+			nsNames, nsResolved = p.nsNames(d), true
+		}
+
+		if r = rz.matchNSDName(nsNames); r != nil {
+			return r
+		}
+	}
+
+	return before
+}
+
+// nsNames returns the lowercased names of the name servers of the zone
+// containing the requested domain of d.  It uses the NS records from the
+// response and resolves them if there are none.
+func (p *Proxy) nsNames(d *DNSContext) (names []string) {
+	names = appendNSNames(names, d.Res)
+	if len(names) > 0 {
+		return names
+	}
+
+	resp := p.resolveSubrequest(d, d.Req.Question[0].Name, dns.TypeNS)
+	names = appendNSNames(names, resp)
+	if len(names) > 0 || resp == nil {
+		return names
+	}
+
+	// The requested name isn't a zone apex, so look up the name servers of
+	// the zone from the SOA record of the negative response.
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return appendNSNames(names, p.resolveSubrequest(d, soa.Hdr.Name, dns.TypeNS))
+		}
+	}
+
+	return names
+}
+
+// appendNSNames appends the lowercased names from the NS records of the answer
+// and the authority sections of resp to names.  resp may be nil.
+func appendNSNames(names []string, resp *dns.Msg) (appended []string) {
+	if resp == nil {
+		return names
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if ns, ok := rr.(*dns.NS); ok {
+				names = append(names, strings.ToLower(ns.Ns))
+			}
+		}
+	}
+
+	return names
+}
+
+// applyRPZAfter applies the response policy triggered by the response of d, if
+// any, or the one triggered by the request of d.  before and beforeZone are the
+// values returned by [Proxy.rpzBefore].
+func (p *Proxy) applyRPZAfter(d *DNSContext, before *rpzRule, beforeZone int) {
+	r := p.rpzAfter(d, before, beforeZone)
+	if r != nil && r.action != rpzActionPassthru {
+		p.applyRPZ(d, r)
+	}
+}
+
+// applyRPZ sets the response to d according to the action of r, which must not
+// be rpzActionPassthru.
+func (p *Proxy) applyRPZ(d *DNSContext, r *rpzRule) {
+	switch r.action {
+	case rpzActionNXDOMAIN:
+		d.Res = p.messages.NewMsgNXDOMAIN(d.Req)
+	case rpzActionNODATA:
+		d.Res = p.messages.NewMsgNODATA(d.Req)
+	case rpzActionDrop:
+		d.Res = nil
+	default:
+		d.Res = p.rpzLocalData(d, r)
+	}
+}
+
+// rpzLocalData returns the response to d with the local data records of r.  If
+// there are no records of the requested type, but there is a CNAME record, the
+// response is the one of [Proxy.replyWithCNAME].
+func (p *Proxy) rpzLocalData(d *DNSContext, r *rpzRule) (resp *dns.Msg) {
+	resp = p.messages.NewMsgNODATA(d.Req)
+
+	q := d.Req.Question[0]
+	var cname *dns.CNAME
+	for _, rr := range r.records {
+		rr = dns.Copy(rr)
+		rr.Header().Name = q.Name
+
+		if c, ok := rr.(*dns.CNAME); ok {
+			// A wildcard target stands for the requested name prepended to
+			// the rest of the target.
+			if suffix, isWildcard := strings.CutPrefix(c.Target, "*."); isWildcard {
+				c.Target = q.Name + suffix
+			}
+
+			cname = c
+		}
+
+		if rr.Header().Rrtype == q.Qtype || q.Qtype == dns.TypeANY {
+			resp.Answer = append(resp.Answer, rr)
+		}
+	}
+
+	if len(resp.Answer) > 0 || cname == nil {
+		return resp
+	}
+
+	return p.replyWithCNAME(d, cname)
+}
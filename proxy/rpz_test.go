@@ -0,0 +1,458 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRPZ is the contents of the response policy zone file used in tests.
+const testRPZ = `$ORIGIN rpz.test.
+$TTL 60
+@                                 IN SOA   localhost. admin.localhost. 1 3600 600 86400 60
+@                                 IN NS    localhost.
+nx.example                        IN CNAME .
+nodata.example                    IN CNAME *.
+*.wild.example                    IN CNAME .
+drop.example                      IN CNAME rpz-drop.
+pass.example                      IN CNAME rpz-passthru.
+local.example                     IN A     192.0.2.100
+rewrite.example                   IN CNAME target.example.
+*.sub.example                     IN CNAME *.target.example.
+32.1.100.51.198.rpz-ip            IN CNAME .
+24.0.2.0.192.rpz-client-ip        IN CNAME *.
+ns.evil.example.rpz-nsdname       IN CNAME .
+32.1.0.0.127.rpz-nsip             IN CNAME .
+`
+
+// newRPZUpstream returns a fake upstream answering the requests used in RPZ
+// tests.
+func newRPZUpstream(t *testing.T) (ups *fakeUpstream) {
+	t.Helper()
+
+	return &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			q := req.Question[0]
+			switch {
+			case q.Qtype == dns.TypeNS && q.Name == "hosted.example.":
+				resp.Answer = append(resp.Answer, &dns.NS{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+					Ns:  "ns.evil.example.",
+				})
+			case q.Qtype != dns.TypeA:
+				// Go on.
+			case q.Name == "bad.example.", q.Name == "pass.example.":
+				resp.Answer = append(resp.Answer, newRR(t, q.Name, dns.TypeA, 60, net.IP{198, 51, 100, 1}))
+			default:
+				resp.Answer = append(resp.Answer, newRR(t, q.Name, dns.TypeA, 60, net.IP{192, 0, 2, 1}))
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+}
+
+// newRPZProxy returns a new proxy applying the response policy zones from
+// confs and resolving the requests using ups.
+func newRPZProxy(t *testing.T, ups upstream.Upstream, confs ...*RPZConfig) (p *Proxy) {
+	t.Helper()
+
+	return mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		ResponsePolicyZones:    confs,
+	})
+}
+
+func TestProxy_Resolve_rpz(t *testing.T) {
+	p := newRPZProxy(t, newRPZUpstream(t), &RPZConfig{
+		Path: writeTestZone(t, testRPZ),
+	})
+
+	localCli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+	otherCli := netip.MustParseAddrPort("192.0.2.200:1234")
+
+	testCases := []struct {
+		cli       netip.AddrPort
+		name      string
+		host      string
+		wantAns   []string
+		qtype     uint16
+		wantRcode int
+		wantDrop  bool
+	}{{
+		cli:       localCli,
+		name:      "no_trigger",
+		host:      "example.",
+		wantAns:   []string{"example.\t60\tIN\tA\t192.0.2.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:       localCli,
+		name:      "qname_nxdomain",
+		host:      "NX.example.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		cli:       localCli,
+		name:      "qname_subdomain",
+		host:      "sub.nx.example.",
+		wantAns:   []string{"sub.nx.example.\t60\tIN\tA\t192.0.2.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:       localCli,
+		name:      "qname_nodata",
+		host:      "nodata.example.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:       localCli,
+		name:      "qname_wildcard",
+		host:      "a.b.wild.example.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		cli:       localCli,
+		name:      "qname_wildcard_apex",
+		host:      "wild.example.",
+		wantAns:   []string{"wild.example.\t60\tIN\tA\t192.0.2.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:      localCli,
+		name:     "drop",
+		host:     "drop.example.",
+		qtype:    dns.TypeA,
+		wantDrop: true,
+	}, {
+		cli:       localCli,
+		name:      "passthru",
+		host:      "pass.example.",
+		wantAns:   []string{"pass.example.\t60\tIN\tA\t198.51.100.1"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:       localCli,
+		name:      "local_data",
+		host:      "local.example.",
+		wantAns:   []string{"local.example.\t60\tIN\tA\t192.0.2.100"},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:       localCli,
+		name:      "local_data_nodata",
+		host:      "local.example.",
+		wantAns:   nil,
+		qtype:     dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:  localCli,
+		name: "local_data_cname",
+		host: "rewrite.example.",
+		wantAns: []string{
+			"rewrite.example.\t60\tIN\tCNAME\ttarget.example.",
+			"target.example.\t60\tIN\tA\t192.0.2.1",
+		},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:  localCli,
+		name: "local_data_wildcard_cname",
+		host: "a.sub.example.",
+		wantAns: []string{
+			"a.sub.example.\t60\tIN\tCNAME\ta.sub.example.target.example.",
+			"a.sub.example.target.example.\t60\tIN\tA\t192.0.2.1",
+		},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		cli:       localCli,
+		name:      "response_ip",
+		host:      "bad.example.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		cli:       localCli,
+		name:      "nsdname",
+		host:      "hosted.example.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		cli:       otherCli,
+		name:      "client_ip",
+		host:      "example.",
+		wantAns:   nil,
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Resolve twice to check the responses from cache as well.
+			for range 2 {
+				d := &DNSContext{
+					Req:  newReq(tc.host, tc.qtype, dns.ClassINET),
+					Addr: tc.cli,
+				}
+
+				require.NoError(t, p.Resolve(d))
+				if tc.wantDrop {
+					assert.Nil(t, d.Res)
+
+					continue
+				}
+
+				require.NotNil(t, d.Res)
+				assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+
+				var ans []string
+				for _, rr := range d.Res.Answer {
+					ans = append(ans, rr.String())
+				}
+				assert.Equal(t, tc.wantAns, ans)
+			}
+		})
+	}
+}
+
+func TestProxy_Resolve_rpzZonesOrder(t *testing.T) {
+	// The first zone only has the triggers matched against the response.
+	const firstRPZ = `$ORIGIN rpz1.test.
+$TTL 60
+@                                 IN SOA   localhost. admin.localhost. 1 3600 600 86400 60
+@                                 IN NS    localhost.
+32.1.100.51.198.rpz-ip            IN CNAME .
+ns.evil.example.rpz-nsdname       IN CNAME .
+`
+
+	const secondRPZ = `$ORIGIN rpz2.test.
+$TTL 60
+@                                 IN SOA   localhost. admin.localhost. 1 3600 600 86400 60
+@                                 IN NS    localhost.
+bad.example                       IN A     192.0.2.100
+hosted.example                    IN A     192.0.2.100
+local.example                     IN A     192.0.2.100
+32.1.2.0.192.rpz-ip               IN CNAME *.
+`
+
+	p := newRPZProxy(t, newRPZUpstream(t), &RPZConfig{
+		Path: writeTestZone(t, firstRPZ),
+	}, &RPZConfig{
+		Path: writeTestZone(t, secondRPZ),
+	})
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantAns   []string
+		wantRcode int
+	}{{
+		name:      "response_ip_before_qname",
+		host:      "bad.example.",
+		wantAns:   nil,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "nsdname_before_qname",
+		host:      "hosted.example.",
+		wantAns:   nil,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "later_zone_qname",
+		host:      "local.example.",
+		wantAns:   []string{"local.example.\t60\tIN\tA\t192.0.2.100"},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "later_zone_response_ip",
+		host:      "example.",
+		wantAns:   nil,
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Resolve twice to check the responses from cache as well.
+			for range 2 {
+				d := &DNSContext{
+					Req:  newReq(tc.host, dns.TypeA, dns.ClassINET),
+					Addr: cli,
+				}
+
+				require.NoError(t, p.Resolve(d))
+				require.NotNil(t, d.Res)
+
+				assert.Equal(t, tc.wantRcode, d.Res.Rcode)
+
+				var ans []string
+				for _, rr := range d.Res.Answer {
+					ans = append(ans, rr.String())
+				}
+				assert.Equal(t, tc.wantAns, ans)
+			}
+		})
+	}
+}
+
+func TestProxy_Resolve_rpzNSDNameCache(t *testing.T) {
+	const (
+		host = "clean.example."
+		zone = "example."
+	)
+
+	var nsReqs []string
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			resp = (&dns.Msg{}).SetReply(req)
+
+			q := req.Question[0]
+			switch {
+			case q.Qtype == dns.TypeA:
+				resp.Answer = append(resp.Answer, newRR(t, q.Name, dns.TypeA, 60, net.IP{192, 0, 2, 1}))
+			case q.Name == zone:
+				nsReqs = append(nsReqs, q.Name)
+				resp.Answer = append(resp.Answer, &dns.NS{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+					Ns:  "ns.good.example.",
+				})
+			default:
+				nsReqs = append(nsReqs, q.Name)
+				resp.Ns = append(resp.Ns, newRR(t, zone, dns.TypeSOA, 60, nil))
+			}
+
+			return resp, nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	p := newRPZProxy(t, ups, &RPZConfig{
+		Path: writeTestZone(t, testRPZ),
+	})
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+	for range 3 {
+		d := &DNSContext{
+			Req:  newReq(host, dns.TypeA, dns.ClassINET),
+			Addr: cli,
+		}
+
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 1)
+	}
+
+	// The name servers are only resolved once, the following lookups are
+	// answered from the cache.
+	assert.Equal(t, []string{host, zone}, nsReqs)
+}
+
+func TestProxy_ReloadRPZ_axfr(t *testing.T) {
+	zp := dns.NewZoneParser(strings.NewReader(testRPZ), "", "")
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	require.NoError(t, zp.Err())
+
+	// Finish the transfer with the SOA record.
+	rrs = append(rrs, rrs[0])
+
+	l, err := net.Listen("tcp", localhostAnyPort.String())
+	require.NoError(t, err)
+
+	srv := &dns.Server{
+		Listener: l,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			ch := make(chan *dns.Envelope, 1)
+			ch <- &dns.Envelope{RR: rrs}
+			close(ch)
+
+			_ = (&dns.Transfer{}).Out(w, req, ch)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	testutil.CleanupAndRequireSuccess(t, srv.Shutdown)
+
+	p := newRPZProxy(t, newRPZUpstream(t), &RPZConfig{
+		Name:    "rpz.test",
+		Primary: l.Addr().String(),
+	})
+
+	d := &DNSContext{
+		Req:  newReq("nx.example.", dns.TypeA, dns.ClassINET),
+		Addr: netip.AddrPortFrom(netutil.IPv4Localhost(), 1234),
+	}
+	require.NoError(t, p.Resolve(d))
+	require.NotNil(t, d.Res)
+
+	assert.Equal(t, dns.RcodeNameError, d.Res.Rcode)
+}
+
+func TestParseRPZPrefix(t *testing.T) {
+	testCases := []struct {
+		name       string
+		trigger    string
+		want       netip.Prefix
+		wantErrMsg string
+	}{{
+		name:       "ipv4",
+		trigger:    "24.0.2.0.192",
+		want:       netip.MustParsePrefix("192.0.2.0/24"),
+		wantErrMsg: "",
+	}, {
+		name:       "ipv6",
+		trigger:    "48.zz.db8.2001",
+		want:       netip.MustParsePrefix("2001:db8::/48"),
+		wantErrMsg: "",
+	}, {
+		name:       "ipv6_middle",
+		trigger:    "128.1.zz.db8.2001",
+		want:       netip.MustParsePrefix("2001:db8::1/128"),
+		wantErrMsg: "",
+	}, {
+		name:       "ipv6_full",
+		trigger:    "128.8.7.6.5.4.3.db8.2001",
+		want:       netip.MustParsePrefix("2001:db8:3:4:5:6:7:8/128"),
+		wantErrMsg: "",
+	}, {
+		name:       "no_addr",
+		trigger:    "32",
+		want:       netip.Prefix{},
+		wantErrMsg: "bad ip trigger",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pref, err := parseRPZPrefix(strings.Split(tc.trigger, "."))
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+			assert.Equal(t, tc.want, pref)
+		})
+	}
+}
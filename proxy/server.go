@@ -8,6 +8,7 @@ import (
 	"net"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
@@ -100,23 +101,37 @@ func (p *Proxy) handleDNSRequest(d *DNSContext) (err error) {
 
 	ip := d.Addr.Addr()
 	d.IsPrivateClient = p.privateNets.Contains(ip)
+	p.selectView(d)
 
 	if !p.handleBefore(d) {
 		return nil
 	}
 
+	// The clients with valid server cookies bypass the ratelimit, since their
+	// addresses can't be spoofed.
+	validCookie := p.handleCookie(d)
+
 	// ratelimit based on IP only, protects CPU cycles and outbound connections
 	//
 	// TODO(e.burkov):  Investigate if written above true and move to UDP server
 	// implementation?
-	if d.Proto == ProtoUDP && p.isRatelimited(ip) {
+	if d.Proto == ProtoUDP && !validCookie && p.isRatelimited(ip) {
 		p.logger.Debug("ratelimited based on ip only", "addr", d.Addr)
 
 		// Don't reply to ratelimited clients.
 		return nil
 	}
 
-	d.Res = p.validateRequest(d)
+	// The padding only makes sense within the encrypted channel it was
+	// received from, so don't forward it to the upstreams.
+	//
+	// See RFC 7830.
+	d.padded = proxyutil.RemovePadding(d.Req)
+
+	if d.Res == nil {
+		d.Res = p.validateRequest(d)
+	}
+
 	if d.Res == nil {
 		if p.RequestHandler != nil {
 			err = errors.Annotate(p.RequestHandler(p, d), "using request handler: %w")
@@ -226,6 +241,14 @@ func (p *Proxy) respond(d *DNSContext) {
 	}
 }
 
+// padResponse pads d.Res according to the block-length policy from RFC 8467, if
+// the request was padded.  It must only be used for the encrypted protocols.
+func padResponse(d *DNSContext) {
+	if d.padded {
+		proxyutil.Pad(d.Res, proxyutil.ResponsePaddingBlockSize)
+	}
+}
+
 // Set TTL value of all records according to our settings
 func (p *Proxy) setMinMaxTTL(r *dns.Msg) {
 	for _, rr := range r.Answer {
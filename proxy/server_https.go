@@ -246,6 +246,8 @@ func (p *Proxy) respondHTTPS(d *DNSContext) (err error) {
 		return nil
 	}
 
+	padResponse(d)
+
 	bytes, err := resp.Pack()
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
@@ -187,6 +187,10 @@ func (p *Proxy) respondTCP(d *DNSContext) error {
 		return conn.Close()
 	}
 
+	if d.Proto == ProtoTLS {
+		padResponse(d)
+	}
+
 	bytes, err := resp.Pack()
 	if err != nil {
 		return fmt.Errorf("packing message: %w", err)
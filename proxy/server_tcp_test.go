@@ -5,11 +5,15 @@ import (
 	"crypto/tls"
 	"crypto/x509"
 	"net"
+	"sync/atomic"
 	"testing"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -55,3 +59,88 @@ func TestTlsProxy(t *testing.T) {
 
 	sendTestMessages(t, conn)
 }
+
+func TestTlsProxy_padding(t *testing.T) {
+	var upsPadded atomic.Bool
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			if opt := req.IsEdns0(); opt != nil {
+				for _, e := range opt.Option {
+					upsPadded.Store(upsPadded.Load() || e.Option() == dns.EDNS0PADDING)
+				}
+			}
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "upstream" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	serverConfig, caPem := newTLSConfig(t)
+	dnsProxy := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		TLSListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		TLSConfig:     serverConfig,
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+	})
+
+	ctx := context.Background()
+	err := dnsProxy.Start(ctx)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, func() (err error) { return dnsProxy.Shutdown(ctx) })
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPem)
+	tlsConfig := &tls.Config{ServerName: tlsServerName, RootCAs: roots}
+
+	addr := dnsProxy.Addr(ProtoTLS)
+	conn, err := dns.DialWithTLS("tcp-tls", addr.String(), tlsConfig)
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, conn.Close)
+
+	testCases := []struct {
+		name       string
+		pad        bool
+		wantPadded bool
+	}{{
+		name:       "padded",
+		pad:        true,
+		wantPadded: true,
+	}, {
+		name:       "not_padded",
+		pad:        false,
+		wantPadded: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestMessage()
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			if tc.pad {
+				proxyutil.Pad(req, proxyutil.QueryPaddingBlockSize)
+			}
+
+			err = conn.WriteMsg(req)
+			require.NoError(t, err)
+
+			buf := make([]byte, dns.MaxMsgSize)
+			n, readErr := conn.Read(buf)
+			require.NoError(t, readErr)
+
+			resp := &dns.Msg{}
+			err = resp.Unpack(buf[:n])
+			require.NoError(t, err)
+
+			assert.False(t, upsPadded.Load())
+			assert.Equal(t, tc.wantPadded, proxyutil.RemovePadding(resp))
+			if tc.wantPadded {
+				assert.Zero(t, n%proxyutil.ResponsePaddingBlockSize)
+			}
+		})
+	}
+}
@@ -23,6 +23,20 @@ const (
 	// or AAAA requests only with the fastest IP address detected by ICMP
 	// response time or TCP connection time.
 	UpstreamModeFastestAddr UpstreamMode = "fastest_addr"
+
+	// UpstreamModeHedged makes server to query the best upstream first and then
+	// the next ones, each after a delay without a response, returning the first
+	// successful response.
+	UpstreamModeHedged UpstreamMode = "hedged"
+
+	// UpstreamModeStrictOrder makes server to query the upstreams one by one in
+	// the configured order, using the next one only if the previous ones
+	// failed.
+	UpstreamModeStrictOrder UpstreamMode = "strict_order"
+
+	// UpstreamModeRoundRobin makes server to start each query with the next
+	// upstream in the configured order, using the following ones if it fails.
+	UpstreamModeRoundRobin UpstreamMode = "round_robin"
 )
 
 // type check
@@ -35,15 +49,21 @@ func (m *UpstreamMode) UnmarshalText(b []byte) (err error) {
 	case
 		UpstreamModeLoadBalance,
 		UpstreamModeParallel,
-		UpstreamModeFastestAddr:
+		UpstreamModeFastestAddr,
+		UpstreamModeHedged,
+		UpstreamModeStrictOrder,
+		UpstreamModeRoundRobin:
 		*m = um
 	default:
 		return fmt.Errorf(
-			"invalid upstream mode %q, supported: %q, %q, %q",
+			"invalid upstream mode %q, supported: %q, %q, %q, %q, %q, %q",
 			b,
 			UpstreamModeLoadBalance,
 			UpstreamModeParallel,
 			UpstreamModeFastestAddr,
+			UpstreamModeHedged,
+			UpstreamModeStrictOrder,
+			UpstreamModeRoundRobin,
 		)
 	}
 
@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -12,6 +15,7 @@ import (
 	"github.com/AdguardTeam/golibs/errors"
 	"github.com/AdguardTeam/golibs/mapsutil"
 	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/miekg/dns"
 )
 
 // UnqualifiedNames is a key for [UpstreamConfig.DomainReservedUpstreams] map to
@@ -30,6 +34,19 @@ type UpstreamConfig struct {
 	// SubdomainExclusions is set of domains with subdomains exclusions.
 	SubdomainExclusions *container.MapSet[string]
 
+	// PatternUpstreams are the upstreams for the domain names matching the
+	// patterns, in the order of their precedence.  Those are only used if
+	// there are no upstreams specified for the domain name itself in
+	// DomainReservedUpstreams, and take priority over the ones specified for
+	// its parent domains.
+	PatternUpstreams []*PatternUpstreams
+
+	// QtypeUpstreams maps the query types to the configurations of the
+	// upstreams used for the queries of those types.  Those take priority over
+	// the other upstreams, unless they contain no upstreams for the queried
+	// domain.  The configurations themselves mustn't contain QtypeUpstreams.
+	QtypeUpstreams map[uint16]*UpstreamConfig
+
 	// Upstreams is a list of default upstreams.
 	Upstreams []upstream.Upstream
 }
@@ -37,6 +54,17 @@ type UpstreamConfig struct {
 // type check
 var _ io.Closer = (*UpstreamConfig)(nil)
 
+// PatternUpstreams are the upstreams for the domain names matching a pattern.
+type PatternUpstreams struct {
+	// Pattern matches the lowercased domain names without the trailing dot.
+	// It must not be nil.
+	Pattern *regexp.Regexp
+
+	// Upstreams are the upstreams for the matching domain names.  If empty,
+	// the default upstreams are used for those.
+	Upstreams []upstream.Upstream
+}
+
 // ParseUpstreamsConfig returns an UpstreamConfig and nil error if the upstream
 // configuration is valid.  Otherwise returns a partially filled UpstreamConfig
 // and wrapped error containing lines with errors.  It also skips empty lines
@@ -87,6 +115,67 @@ var _ io.Closer = (*UpstreamConfig)(nil)
 // will send queries for all subdomains *.domain.com to 1.2.3.4, but domain.com
 // query will be sent to default server 3.4.5.6 as every other query.
 //
+// # Domain patterns
+//
+// Domain specifications may also be patterns:
+//
+//   - label wildcards: [/*.corp-*.domain.com/api.*.domain.com/]<upstreamString>
+//   - regular expressions: [/~api[0-9]+\.domain\.com/]<upstreamString>
+//
+// The asterisk within a label matches any part of a single label, the asterisk
+// as the middle label matches any single label, and the asterisk as the first
+// label matches any number of labels, but at least one.  Regular expressions
+// start with a tilde, can't contain slashes, and must match the whole
+// lowercased domain name without the trailing dot.
+//
+// Patterns are only checked if there are no upstreams specified for the
+// queried domain name itself.  Those are checked in the order of the
+// configuration, and the first matching one takes priority over the upstreams
+// specified for the parent domains of the queried domain name.  Using "#"
+// instead of upstreams for a pattern sends the matching queries to the default
+// upstreams.  So the following config:
+//
+//	[/domain.com/]1.2.3.4
+//	[/*.corp-*.domain.com/]2.3.4.5
+//	[/corp-a.domain.com/]3.4.5.6
+//	4.5.6.7
+//
+// will send queries for www.corp-b.domain.com and www.corp-a.domain.com to
+// 2.3.4.5, queries for corp-a.domain.com to 3.4.5.6, and other queries for
+// domain.com and its subdomains to 1.2.3.4.
+//
+// # Priority tiers and weights
+//
+// Any upstream may be suffixed with a parenthesized comma-separated list of
+// its priority tier and static weight, see [WeightedUpstream]:
+//
+//	1.2.3.4(weight=3) 2.3.4.5
+//	3.4.5.6(tier=2)
+//	[/domain.com/]4.5.6.7 5.6.7.8(tier=2,weight=0.5)
+//
+// So the config above will send three times more queries to 1.2.3.4 than to
+// 2.3.4.5, given the same round-trip times of those, and only send the queries
+// to 3.4.5.6 if both of them fail.  The queries for domain.com are sent to
+// 5.6.7.8 only if 4.5.6.7 fails.  The upstreams without a tier are in the
+// tier 1, and the ones without a weight have the weight of 1.
+//
+// # Query type specific upstreams
+//
+// Any of the lines above may be prefixed with a comma-separated list of query
+// types in curly braces to only apply to the queries of those types:
+//
+//	{PTR}1.2.3.4
+//	{TXT,HTTPS}[/domain.com/]2.3.4.5
+//	{TXT}[/www.domain.com/]#
+//	3.4.5.6
+//
+// So the config above will send all PTR queries to 1.2.3.4 and TXT and HTTPS
+// queries for domain.com and its subdomains to 2.3.4.5.  The TXT queries for
+// www.domain.com and its subdomains, as well as other queries, will be sent to
+// 3.4.5.6.  The query type specific upstreams take priority over all the
+// others, and the more specific domains take priority within the same query
+// type.
+//
 // TODO(e.burkov):  Consider supporting multiple upstreams in a single line for
 // default upstream syntax.
 func ParseUpstreamsConfig(
@@ -101,15 +190,7 @@ func ParseUpstreamsConfig(
 		opts.Logger = slog.Default()
 	}
 
-	p := &configParser{
-		options:                  opts,
-		logger:                   opts.Logger,
-		upstreamsIndex:           map[string]upstream.Upstream{},
-		domainReservedUpstreams:  map[string][]upstream.Upstream{},
-		specifiedDomainUpstreams: map[string][]upstream.Upstream{},
-		subdomainsOnlyUpstreams:  map[string][]upstream.Upstream{},
-		subdomainsOnlyExclusions: container.NewMapSet[string](),
-	}
+	p := newConfigParser(opts, map[string]upstream.Upstream{})
 
 	return p.parse(lines)
 }
@@ -164,10 +245,35 @@ type configParser struct {
 	// subdomainsOnlyExclusions is set of domains with subdomains exclusions.
 	subdomainsOnlyExclusions *container.MapSet[string]
 
+	// patternUpstreams are the upstreams for the domain patterns in the order
+	// of their appearance.
+	patternUpstreams []*PatternUpstreams
+
+	// qtypeParsers maps the query types to the parsers of the lines specific
+	// to those.  It's nil for such parsers themselves.
+	qtypeParsers map[uint16]*configParser
+
 	// upstreams is a list of default upstreams.
 	upstreams []upstream.Upstream
 }
 
+// newConfigParser returns a new properly initialized *configParser sharing the
+// index of the created upstreams with other parsers.
+func newConfigParser(
+	opts *upstream.Options,
+	upstreamsIndex map[string]upstream.Upstream,
+) (p *configParser) {
+	return &configParser{
+		options:                  opts,
+		logger:                   opts.Logger,
+		upstreamsIndex:           upstreamsIndex,
+		domainReservedUpstreams:  map[string][]upstream.Upstream{},
+		specifiedDomainUpstreams: map[string][]upstream.Upstream{},
+		subdomainsOnlyUpstreams:  map[string][]upstream.Upstream{},
+		subdomainsOnlyExclusions: container.NewMapSet[string](),
+	}
+}
+
 // parse returns UpstreamConfig and error if upstreams configuration is invalid.
 func (p *configParser) parse(lines []string) (c *UpstreamConfig, err error) {
 	var errs []error
@@ -177,6 +283,19 @@ func (p *configParser) parse(lines []string) (c *UpstreamConfig, err error) {
 		}
 	}
 
+	c = p.config()
+	if len(p.qtypeParsers) > 0 {
+		c.QtypeUpstreams = make(map[uint16]*UpstreamConfig, len(p.qtypeParsers))
+		for qtype, qp := range p.qtypeParsers {
+			c.QtypeUpstreams[qtype] = qp.config()
+		}
+	}
+
+	return c, errors.Join(errs...)
+}
+
+// config returns the upstream configuration with the parsed upstreams.
+func (p *configParser) config() (c *UpstreamConfig) {
 	for host, ups := range p.subdomainsOnlyUpstreams {
 		// Rewrite ups for wildcard subdomains to remove upper level domains
 		// specs.
@@ -188,7 +307,8 @@ func (p *configParser) parse(lines []string) (c *UpstreamConfig, err error) {
 		DomainReservedUpstreams:  p.domainReservedUpstreams,
 		SpecifiedDomainUpstreams: p.specifiedDomainUpstreams,
 		SubdomainExclusions:      p.subdomainsOnlyExclusions,
-	}, errors.Join(errs...)
+		PatternUpstreams:         p.patternUpstreams,
+	}
 }
 
 // parseLine returns an error if upstream configuration line is invalid.
@@ -197,6 +317,10 @@ func (p *configParser) parseLine(idx int, confLine string) (err error) {
 		return nil
 	}
 
+	if confLine[0] == '{' {
+		return p.parseQtypeLine(idx, confLine)
+	}
+
 	upstreams, domains, err := splitConfigLine(confLine)
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -220,9 +344,64 @@ func (p *configParser) parseLine(idx int, confLine string) (err error) {
 	return nil
 }
 
+// parseQtypeLine parses the upstream configuration line prefixed with the query
+// types.
+func (p *configParser) parseQtypeLine(idx int, confLine string) (err error) {
+	qtypesLine, confLine, found := strings.Cut(confLine[len("{"):], "}")
+	if !found || confLine == "" || confLine[0] == '{' {
+		return errors.Error("wrong upstream format")
+	}
+
+	qtypes, err := parseQtypes(qtypesLine)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
+	if p.qtypeParsers == nil {
+		p.qtypeParsers = map[uint16]*configParser{}
+	}
+
+	for _, qt := range qtypes {
+		qp := p.qtypeParsers[qt]
+		if qp == nil {
+			qp = newConfigParser(p.options, p.upstreamsIndex)
+			p.qtypeParsers[qt] = qp
+		}
+
+		err = qp.parseLine(idx, confLine)
+		if err != nil {
+			// Don't wrap the error since it's informative enough as is.
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseQtypes parses the comma-separated list of query types.
+func parseQtypes(qtypesLine string) (qtypes []uint16, err error) {
+	for _, s := range strings.Split(qtypesLine, ",") {
+		qt, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(s))]
+		if !ok {
+			return nil, fmt.Errorf("unknown query type %q", s)
+		}
+
+		qtypes = append(qtypes, qt)
+	}
+
+	return qtypes, nil
+}
+
+// patternPrefix is the prefix of the domain specifications containing regular
+// expressions.  It's also used to mark the domain patterns after parsing.
+const patternPrefix = "~"
+
 // splitConfigLine parses upstream configuration line and returns list upstream
 // addresses (one or many), list of domains for which this upstream is reserved
-// (may be nil).  It returns an error if the upstream format is incorrect.
+// (may be nil).  The domain patterns are returned as the anchored regular
+// expressions prefixed with [patternPrefix].  It returns an error if the
+// upstream format is incorrect.
 func splitConfigLine(confLine string) (upstreams, domains []string, err error) {
 	if !strings.HasPrefix(confLine, "[/") {
 		return []string{confLine}, nil, nil
@@ -242,6 +421,18 @@ func splitConfigLine(confLine string) (upstreams, domains []string, err error) {
 			continue
 		}
 
+		if isDomainPattern(confHost) {
+			var expr string
+			expr, err = parseDomainPattern(confHost)
+			if err != nil {
+				return nil, nil, fmt.Errorf("domain pattern %q: %w", confHost, err)
+			}
+
+			domains = append(domains, patternPrefix+expr)
+
+			continue
+		}
+
 		host := strings.TrimPrefix(confHost, "*.")
 		if err = netutil.ValidateDomainName(host); err != nil {
 			return nil, nil, err
@@ -253,8 +444,68 @@ func splitConfigLine(confLine string) (upstreams, domains []string, err error) {
 	return strings.Fields(upstreamsLine), domains, nil
 }
 
+// isDomainPattern returns true if the domain specification is a pattern, i.e.
+// a regular expression or a domain name containing wildcards other than the
+// leading "*." one.
+func isDomainPattern(spec string) (ok bool) {
+	return strings.HasPrefix(spec, patternPrefix) ||
+		strings.Contains(strings.TrimPrefix(spec, "*."), "*")
+}
+
+// parseDomainPattern returns the regular expression matching the whole
+// lowercased domain name without the trailing dot for the domain pattern spec.
+func parseDomainPattern(spec string) (expr string, err error) {
+	if re, ok := strings.CutPrefix(spec, patternPrefix); ok {
+		if re == "" {
+			return "", errors.Error("empty regular expression")
+		}
+
+		expr = `^(?:` + re + `)$`
+		_, err = regexp.Compile(expr)
+
+		// Don't wrap the error since it's informative enough as is.
+		return expr, err
+	}
+
+	spec = strings.ToLower(spec)
+	err = netutil.ValidateDomainName(strings.ReplaceAll(spec, "*", "x"))
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return "", err
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("^")
+	if rest, ok := strings.CutPrefix(spec, "*."); ok {
+		// Match any number of labels, but at least one.
+		b.WriteString(`(?:[^.]+\.)+`)
+		spec = rest
+	}
+
+	for i, label := range strings.Split(spec, ".") {
+		if i > 0 {
+			b.WriteString(`\.`)
+		}
+
+		if label == "*" {
+			b.WriteString(`[^.]+`)
+		} else {
+			b.WriteString(strings.ReplaceAll(regexp.QuoteMeta(label), `\*`, `[^.]*`))
+		}
+	}
+	b.WriteString("$")
+
+	return b.String(), nil
+}
+
 // specifyUpstream specifies the upstream for domains.
 func (p *configParser) specifyUpstream(domains []string, u string, idx int) (err error) {
+	u, weighted, err := parseUpstreamWeight(u)
+	if err != nil {
+		// Don't wrap the error since it's informative enough as is.
+		return err
+	}
+
 	dnsUpstream, ok := p.upstreamsIndex[u]
 	// TODO(e.burkov):  Improve identifying duplicate upstreams.
 	if !ok {
@@ -268,6 +519,11 @@ func (p *configParser) specifyUpstream(domains []string, u string, idx int) (err
 		p.upstreamsIndex[u] = dnsUpstream
 	}
 
+	if weighted != nil {
+		weighted.Upstream = dnsUpstream
+		dnsUpstream = weighted
+	}
+
 	addr := dnsUpstream.Address()
 	if len(domains) == 0 {
 		// TODO(s.chzhen):  Handle duplicates.
@@ -289,10 +545,56 @@ func (p *configParser) specifyUpstream(domains []string, u string, idx int) (err
 	return nil
 }
 
+// parseUpstreamWeight cuts the parenthesized comma-separated list of the
+// priority tier and weight parameters from the end of the upstream string u,
+// e.g. "1.1.1.1(tier=2,weight=0.5)".  weighted is nil if there are no such
+// parameters, otherwise its Upstream field is nil.
+func parseUpstreamWeight(u string) (addr string, weighted *WeightedUpstream, err error) {
+	i := strings.LastIndexByte(u, '(')
+	if i < 0 || !strings.HasSuffix(u, ")") {
+		return u, nil, nil
+	}
+
+	addr, params := u[:i], u[i+len("("):len(u)-len(")")]
+	weighted = &WeightedUpstream{}
+	for _, param := range strings.Split(params, ",") {
+		key, val, _ := strings.Cut(param, "=")
+		switch key {
+		case "tier":
+			var tier uint64
+			tier, err = strconv.ParseUint(val, 10, 0)
+			if err == nil && tier == 0 {
+				err = errors.Error("must be positive")
+			}
+
+			weighted.Tier = uint(tier)
+		case "weight":
+			weighted.Weight, err = strconv.ParseFloat(val, 64)
+			if err == nil && !(weighted.Weight > 0 && weighted.Weight < math.Inf(1)) {
+				err = errors.Error("must be positive and finite")
+			}
+		default:
+			err = errors.Error("unknown parameter")
+		}
+
+		if err != nil {
+			return "", nil, fmt.Errorf("upstream %q: parameter %q: %w", addr, key, err)
+		}
+	}
+
+	return addr, weighted, nil
+}
+
 // excludeFromReserved excludes more specific domains from reserved upstreams
 // querying.
 func (p *configParser) excludeFromReserved(domains []string) {
 	for _, host := range domains {
+		if expr, ok := strings.CutPrefix(host, patternPrefix); ok {
+			p.patternUpstreamsFor(expr).Upstreams = nil
+
+			continue
+		}
+
 		if trimmed := strings.TrimPrefix(host, "*."); trimmed != host {
 			p.subdomainsOnlyExclusions.Add(trimmed)
 			p.subdomainsOnlyUpstreams[trimmed] = nil
@@ -308,6 +610,13 @@ func (p *configParser) excludeFromReserved(domains []string) {
 // includeToReserved includes domains to reserved upstreams querying.
 func (p *configParser) includeToReserved(dnsUpstream upstream.Upstream, domains []string) {
 	for _, host := range domains {
+		if expr, ok := strings.CutPrefix(host, patternPrefix); ok {
+			pu := p.patternUpstreamsFor(expr)
+			pu.Upstreams = append(pu.Upstreams, dnsUpstream)
+
+			continue
+		}
+
 		if strings.HasPrefix(host, "*.") {
 			host = host[len("*."):]
 
@@ -323,6 +632,24 @@ func (p *configParser) includeToReserved(dnsUpstream upstream.Upstream, domains
 	}
 }
 
+// patternUpstreamsFor returns the upstreams for the regular expression expr,
+// which must be valid, adding those if there are none yet.
+func (p *configParser) patternUpstreamsFor(expr string) (pu *PatternUpstreams) {
+	i := slices.IndexFunc(p.patternUpstreams, func(pu *PatternUpstreams) (ok bool) {
+		return pu.Pattern.String() == expr
+	})
+	if i >= 0 {
+		return p.patternUpstreams[i]
+	}
+
+	pu = &PatternUpstreams{
+		Pattern: regexp.MustCompile(expr),
+	}
+	p.patternUpstreams = append(p.patternUpstreams, pu)
+
+	return pu
+}
+
 // validate returns an error if the upstreams aren't configured properly.  c
 // considered valid if it contains at least a single default upstream.  Empty c
 // causes [upstream.ErrNoUpstreams].
@@ -337,7 +664,10 @@ func (uc *UpstreamConfig) validate() (err error) {
 		return errNilConf
 	case len(uc.Upstreams) > 0:
 		return nil
-	case len(uc.DomainReservedUpstreams) == 0 && len(uc.SpecifiedDomainUpstreams) == 0:
+	case len(uc.DomainReservedUpstreams) == 0 &&
+		len(uc.SpecifiedDomainUpstreams) == 0 &&
+		len(uc.PatternUpstreams) == 0 &&
+		len(uc.QtypeUpstreams) == 0:
 		return upstream.ErrNoUpstreams
 	default:
 		return errNoDefault
@@ -346,6 +676,8 @@ func (uc *UpstreamConfig) validate() (err error) {
 
 // ValidatePrivateConfig returns an error if uc isn't valid, or, treated as
 // private upstreams configuration, contains specifications for invalid domains.
+// Domain patterns aren't allowed in such configuration, since those may match
+// any domain.
 func ValidatePrivateConfig(uc *UpstreamConfig, privateSubnets netutil.SubnetSet) (err error) {
 	if err = uc.validate(); err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -353,6 +685,13 @@ func ValidatePrivateConfig(uc *UpstreamConfig, privateSubnets netutil.SubnetSet)
 	}
 
 	var errs []error
+	checkPatterns := func(c *UpstreamConfig) {
+		for _, pu := range c.PatternUpstreams {
+			errs = append(errs, fmt.Errorf("domain pattern %q is not allowed", pu.Pattern))
+		}
+	}
+
+	checkPatterns(uc)
 	rangeFunc := func(domain string, _ []upstream.Upstream) (ok bool) {
 		pref, extErr := netutil.ExtractReversedAddr(domain)
 		switch {
@@ -371,10 +710,36 @@ func ValidatePrivateConfig(uc *UpstreamConfig, privateSubnets netutil.SubnetSet)
 	}
 
 	mapsutil.SortedRange(uc.DomainReservedUpstreams, rangeFunc)
+	mapsutil.SortedRange(uc.QtypeUpstreams, func(_ uint16, qc *UpstreamConfig) (ok bool) {
+		mapsutil.SortedRange(qc.DomainReservedUpstreams, rangeFunc)
+		checkPatterns(qc)
+
+		return true
+	})
 
 	return errors.Join(errs...)
 }
 
+// getUpstreamsForQuestion returns the upstreams specified for resolving q.  The
+// upstreams specified for the query type of q take priority over the others.
+// It always returns the default set of upstreams if there are no upstreams
+// specified for q.
+func (uc *UpstreamConfig) getUpstreamsForQuestion(q dns.Question) (ups []upstream.Upstream) {
+	getUpstreams := (*UpstreamConfig).getUpstreamsForDomain
+	if q.Qtype == dns.TypeDS {
+		getUpstreams = (*UpstreamConfig).getUpstreamsForDS
+	}
+
+	if qc := uc.QtypeUpstreams[q.Qtype]; qc != nil {
+		ups = getUpstreams(qc, q.Name)
+		if len(ups) > 0 {
+			return ups
+		}
+	}
+
+	return getUpstreams(uc, q.Name)
+}
+
 // getUpstreamsForDomain returns the upstreams specified for resolving fqdn.  It
 // always returns the default set of upstreams if the domain is not reserved for
 // any other upstreams.
@@ -386,9 +751,10 @@ func ValidatePrivateConfig(uc *UpstreamConfig, privateSubnets netutil.SubnetSet)
 //   - www.host.com
 //
 // The request for mail.host.com will be resolved using the upstreams specified
-// for host.com.
+// for host.com.  The patterns are only checked if there are no upstreams
+// specified for fqdn itself and take priority over its parent domains.
 func (uc *UpstreamConfig) getUpstreamsForDomain(fqdn string) (ups []upstream.Upstream) {
-	if len(uc.DomainReservedUpstreams) == 0 {
+	if len(uc.DomainReservedUpstreams) == 0 && len(uc.PatternUpstreams) == 0 {
 		return uc.Upstreams
 	}
 
@@ -402,6 +768,10 @@ func (uc *UpstreamConfig) getUpstreamsForDomain(fqdn string) (ups []upstream.Ups
 		return ups
 	}
 
+	if ups, ok = uc.lookupPatterns(fqdn); ok {
+		return ups
+	}
+
 	if _, fqdn, _ = strings.Cut(fqdn, "."); fqdn == "" {
 		fqdn = UnqualifiedNames
 	}
@@ -469,6 +839,58 @@ func (uc *UpstreamConfig) lookupUpstreams(name string) (ups []upstream.Upstream,
 	return ups, true
 }
 
+// appendAll appends all the upstreams of uc, including the ones specified for
+// domains, patterns, and query types, to ups.  uc may be nil.
+func (uc *UpstreamConfig) appendAll(ups []upstream.Upstream) (appended []upstream.Upstream) {
+	if uc == nil {
+		return ups
+	}
+
+	ups = append(ups, uc.Upstreams...)
+	for _, specUps := range []map[string][]upstream.Upstream{
+		uc.DomainReservedUpstreams,
+		uc.SpecifiedDomainUpstreams,
+	} {
+		mapsutil.SortedRange(specUps, func(_ string, dUps []upstream.Upstream) (ok bool) {
+			ups = append(ups, dUps...)
+
+			return true
+		})
+	}
+
+	for _, pu := range uc.PatternUpstreams {
+		ups = append(ups, pu.Upstreams...)
+	}
+
+	mapsutil.SortedRange(uc.QtypeUpstreams, func(_ uint16, qc *UpstreamConfig) (ok bool) {
+		ups = qc.appendAll(ups)
+
+		return true
+	})
+
+	return ups
+}
+
+// lookupPatterns returns the upstreams for the first pattern matching fqdn.  It
+// returns default upstream list for the patterns excluded from reserved
+// upstreams.
+func (uc *UpstreamConfig) lookupPatterns(fqdn string) (ups []upstream.Upstream, ok bool) {
+	name := strings.TrimSuffix(fqdn, ".")
+	for _, pu := range uc.PatternUpstreams {
+		if !pu.Pattern.MatchString(name) {
+			continue
+		}
+
+		if len(pu.Upstreams) == 0 {
+			return uc.Upstreams, true
+		}
+
+		return pu.Upstreams, true
+	}
+
+	return nil, false
+}
+
 // Close implements the io.Closer interface for *UpstreamConfig.
 func (uc *UpstreamConfig) Close() (err error) {
 	closeErrs := closeAll(nil, uc.Upstreams...)
@@ -489,6 +911,18 @@ func (uc *UpstreamConfig) Close() (err error) {
 		}
 	}
 
+	for _, pu := range uc.PatternUpstreams {
+		closeErrs = closeAll(closeErrs, pu.Upstreams...)
+	}
+
+	mapsutil.SortedRange(uc.QtypeUpstreams, func(_ uint16, qc *UpstreamConfig) (ok bool) {
+		if closeErr := qc.Close(); closeErr != nil {
+			closeErrs = append(closeErrs, closeErr)
+		}
+
+		return true
+	})
+
 	if len(closeErrs) > 0 {
 		return fmt.Errorf("failed to close some upstreams: %w", errors.Join(closeErrs...))
 	}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"slices"
 	"testing"
 
 	"github.com/AdguardTeam/dnsproxy/upstream"
@@ -8,6 +9,7 @@ import (
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/netutil"
 	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -193,6 +195,12 @@ func TestUpstreamConfig_Validate(t *testing.T) {
 			"[/domain.example/]udp://upstream.example:53",
 			"[/another.domain.example/]#",
 		},
+	}, {
+		name:    "qtype_only",
+		wantErr: errors.Error("no default upstreams specified"),
+		in: []string{
+			"{PTR}udp://upstream.example:53",
+		},
 	}}
 
 	for _, tc := range testCases {
@@ -257,6 +265,10 @@ func TestValidatePrivateConfig(t *testing.T) {
 		name:    "partial_good",
 		wantErr: "",
 		u:       "[/a.1.2.3.10.in-addr.arpa/a.10.in-addr.arpa/]#",
+	}, {
+		name:    "pattern",
+		wantErr: `domain pattern "^(?:[^.]+\\.)+1[^.]*\\.in-addr\\.arpa$" is not allowed`,
+		u:       "[/*.1*.in-addr.arpa/]#",
 	}}
 
 	for _, tc := range testCases {
@@ -437,6 +449,313 @@ func TestGetUpstreamsForDomain_default_wildcards(t *testing.T) {
 	}
 }
 
+func TestGetUpstreamsForDomain_patterns(t *testing.T) {
+	conf := []string{
+		"0.0.0.1",
+		"[/x/]0.0.0.2",
+		"[/*.corp-*.x/]0.0.0.3",
+		"[/corp-a.x/]0.0.0.4",
+		"[/api.*.x/~^cdn[0-9]+\\.x$/]0.0.0.5",
+		"[/api.*.x/]0.0.0.6",
+		"[/api.corp-*.x/]0.0.0.7",
+		"[/*.corp-b.x/~^cdn1\\.x$/]#",
+		"{TXT}[/~.*\\.x/]0.0.0.8",
+	}
+
+	uconf, err := ParseUpstreamsConfig(conf, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		in    string
+		want  []string
+		qtype uint16
+	}{{
+		name:  "label_wildcard",
+		in:    "www.corp-a.x.",
+		want:  []string{"0.0.0.3:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "label_wildcard_deep",
+		in:    "a.b.Corp-C.x.",
+		want:  []string{"0.0.0.3:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "exact_over_pattern",
+		in:    "corp-a.x.",
+		want:  []string{"0.0.0.4:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "parent_not_matched",
+		in:    "corp.x.",
+		want:  []string{"0.0.0.2:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "middle_label",
+		in:    "api.eu.x.",
+		want:  []string{"0.0.0.5:53", "0.0.0.6:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "middle_label_single",
+		in:    "api.eu.west.x.",
+		want:  []string{"0.0.0.2:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "first_pattern_wins",
+		in:    "api.corp-a.x.",
+		want:  []string{"0.0.0.3:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "regexp",
+		in:    "cdn42.x.",
+		want:  []string{"0.0.0.5:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "regexp_anchored",
+		in:    "www.cdn42.x.",
+		want:  []string{"0.0.0.2:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "excluded",
+		in:    "cdn1.x.",
+		want:  []string{"0.0.0.5:53"},
+		qtype: dns.TypeA,
+	}, {
+		name:  "qtype",
+		in:    "www.corp-a.x.",
+		want:  []string{"0.0.0.8:53"},
+		qtype: dns.TypeTXT,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ups := uconf.getUpstreamsForQuestion(dns.Question{
+				Name:   tc.in,
+				Qtype:  tc.qtype,
+				Qclass: dns.ClassINET,
+			})
+			assertUpstreamsAddrs(t, ups, tc.want)
+		})
+	}
+}
+
+func TestParseUpstreamsConfig_badPattern(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		line       string
+	}{{
+		name:       "empty_regexp",
+		wantErrMsg: `parsing error at index 0: domain pattern "~": empty regular expression`,
+		line:       "[/~/]" + generalUpstream,
+	}, {
+		name: "bad_regexp",
+		wantErrMsg: `parsing error at index 0: domain pattern "~a(": ` +
+			"error parsing regexp: missing closing ): `^(?:a()$`",
+		line: "[/~a(/]" + generalUpstream,
+	}, {
+		name: "bad_wildcard",
+		wantErrMsg: `parsing error at index 0: domain pattern "a.*.b c": ` +
+			`bad domain name "a.x.b c": bad top-level domain name label "b c": ` +
+			`bad top-level domain name label rune ' '`,
+		line: "[/a.*.b c/]" + generalUpstream,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseUpstreamsConfig([]string{tc.line}, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestParseUpstreamsConfig_weights(t *testing.T) {
+	conf, err := ParseUpstreamsConfig([]string{
+		"1.2.3.4",
+		"1.2.3.4(tier=2,weight=0.5)",
+		"[/example.org/]1.2.3.4(weight=3)",
+	}, nil)
+	require.NoError(t, err)
+	require.Len(t, conf.Upstreams, 2)
+
+	_, ok := conf.Upstreams[0].(*WeightedUpstream)
+	assert.False(t, ok)
+
+	wu := testutil.RequireTypeAssert[*WeightedUpstream](t, conf.Upstreams[1])
+	assert.Equal(t, &WeightedUpstream{Upstream: conf.Upstreams[0], Weight: 0.5, Tier: 2}, wu)
+
+	ups := conf.DomainReservedUpstreams["example.org."]
+	require.Len(t, ups, 1)
+
+	wu = testutil.RequireTypeAssert[*WeightedUpstream](t, ups[0])
+	assert.Equal(t, &WeightedUpstream{Upstream: conf.Upstreams[0], Weight: 3}, wu)
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		line       string
+	}{{
+		name:       "zero_tier",
+		wantErrMsg: `parsing error at index 0: upstream "1.2.3.4": parameter "tier": must be positive`,
+		line:       "1.2.3.4(tier=0)",
+	}, {
+		name: "bad_tier",
+		wantErrMsg: `parsing error at index 0: upstream "1.2.3.4": parameter "tier": ` +
+			`strconv.ParseUint: parsing "a": invalid syntax`,
+		line: "1.2.3.4(tier=a)",
+	}, {
+		name: "negative_weight",
+		wantErrMsg: `parsing error at index 0: upstream "1.2.3.4": parameter "weight": ` +
+			`must be positive and finite`,
+		line: "1.2.3.4(weight=-1)",
+	}, {
+		name:       "unknown",
+		wantErrMsg: `parsing error at index 0: upstream "1.2.3.4": parameter "ttl": unknown parameter`,
+		line:       "1.2.3.4(ttl=1)",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err = ParseUpstreamsConfig([]string{tc.line}, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
+func TestUpstreamConfig_GetUpstreamsForQuestion(t *testing.T) {
+	t.Parallel()
+
+	const (
+		ptrUpstream   = "tcp://ptr.upstream:53"
+		txtUpstream   = "tcp://txt.upstream:53"
+		dsUpstream    = "tcp://ds.upstream:53"
+		otherUpstream = "tcp://other.upstream:53"
+	)
+
+	lines := append(slices.Clone(testUpstreamConfigLines),
+		"{PTR}"+ptrUpstream,
+		"{txt, HTTPS}[/"+firstLevelDomain+"/]"+txtUpstream,
+		"{TXT}[/"+subDomain+"/]#",
+		"{TXT}[/"+generalDomain+"/]"+otherUpstream,
+		"{DS}[/"+firstLevelDomain+"/]"+dsUpstream,
+	)
+
+	config, err := ParseUpstreamsConfig(lines, nil)
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name  string
+		in    string
+		want  []string
+		qtype uint16
+	}{{
+		name:  "ptr",
+		in:    "1.0.0.127.in-addr.arpa.",
+		want:  []string{ptrUpstream},
+		qtype: dns.TypePTR,
+	}, {
+		name:  "ptr_domain",
+		in:    firstLevelFQDN,
+		want:  []string{ptrUpstream},
+		qtype: dns.TypePTR,
+	}, {
+		name:  "txt",
+		in:    anotherSubFQDN,
+		want:  []string{txtUpstream},
+		qtype: dns.TypeTXT,
+	}, {
+		name:  "https",
+		in:    firstLevelFQDN,
+		want:  []string{txtUpstream},
+		qtype: dns.TypeHTTPS,
+	}, {
+		name:  "txt_excluded",
+		in:    subFQDN,
+		want:  []string{subdomainUpstream},
+		qtype: dns.TypeTXT,
+	}, {
+		name:  "txt_more_specific",
+		in:    generalFQDN,
+		want:  []string{otherUpstream},
+		qtype: dns.TypeTXT,
+	}, {
+		name:  "txt_unspecified",
+		in:    unspecifiedFQDN,
+		want:  []string{generalUpstream},
+		qtype: dns.TypeTXT,
+	}, {
+		name:  "a",
+		in:    firstLevelFQDN,
+		want:  []string{domainUpstream},
+		qtype: dns.TypeA,
+	}, {
+		name:  "ds",
+		in:    subFQDN,
+		want:  []string{dsUpstream},
+		qtype: dns.TypeDS,
+	}, {
+		name:  "ds_unspecified",
+		in:    firstLevelFQDN,
+		want:  []string{tldUpstream},
+		qtype: dns.TypeDS,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			ups := config.getUpstreamsForQuestion(dns.Question{
+				Name:   tc.in,
+				Qtype:  tc.qtype,
+				Qclass: dns.ClassINET,
+			})
+			assertUpstreamsAddrs(t, ups, tc.want)
+		})
+	}
+
+	t.Run("shared", func(t *testing.T) {
+		t.Parallel()
+
+		txtUps := config.QtypeUpstreams[dns.TypeTXT].DomainReservedUpstreams[firstLevelFQDN]
+		httpsUps := config.QtypeUpstreams[dns.TypeHTTPS].DomainReservedUpstreams[firstLevelFQDN]
+		require.Len(t, txtUps, 1)
+		require.Len(t, httpsUps, 1)
+
+		assert.Same(t, txtUps[0], httpsUps[0])
+	})
+}
+
+func TestParseUpstreamsConfig_badQtype(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		line       string
+	}{{
+		name:       "unknown",
+		wantErrMsg: `parsing error at index 0: unknown query type "BAD"`,
+		line:       "{BAD}" + generalUpstream,
+	}, {
+		name:       "empty",
+		wantErrMsg: `parsing error at index 0: unknown query type ""`,
+		line:       "{}" + generalUpstream,
+	}, {
+		name:       "unclosed",
+		wantErrMsg: `parsing error at index 0: wrong upstream format`,
+		line:       "{TXT" + generalUpstream,
+	}, {
+		name:       "nested",
+		wantErrMsg: `parsing error at index 0: wrong upstream format`,
+		line:       "{TXT}{A}" + generalUpstream,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseUpstreamsConfig([]string{tc.line}, nil)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
+
 // upsSink is the typed sink variable for the result of benchmarked function.
 var upsSink []upstream.Upstream
 
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// WeightedUpstream is an upstream with a static priority tier and weight.  The
+// upstreams of the next tier are only used for a request if all the upstreams
+// of the previous tiers failed to resolve it.  Within a tier, the weight is
+// combined with the one calculated from the measured round-trip time of the
+// upstream when load-balancing.
+type WeightedUpstream struct {
+	// Upstream is the actual upstream.  It must not be nil.
+	upstream.Upstream
+
+	// Weight is the static weight of the upstream.  Zero means 1.
+	Weight float64
+
+	// Tier is the priority tier of the upstream, the lower tiers are used
+	// first.  Zero means 1, which is also the tier of the upstreams not wrapped
+	// into *WeightedUpstream.
+	Tier uint
+}
+
+// type check
+var _ upstream.Upstream = (*WeightedUpstream)(nil)
+
+// upstreamTier returns the priority tier of u.
+func upstreamTier(u upstream.Upstream) (tier uint) {
+	if wu, ok := u.(*WeightedUpstream); ok {
+		return max(wu.Tier, 1)
+	}
+
+	return 1
+}
+
+// upstreamWeight returns the static weight of u.
+func upstreamWeight(u upstream.Upstream) (weight float64) {
+	if wu, ok := u.(*WeightedUpstream); ok && wu.Weight > 0 {
+		return wu.Weight
+	}
+
+	return 1
+}
+
+// upstreamTiers splits ups into the priority tiers in the order of their use.
+// It returns ups itself as the only tier if all the upstreams are in the same
+// tier.
+func upstreamTiers(ups []upstream.Upstream) (tiers [][]upstream.Upstream) {
+	if len(ups) == 0 {
+		return [][]upstream.Upstream{ups}
+	}
+
+	first := upstreamTier(ups[0])
+	if !slices.ContainsFunc(ups[1:], func(u upstream.Upstream) (ok bool) {
+		return upstreamTier(u) != first
+	}) {
+		return [][]upstream.Upstream{ups}
+	}
+
+	sorted := slices.Clone(ups)
+	slices.SortStableFunc(sorted, func(a, b upstream.Upstream) (res int) {
+		return cmp.Compare(upstreamTier(a), upstreamTier(b))
+	})
+
+	for len(sorted) > 0 {
+		tier := upstreamTier(sorted[0])
+		i := slices.IndexFunc(sorted, func(u upstream.Upstream) (ok bool) {
+			return upstreamTier(u) != tier
+		})
+		if i < 0 {
+			i = len(sorted)
+		}
+
+		tiers = append(tiers, sorted[:i:i])
+		sorted = sorted[i:]
+	}
+
+	return tiers
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/netutil"
+)
+
+// View is a set of settings applied to the requests from particular clients
+// instead of the corresponding settings of [Config].
+type View struct {
+	// UpstreamConfig is the configuration of the upstreams resolving the
+	// requests within the view.  It must not be nil.
+	UpstreamConfig *UpstreamConfig
+
+	// EDNSAddr is the ECS IP used in the requests within the view.  See
+	// [Config.EDNSAddr].
+	EDNSAddr net.IP
+
+	// Name is the name of the view.  It must be unique.
+	Name string
+
+	// ClientSubnets are the subnets of the clients the view is applied to.  If
+	// empty, the view is applied to any client.
+	ClientSubnets []netip.Prefix
+
+	// ListenAddrs are the local addresses of the listeners the view is applied
+	// to.  An address with an unspecified IP matches any IP with the same
+	// port.  If empty, the view is applied to the requests from any listener.
+	ListenAddrs []netip.AddrPort
+
+	// DNS64Prefs is the set of NAT64 prefixes used for DNS64 handling within
+	// the view.  See [Config.DNS64Prefs].
+	DNS64Prefs []netip.Prefix
+
+	// CacheSizeBytes is the maximum size of the cache of the view in bytes.
+	// If not positive, the default size is used.
+	CacheSizeBytes int
+
+	// CacheEnabled defines if the view has its own response cache.  If false,
+	// the responses within the view aren't cached.
+	CacheEnabled bool
+
+	// EnableEDNSClientSubnet defines if the EDNS Client Subnet option is used
+	// within the view.
+	EnableEDNSClientSubnet bool
+
+	// UseDNS64 enables DNS64 handling within the view.
+	UseDNS64 bool
+}
+
+// view is a validated [View].
+type view struct {
+	// upstream is the upstream configuration of the view, along with its
+	// cache.
+	upstream *CustomUpstreamConfig
+
+	// ednsAddr is the ECS IP used in the requests within the view.
+	ednsAddr net.IP
+
+	// name is the name of the view.
+	name string
+
+	// clientSubnets are the subnets of the clients the view is applied to.
+	clientSubnets netutil.SliceSubnetSet
+
+	// listenAddrs are the local addresses of the listeners the view is
+	// applied to.
+	listenAddrs []netip.AddrPort
+
+	// dns64Prefs are the NAT64 prefixes used for DNS64 within the view.  It's
+	// empty if DNS64 is disabled.
+	dns64Prefs netutil.SliceSubnetSet
+
+	// enableECS defines if the EDNS Client Subnet option is used within the
+	// view.
+	enableECS bool
+}
+
+// newViews validates confs and returns the views for those.
+func newViews(confs []*View) (views []*view, err error) {
+	names := make(map[string]unit, len(confs))
+	for i, c := range confs {
+		if _, ok := names[c.Name]; ok {
+			return nil, fmt.Errorf("view at index %d: duplicate name %q", i, c.Name)
+		}
+
+		names[c.Name] = unit{}
+
+		var v *view
+		v, err = newView(c)
+		if err != nil {
+			return nil, fmt.Errorf("view %q: %w", c.Name, err)
+		}
+
+		views = append(views, v)
+	}
+
+	return views, nil
+}
+
+// newView validates c and returns the view for it.
+func newView(c *View) (v *view, err error) {
+	if c.Name == "" {
+		return nil, errors.Error("empty name")
+	}
+
+	err = c.UpstreamConfig.validate()
+	if err != nil {
+		return nil, fmt.Errorf("validating upstreams: %w", err)
+	}
+
+	dns64Prefs, err := newDNS64Prefs(c.UseDNS64, c.DNS64Prefs)
+	if err != nil {
+		return nil, fmt.Errorf("dns64: %w", err)
+	}
+
+	subnets := make(netutil.SliceSubnetSet, 0, len(c.ClientSubnets))
+	for _, pref := range c.ClientSubnets {
+		subnets = append(subnets, pref.Masked())
+	}
+
+	return &view{
+		upstream: NewCustomUpstreamConfig(
+			c.UpstreamConfig,
+			c.CacheEnabled,
+			c.CacheSizeBytes,
+			c.EnableEDNSClientSubnet,
+		),
+		ednsAddr:      c.EDNSAddr,
+		name:          c.Name,
+		clientSubnets: subnets,
+		listenAddrs:   slices.Clone(c.ListenAddrs),
+		dns64Prefs:    dns64Prefs,
+		enableECS:     c.EnableEDNSClientSubnet,
+	}, nil
+}
+
+// matches returns true if the view is applied to the requests from the client
+// with address cli received on the local address local.
+func (v *view) matches(cli netip.Addr, local netip.AddrPort) (ok bool) {
+	if len(v.clientSubnets) > 0 && !v.clientSubnets.Contains(cli) {
+		return false
+	}
+
+	if len(v.listenAddrs) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(v.listenAddrs, func(addr netip.AddrPort) (found bool) {
+		return addr.Port() == local.Port() &&
+			(addr.Addr().IsUnspecified() || addr.Addr().Unmap() == local.Addr())
+	})
+}
+
+// selectView sets the first view applied to the request of d into it, if any.
+func (p *Proxy) selectView(d *DNSContext) {
+	if len(p.views) == 0 {
+		return
+	}
+
+	cli := d.Addr.Addr().Unmap()
+	local := d.localAddr()
+	for _, v := range p.views {
+		if v.matches(cli, local) {
+			p.logger.Debug("selected view", "name", v.name, "addr", d.Addr)
+
+			d.view = v
+			d.CustomUpstreamConfig = v.upstream
+
+			return
+		}
+	}
+}
+
+// ecsSettings returns true if the EDNS Client Subnet option is used for the
+// request of d, along with the ECS IP to use.
+func (p *Proxy) ecsSettings(d *DNSContext) (enabled bool, addr net.IP) {
+	if d.view != nil {
+		return d.view.enableECS, d.view.ednsAddr
+	}
+
+	return p.EnableEDNSClientSubnet, p.EDNSAddr
+}
+
+// localAddr returns the local address the request of d has been received on.
+// It's an invalid address if it's unknown.
+func (d *DNSContext) localAddr() (addr netip.AddrPort) {
+	var la net.Addr
+	switch {
+	case d.Conn != nil:
+		la = d.Conn.LocalAddr()
+	case d.QUICConnection != nil:
+		la = d.QUICConnection.LocalAddr()
+	case d.DNSCryptResponseWriter != nil:
+		la = d.DNSCryptResponseWriter.LocalAddr()
+	case d.HTTPRequest != nil:
+		la, _ = d.HTTPRequest.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	}
+
+	if la == nil {
+		return netip.AddrPort{}
+	}
+
+	addr = netutil.NetAddrToAddrPort(la)
+	if d.localIP.IsValid() {
+		// The UDP listener may be bound to an unspecified address, so use the
+		// actual destination address of the packet.
+		addr = netip.AddrPortFrom(d.localIP, addr.Port())
+	}
+
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxy_Resolve_views(t *testing.T) {
+	defaultUps := newAddrUpstream(t, net.IP{192, 0, 2, 1})
+	officeUps := newAddrUpstream(t, net.IP{192, 0, 2, 2})
+	guestUps := newAddrUpstream(t, net.IP{192, 0, 2, 3})
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{defaultUps},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		Views: []*View{{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{officeUps},
+			},
+			Name:          "office",
+			ClientSubnets: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")},
+			CacheEnabled:  true,
+		}, {
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{guestUps},
+			},
+			Name:          "guest",
+			ClientSubnets: []netip.Prefix{netip.MustParsePrefix("10.0.1.0/24")},
+			UseDNS64:      true,
+		}},
+	})
+
+	testCases := []struct {
+		cli     netip.Addr
+		name    string
+		wantAns string
+		qtype   uint16
+	}{{
+		cli:     netutil.IPv4Localhost(),
+		name:    "default",
+		wantAns: "example.\t60\tIN\tA\t192.0.2.1",
+		qtype:   dns.TypeA,
+	}, {
+		cli:     netip.MustParseAddr("10.0.0.1"),
+		name:    "office",
+		wantAns: "example.\t60\tIN\tA\t192.0.2.2",
+		qtype:   dns.TypeA,
+	}, {
+		cli:     netip.MustParseAddr("::ffff:10.0.0.1"),
+		name:    "office_mapped",
+		wantAns: "example.\t60\tIN\tA\t192.0.2.2",
+		qtype:   dns.TypeA,
+	}, {
+		cli:     netip.MustParseAddr("10.0.1.1"),
+		name:    "guest",
+		wantAns: "example.\t60\tIN\tA\t192.0.2.3",
+		qtype:   dns.TypeA,
+	}, {
+		cli:     netip.MustParseAddr("10.0.1.1"),
+		name:    "guest_dns64",
+		wantAns: "example.\t60\tIN\tAAAA\t64:ff9b::c000:203",
+		qtype:   dns.TypeAAAA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &DNSContext{
+				Req:  newReq("example.", tc.qtype, dns.ClassINET),
+				Addr: netip.AddrPortFrom(tc.cli, 1234),
+			}
+
+			p.selectView(d)
+			require.NoError(t, p.Resolve(d))
+			require.NotNil(t, d.Res)
+			require.Len(t, d.Res.Answer, 1)
+
+			assert.Equal(t, tc.wantAns, d.Res.Answer[0].String())
+		})
+	}
+}
+
+func TestProxy_Resolve_viewCache(t *testing.T) {
+	var exchanges atomic.Uint32
+	viewClosed := false
+
+	viewUps := newAddrUpstream(t, net.IP{192, 0, 2, 2})
+	onExchange := viewUps.onExchange
+	viewUps.onExchange = func(req *dns.Msg) (resp *dns.Msg, err error) {
+		exchanges.Add(1)
+
+		return onExchange(req)
+	}
+	viewUps.onClose = func() (err error) {
+		viewClosed = true
+
+		return nil
+	}
+
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newAddrUpstream(t, net.IP{192, 0, 2, 1})},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           false,
+		Views: []*View{{
+			UpstreamConfig: &UpstreamConfig{
+				Upstreams: []upstream.Upstream{viewUps},
+			},
+			Name:         "cached",
+			CacheEnabled: true,
+		}},
+	})
+
+	ctx := context.Background()
+	require.NoError(t, p.Start(ctx))
+
+	for range 3 {
+		d := &DNSContext{
+			Req:  newReq("example.", dns.TypeA, dns.ClassINET),
+			Addr: netip.AddrPortFrom(netutil.IPv4Localhost(), 1234),
+		}
+
+		p.selectView(d)
+		require.NoError(t, p.Resolve(d))
+		require.NotNil(t, d.Res)
+		require.Len(t, d.Res.Answer, 1)
+
+		assert.Equal(t, "example.\t60\tIN\tA\t192.0.2.2", d.Res.Answer[0].String())
+	}
+
+	assert.Equal(t, uint32(1), exchanges.Load())
+
+	require.NoError(t, p.Shutdown(ctx))
+	assert.True(t, viewClosed)
+}
+
+func TestView_matches(t *testing.T) {
+	v, err := newView(&View{
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{newAddrUpstream(t, net.IP{192, 0, 2, 1})},
+		},
+		Name:          "test",
+		ClientSubnets: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+		ListenAddrs: []netip.AddrPort{
+			netip.MustParseAddrPort("127.0.0.1:53"),
+			netip.MustParseAddrPort("[::]:5353"),
+		},
+	})
+	require.NoError(t, err)
+
+	inSubnet := netip.MustParseAddr("192.0.2.1")
+
+	testCases := []struct {
+		cli   netip.Addr
+		local netip.AddrPort
+		name  string
+		want  bool
+	}{{
+		cli:   inSubnet,
+		local: netip.MustParseAddrPort("127.0.0.1:53"),
+		name:  "match",
+		want:  true,
+	}, {
+		cli:   inSubnet,
+		local: netip.MustParseAddrPort("[2001:db8::1]:5353"),
+		name:  "unspecified_listener",
+		want:  true,
+	}, {
+		cli:   inSubnet,
+		local: netip.MustParseAddrPort("127.0.0.2:53"),
+		name:  "other_listener",
+		want:  false,
+	}, {
+		cli:   inSubnet,
+		local: netip.AddrPort{},
+		name:  "unknown_listener",
+		want:  false,
+	}, {
+		cli:   netip.MustParseAddr("198.51.100.1"),
+		local: netip.MustParseAddrPort("127.0.0.1:53"),
+		name:  "other_client",
+		want:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, v.matches(tc.cli, tc.local))
+		})
+	}
+}
+
+func TestNewViews_bad(t *testing.T) {
+	upsConf := &UpstreamConfig{
+		Upstreams: []upstream.Upstream{newAddrUpstream(t, net.IP{192, 0, 2, 1})},
+	}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		confs      []*View
+	}{{
+		name:       "no_name",
+		wantErrMsg: `view "": empty name`,
+		confs:      []*View{{UpstreamConfig: upsConf}},
+	}, {
+		name:       "duplicate",
+		wantErrMsg: `view at index 1: duplicate name "test"`,
+		confs: []*View{{
+			UpstreamConfig: upsConf,
+			Name:           "test",
+		}, {
+			UpstreamConfig: upsConf,
+			Name:           "test",
+		}},
+	}, {
+		name:       "no_upstreams",
+		wantErrMsg: `view "test": validating upstreams: upstream config is nil`,
+		confs:      []*View{{Name: "test"}},
+	}, {
+		name:       "bad_dns64",
+		wantErrMsg: `view "test": dns64: prefix at index 0: "192.0.2.0/24" is not an IPv6 prefix`,
+		confs: []*View{{
+			UpstreamConfig: upsConf,
+			Name:           "test",
+			DNS64Prefs:     []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+			UseDNS64:       true,
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newViews(tc.confs)
+			testutil.AssertErrorMsg(t, tc.wantErrMsg, err)
+		})
+	}
+}
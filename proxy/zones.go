@@ -0,0 +1,357 @@
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/AdguardTeam/golibs/mapsutil"
+	"github.com/miekg/dns"
+)
+
+// maxZoneCNAMEChain is the maximum number of CNAME records followed within a
+// zone when answering a single request.
+const maxZoneCNAMEChain = 16
+
+// zoneSet is an immutable set of local authoritative zones.
+type zoneSet struct {
+	// zones are sorted by the number of labels in their origins in descending
+	// order, so that the closest enclosing zone is found first.
+	zones []*zone
+}
+
+// loadZones parses the zone files at paths.  Each file must contain a single
+// zone with exactly one SOA record at its apex.
+func loadZones(paths []string) (zs *zoneSet, err error) {
+	zs = &zoneSet{
+		zones: make([]*zone, 0, len(paths)),
+	}
+
+	origins := map[string]string{}
+	for _, p := range paths {
+		var z *zone
+		z, err = loadZoneFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("zone file %q: %w", p, err)
+		}
+
+		if prev, ok := origins[z.origin]; ok {
+			return nil, fmt.Errorf(
+				"zone file %q: zone %q is already loaded from %q",
+				p,
+				z.origin,
+				prev,
+			)
+		}
+
+		origins[z.origin] = p
+		zs.zones = append(zs.zones, z)
+	}
+
+	slices.SortStableFunc(zs.zones, func(a, b *zone) (res int) {
+		return dns.CountLabel(b.origin) - dns.CountLabel(a.origin)
+	})
+
+	return zs, nil
+}
+
+// find returns the zone containing the lowercased name or nil if there is no
+// such zone.
+func (zs *zoneSet) find(name string) (z *zone) {
+	for _, z = range zs.zones {
+		if dns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+
+	return nil
+}
+
+// answer returns the authoritative response to req or nil if req doesn't
+// belong to any of the zones or is delegated from it.
+func (zs *zoneSet) answer(req *dns.Msg) (resp *dns.Msg) {
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	z := zs.find(name)
+	if z == nil || q.Qclass != z.soa.Hdr.Class || z.isDelegated(name, q.Qtype) {
+		return nil
+	}
+
+	resp = reply(req, dns.RcodeSuccess)
+	resp.Authoritative = true
+	z.resolve(resp, q.Name, q.Qtype)
+
+	return resp
+}
+
+// zone is a single local authoritative zone.
+type zone struct {
+	// soa is the SOA record at the apex of the zone.
+	soa *dns.SOA
+
+	// records maps the lowercased owner names to the RRsets of the zone by
+	// their types.
+	records map[string]map[uint16][]dns.RR
+
+	// names is the set of the lowercased names existing in the zone, including
+	// the empty non-terminals.
+	names map[string]unit
+
+	// origin is the lowercased name of the apex of the zone.
+	origin string
+}
+
+// loadZoneFile parses the zone file at path.
+func loadZoneFile(path string) (z *zone, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		// Don't wrap the error, since it's informative enough as is.
+		return nil, err
+	}
+	defer func() { err = errors.WithDeferred(err, f.Close()) }()
+
+	zp := dns.NewZoneParser(f, "", path)
+	zp.SetIncludeAllowed(true)
+
+	var rrs []dns.RR
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+
+	err = zp.Err()
+	if err != nil {
+		return nil, fmt.Errorf("parsing: %w", err)
+	}
+
+	return newZone(rrs)
+}
+
+// newZone returns a new zone containing rrs.  rrs must contain exactly one SOA
+// record, and all the other records must belong to its zone.
+func newZone(rrs []dns.RR) (z *zone, err error) {
+	z = &zone{
+		records: map[string]map[uint16][]dns.RR{},
+		names:   map[string]unit{},
+	}
+
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if z.soa != nil {
+				return nil, errors.Error("more than one soa record")
+			}
+
+			z.soa = soa
+			z.origin = strings.ToLower(soa.Hdr.Name)
+		}
+	}
+
+	if z.soa == nil {
+		return nil, errors.Error("no soa record")
+	}
+
+	for _, rr := range rrs {
+		err = z.add(rr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return z, nil
+}
+
+// add adds rr to z.
+func (z *zone) add(rr dns.RR) (err error) {
+	hdr := rr.Header()
+	name := strings.ToLower(hdr.Name)
+	if !dns.IsSubDomain(z.origin, name) {
+		return fmt.Errorf("record %q is out of zone %q", hdr.Name, z.origin)
+	}
+
+	rrsets := z.records[name]
+	if rrsets == nil {
+		rrsets = map[uint16][]dns.RR{}
+		z.records[name] = rrsets
+	}
+
+	rrsets[hdr.Rrtype] = append(rrsets[hdr.Rrtype], rr)
+
+	// Add the empty non-terminals between the apex and the name.
+	for n := name; ; {
+		z.names[n] = unit{}
+		if n == z.origin {
+			break
+		}
+
+		n = parentName(n)
+	}
+
+	return nil
+}
+
+// isDelegated returns true if the lowercased name is delegated from z to
+// another zone, so that z isn't authoritative for it.  The DS records are
+// served by the parent zone.
+func (z *zone) isDelegated(name string, qtype uint16) (ok bool) {
+	if qtype != dns.TypeDS && z.hasNS(name) {
+		return true
+	}
+
+	for n := name; n != z.origin; {
+		n = parentName(n)
+		if z.hasNS(n) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasNS returns true if the lowercased name is not the apex of z and has NS
+// records.
+func (z *zone) hasNS(name string) (ok bool) {
+	return name != z.origin && len(z.records[name][dns.TypeNS]) > 0
+}
+
+// resolve fills resp with the answer for name and qtype, following the CNAME
+// records within z.
+func (z *zone) resolve(resp *dns.Msg, name string, qtype uint16) {
+	seen := map[string]unit{}
+	for range maxZoneCNAMEChain {
+		lowName := strings.ToLower(name)
+		seen[lowName] = unit{}
+
+		rrsets, ok := z.lookup(name, lowName)
+		if !ok {
+			resp.Rcode = dns.RcodeNameError
+			resp.Ns = []dns.RR{z.negativeSOA()}
+
+			return
+		}
+
+		if qtype == dns.TypeANY && len(rrsets) > 0 {
+			mapsutil.SortedRange(rrsets, func(_ uint16, rrs []dns.RR) (cont bool) {
+				resp.Answer = append(resp.Answer, rrs...)
+
+				return true
+			})
+
+			return
+		} else if rrs := rrsets[qtype]; len(rrs) > 0 {
+			resp.Answer = append(resp.Answer, rrs...)
+
+			return
+		}
+
+		cnames := rrsets[dns.TypeCNAME]
+		if len(cnames) == 0 {
+			resp.Ns = []dns.RR{z.negativeSOA()}
+
+			return
+		}
+
+		resp.Answer = append(resp.Answer, cnames[0])
+
+		name = cnames[0].(*dns.CNAME).Target
+		lowName = strings.ToLower(name)
+		if _, ok = seen[lowName]; ok || !dns.IsSubDomain(z.origin, lowName) {
+			return
+		} else if z.isDelegated(lowName, qtype) {
+			return
+		}
+	}
+}
+
+// lookup returns the RRsets of z for name, which lowercased form is lowName,
+// synthesizing them from the wildcard records if needed.  ok is false if there
+// is no such name in z.
+func (z *zone) lookup(name, lowName string) (rrsets map[uint16][]dns.RR, ok bool) {
+	if _, ok = z.names[lowName]; ok {
+		return z.records[lowName], true
+	}
+
+	// Find the closest encloser and synthesize the answer from its wildcard,
+	// if any.  See RFC 4592.
+	for n := lowName; n != z.origin; {
+		n = parentName(n)
+		if _, ok = z.names[n]; !ok {
+			continue
+		}
+
+		wildcard := z.records["*."+n]
+		if wildcard == nil {
+			return nil, false
+		}
+
+		return synthesize(wildcard, name), true
+	}
+
+	return nil, false
+}
+
+// negativeSOA returns the SOA record of z to put into the negative responses.
+// Its TTL is the minimum of its own TTL and its MINIMUM field, see RFC 2308.
+func (z *zone) negativeSOA() (soa *dns.SOA) {
+	soa = dns.Copy(z.soa).(*dns.SOA)
+	soa.Hdr.Ttl = min(soa.Hdr.Ttl, soa.Minttl)
+
+	return soa
+}
+
+// synthesize returns the copies of the wildcard RRsets owned by name.
+func synthesize(wildcard map[uint16][]dns.RR, name string) (rrsets map[uint16][]dns.RR) {
+	rrsets = make(map[uint16][]dns.RR, len(wildcard))
+	for t, rrs := range wildcard {
+		synth := make([]dns.RR, 0, len(rrs))
+		for _, rr := range rrs {
+			rr = dns.Copy(rr)
+			rr.Header().Name = name
+			synth = append(synth, rr)
+		}
+
+		rrsets[t] = synth
+	}
+
+	return rrsets
+}
+
+// replyFromZones sets the authoritative response from the local zones into d,
+// if any of them contains the requested name.  ok is true if the response is
+// set.
+func (p *Proxy) replyFromZones(d *DNSContext) (ok bool) {
+	zs := p.zones.Load()
+	if zs == nil {
+		return false
+	}
+
+	d.Res = zs.answer(d.Req)
+	if d.Res == nil {
+		return false
+	}
+
+	filterMsg(d.Res, d.Res, d.adBit, d.doBit, 0)
+
+	return true
+}
+
+// ReloadZones parses the files from [Config.ZoneFiles] again and replaces the
+// served zones with the parsed ones.  If any of the files fails to parse, the
+// previously loaded zones are kept.  It is safe for concurrent use.
+func (p *Proxy) ReloadZones() (err error) {
+	if len(p.ZoneFiles) == 0 {
+		return nil
+	}
+
+	zs, err := loadZones(p.ZoneFiles)
+	if err != nil {
+		return fmt.Errorf("loading zones: %w", err)
+	}
+
+	p.zones.Store(zs)
+
+	p.logger.Info("zones loaded", "count", len(zs.zones))
+
+	return nil
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/logutil/slogutil"
+	"github.com/AdguardTeam/golibs/netutil"
+	"github.com/AdguardTeam/golibs/testutil"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testZone is the contents of the zone file used in tests.
+const testZone = `$ORIGIN example.test.
+$TTL 300
+@          IN SOA  ns.example.test. admin.example.test. 1 3600 600 86400 60
+@          IN NS   ns.example.test.
+ns         IN A    192.0.2.53
+www        IN A    192.0.2.1
+www        IN AAAA 2001:db8::1
+alias      IN CNAME www
+chain      IN CNAME alias.EXAMPLE.test.
+outside    IN CNAME www.example.org.
+loop       IN CNAME loop
+*.wild     IN A    192.0.2.2
+a.b.ent    IN A    192.0.2.3
+sub        IN NS   ns.sub.example.test.
+ns.sub     IN A    192.0.2.54
+`
+
+// writeTestZone writes the zone file with data into a temporary directory and
+// returns its path.
+func writeTestZone(t *testing.T, data string) (path string) {
+	t.Helper()
+
+	path = filepath.Join(t.TempDir(), "zone.db")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+
+	return path
+}
+
+func TestProxy_Resolve_zones(t *testing.T) {
+	var exchanges atomic.Uint32
+	ups := &fakeUpstream{
+		onExchange: func(req *dns.Msg) (resp *dns.Msg, err error) {
+			exchanges.Add(1)
+
+			return (&dns.Msg{}).SetReply(req), nil
+		},
+		onAddress: func() (addr string) { return "fake.address" },
+		onClose:   func() (err error) { return nil },
+	}
+
+	zonePath := writeTestZone(t, testZone)
+	p := mustNew(t, &Config{
+		Logger:        slogutil.NewDiscardLogger(),
+		UDPListenAddr: []*net.UDPAddr{net.UDPAddrFromAddrPort(localhostAnyPort)},
+		TCPListenAddr: []*net.TCPAddr{net.TCPAddrFromAddrPort(localhostAnyPort)},
+		UpstreamConfig: &UpstreamConfig{
+			Upstreams: []upstream.Upstream{ups},
+		},
+		TrustedProxies:         defaultTrustedProxies,
+		RatelimitSubnetLenIPv4: 24,
+		RatelimitSubnetLenIPv6: 64,
+		CacheEnabled:           true,
+		ZoneFiles:              []string{zonePath},
+	})
+
+	cli := netip.AddrPortFrom(netutil.IPv4Localhost(), 1234)
+
+	testCases := []struct {
+		name       string
+		host       string
+		wantAnswer []string
+		qtype      uint16
+		wantRcode  int
+		wantSOA    bool
+	}{{
+		name:       "exact",
+		host:       "www.example.test.",
+		wantAnswer: []string{"www.example.test.\t300\tIN\tA\t192.0.2.1"},
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    false,
+	}, {
+		name:       "case_insensitive",
+		host:       "WWW.Example.Test.",
+		wantAnswer: []string{"www.example.test.\t300\tIN\tAAAA\t2001:db8::1"},
+		qtype:      dns.TypeAAAA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    false,
+	}, {
+		name:       "nodata",
+		host:       "www.example.test.",
+		wantAnswer: nil,
+		qtype:      dns.TypeMX,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    true,
+	}, {
+		name:       "nxdomain",
+		host:       "none.example.test.",
+		wantAnswer: nil,
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeNameError,
+		wantSOA:    true,
+	}, {
+		name:       "empty_non_terminal",
+		host:       "b.ent.example.test.",
+		wantAnswer: nil,
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    true,
+	}, {
+		name:       "wildcard",
+		host:       "any.thing.wild.example.test.",
+		wantAnswer: []string{"any.thing.wild.example.test.\t300\tIN\tA\t192.0.2.2"},
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    false,
+	}, {
+		name: "cname_chain",
+		host: "chain.example.test.",
+		wantAnswer: []string{
+			"chain.example.test.\t300\tIN\tCNAME\talias.EXAMPLE.test.",
+			"alias.example.test.\t300\tIN\tCNAME\twww.example.test.",
+			"www.example.test.\t300\tIN\tA\t192.0.2.1",
+		},
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantSOA:   false,
+	}, {
+		name:       "cname_query",
+		host:       "alias.example.test.",
+		wantAnswer: []string{"alias.example.test.\t300\tIN\tCNAME\twww.example.test."},
+		qtype:      dns.TypeCNAME,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    false,
+	}, {
+		name:       "cname_outside",
+		host:       "outside.example.test.",
+		wantAnswer: []string{"outside.example.test.\t300\tIN\tCNAME\twww.example.org."},
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    false,
+	}, {
+		name:       "cname_loop",
+		host:       "loop.example.test.",
+		wantAnswer: []string{"loop.example.test.\t300\tIN\tCNAME\tloop.example.test."},
+		qtype:      dns.TypeA,
+		wantRcode:  dns.RcodeSuccess,
+		wantSOA:    false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &DNSContext{
+				Req:  newReq(tc.host, tc.qtype, dns.ClassINET),
+				Addr: cli,
+			}
+
+			require.NoError(t, p.Resolve(dctx))
+			require.NotNil(t, dctx.Res)
+
+			assert.True(t, dctx.Res.Authoritative)
+			assert.Equal(t, tc.wantRcode, dctx.Res.Rcode)
+
+			var answer []string
+			for _, rr := range dctx.Res.Answer {
+				answer = append(answer, rr.String())
+			}
+			assert.Equal(t, tc.wantAnswer, answer)
+
+			if !tc.wantSOA {
+				assert.Empty(t, dctx.Res.Ns)
+
+				return
+			}
+
+			require.Len(t, dctx.Res.Ns, 1)
+			soa := testutil.RequireTypeAssert[*dns.SOA](t, dctx.Res.Ns[0])
+			assert.Equal(t, uint32(60), soa.Hdr.Ttl)
+		})
+	}
+
+	require.Zero(t, exchanges.Load())
+
+	t.Run("delegated", func(t *testing.T) {
+		dctx := &DNSContext{
+			Req:  newReq("host.sub.example.test.", dns.TypeA, dns.ClassINET),
+			Addr: cli,
+		}
+
+		require.NoError(t, p.Resolve(dctx))
+		require.NotNil(t, dctx.Res)
+
+		assert.False(t, dctx.Res.Authoritative)
+		assert.Equal(t, uint32(1), exchanges.Load())
+	})
+
+	t.Run("reload", func(t *testing.T) {
+		const newZone = `example.test. 300 IN SOA ns.example.test. admin.example.test. 2 3600 600 86400 60
+www.example.test. 300 IN A 192.0.2.100
+`
+
+		require.NoError(t, os.WriteFile(zonePath, []byte("bad zone"), 0o600))
+		require.Error(t, p.ReloadZones())
+
+		dctx := &DNSContext{
+			Req:  newReq("www.example.test.", dns.TypeA, dns.ClassINET),
+			Addr: cli,
+		}
+		require.NoError(t, p.Resolve(dctx))
+		require.Len(t, dctx.Res.Answer, 1)
+
+		a := testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.IP{192, 0, 2, 1}, a.A.To4())
+
+		require.NoError(t, os.WriteFile(zonePath, []byte(newZone), 0o600))
+		require.NoError(t, p.ReloadZones())
+
+		dctx = &DNSContext{
+			Req:  newReq("www.example.test.", dns.TypeA, dns.ClassINET),
+			Addr: cli,
+		}
+		require.NoError(t, p.Resolve(dctx))
+		require.Len(t, dctx.Res.Answer, 1)
+
+		a = testutil.RequireTypeAssert[*dns.A](t, dctx.Res.Answer[0])
+		assert.Equal(t, net.IP{192, 0, 2, 100}, a.A.To4())
+	})
+}
+
+func TestLoadZones(t *testing.T) {
+	testCases := []struct {
+		name       string
+		data       string
+		wantErrMsg string
+	}{{
+		name:       "no_soa",
+		data:       "www.example.test. 300 IN A 192.0.2.1\n",
+		wantErrMsg: "no soa record",
+	}, {
+		name: "two_soa",
+		data: "a.test. 300 IN SOA ns.a.test. admin.a.test. 1 3600 600 86400 60\n" +
+			"b.test. 300 IN SOA ns.b.test. admin.b.test. 1 3600 600 86400 60\n",
+		wantErrMsg: "more than one soa record",
+	}, {
+		name: "out_of_zone",
+		data: "a.test. 300 IN SOA ns.a.test. admin.a.test. 1 3600 600 86400 60\n" +
+			"www.b.test. 300 IN A 192.0.2.1\n",
+		wantErrMsg: `record "www.b.test." is out of zone "a.test."`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := writeTestZone(t, tc.data)
+
+			_, err := loadZones([]string{path})
+			testutil.AssertErrorMsg(t, "zone file "+strconv.Quote(path)+": "+tc.wantErrMsg, err)
+		})
+	}
+
+	t.Run("duplicate", func(t *testing.T) {
+		path := writeTestZone(t, testZone)
+
+		_, err := loadZones([]string{path, path})
+		require.Error(t, err)
+	})
+}
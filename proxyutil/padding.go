@@ -0,0 +1,60 @@
+package proxyutil
+
+import (
+	"slices"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// QueryPaddingBlockSize is the block length to pad the queries to, see
+	// RFC 8467.
+	QueryPaddingBlockSize = 128
+
+	// ResponsePaddingBlockSize is the block length to pad the responses to, see
+	// RFC 8467.
+	ResponsePaddingBlockSize = 468
+)
+
+// paddingOptionHdrLen is the length of the EDNS(0) option code and length
+// fields.
+const paddingOptionHdrLen = 4
+
+// Pad adds the EDNS(0) Padding option, see RFC 7830, to msg so that the length
+// of its wire format becomes a multiple of blockSize, replacing the existing
+// one.  msg is left unpadded if it has no OPT record or if the padded message
+// would exceed the maximum DNS message size.  blockSize must be positive.
+func Pad(msg *dns.Msg, blockSize int) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	RemovePadding(msg)
+
+	l := msg.Len() + paddingOptionHdrLen
+	padLen := (blockSize - l%blockSize) % blockSize
+	if l+padLen > dns.MaxMsgSize {
+		return
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{
+		Padding: make([]byte, padLen),
+	})
+}
+
+// RemovePadding removes the EDNS(0) Padding option from msg, if any.  removed
+// is true if msg contained it.
+func RemovePadding(msg *dns.Msg) (removed bool) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return false
+	}
+
+	l := len(opt.Option)
+	opt.Option = slices.DeleteFunc(opt.Option, func(e dns.EDNS0) (ok bool) {
+		return e.Option() == dns.EDNS0PADDING
+	})
+
+	return len(opt.Option) != l
+}
@@ -0,0 +1,160 @@
+package upstream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/errors"
+	"github.com/miekg/dns"
+)
+
+const (
+	// clientCookieLen is the length of a client cookie, see RFC 7873.
+	clientCookieLen = 8
+
+	// minServerCookieLen is the minimum length of a server cookie.
+	minServerCookieLen = 8
+
+	// maxServerCookieLen is the maximum length of a server cookie.
+	maxServerCookieLen = 32
+)
+
+// errCookie is returned when the response contains a cookie that doesn't
+// correspond to the request or lacks a cookie expected from the server.
+const errCookie errors.Error = "bad cookie"
+
+// cookieJar keeps the client cookie and the server cookies received from the
+// addresses of a single upstream, see RFC 7873.  It's safe for concurrent use.
+type cookieJar struct {
+	// mu protects servers.
+	mu *sync.Mutex
+
+	// servers maps the remote addresses of the upstream to the last server
+	// cookies received from them.
+	servers map[string][]byte
+
+	// client is the client cookie sent to the upstream.
+	client []byte
+}
+
+// newCookieJar returns a new properly initialized *cookieJar with a random
+// client cookie.
+func newCookieJar() (j *cookieJar) {
+	client := make([]byte, clientCookieLen)
+
+	// Don't check the error since it's always nil.
+	_, _ = rand.Read(client)
+
+	return &cookieJar{
+		mu:      &sync.Mutex{},
+		servers: map[string][]byte{},
+		client:  client,
+	}
+}
+
+// withCookie returns a shallow copy of req with the COOKIE option for the
+// remote address addr added to its OPT record, replacing the existing one.
+func (j *cookieJar) withCookie(req *dns.Msg, addr string) (withCookie *dns.Msg) {
+	j.mu.Lock()
+	cookie := append(bytes.Clone(j.client), j.servers[addr]...)
+	j.mu.Unlock()
+
+	opt := &dns.OPT{
+		Hdr: dns.RR_Header{
+			Name:   ".",
+			Rrtype: dns.TypeOPT,
+			Class:  dns.MinMsgSize,
+		},
+	}
+
+	withCookie = &dns.Msg{}
+	*withCookie = *req
+	withCookie.Extra = make([]dns.RR, 0, len(req.Extra)+1)
+	for _, rr := range req.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			opt.Hdr = o.Hdr
+			for _, e := range o.Option {
+				if e.Option() != dns.EDNS0COOKIE {
+					opt.Option = append(opt.Option, e)
+				}
+			}
+
+			continue
+		}
+
+		withCookie.Extra = append(withCookie.Extra, rr)
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+		Code:   dns.EDNS0COOKIE,
+		Cookie: hex.EncodeToString(cookie),
+	})
+	withCookie.Extra = append(withCookie.Extra, opt)
+
+	return withCookie
+}
+
+// update checks the COOKIE option of resp received from the remote address
+// addr, remembers the server cookie from it, and removes it from resp.  It
+// returns an error wrapping [errCookie] if the option doesn't correspond to the
+// client cookie or if it's missing while a server cookie from addr is already
+// known, see RFC 7873 Section 5.3.
+func (j *cookieJar) update(resp *dns.Msg, addr string) (err error) {
+	o := resp.IsEdns0()
+	if o == nil {
+		return j.checkMissing(addr)
+	}
+
+	var cookie []byte
+	options := o.Option[:0]
+	for _, e := range o.Option {
+		c, ok := e.(*dns.EDNS0_COOKIE)
+		if !ok {
+			options = append(options, e)
+
+			continue
+		}
+
+		cookie, err = hex.DecodeString(c.Cookie)
+		if err != nil {
+			return fmt.Errorf("%w: %w", errCookie, err)
+		}
+	}
+
+	o.Option = options
+	if cookie == nil {
+		return j.checkMissing(addr)
+	}
+
+	client := cookie[:min(clientCookieLen, len(cookie))]
+	server := cookie[len(client):]
+	if !bytes.Equal(client, j.client) {
+		return fmt.Errorf("%w: mismatched client cookie %x", errCookie, client)
+	} else if l := len(server); l < minServerCookieLen || l > maxServerCookieLen {
+		return fmt.Errorf("%w: server cookie length %d", errCookie, l)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.servers[addr] = server
+
+	return nil
+}
+
+// checkMissing returns an error wrapping [errCookie] if a server cookie from
+// addr is known, since a server supporting cookies must always send them back.
+// Otherwise, the upstream doesn't support cookies and it returns nil.
+func (j *cookieJar) checkMissing(addr string) (err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.servers[addr] != nil {
+		return fmt.Errorf("%w: missing from %s", errCookie, addr)
+	}
+
+	return nil
+}
@@ -161,6 +161,9 @@ func (p *dnsOverHTTPS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 		}
 	}()
 
+	req, addedOPT := padQuery(req)
+	defer func() { unpadResponse(resp, addedOPT) }()
+
 	// Check if there was already an active client before sending the request.
 	// We'll only attempt to re-connect if there was one.
 	client, isCached, err := p.getClient()
@@ -161,6 +161,9 @@ func (p *dnsOverQUIC) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 		}
 	}()
 
+	req, addedOPT := padQuery(req)
+	defer func() { unpadResponse(resp, addedOPT) }()
+
 	// Gets or opens a QUIC connection to use for this query.
 	conn, cached, err := p.getConnection()
 	if err != nil {
@@ -90,6 +90,9 @@ func (p *dnsOverTLS) Address() string { return p.addr.String() }
 
 // Exchange implements the [Upstream] interface for *dnsOverTLS.
 func (p *dnsOverTLS) Exchange(req *dns.Msg) (reply *dns.Msg, err error) {
+	req, addedOPT := padQuery(req)
+	defer func() { unpadResponse(reply, addedOPT) }()
+
 	h, err := p.getDialer()
 	if err != nil {
 		return nil, fmt.Errorf("getting conn to %s: %w", p.addr, err)
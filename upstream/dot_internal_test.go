@@ -11,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
 	"github.com/AdguardTeam/golibs/logutil/slogutil"
 	"github.com/AdguardTeam/golibs/testutil"
 	"github.com/miekg/dns"
@@ -207,6 +208,57 @@ func TestUpstream_dnsOverTLS_poolDeadline(t *testing.T) {
 	require.Nil(t, response)
 }
 
+func TestUpstream_dnsOverTLS_padding(t *testing.T) {
+	srv := startDoTServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+		pt := testutil.PanicT{}
+
+		opt := req.IsEdns0()
+		require.NotNil(pt, opt)
+		require.Zero(pt, req.Len()%proxyutil.QueryPaddingBlockSize)
+
+		resp := respondToTestMessage(req)
+		resp.SetEdns0(opt.UDPSize(), false)
+		proxyutil.Pad(resp, proxyutil.ResponsePaddingBlockSize)
+
+		require.NoError(pt, w.WriteMsg(resp))
+	})
+
+	addr := fmt.Sprintf("tls://127.0.0.1:%d", srv.port)
+	u, err := AddressToUpstream(addr, &Options{
+		Logger:             slogutil.NewDiscardLogger(),
+		InsecureSkipVerify: true,
+	})
+	require.NoError(t, err)
+	testutil.CleanupAndRequireSuccess(t, u.Close)
+
+	t.Run("no_edns", func(t *testing.T) {
+		req := createTestMessage()
+
+		resp, exchErr := u.Exchange(req)
+		require.NoError(t, exchErr)
+		requireResponse(t, req, resp)
+
+		assert.Nil(t, req.IsEdns0())
+		assert.Nil(t, resp.IsEdns0())
+	})
+
+	t.Run("edns", func(t *testing.T) {
+		req := createTestMessage()
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		resp, exchErr := u.Exchange(req)
+		require.NoError(t, exchErr)
+		requireResponse(t, req, resp)
+
+		assert.Empty(t, req.IsEdns0().Option)
+
+		opt := resp.IsEdns0()
+		require.NotNil(t, opt)
+
+		assert.Empty(t, opt.Option)
+	})
+}
+
 // testDoTServer is a test DNS-over-TLS server that can be used in unit-tests.
 type testDoTServer struct {
 	// srv is the *dns.Server instance that listens for DoT requests.
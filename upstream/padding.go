@@ -0,0 +1,60 @@
+package upstream
+
+import (
+	"slices"
+
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/miekg/dns"
+)
+
+// padQuery returns a shallow copy of req padded according to the block-length
+// policy from RFC 8467.  It's used for the encrypted upstreams only, since
+// padding doesn't protect the plain DNS messages.  If req has no OPT record, it
+// is added to the copy and addedOPT is true.
+func padQuery(req *dns.Msg) (padded *dns.Msg, addedOPT bool) {
+	padded = &dns.Msg{}
+	*padded = *req
+	padded.Extra = make([]dns.RR, 0, len(req.Extra)+1)
+
+	hasOPT := false
+	for _, rr := range req.Extra {
+		if o, ok := rr.(*dns.OPT); ok {
+			// Clone the OPT record to not modify the original request.
+			rr = &dns.OPT{
+				Hdr:    o.Hdr,
+				Option: slices.Clone(o.Option),
+			}
+			hasOPT = true
+		}
+
+		padded.Extra = append(padded.Extra, rr)
+	}
+
+	if !hasOPT {
+		padded.SetEdns0(dns.DefaultMsgSize, false)
+	}
+
+	proxyutil.Pad(padded, proxyutil.QueryPaddingBlockSize)
+
+	return padded, !hasOPT
+}
+
+// unpadResponse removes the padding from resp received for the query padded
+// with [padQuery], so that it isn't forwarded further.  addedOPT is the value
+// returned by [padQuery], if it's true, the OPT record is removed entirely.
+// resp may be nil.
+func unpadResponse(resp *dns.Msg, addedOPT bool) {
+	if resp == nil {
+		return
+	}
+
+	if !addedOPT {
+		proxyutil.RemovePadding(resp)
+
+		return
+	}
+
+	resp.Extra = slices.DeleteFunc(resp.Extra, func(rr dns.RR) (ok bool) {
+		return rr.Header().Rrtype == dns.TypeOPT
+	})
+}
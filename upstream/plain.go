@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/AdguardTeam/dnsproxy/internal/bootstrap"
@@ -46,6 +48,19 @@ type plainDNS struct {
 
 	// timeout is the timeout for DNS requests.
 	timeout time.Duration
+
+	// cookies keeps the DNS cookies of the upstream.  It's nil if the cookies
+	// are disabled.
+	cookies *cookieJar
+
+	// caseIgnored is true if the upstream has been detected to not preserve
+	// the case of the query name, so that the case isn't randomized for it
+	// anymore.
+	caseIgnored atomic.Bool
+
+	// randomizeCase is true if the case of the query name should be
+	// randomized, see [Options.RandomizeCase].
+	randomizeCase bool
 }
 
 // newPlain returns the plain DNS Upstream.  addr.Scheme should be either "udp"
@@ -60,13 +75,21 @@ func newPlain(addr *url.URL, opts *Options) (u *plainDNS, err error) {
 
 	addPort(addr, defaultPortPlain)
 
-	return &plainDNS{
+	u = &plainDNS{
 		addr:      addr,
 		logger:    opts.Logger,
 		getDialer: newDialerInitializer(addr, opts),
 		net:       addr.Scheme,
 		timeout:   opts.Timeout,
-	}, nil
+
+		randomizeCase: opts.RandomizeCase,
+	}
+
+	if opts.Cookies {
+		u.cookies = newCookieJar()
+	}
+
+	return u, nil
 }
 
 // type check
@@ -109,7 +132,7 @@ func (p *plainDNS) dialExchange(
 	}
 	defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-	resp, _, err = client.ExchangeWithConn(req, conn)
+	resp, err = p.exchangeWithConn(client, conn, req)
 	if isExpectedConnErr(err) {
 		conn.Conn, err = dial(ctx, network, "")
 		if err != nil {
@@ -117,14 +140,72 @@ func (p *plainDNS) dialExchange(
 		}
 		defer func(c net.Conn) { err = errors.WithDeferred(err, c.Close()) }(conn.Conn)
 
-		resp, _, err = client.ExchangeWithConn(req, conn)
+		resp, err = p.exchangeWithConn(client, conn, req)
 	}
 
 	if err != nil {
 		return resp, fmt.Errorf("exchanging with %s over %s: %w", addr, network, err)
 	}
 
-	return resp, validatePlainResponse(req, resp)
+	err = validatePlainResponse(req, resp)
+	if err != nil || !p.randomizesCase() {
+		return resp, err
+	}
+
+	respName := resp.Question[0].Name
+	if respName == req.Question[0].Name {
+		return resp, nil
+	} else if network == networkUDP {
+		return resp, fmt.Errorf("%w: mismatched name case %q", errQuestion, respName)
+	}
+
+	// The responses over TCP can't be spoofed as easily, so the upstream
+	// itself doesn't preserve the case.
+	p.caseIgnored.Store(true)
+	p.logger.Info("upstream does not preserve query name case, not randomizing it", "addr", addr)
+
+	return resp, nil
+}
+
+// exchangeWithConn exchanges req over conn using client, sending the DNS
+// cookies if enabled.
+func (p *plainDNS) exchangeWithConn(
+	client *dns.Client,
+	conn *dns.Conn,
+	req *dns.Msg,
+) (resp *dns.Msg, err error) {
+	if p.cookies == nil {
+		resp, _, err = client.ExchangeWithConn(req, conn)
+
+		return resp, err
+	}
+
+	addr := conn.RemoteAddr().String()
+	resp, _, err = client.ExchangeWithConn(p.cookies.withCookie(req, addr), conn)
+	if err != nil {
+		return resp, err
+	}
+
+	err = p.cookies.update(resp, addr)
+	if err != nil || resp.Rcode != dns.RcodeBadCookie {
+		return resp, err
+	}
+
+	// The server cookie has just been updated, so retry once.
+	//
+	// See RFC 7873 Section 5.3.
+	resp, _, err = client.ExchangeWithConn(p.cookies.withCookie(req, addr), conn)
+	if err != nil {
+		return resp, err
+	}
+
+	return resp, p.cookies.update(resp, addr)
+}
+
+// randomizesCase returns true if the case of the query names is randomized for
+// p.
+func (p *plainDNS) randomizesCase() (ok bool) {
+	return p.randomizeCase && !p.caseIgnored.Load()
 }
 
 // isExpectedConnErr returns true if the error is expected.  In this case,
@@ -137,6 +218,22 @@ func isExpectedConnErr(err error) (is bool) {
 
 // Exchange implements the [Upstream] interface for *plainDNS.
 func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if !p.randomizesCase() || len(req.Question) != 1 {
+		return p.exchange(req)
+	}
+
+	wireReq := withRandomCase(req)
+	resp, err = p.exchange(wireReq)
+	if resp != nil {
+		restoreCase(resp, wireReq.Question[0].Name, req.Question[0].Name)
+	}
+
+	return resp, err
+}
+
+// exchange sends req to the upstream over UDP, falling back to TCP if needed,
+// or over TCP only, depending on the network of p.
+func (p *plainDNS) exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 	dial, err := p.getDialer()
 	if err != nil {
 		// Don't wrap the error since it's informative enough as is.
@@ -156,8 +253,9 @@ func (p *plainDNS) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
 		return resp, err
 	}
 
-	if errors.Is(err, errQuestion) {
-		// The upstream responds with malformed messages, so try TCP.
+	if errors.Is(err, errQuestion) || errors.Is(err, errCookie) {
+		// The upstream responds with malformed or spoofed messages, so try
+		// TCP.
 		p.logger.Debug(
 			"plain response is malformed, using tcp",
 			"addr", addr,
@@ -186,6 +284,51 @@ func (p *plainDNS) Close() (err error) {
 	return nil
 }
 
+// withRandomCase returns a shallow copy of req with the case of the letters of
+// its query name randomized, also known as the DNS 0x20 encoding.  req must
+// have exactly one question.
+func withRandomCase(req *dns.Msg) (randomized *dns.Msg) {
+	name := []byte(req.Question[0].Name)
+
+	var bits uint64
+	for i, c := range name {
+		if i%64 == 0 {
+			bits = rand.Uint64()
+		}
+
+		if lower := c | 0x20; lower >= 'a' && lower <= 'z' {
+			name[i] = lower &^ byte((bits&1)<<5)
+		}
+
+		bits >>= 1
+	}
+
+	randomized = &dns.Msg{}
+	*randomized = *req
+	randomized.Question = []dns.Question{req.Question[0]}
+	randomized.Question[0].Name = string(name)
+
+	return randomized
+}
+
+// restoreCase replaces the wireName in the question and the owner names of the
+// records of resp with the original name.
+func restoreCase(resp *dns.Msg, wireName, name string) {
+	for i := range resp.Question {
+		if resp.Question[i].Name == wireName {
+			resp.Question[i].Name = name
+		}
+	}
+
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if hdr := rr.Header(); hdr.Name == wireName {
+				hdr.Name = name
+			}
+		}
+	}
+}
+
 // errQuestion is returned when a message has malformed question section.
 const errQuestion errors.Error = "bad question section"
 
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -143,6 +144,259 @@ func TestUpstream_plainDNS_fallbackToTCP(t *testing.T) {
 	}
 }
 
+func TestUpstream_plainDNS_randomizeCase(t *testing.T) {
+	const (
+		host      = "Example.ORG"
+		reqsNum   = 10
+		wireLower = "example.org."
+	)
+
+	// echo returns the name as is.
+	echo := func(name string) (respName string) { return name }
+
+	testCases := []struct {
+		udpName  func(name string) (respName string)
+		tcpName  func(name string) (respName string)
+		name     string
+		wantUDP  uint32
+		wantTCP  uint32
+		wantRand bool
+	}{{
+		udpName:  echo,
+		tcpName:  echo,
+		name:     "preserving",
+		wantUDP:  reqsNum,
+		wantTCP:  0,
+		wantRand: true,
+	}, {
+		udpName:  strings.ToLower,
+		tcpName:  strings.ToLower,
+		name:     "lowercasing",
+		wantUDP:  reqsNum,
+		wantTCP:  1,
+		wantRand: false,
+	}, {
+		udpName:  strings.ToLower,
+		tcpName:  echo,
+		name:     "mismatched_udp",
+		wantUDP:  reqsNum,
+		wantTCP:  reqsNum,
+		wantRand: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var udpReqNum, tcpReqNum atomic.Uint32
+			lastName := &atomic.Pointer[string]{}
+			srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				name := req.Question[0].Name
+				lastName.Store(&name)
+
+				resp := (&dns.Msg{}).SetReply(req)
+				if w.RemoteAddr().Network() == networkUDP {
+					udpReqNum.Add(1)
+					resp.Question[0].Name = tc.udpName(name)
+				} else {
+					tcpReqNum.Add(1)
+					resp.Question[0].Name = tc.tcpName(name)
+				}
+
+				resp.Answer = append(resp.Answer, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   resp.Question[0].Name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    100,
+					},
+					A: net.IPv4(8, 8, 8, 8),
+				})
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:        slogutil.NewDiscardLogger(),
+				Timeout:       100 * time.Millisecond,
+				RandomizeCase: true,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			// Check the randomization after the first request, since the
+			// upstreams not preserving the case are detected with it.
+			randomized := false
+			for i := range reqsNum {
+				req := createHostTestMessage(host)
+
+				resp, exchErr := u.Exchange(req)
+				require.NoError(t, exchErr)
+				requireResponse(t, req, resp)
+
+				wireName := *lastName.Load()
+				require.Equal(t, wireLower, strings.ToLower(wireName))
+				randomized = randomized || (i > 0 && wireName != req.Question[0].Name)
+
+				if tc.wantRand {
+					assert.Equal(t, req.Question[0].Name, resp.Question[0].Name)
+					assert.Equal(t, req.Question[0].Name, resp.Answer[0].Header().Name)
+				}
+			}
+
+			assert.Equal(t, tc.wantRand, randomized)
+			assert.Equal(t, tc.wantUDP, udpReqNum.Load())
+			assert.Equal(t, tc.wantTCP, tcpReqNum.Load())
+		})
+	}
+}
+
+func TestUpstream_plainDNS_cookies(t *testing.T) {
+	const (
+		reqsNum = 10
+		server  = "0102030405060708"
+	)
+
+	testCases := []struct {
+		name        string
+		echo        bool
+		requireSrv  bool
+		spoofUDP    bool
+		stripUDP    bool
+		wantUDP     uint32
+		wantTCP     uint32
+		wantSrvSent bool
+	}{{
+		name:        "supported",
+		echo:        true,
+		requireSrv:  false,
+		spoofUDP:    false,
+		wantUDP:     reqsNum,
+		wantTCP:     0,
+		wantSrvSent: true,
+	}, {
+		name:        "bad_cookie",
+		echo:        true,
+		requireSrv:  true,
+		spoofUDP:    false,
+		wantUDP:     reqsNum + 1,
+		wantTCP:     0,
+		wantSrvSent: true,
+	}, {
+		name:        "unsupported",
+		echo:        false,
+		requireSrv:  false,
+		spoofUDP:    false,
+		wantUDP:     reqsNum,
+		wantTCP:     0,
+		wantSrvSent: false,
+	}, {
+		name:        "mismatched_udp",
+		echo:        true,
+		requireSrv:  false,
+		spoofUDP:    true,
+		wantUDP:     reqsNum,
+		wantTCP:     reqsNum,
+		wantSrvSent: true,
+	}, {
+		name:        "missing_udp",
+		echo:        true,
+		requireSrv:  false,
+		spoofUDP:    false,
+		stripUDP:    true,
+		wantUDP:     reqsNum,
+		wantTCP:     reqsNum - 1,
+		wantSrvSent: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var udpReqNum, tcpReqNum atomic.Uint32
+			var srvSent atomic.Bool
+			srv := startDNSServer(t, func(w dns.ResponseWriter, req *dns.Msg) {
+				isUDP := w.RemoteAddr().Network() == networkUDP
+				if isUDP {
+					udpReqNum.Add(1)
+				} else {
+					tcpReqNum.Add(1)
+				}
+
+				cookie := reqCookie(req)
+				require.GreaterOrEqual(testutil.PanicT{}, len(cookie), 2*clientCookieLen)
+
+				client := cookie[:2*clientCookieLen]
+				hasSrv := cookie[len(client):] == server
+				srvSent.Store(srvSent.Load() || hasSrv)
+
+				resp := (&dns.Msg{}).SetReply(req)
+				if !tc.echo || (tc.stripUDP && isUDP && hasSrv) {
+					require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+
+					return
+				}
+
+				if tc.spoofUDP && isUDP {
+					client = "ffffffffffffffff"
+				}
+
+				resp.SetEdns0(dns.MinMsgSize, false)
+				opt := resp.IsEdns0()
+				opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{
+					Code:   dns.EDNS0COOKIE,
+					Cookie: client + server,
+				})
+
+				if tc.requireSrv && !hasSrv {
+					resp.Rcode = dns.RcodeBadCookie
+				}
+
+				require.NoError(testutil.PanicT{}, w.WriteMsg(resp))
+			})
+			testutil.CleanupAndRequireSuccess(t, srv.Close)
+
+			addr := fmt.Sprintf("127.0.0.1:%d", srv.port)
+			u, err := AddressToUpstream(addr, &Options{
+				Logger:  slogutil.NewDiscardLogger(),
+				Timeout: 100 * time.Millisecond,
+				Cookies: true,
+			})
+			require.NoError(t, err)
+			testutil.CleanupAndRequireSuccess(t, u.Close)
+
+			for range reqsNum {
+				req := createTestMessage()
+
+				resp, exchErr := u.Exchange(req)
+				require.NoError(t, exchErr)
+
+				assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+				assert.Empty(t, reqCookie(resp))
+				assert.Nil(t, req.IsEdns0())
+			}
+
+			assert.Equal(t, tc.wantSrvSent, srvSent.Load())
+			assert.Equal(t, tc.wantUDP, udpReqNum.Load())
+			assert.Equal(t, tc.wantTCP, tcpReqNum.Load())
+		})
+	}
+}
+
+// reqCookie returns the hex-encoded COOKIE option of msg or an empty string.
+func reqCookie(msg *dns.Msg) (cookie string) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, e := range opt.Option {
+		if c, ok := e.(*dns.EDNS0_COOKIE); ok {
+			return c.Cookie
+		}
+	}
+
+	return ""
+}
+
 // testDNSServer is a simple DNS server that can be used in unit-tests.
 type testDNSServer struct {
 	udpListener net.PacketConn
@@ -103,6 +103,17 @@ type Options struct {
 	// PreferIPv6 tells the bootstrapper to prefer IPv6 addresses for an
 	// upstream.
 	PreferIPv6 bool
+
+	// RandomizeCase enables the DNS 0x20 encoding for the plain DNS upstreams,
+	// randomizing the case of the query names and rejecting the responses with
+	// the case of the name not matching exactly.  The case isn't randomized
+	// anymore for the upstreams detected to not preserve it.
+	RandomizeCase bool
+
+	// Cookies enables the DNS cookies, see RFC 7873, for the plain DNS
+	// upstreams.  The server cookies are remembered for each address of the
+	// upstream, and the responses with mismatched client cookies are rejected.
+	Cookies bool
 }
 
 // Clone copies o to a new struct.  Note, that this is not a deep clone.
@@ -116,6 +127,8 @@ func (o *Options) Clone() (clone *Options) {
 		VerifyDNSCryptCertificate: o.VerifyDNSCryptCertificate,
 		InsecureSkipVerify:        o.InsecureSkipVerify,
 		PreferIPv6:                o.PreferIPv6,
+		RandomizeCase:             o.RandomizeCase,
+		Cookies:                   o.Cookies,
 		QUICTracer:                o.QUICTracer,
 		RootCAs:                   o.RootCAs,
 		CipherSuites:              o.CipherSuites,